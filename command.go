@@ -0,0 +1,347 @@
+package goutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time to wait after sending SIGTERM to a cancelled command before killing
+// it with SIGKILL.
+var DefaultCommandKillGracePeriod = 5 * time.Second
+
+// Time to wait for the output once the command has finished; some child may
+// keep the outputs open.
+const commandDrainTimeout = 1 * time.Second
+
+// Options of a command to run; the proxy manager is optional, and if it is
+// not set, the command is run without proxy.
+type Command struct {
+	Command   string
+	Arguments []string
+	// Initial directory; if empty, the current one
+	Dir   string
+	Stdin io.Reader
+	// Variables added to the environment of the current process
+	Env map[string]string
+	// If true, Env replaces the environment of the current process
+	ReplaceEnv      bool
+	ProxyManager    *ProxyManager
+	ProxifyStrategy string
+	// Used to get the proxy from the proxy manager; if both are empty, the
+	// default proxy is used.
+	DestinationUrl     string
+	DestinationAddress string
+	// See RunContext; DefaultCommandKillGracePeriod if 0
+	KillGracePeriod time.Duration
+	// Called with every line written by the command to stdout or stderr
+	// (without the line terminator) as soon as it is written; lines of both
+	// outputs are received in the order they were written.
+	OnOutputLine func(stream string, line string)
+	// Same as OnOutputLine, but with the raw data, not split in lines
+	OnOutputChunk func(stream string, data []byte)
+	// Channel where the lines are also sent; it is closed when the command
+	// finishes. Reading must keep up, as the command blocks when the
+	// channel is full; once the context is done, the lines not read are
+	// dropped.
+	OutputLines chan<- *CommandOutputLine
+	// Only the last bytes of the outputs are kept in the result; 0 means
+	// no limit, and a negative value that the outputs are not captured.
+	MaxCaptureBytes int
+	// Called once the command has been started
+	OnStarted func(pid int)
+}
+
+type CommandResult struct {
+	Pid int
+	// Exit code of the command, or -1 if it was ended by a signal
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	// Stdout and stderr merged, in the order they were written
+	Output string
+	// Some output was discarded because of MaxCaptureBytes
+	OutputTruncated bool
+	Duration        time.Duration
+	// Proxification strategy used to run the command; PROXIFY_STRATEGY_NONE
+	// when the command has not been proxified.
+	Strategy string
+	// The command was killed because its context was cancelled or timed out
+	Killed   bool
+	TimedOut bool
+	// Signal that ended the command, or 0 if it exited by itself
+	Signal syscall.Signal
+}
+
+func NewCommand(command string, arguments ...string) *Command {
+	c := Command{}
+	c.Command = command
+	c.Arguments = arguments
+	c.Env = map[string]string{}
+	c.ProxifyStrategy = PROXIFY_STRATEGY_AUTO
+	return &c
+}
+
+func (c *Command) Run() (*CommandResult, error) {
+	return c.RunContext(context.Background())
+}
+
+// Runs the command in its own process group, killing it and all its
+// children if the context is cancelled; SIGTERM is sent first, and SIGKILL
+// if the command is still running after the kill grace period. The output
+// of children that outlive the command is only read for a moment after it
+// finishes.
+func (c *Command) RunContext(ctx context.Context) (*CommandResult, error) {
+
+	// Created first, so the channel of the lines is closed on every error
+	output := newCommandOutput(ctx, c)
+	defer output.Close()
+
+	cmd, pc, err := c.prepare()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Cleanup()
+
+	if c.Stdin != nil {
+		cmd.Stdin = c.Stdin
+	}
+
+	// Own process group, to be able to kill the children on cancellation
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	waitOutput, err := pipeCommandOutput(cmd, output.Writer(COMMAND_STDOUT), output.Writer(COMMAND_STDERR))
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	closeCommandPipes(cmd)
+	if err != nil {
+		waitOutput(0)
+		return nil, err
+	}
+
+	result := CommandResult{}
+	result.Pid = cmd.Process.Pid
+	result.Strategy = pc.Strategy
+
+	if c.OnStarted != nil {
+		c.OnStarted(result.Pid)
+	}
+
+	err = waitCommand(ctx, c.KillGracePeriod, cmd, &result)
+	waitOutput(commandDrainTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	output.Close()
+	result.Duration = time.Since(start)
+	result.Stdout = output.stdout.String()
+	result.Stderr = output.stderr.String()
+	result.Output = output.merged.String()
+	result.OutputTruncated = output.stdout.Truncated() || output.stderr.Truncated()
+	return &result, nil
+
+}
+
+// Returns the command to run, proxified if needed; the Cleanup function of
+// the proxified command must be called once the command finishes.
+func (c *Command) prepare() (*exec.Cmd, *proxifiedCommand, error) {
+
+	p, err := getProxyForDestination(c.ProxyManager, c.DestinationUrl, c.DestinationAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	strategy := c.ProxifyStrategy
+	if strategy == "" {
+		strategy = PROXIFY_STRATEGY_AUTO
+	}
+
+	pc, err := proxifyCommand(p, strategy, c.Command, c.Arguments, c.environment())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(pc.Command, pc.Arguments...)
+	cmd.Env = EnvironmentMapToList(pc.Env)
+	cmd.Dir = c.Dir
+	return cmd, pc, nil
+
+}
+
+// Connects the outputs of the command to pipes read in background, instead of
+// letting exec copy them, as Wait would block until every child that
+// inherited them finishes. Returns the function that waits for the outputs
+// to be read; once the timeout expires, the pipes are closed.
+func pipeCommandOutput(cmd *exec.Cmd, stdout io.Writer, stderr io.Writer) (func(timeout time.Duration), error) {
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating pipe")
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		return nil, errors.Wrap(err, "Error creating pipe")
+	}
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, stdoutReader)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, stderrReader)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return func(timeout time.Duration) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			Log.Debugf("Outputs of command %v still open after it finished", cmd.Path)
+		}
+		stdoutReader.Close()
+		stderrReader.Close()
+		<-done
+	}, nil
+
+}
+
+// Closes the write ends of the pipes of the outputs, that only the command
+// must keep open once it is started.
+func closeCommandPipes(cmd *exec.Cmd) {
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if f, ok := w.(*os.File); ok {
+			f.Close()
+		}
+	}
+}
+
+// Returns the environment the command is run with; it is always a new map,
+// as proxifying the command adds variables to it.
+func (c *Command) environment() map[string]string {
+	env := map[string]string{}
+	if !c.ReplaceEnv {
+		env = GetEnvironmentMap()
+	}
+	for key, val := range c.Env {
+		env[key] = val
+	}
+	return env
+}
+
+// Returns the environment of the current process as a map
+func GetEnvironmentMap() map[string]string {
+	env := map[string]string{}
+	for _, e := range os.Environ() {
+		elems := strings.SplitN(e, "=", 2)
+		val := ""
+		if len(elems) >= 2 {
+			val = elems[1]
+		}
+		env[elems[0]] = val
+	}
+	return env
+}
+
+// Converts an environment map to the KEY=value list used by exec.Cmd
+func EnvironmentMapToList(env map[string]string) []string {
+	envList := []string{}
+	for key, val := range env {
+		envList = append(envList, fmt.Sprintf("%v=%v", key, val))
+	}
+	return envList
+}
+
+// Runs the command as in Command.RunContext, with the grace period
+// (DefaultCommandKillGracePeriod if 0). If env is nil, the environment of the
+// current process is used.
+func RunCommandAndWaitContext(ctx context.Context, gracePeriod time.Duration, initialPath string, stdin io.Reader, command string, arguments []string, env map[string]string) (*CommandResult, error) {
+	c := NewCommand(command, arguments...)
+	c.Dir = initialPath
+	c.Stdin = stdin
+	if env != nil {
+		c.Env = env
+		c.ReplaceEnv = true
+	}
+	c.KillGracePeriod = gracePeriod
+	return c.RunContext(ctx)
+}
+
+// Waits for the started command to finish, killing its process group if the
+// context is done, and fills the exit information in the result.
+func waitCommand(ctx context.Context, gracePeriod time.Duration, cmd *exec.Cmd, result *CommandResult) error {
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		result.Killed = true
+		result.TimedOut = ctx.Err() == context.DeadlineExceeded
+		err = killProcessGroup(cmd.Process.Pid, gracePeriod, done)
+	}
+
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	result.ExitCode = status.ExitStatus()
+	if status.Signaled() {
+		result.Signal = status.Signal()
+	}
+	return nil
+
+}
+
+func killProcessGroup(pid int, gracePeriod time.Duration, done chan error) error {
+
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultCommandKillGracePeriod
+	}
+
+	Log.Debugf("Sending SIGTERM to process group %v", pid)
+	syscall.Kill(-pid, syscall.SIGTERM)
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		Log.Debugf("Process group %v still running after %v, sending SIGKILL", pid, gracePeriod)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return <-done
+	}
+
+}
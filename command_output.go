@@ -0,0 +1,212 @@
+package goutils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+const COMMAND_STDOUT = "stdout"
+const COMMAND_STDERR = "stderr"
+
+type CommandOutputLine struct {
+	// COMMAND_STDOUT or COMMAND_STDERR
+	Stream string
+	Line   string
+}
+
+// Receives the outputs of a running command, captures them and sends them to
+// the callbacks and channel of the command. Writes from both outputs are
+// serialized, so the merged output keeps the order they were received in.
+// The lines are queued, and sent without the lock, so a slow reader of the
+// channel doesn't block the capture; once the context is done, the lines
+// that the reader doesn't take are dropped.
+type commandOutput struct {
+	lock          sync.Mutex
+	sendLock      sync.Mutex
+	closed        bool
+	stdout        *tailBuffer
+	stderr        *tailBuffer
+	merged        *tailBuffer
+	pending       map[string]*bytes.Buffer
+	queue         []*CommandOutputLine
+	done          <-chan struct{}
+	onOutputLine  func(stream string, line string)
+	onOutputChunk func(stream string, data []byte)
+	outputLines   chan<- *CommandOutputLine
+}
+
+func newCommandOutput(ctx context.Context, c *Command) *commandOutput {
+	return &commandOutput{
+		stdout: newTailBuffer(c.MaxCaptureBytes),
+		stderr: newTailBuffer(c.MaxCaptureBytes),
+		merged: newTailBuffer(c.MaxCaptureBytes),
+		pending: map[string]*bytes.Buffer{
+			COMMAND_STDOUT: {},
+			COMMAND_STDERR: {},
+		},
+		done:          ctx.Done(),
+		onOutputLine:  c.OnOutputLine,
+		onOutputChunk: c.OnOutputChunk,
+		outputLines:   c.OutputLines,
+	}
+}
+
+func (o *commandOutput) Writer(stream string) io.Writer {
+	return &commandOutputWriter{output: o, stream: stream}
+}
+
+func (o *commandOutput) write(stream string, data []byte) {
+	o.capture(stream, data)
+	o.send()
+}
+
+// Captures the data, and queues its complete lines
+func (o *commandOutput) capture(stream string, data []byte) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if stream == COMMAND_STDOUT {
+		o.stdout.Write(data)
+	} else {
+		o.stderr.Write(data)
+	}
+	o.merged.Write(data)
+
+	if o.onOutputChunk != nil {
+		o.onOutputChunk(stream, data)
+	}
+
+	if o.onOutputLine == nil && o.outputLines == nil {
+		return
+	}
+	pending := o.pending[stream]
+	pending.Write(data)
+	for {
+		i := bytes.IndexByte(pending.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := pending.Next(i + 1)
+		o.queueLine(stream, line[:i])
+	}
+
+}
+
+func (o *commandOutput) queueLine(stream string, data []byte) {
+	line := string(bytes.TrimSuffix(data, []byte("\r")))
+	o.queue = append(o.queue, &CommandOutputLine{Stream: stream, Line: line})
+}
+
+// Sends the queued lines; the send lock is taken before taking the queue,
+// so the lines are sent in the order they were queued.
+func (o *commandOutput) send() {
+
+	o.sendLock.Lock()
+	defer o.sendLock.Unlock()
+
+	o.lock.Lock()
+	queue := o.queue
+	o.queue = nil
+	closed := o.closed
+	o.lock.Unlock()
+
+	for _, line := range queue {
+		if o.onOutputLine != nil {
+			o.onOutputLine(line.Stream, line.Line)
+		}
+		if o.outputLines != nil && !closed {
+			select {
+			case o.outputLines <- line:
+			case <-o.done:
+				Log.Debugf("Command cancelled, line of %v not sent: %v", line.Stream, line.Line)
+			}
+		}
+	}
+
+}
+
+// Sends the incomplete lines, and closes the lines channel
+func (o *commandOutput) Close() {
+
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return
+	}
+	for _, stream := range []string{COMMAND_STDOUT, COMMAND_STDERR} {
+		if o.pending[stream].Len() > 0 {
+			o.queueLine(stream, o.pending[stream].Bytes())
+			o.pending[stream].Reset()
+		}
+	}
+	o.lock.Unlock()
+
+	o.send()
+
+	o.sendLock.Lock()
+	defer o.sendLock.Unlock()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	if o.outputLines != nil {
+		close(o.outputLines)
+	}
+
+}
+
+type commandOutputWriter struct {
+	output *commandOutput
+	stream string
+}
+
+func (w *commandOutputWriter) Write(data []byte) (int, error) {
+	w.output.write(w.stream, data)
+	return len(data), nil
+}
+
+// Buffer that only keeps the last bytes written to it; if max is 0, all the
+// data is kept, and if it is negative, nothing.
+type tailBuffer struct {
+	max     int
+	data    []byte
+	written int
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(data []byte) (int, error) {
+	b.written += len(data)
+	if b.max < 0 {
+		return len(data), nil
+	}
+	b.data = append(b.data, data...)
+	// Compact only from time to time, to avoid copying in every write
+	if b.max > 0 && len(b.data) > 2*b.max {
+		b.data = append([]byte{}, b.data[len(b.data)-b.max:]...)
+	}
+	return len(data), nil
+}
+
+// Returns true if some data has been discarded; never when nothing is
+// captured.
+func (b *tailBuffer) Truncated() bool {
+	if b.max < 0 {
+		return false
+	}
+	return b.written > len(b.String())
+}
+
+func (b *tailBuffer) String() string {
+	if b.max > 0 && len(b.data) > b.max {
+		return string(b.data[len(b.data)-b.max:])
+	}
+	return string(b.data)
+}
@@ -0,0 +1,80 @@
+package goutils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommandOutputLines(t *testing.T) {
+
+	c := NewCommand("sh", "-c", "echo a; sleep 0.05; echo b >&2; sleep 0.05; printf 'c\\r\\nd'; sleep 0.05; echo e >&2")
+	lines := []string{}
+	c.OnOutputLine = func(stream string, line string) {
+		lines = append(lines, stream+":"+line)
+	}
+	channel := make(chan *CommandOutputLine, 100)
+	c.OutputLines = channel
+	c.MaxCaptureBytes = 3
+
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := []string{}
+	for line := range channel {
+		received = append(received, line.Stream+":"+line.Line)
+	}
+	want := []string{"stdout:a", "stderr:b", "stdout:c", "stderr:e", "stdout:d"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Unexpected lines %v, want %v", lines, want)
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("Unexpected lines in the channel %v, want %v", received, want)
+	}
+	if result.Stdout != "\r\nd" || !result.OutputTruncated {
+		t.Errorf("Unexpected captured output %q, truncated %v", result.Stdout, result.OutputTruncated)
+	}
+
+}
+
+func TestCommandOutputNotCaptured(t *testing.T) {
+	c := NewCommand("echo", "hello")
+	c.MaxCaptureBytes = -1
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "" || result.OutputTruncated {
+		t.Errorf("Unexpected captured output %q, truncated %v", result.Stdout, result.OutputTruncated)
+	}
+}
+
+// The channel is never read; the command must finish once it is cancelled
+func TestCommandOutputLinesNotRead(t *testing.T) {
+
+	c := NewCommand("sh", "-c", "while true; do echo line; done")
+	c.OutputLines = make(chan *CommandOutputLine)
+	c.KillGracePeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.RunContext(ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command blocked sending the lines")
+	}
+
+}
@@ -0,0 +1,283 @@
+package goutils
+
+import (
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Bytes of the output kept to match the expectations
+const ptyExpectBufferSize = 4096
+
+// Time to wait for the terminal echo to be disabled before sending a secret
+const ptyEchoTimeout = 2 * time.Second
+
+// Time to wait for the output once the command has finished; some child may
+// keep the terminal open.
+const ptyDrainTimeout = 1 * time.Second
+
+// Response sent to a command run in a pseudo-terminal when its output
+// matches the pattern, for example, to answer a password prompt.
+type PtyExpectation struct {
+	Pattern *regexp.Regexp
+	// Returns the text sent to the command; a newline is appended to it
+	Response func() (string, error)
+	// Answer only the first time the pattern matches
+	Once bool
+	// The response is a password; it is not sent until the terminal echo is
+	// disabled, so it doesn't appear in the output.
+	Secret bool
+}
+
+func NewPtyExpectation(pattern string, response string, once bool) (*PtyExpectation, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error compiling regular expression %v", pattern)
+	}
+	e := PtyExpectation{}
+	e.Pattern = re
+	e.Response = func() (string, error) {
+		return response, nil
+	}
+	e.Once = once
+	return &e, nil
+}
+
+// Answers password prompts with the password of the proxy, as returned by
+// its password manager. It is only answered once, to not loop when the
+// password is wrong.
+func NewProxyPasswordPtyExpectation(p *Proxy) *PtyExpectation {
+	e := PtyExpectation{}
+	e.Pattern = regexp.MustCompile(`(?i)password[^\n]*:\s*$`)
+	e.Response = p.GetPassword
+	e.Once = true
+	e.Secret = true
+	return &e
+}
+
+// Command run inside a pseudo-terminal, for programs that need a TTY; stdout
+// and stderr are the same, so all the output is received as COMMAND_STDOUT.
+type PtyCommand struct {
+	*Command
+	Rows         uint16
+	Cols         uint16
+	Expectations []*PtyExpectation
+	// Receives everything the command writes to the terminal; what is sent
+	// to it (the responses, for example) is only included if the terminal
+	// echoes it.
+	Transcript io.Writer
+	lock       sync.Mutex
+	pty        *os.File
+}
+
+func NewPtyCommand(command string, arguments ...string) *PtyCommand {
+	c := PtyCommand{}
+	c.Command = NewCommand(command, arguments...)
+	c.Rows = 24
+	c.Cols = 80
+	c.Expectations = []*PtyExpectation{}
+	return &c
+}
+
+func (c *PtyCommand) AddExpectation(e *PtyExpectation) {
+	c.Expectations = append(c.Expectations, e)
+}
+
+// Changes the size of the terminal, also while the command is running
+func (c *PtyCommand) Resize(rows uint16, cols uint16) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Rows = rows
+	c.Cols = cols
+	if c.pty != nil {
+		err := pty.Setsize(c.pty, &pty.Winsize{Rows: rows, Cols: cols})
+		if err != nil {
+			return errors.Wrap(err, "Error resizing the pseudo-terminal")
+		}
+	}
+	return nil
+}
+
+// Writes to the terminal of the running command, as if it was typed
+func (c *PtyCommand) Write(data []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pty == nil {
+		return 0, errors.New("Command not running")
+	}
+	return c.pty.Write(data)
+}
+
+func (c *PtyCommand) Run() (*CommandResult, error) {
+	return c.RunContext(context.Background())
+}
+
+// Same as Command.RunContext, but running the command in a pseudo-terminal
+func (c *PtyCommand) RunContext(ctx context.Context) (*CommandResult, error) {
+
+	output := newCommandOutput(ctx, c.Command)
+	defer output.Close()
+
+	cmd, pc, err := c.prepare()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Cleanup()
+
+	start := time.Now()
+	c.lock.Lock()
+	// The command is started in a new session, so its process group can be killed
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: c.Rows, Cols: c.Cols})
+	if err != nil {
+		c.lock.Unlock()
+		return nil, errors.Wrap(err, "Error starting command in a pseudo-terminal")
+	}
+	c.pty = f
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		c.pty = nil
+		f.Close()
+		c.lock.Unlock()
+	}()
+
+	result := CommandResult{}
+	result.Pid = cmd.Process.Pid
+	result.Strategy = pc.Strategy
+
+	if c.OnStarted != nil {
+		c.OnStarted(result.Pid)
+	}
+
+	if c.Stdin != nil {
+		go io.Copy(f, c.Stdin)
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readOutput(f, output)
+	}()
+
+	err = waitCommand(ctx, c.KillGracePeriod, cmd, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(ptyDrainTimeout):
+		Log.Debugf("Terminal of command %v still open after it finished", c.Command.Command)
+		f.Close()
+		<-readDone
+	}
+
+	output.Close()
+	result.Duration = time.Since(start)
+	result.Stdout = output.stdout.String()
+	result.Output = output.merged.String()
+	result.OutputTruncated = output.stdout.Truncated()
+	return &result, nil
+
+}
+
+// Reads the output of the terminal until it is closed, answering the expectations
+func (c *PtyCommand) readOutput(f *os.File, output *commandOutput) {
+
+	answered := map[*PtyExpectation]bool{}
+	pending := []byte{}
+	buf := make([]byte, 4096)
+
+	for {
+
+		n, err := f.Read(buf)
+		if n > 0 {
+
+			data := buf[:n]
+			output.write(COMMAND_STDOUT, data)
+			if c.Transcript != nil {
+				c.Transcript.Write(data)
+			}
+
+			pending = append(pending, data...)
+			if len(pending) > ptyExpectBufferSize {
+				pending = pending[len(pending)-ptyExpectBufferSize:]
+			}
+
+			for _, e := range c.Expectations {
+				if e.Once && answered[e] {
+					continue
+				}
+				loc := e.Pattern.FindIndex(pending)
+				if loc == nil {
+					continue
+				}
+				answered[e] = true
+				pending = pending[loc[1]:]
+				response, err := e.Response()
+				if err != nil {
+					Log.Errorf("Error getting the response for %v: %v", e.Pattern, err)
+					continue
+				}
+				if e.Secret && !waitPtyEchoDisabled(f, ptyEchoTimeout) {
+					Log.Errorf("Terminal echo not disabled, response for %v not sent", e.Pattern)
+					continue
+				}
+				_, err = f.Write([]byte(response + "\n"))
+				if err != nil {
+					Log.Errorf("Error writing the response for %v: %v", e.Pattern, err)
+				}
+			}
+
+		}
+
+		// EIO is returned once the command has finished
+		if err != nil {
+			return
+		}
+
+	}
+
+}
+
+func waitPtyEchoDisabled(f *os.File, timeout time.Duration) bool {
+
+	// Fd() is not used, as it would make the file blocking
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		Log.Errorf("Error getting terminal file descriptor: %v", err)
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var termios *unix.Termios
+		var ioctlErr error
+		err = rawConn.Control(func(fd uintptr) {
+			termios, ioctlErr = unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		})
+		if err == nil {
+			err = ioctlErr
+		}
+		if err != nil {
+			Log.Errorf("Error getting terminal attributes: %v", err)
+			return false
+		}
+		if termios.Lflag&unix.ECHO == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
@@ -0,0 +1,88 @@
+package goutils
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPtyCommandPassword(t *testing.T) {
+
+	c := NewPtyCommand("sh", "-c", "if [ -t 0 ]; then echo tty; fi; printf 'Password: '; stty -echo; read p; stty echo; echo; echo got=$p")
+	c.AddExpectation(NewProxyPasswordPtyExpectation(NewEmptyProxy(NewSimpleProxyPasswordManager("s3cret"))))
+	transcript := &bytes.Buffer{}
+	c.Transcript = transcript
+
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 || !strings.Contains(result.Stdout, "tty") || !strings.Contains(result.Stdout, "got=s3cret") {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	// The password is only in the output of the command, not echoed
+	if strings.Count(transcript.String(), "s3cret") != 1 {
+		t.Errorf("Password echoed by the terminal: %q", transcript.String())
+	}
+
+}
+
+func TestPtyCommandExpectations(t *testing.T) {
+
+	c := NewPtyCommand("sh", "-c", "for i in 1 2; do printf 'Continue? '; read a; echo answer=$a; done; printf 'Name: '; read n; echo name=$n")
+	e, err := NewPtyExpectation(`Continue\? $`, "yes", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddExpectation(e)
+	e, err = NewPtyExpectation(`Name: $`, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddExpectation(e)
+
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(result.Stdout, "answer=yes") != 2 || !strings.Contains(result.Stdout, "name=test") {
+		t.Errorf("Unexpected output %q", result.Stdout)
+	}
+
+	_, err = NewPtyExpectation("(", "", false)
+	if err == nil {
+		t.Errorf("Invalid pattern accepted")
+	}
+
+}
+
+func TestPtyCommandSize(t *testing.T) {
+	c := NewPtyCommand("stty", "size")
+	c.Rows = 30
+	c.Cols = 100
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(result.Stdout) != "30 100" {
+		t.Errorf("Unexpected size %q", result.Stdout)
+	}
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Errorf("Written to a command not running")
+	}
+}
+
+func TestPtyCommandContextKill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c := NewPtyCommand("sleep", "10")
+	result, err := c.RunContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Killed || !result.TimedOut {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,129 @@
+package goutils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunCommandAndWaitContextKill(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The shell ignores SIGTERM, so it must be killed
+	result, err := RunCommandAndWaitContext(ctx, 300*time.Millisecond, "", nil, "sh", []string{"-c", "trap '' TERM; sleep 10 & wait; echo finished"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Killed || !result.TimedOut || result.Signal != syscall.SIGKILL || result.ExitCode != -1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	result, err = RunCommandAndWaitContext(context.Background(), 0, "", nil, "sh", []string{"-c", "echo output; exit 3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Killed || result.ExitCode != 3 || result.Stdout != "output\n" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+}
+
+// A child that keeps the outputs open must not block the command
+func TestRunCommandAndWaitContextChildKeepsOutput(t *testing.T) {
+
+	start := time.Now()
+	result, err := RunCommandAndWaitContext(context.Background(), 0, "", nil, "sh", []string{"-c", "sleep 10 & echo started"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The child is in the process group of the command
+	defer syscall.Kill(-result.Pid, syscall.SIGKILL)
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Command waited for its child")
+	}
+	if result.Stdout != "started\n" {
+		t.Errorf("Unexpected output %q", result.Stdout)
+	}
+	if err := syscall.Kill(-result.Pid, 0); err != nil {
+		t.Errorf("Command not run in its own process group: %v", err)
+	}
+
+}
+
+func TestCommandOptions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("GOUTILS_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("GOUTILS_TEST_INHERITED")
+
+	c := NewCommand("sh", "-c", "echo $GOUTILS_TEST_VAR $GOUTILS_TEST_INHERITED; pwd; cat; echo error >&2; exit 2")
+	c.Env["GOUTILS_TEST_VAR"] = "value"
+	c.Dir = dir
+	c.Stdin = strings.NewReader("input")
+	result, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realDir, _ := filepath.EvalSymlinks(dir)
+	if result.Stdout != "value inherited\n"+realDir+"\ninput" || result.Stderr != "error\n" {
+		t.Errorf("Unexpected output %q, error %q", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 2 || result.Pid <= 0 || result.Duration <= 0 || result.Strategy != PROXIFY_STRATEGY_NONE {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	c = NewCommand("sh", "-c", "echo $GOUTILS_TEST_VAR $GOUTILS_TEST_INHERITED")
+	c.Env["GOUTILS_TEST_VAR"] = "value"
+	c.ReplaceEnv = true
+	result, err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "value\n" {
+		t.Errorf("Environment not replaced: %q", result.Stdout)
+	}
+
+	_, err = NewCommand("goutils-missing-command").Run()
+	if err == nil {
+		t.Errorf("Missing command run")
+	}
+
+}
+
+// The old functions return the values of the result
+func TestRunCommandAndWait(t *testing.T) {
+
+	err, pid, exitCode, stdout, stderr := RunCommandAndWait("/", strings.NewReader("input"), "sh", []string{"-c", "pwd; cat; echo error >&2; exit 1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid <= 0 || exitCode != 1 || stdout != "/\ninput" || stderr != "error\n" {
+		t.Errorf("Unexpected result %v, %v, %q, %q", pid, exitCode, stdout, stderr)
+	}
+
+	err, _, _, _, _ = RunCommandAndWait("", nil, "goutils-missing-command", nil, nil)
+	if err == nil {
+		t.Errorf("Missing command run")
+	}
+
+	called := false
+	err, _, exitCode, stdout, _ = RunCommandProxified(nil, "", "", "", nil, "echo", []string{"direct"}, nil, func(err error, pid int, exitCode int, stdout string, stderr string) {
+		called = err == nil && stdout == "direct\n"
+	})
+	if err != nil || exitCode != 0 || stdout != "direct\n" || !called {
+		t.Errorf("Unexpected result %v, %q, callback called %v: %v", exitCode, stdout, called, err)
+	}
+
+}
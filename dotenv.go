@@ -0,0 +1,376 @@
+package goutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Variable of a .env file; Start and End are the offsets of its line (or
+// lines, if the value is multiline), without the line break.
+type dotEnvEntry struct {
+	Key    string
+	Value  string
+	Export bool
+	Start  int
+	End    int
+}
+
+var dotEnvKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*`)
+var dotEnvUnquotedRegexp = regexp.MustCompile(`^[A-Za-z0-9_./:@,+=%-]*$`)
+
+// Parses the content of a .env file. Lines are KEY=value, optionally
+// starting with "export"; values can be unquoted (until a " #" comment),
+// single quoted (literal), or double quoted (with \n, \t, \", \\ and \$
+// escapes). Single and double quoted values can span several lines.
+// Unquoted and double quoted values can use ${VAR}, ${VAR:-default} and
+// $VAR, that are replaced by the variables defined before in the file, or
+// by the ones returned by lookup, that can be nil.
+func ParseDotEnv(data []byte, lookup func(string) (string, bool)) (map[string]string, error) {
+	entries, err := parseDotEnvEntries(string(data), lookup)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	for _, e := range entries {
+		env[e.Key] = e.Value
+	}
+	return env, nil
+}
+
+// Loads the .env file; the variables of the current process can be used in
+// the values.
+func LoadDotEnvFile(path string, failIfNotFound bool) (map[string]string, error) {
+	exists, err := FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if failIfNotFound {
+			return nil, errors.Errorf("File %v doesn't exist.", path)
+		}
+		return map[string]string{}, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening file %v.", path)
+	}
+	env, err := ParseDotEnv(content, os.LookupEnv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading file %v", path)
+	}
+	return env, nil
+}
+
+// Sets the variables of the .env file in the environment of the current
+// process; if override is false, the variables already set are kept.
+func LoadDotEnvFileIntoEnvironment(path string, override bool) error {
+	env, err := LoadDotEnvFile(path, true)
+	if err != nil {
+		return err
+	}
+	for _, k := range sortedEnvKeys(env) {
+		if _, exists := os.LookupEnv(k); exists && !override {
+			continue
+		}
+		err = os.Setenv(k, env[k])
+		if err != nil {
+			return errors.Wrapf(err, "Error setting environment variable %v", k)
+		}
+	}
+	return nil
+}
+
+// Adds the variables of the .env file to the env map, as used by Command and
+// RunCommandAndWait, that must not be nil; if override is false, the
+// variables already in the map are kept.
+func MergeDotEnvFile(env map[string]string, path string, override bool) error {
+	if env == nil {
+		return errors.New("The map of variables is nil")
+	}
+	vars, err := LoadDotEnvFile(path, true)
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		if _, exists := env[k]; exists && !override {
+			continue
+		}
+		env[k] = v
+	}
+	return nil
+}
+
+// Returns the .env content of the variables, sorted by name
+func FormatDotEnv(env map[string]string) []byte {
+	content := ""
+	for _, k := range sortedEnvKeys(env) {
+		content += fmt.Sprintf("%v=%v\n", k, FormatDotEnvValue(env[k]))
+	}
+	return []byte(content)
+}
+
+// Returns the value unquoted if it is safe, or double quoted and escaped
+func FormatDotEnvValue(value string) string {
+	if dotEnvUnquotedRegexp.MatchString(value) {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "$", `\$`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// Saves the variables to the file, replacing it; the file is only readable
+// by the user, as it may contain passwords.
+func SaveDotEnvFile(path string, env map[string]string) error {
+	err := WriteFileAtomic(path, FormatDotEnv(env), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error saving file %v", path)
+	}
+	return nil
+}
+
+// Sets the variables in the file, and removes the ones in remove, keeping
+// the comments and the rest of the variables; new variables are added at the
+// end. The file is created if it doesn't exist.
+func UpdateDotEnvFile(path string, vars map[string]string, remove []string) error {
+
+	content := ""
+	exists, err := FileExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "Error opening file %v.", path)
+		}
+		content = string(data)
+	}
+
+	entries, err := parseDotEnvEntries(content, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Error loading file %v", path)
+	}
+
+	removed := map[string]bool{}
+	for _, k := range remove {
+		removed[k] = true
+	}
+	updated := map[string]bool{}
+
+	// Edited from the end, so the offsets of the previous entries are valid
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if value, ok := vars[e.Key]; ok {
+			line := fmt.Sprintf("%v=%v", e.Key, FormatDotEnvValue(value))
+			if e.Export {
+				line = "export " + line
+			}
+			content = content[:e.Start] + line + content[e.End:]
+			updated[e.Key] = true
+		} else if removed[e.Key] {
+			end := e.End
+			if strings.HasPrefix(content[end:], "\r\n") {
+				end += 2
+			} else if strings.HasPrefix(content[end:], "\n") {
+				end++
+			}
+			content = content[:e.Start] + content[end:]
+		}
+	}
+
+	for _, k := range sortedEnvKeys(vars) {
+		if updated[k] {
+			continue
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += fmt.Sprintf("%v=%v\n", k, FormatDotEnvValue(vars[k]))
+	}
+
+	err = WriteFileAtomic(path, []byte(content), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error saving file %v", path)
+	}
+	return nil
+
+}
+
+func sortedEnvKeys(env map[string]string) []string {
+	keys := []string{}
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func parseDotEnvEntries(content string, lookup func(string) (string, bool)) ([]dotEnvEntry, error) {
+
+	entries := []dotEnvEntry{}
+	defined := map[string]string{}
+	resolve := func(name string) (string, bool) {
+		if v, ok := defined[name]; ok {
+			return v, true
+		}
+		if lookup != nil {
+			return lookup(name)
+		}
+		return "", false
+	}
+
+	pos := 0
+	line := 1
+	for pos < len(content) {
+
+		start := pos
+		end := strings.IndexByte(content[pos:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += pos
+		}
+		text := strings.TrimSpace(content[pos:end])
+		if text == "" || strings.HasPrefix(text, "#") {
+			pos = end + 1
+			line++
+			continue
+		}
+
+		// Position after the leading spaces
+		pos += strings.Index(content[pos:end], text)
+		e := dotEnvEntry{Start: start}
+		if strings.HasPrefix(text, "export ") || strings.HasPrefix(text, "export\t") {
+			e.Export = true
+			pos += len("export")
+			for pos < end && (content[pos] == ' ' || content[pos] == '\t') {
+				pos++
+			}
+		}
+
+		key := dotEnvKeyRegexp.FindString(content[pos:end])
+		if key == "" {
+			return nil, errors.Errorf("Error in line %v: invalid variable name", line)
+		}
+		e.Key = key
+		pos += len(key)
+		for pos < end && (content[pos] == ' ' || content[pos] == '\t') {
+			pos++
+		}
+		if pos >= end || content[pos] != '=' {
+			return nil, errors.Errorf("Error in line %v: expected = after %v", line, key)
+		}
+		pos++
+		for pos < end && (content[pos] == ' ' || content[pos] == '\t') {
+			pos++
+		}
+
+		startLine := line
+		if pos < len(content) && (content[pos] == '"' || content[pos] == '\'') {
+			quote := content[pos]
+			value := []byte{}
+			pos++
+			closed := false
+			for pos < len(content) {
+				c := content[pos]
+				if c == quote {
+					closed = true
+					pos++
+					break
+				}
+				if c == '\n' {
+					line++
+				}
+				if c == '\\' && quote == '"' && pos+1 < len(content) {
+					pos++
+					switch content[pos] {
+					case 'n':
+						value = append(value, '\n')
+					case 'r':
+						value = append(value, '\r')
+					case 't':
+						value = append(value, '\t')
+					case '$':
+						// Marked, so it is not interpolated
+						value = append(value, 0)
+					case '"', '\\':
+						value = append(value, content[pos])
+					case '\n':
+						// Line continuation
+						line++
+					default:
+						value = append(value, '\\', content[pos])
+					}
+					pos++
+					continue
+				}
+				value = append(value, c)
+				pos++
+			}
+			if !closed {
+				return nil, errors.Errorf("Error in line %v: unterminated quoted value of %v", startLine, key)
+			}
+			end = strings.IndexByte(content[pos:], '\n')
+			if end < 0 {
+				end = len(content)
+			} else {
+				end += pos
+			}
+			rest := strings.TrimSpace(content[pos:end])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, errors.Errorf("Error in line %v: unexpected %v after the value of %v", line, rest, key)
+			}
+			if quote == '"' {
+				e.Value = interpolateDotEnvValue(string(value), resolve)
+			} else {
+				e.Value = string(value)
+			}
+		} else {
+			value := content[pos:end]
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			} else if i := strings.Index(value, "\t#"); i >= 0 {
+				value = value[:i]
+			}
+			e.Value = interpolateDotEnvValue(strings.Replace(strings.TrimSpace(value), `\$`, "\x00", -1), resolve)
+		}
+
+		e.End = end
+		if e.End > start && content[e.End-1] == '\r' {
+			e.End--
+		}
+		entries = append(entries, e)
+		defined[e.Key] = e.Value
+		pos = end + 1
+		line++
+
+	}
+
+	return entries, nil
+
+}
+
+var dotEnvVariableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Replaces ${VAR}, ${VAR:-default} and $VAR; escaped dollars are marked
+// with a zero byte.
+func interpolateDotEnvValue(value string, resolve func(string) (string, bool)) string {
+	value = dotEnvVariableRegexp.ReplaceAllStringFunc(value, func(match string) string {
+		groups := dotEnvVariableRegexp.FindStringSubmatch(match)
+		name := groups[1]
+		if name == "" {
+			name = groups[4]
+		}
+		if v, ok := resolve(name); ok && (v != "" || groups[2] == "") {
+			return v
+		}
+		return groups[3]
+	})
+	return strings.Replace(value, "\x00", "$", -1)
+}
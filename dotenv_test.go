@@ -0,0 +1,298 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+
+	lookup := func(name string) (string, bool) {
+		switch name {
+		case "HOME":
+			return "/home/user", true
+		case "EMPTY":
+			return "", true
+		}
+		return "", false
+	}
+
+	tests := []struct {
+		content string
+		want    map[string]string
+	}{
+		{"", map[string]string{}},
+		{"# Comment\n\n  # Indented comment\n", map[string]string{}},
+		{"A=1\nB=two words", map[string]string{"A": "1", "B": "two words"}},
+		{"  A = 1  \n", map[string]string{"A": "1"}},
+		{"export A=1\nexport\tB=2", map[string]string{"A": "1", "B": "2"}},
+		{"A=value # comment\nB=value#not a comment\nC=x\t# comment", map[string]string{"A": "value", "B": "value#not a comment", "C": "x"}},
+		{"A=\nB=''\nC=\"\"", map[string]string{"A": "", "B": "", "C": ""}},
+		{"A.B_c=1", map[string]string{"A.B_c": "1"}},
+		{"A=1\nA=2", map[string]string{"A": "2"}},
+		{"A=1\r\nB='2'\r\n", map[string]string{"A": "1", "B": "2"}},
+
+		// Single quotes are literal
+		{`A='$HOME \n "x"' # comment`, map[string]string{"A": `$HOME \n "x"`}},
+		// Double quotes have escapes
+		{`A="a\nb\tc\rd \"e\" \\ \$HOME \x"`, map[string]string{"A": "a\nb\tc\rd \"e\" \\ $HOME \\x"}},
+		{`A="it's"`, map[string]string{"A": "it's"}},
+
+		// Multiline values
+		{"A='line 1\nline 2'\nB=\"line 3\n  line 4\"\nC=3", map[string]string{"A": "line 1\nline 2", "B": "line 3\n  line 4", "C": "3"}},
+		{"A=\"one \\\ntwo\"", map[string]string{"A": "one two"}},
+
+		// Variables
+		{"A=$HOME/bin\nB=${HOME}/lib\nC=\"$HOME\"", map[string]string{"A": "/home/user/bin", "B": "/home/user/lib", "C": "/home/user"}},
+		{"A=1\nB=${A}2\nC=$A$B", map[string]string{"A": "1", "B": "12", "C": "112"}},
+		{"HOME=/root\nA=$HOME", map[string]string{"HOME": "/root", "A": "/root"}},
+		{"A=$MISSING\nB=${MISSING}", map[string]string{"A": "", "B": ""}},
+		{"A=${MISSING:-default value}\nB=\"${EMPTY:-default}\"\nC=${HOME:-default}", map[string]string{"A": "default value", "B": "default", "C": "/home/user"}},
+		{"A=${EMPTY}x", map[string]string{"A": "x"}},
+		{`A=\$HOME`, map[string]string{"A": "$HOME"}},
+		{"A='${HOME:-x}'", map[string]string{"A": "${HOME:-x}"}},
+		{"A=$1 costs $", map[string]string{"A": "$1 costs $"}},
+	}
+
+	for _, test := range tests {
+		env, err := ParseDotEnv([]byte(test.content), lookup)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(env, test.want) {
+			t.Errorf("Unexpected variables %q of %q, want %q", env, test.content, test.want)
+		}
+	}
+
+	// Without lookup, only the variables of the file are used
+	env, err := ParseDotEnv([]byte("A=$HOME\nB=${HOME:-none}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env, map[string]string{"A": "", "B": "none"}) {
+		t.Errorf("Unexpected variables %q", env)
+	}
+
+	for _, content := range []string{
+		"A",
+		"A B=1",
+		"1A=1",
+		"=1",
+		"A='open",
+		"A=\"open\nB=1\n",
+		"A='1' 2",
+		"A=\"1\"x",
+	} {
+		if env, err := ParseDotEnv([]byte(content), nil); err == nil {
+			t.Errorf("Invalid content %q parsed as %q", content, env)
+		}
+	}
+
+}
+
+func TestFormatDotEnv(t *testing.T) {
+
+	env := map[string]string{
+		"PLAIN":   "http://user@proxy:3128/path,x=1%",
+		"EMPTY":   "",
+		"SPACES":  "two words",
+		"QUOTES":  `say "hi" it's`,
+		"ESCAPES": "a\\b\nc\td\re",
+		"DOLLAR":  "$HOME ${X:-y}",
+		"COMMENT": "a #b",
+	}
+	content := FormatDotEnv(env)
+	want := `COMMENT="a #b"
+DOLLAR="\$HOME \${X:-y}"
+EMPTY=
+ESCAPES="a\\b\nc\td\re"
+PLAIN=http://user@proxy:3128/path,x=1%
+QUOTES="say \"hi\" it's"
+SPACES="two words"
+`
+	if string(content) != want {
+		t.Errorf("Unexpected content %q, want %q", content, want)
+	}
+
+	parsed, err := ParseDotEnv(content, func(string) (string, bool) { return "x", true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, env) {
+		t.Errorf("Unexpected variables %q, want %q", parsed, env)
+	}
+
+}
+
+func TestDotEnvFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".env")
+
+	env, err := LoadDotEnvFile(path, false)
+	if err != nil || len(env) != 0 {
+		t.Errorf("Unexpected variables %v of a missing file: %v", env, err)
+	}
+	if _, err := LoadDotEnvFile(path, true); err == nil {
+		t.Errorf("Missing file loaded")
+	}
+
+	if err := SaveDotEnvFile(path, map[string]string{"GOUTILS_TEST_A": "a b", "GOUTILS_TEST_B": "$GOUTILS_TEST_A"}); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected mode of %v: %v", path, err)
+	}
+
+	vars := map[string]string{"GOUTILS_TEST_A": "kept"}
+	if err := MergeDotEnvFile(vars, path, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vars, map[string]string{"GOUTILS_TEST_A": "kept", "GOUTILS_TEST_B": "$GOUTILS_TEST_A"}) {
+		t.Errorf("Unexpected merged variables %v", vars)
+	}
+	if err := MergeDotEnvFile(vars, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if vars["GOUTILS_TEST_A"] != "a b" {
+		t.Errorf("Unexpected overridden variables %v", vars)
+	}
+	if err := MergeDotEnvFile(nil, path, true); err == nil {
+		t.Errorf("Variables merged into a nil map")
+	}
+
+	defer os.Unsetenv("GOUTILS_TEST_A")
+	defer os.Unsetenv("GOUTILS_TEST_B")
+	os.Setenv("GOUTILS_TEST_A", "kept")
+	if err := LoadDotEnvFileIntoEnvironment(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("GOUTILS_TEST_A") != "kept" || os.Getenv("GOUTILS_TEST_B") != "$GOUTILS_TEST_A" {
+		t.Errorf("Unexpected environment %v, %v", os.Getenv("GOUTILS_TEST_A"), os.Getenv("GOUTILS_TEST_B"))
+	}
+	if err := LoadDotEnvFileIntoEnvironment(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("GOUTILS_TEST_A") != "a b" {
+		t.Errorf("Variable not overridden")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("A='open\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDotEnvFile(path, true); err == nil {
+		t.Errorf("Invalid file loaded")
+	}
+
+}
+
+func TestUpdateDotEnvFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".env")
+
+	tests := []struct {
+		content string
+		vars    map[string]string
+		remove  []string
+		want    string
+	}{
+		// New files
+		{"", map[string]string{"B": "2", "A": "1"}, nil, "A=1\nB=2\n"},
+		// Comment lines, empty lines and exports are kept
+		{"# Settings\nexport A=1 # first\n\n  B = 'x'\nC=3\n", map[string]string{"A": "new value", "B": "y"}, []string{"C"}, "# Settings\nexport A=\"new value\"\n\nB=y\n"},
+		// Multiline values are replaced whole
+		{"A=\"line 1\nline 2\"\nB=2\n", map[string]string{"A": "x"}, nil, "A=x\nB=2\n"},
+		{"A='line 1\nline 2'\nB=2\n", nil, []string{"A"}, "B=2\n"},
+		// Added at the end, even without final line break
+		{"A=1", map[string]string{"B": "2"}, nil, "A=1\nB=2\n"},
+		// Windows line breaks are kept, and removed lines are removed whole
+		{"# c\r\nA=1\r\nB=2\r\nC=3\r\n", map[string]string{"C": "4"}, []string{"B"}, "# c\r\nA=1\r\nC=4\r\n"},
+		{"A=1\r\nB=2", map[string]string{"A": "x"}, []string{"B"}, "A=x\r\n"},
+		// Missing variables are ignored when removed
+		{"A=1\n", nil, []string{"B"}, "A=1\n"},
+		// Repeated variables are all updated
+		{"A=1\nA=2\n", map[string]string{"A": "3"}, nil, "A=3\nA=3\n"},
+	}
+
+	for _, test := range tests {
+		os.Remove(path)
+		if test.content != "" {
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := UpdateDotEnvFile(path, test.vars, test.remove); err != nil {
+			t.Errorf("Error updating %q: %v", test.content, err)
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.want {
+			t.Errorf("Unexpected content %q of %q, want %q", content, test.content, test.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("A='open\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDotEnvFile(path, map[string]string{"A": "1"}, nil); err == nil {
+		t.Errorf("Invalid file updated")
+	}
+
+}
+
+func TestSetDotEnvProxy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".env")
+	if err := ioutil.WriteFile(path, []byte("# Proxy\nHTTP_PROXY=old\nOTHER=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewEmptyProxy(nil)
+	p.Protocol = "http"
+	p.Address = "10.1.1.1"
+	p.Port = 3128
+	p.Exceptions = []string{"localhost", "intranet"}
+	if err := SetDotEnvProxy(path, p); err != nil {
+		t.Fatal(err)
+	}
+	env, err := LoadDotEnvFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["HTTP_PROXY"] != "http://10.1.1.1:3128" || env["https_proxy"] != "http://10.1.1.1:3128" || env["NO_PROXY"] != "localhost,intranet" || env["OTHER"] != "1" {
+		t.Errorf("Unexpected variables %v", env)
+	}
+
+	if err := SetDotEnvProxy(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "# Proxy\nOTHER=1\n" {
+		t.Errorf("Unexpected content %q", content)
+	}
+
+}
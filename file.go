@@ -2,8 +2,13 @@ package goutils
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -82,3 +87,156 @@ func ReadFileLines(path string) ([]string, error) {
 	return lines, nil
 
 }
+
+// Writes the file without leaving it truncated if the program crashes or the
+// disk is full: the data is written to a temporary file in the same
+// directory, that replaces the file when it is synced to disk. The
+// permissions and owner of an existing file are kept; the mode is used for
+// new files.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	return WriteFileAtomicWithBackups(path, data, mode, 0)
+}
+
+// Like WriteFileAtomic, but before replacing the file, it is kept as
+// <path>.bak.1, and the previous backups are rotated up to <path>.bak.<n>.
+func WriteFileAtomicWithBackups(path string, data []byte, mode os.FileMode, backups int) error {
+
+	// Symbolic links are kept, replacing the file they point to
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Error checking file %v", path)
+	}
+	if stat != nil && stat.IsDir() {
+		return errors.Errorf("Path %v is a directory", path)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, tmpPath, err := createTempFileFor(path, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if stat != nil {
+		err = tmp.Chmod(stat.Mode().Perm())
+		if err != nil {
+			return errors.Wrapf(err, "Error setting permissions of %v", tmpPath)
+		}
+		if owner, ok := stat.Sys().(*syscall.Stat_t); ok {
+			if err := tmp.Chown(int(owner.Uid), int(owner.Gid)); err != nil {
+				Log.Debugf("Error keeping owner of %v: %v", path, err)
+			}
+		}
+	}
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing file %v", tmpPath)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "Error syncing file %v", tmpPath)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Error closing file %v", tmpPath)
+	}
+	tmp = nil
+
+	if stat != nil && backups > 0 {
+		err = rotateBackups(path, backups)
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "Error replacing file %v", path)
+	}
+
+	// Makes the rename durable; not all the filesystems support it
+	if d, err := os.Open(dir); err == nil {
+		if err := d.Sync(); err != nil {
+			Log.Debugf("Error syncing directory %v: %v", dir, err)
+		}
+		d.Close()
+	}
+
+	return nil
+
+}
+
+// Returns the backups of the file that exist, from the newest to the oldest
+func BackupFiles(path string) []string {
+	backups := []string{}
+	for i := 1; ; i++ {
+		backup := fmt.Sprintf("%v.bak.%v", path, i)
+		if exists, err := FileExists(backup); err != nil || !exists {
+			return backups
+		}
+		backups = append(backups, backup)
+	}
+}
+
+// Creates the temporary file with the mode; the name is unique, so
+// concurrent writes of the same file don't use the same temporary file.
+func createTempFileFor(path string, mode os.FileMode) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%v.tmp%v", filepath.Base(path), time.Now().UnixNano()))
+		f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err == nil {
+			return f, tmpPath, nil
+		}
+		if !os.IsExist(err) || i >= 10 {
+			return nil, "", errors.Wrapf(err, "Error creating temporary file for %v", path)
+		}
+	}
+}
+
+// Moves <path>.bak.<i> to <path>.bak.<i+1>, removing the oldest one, and
+// keeps the current file as <path>.bak.1
+func rotateBackups(path string, backups int) error {
+
+	backup := func(i int) string {
+		return fmt.Sprintf("%v.bak.%v", path, i)
+	}
+
+	err := os.Remove(backup(backups))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Error removing backup %v", backup(backups))
+	}
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backup(i), backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Error rotating backup %v", backup(i))
+		}
+	}
+
+	// A hard link keeps the current file until it is replaced; if links are
+	// not supported, it is copied
+	err = os.Link(path, backup(1))
+	if err != nil {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = ioutil.WriteFile(backup(1), content, 0600)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Error creating backup of %v", path)
+		}
+	}
+
+	return nil
+
+}
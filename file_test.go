@@ -0,0 +1,169 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func assertTestFile(t *testing.T, path string, content string, mode os.FileMode) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("Unexpected content %q of %v, want %q", data, path, content)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != mode {
+		t.Errorf("Unexpected mode %v of %v, want %v", stat.Mode().Perm(), path, mode)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := WriteFileAtomic(path, []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertTestFile(t, path, "one", 0600)
+
+	// The permissions of the existing file are kept
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("two"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertTestFile(t, path, "two", 0640)
+
+	// Links are kept, and the file they point to is replaced
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(link, []byte("three"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Lstat(link); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Link replaced: %v", err)
+	}
+	assertTestFile(t, path, "three", 0640)
+
+	if err := WriteFileAtomic(dir, []byte("x"), 0600); err == nil {
+		t.Errorf("Directory replaced")
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "file"), []byte("x"), 0600); err == nil {
+		t.Errorf("File written in a missing directory")
+	}
+
+	// Without temporary files left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"file", "link"}) {
+		t.Errorf("Unexpected files %v", names)
+	}
+
+}
+
+func TestWriteFileAtomicWithBackups(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	for _, content := range []string{"1", "2", "3", "4"} {
+		if err := WriteFileAtomicWithBackups(path, []byte(content), 0600, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertTestFile(t, path, "4", 0600)
+	backups := BackupFiles(path)
+	if !reflect.DeepEqual(backups, []string{path + ".bak.1", path + ".bak.2"}) {
+		t.Fatalf("Unexpected backups %v", backups)
+	}
+	assertTestFile(t, backups[0], "3", 0600)
+	assertTestFile(t, backups[1], "2", 0600)
+
+	// The backups are not hard links of the new file
+	if err := WriteFileAtomicWithBackups(path, []byte("5"), 0600, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertTestFile(t, backups[0], "4", 0600)
+	assertTestFile(t, backups[1], "3", 0600)
+
+	if backups := BackupFiles(filepath.Join(dir, "other")); len(backups) != 0 {
+		t.Errorf("Unexpected backups %v", backups)
+	}
+
+}
+
+func TestNewMapHelperFromFileOrBackup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	h, err := NewMapHelperFromFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Backups = 2
+	for i := 1; i <= 3; i++ {
+		h.SetInt("n", i)
+		if err := h.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The newest backup that can be loaded is used
+	if err := ioutil.WriteFile(path, []byte(`{"n": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".bak.1", []byte(`{"n": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err = NewMapHelperFromFileOrBackup(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.GetInt("n", 0) != 1 || h.Filename != path {
+		t.Errorf("Unexpected helper %v loaded from %v", h.Data, h.Filename)
+	}
+
+	if err := os.Remove(path + ".bak.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMapHelperFromFileOrBackup(path, true); err == nil {
+		t.Errorf("Invalid file loaded without valid backups")
+	}
+
+	h, err = NewMapHelperFromFileOrBackup(filepath.Join(dir, "missing.json"), false)
+	if err != nil || h.Count() != 0 {
+		t.Errorf("Unexpected helper %v: %v", h, err)
+	}
+
+}
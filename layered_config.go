@@ -0,0 +1,318 @@
+package goutils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const CONFIG_LAYER_DEFAULTS = "defaults"
+const CONFIG_LAYER_SYSTEM = "system"
+const CONFIG_LAYER_USER = "user"
+const CONFIG_LAYER_ENVIRONMENT = "environment"
+const CONFIG_LAYER_FLAGS = "flags"
+
+// Lists of upper layers replace the ones of lower layers
+const CONFIG_LIST_MERGE_REPLACE = "replace"
+
+// Lists of upper layers are appended to the ones of lower layers
+const CONFIG_LIST_MERGE_APPEND = "append"
+
+// Extensions of the config files, in the order they are searched
+var configFileExtensions = []string{".json", ".jsonc", ".yaml", ".yml", ".toml", ".ini", ".conf"}
+
+type ConfigLayer struct {
+	Name   string
+	Helper *MapHelper
+	// Layers loaded from files are saved by Save when modified
+	Modified bool
+}
+
+// Configuration merged from several layers; each layer overrides the ones
+// before it. Maps are merged key by key, and lists according to ListMerge.
+type LayeredConfig struct {
+	AppName string
+	// Name of the config files, without extension
+	FileName string
+	// Codec of the user file, if it doesn't exist yet
+	DefaultCodec string
+	// One of the CONFIG_LIST_MERGE_ constants
+	ListMerge string
+	// Layer modified by Set and Delete
+	WriteLayer string
+	// From the lowest priority to the highest
+	Layers []*ConfigLayer
+}
+
+// Creates the config with the default layers, all empty
+func NewLayeredConfig(appName string) *LayeredConfig {
+	c := LayeredConfig{}
+	c.AppName = appName
+	c.FileName = "config"
+	c.DefaultCodec = MAP_HELPER_CODEC_JSON
+	c.ListMerge = CONFIG_LIST_MERGE_REPLACE
+	c.WriteLayer = CONFIG_LAYER_USER
+	for _, name := range []string{CONFIG_LAYER_DEFAULTS, CONFIG_LAYER_SYSTEM, CONFIG_LAYER_USER, CONFIG_LAYER_ENVIRONMENT, CONFIG_LAYER_FLAGS} {
+		c.Layers = append(c.Layers, &ConfigLayer{Name: name, Helper: NewEmptyMapHelper()})
+	}
+	return &c
+}
+
+func (c *LayeredConfig) GetLayer(name string) *ConfigLayer {
+	for _, l := range c.Layers {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Replaces the helper of the layer, or adds the layer on top of the rest
+func (c *LayeredConfig) SetLayer(name string, h *MapHelper) {
+	if l := c.GetLayer(name); l != nil {
+		l.Helper = h
+		return
+	}
+	c.Layers = append(c.Layers, &ConfigLayer{Name: name, Helper: h})
+}
+
+func (c *LayeredConfig) SetDefaults(h *MapHelper) {
+	c.SetLayer(CONFIG_LAYER_DEFAULTS, h)
+}
+
+func (c *LayeredConfig) SetDefaultsFromSchema(s *MapHelperSchema) {
+	c.SetLayer(CONFIG_LAYER_DEFAULTS, s.WithDefaults(NewEmptyMapHelper()))
+}
+
+// Returns /etc/<app>
+func (c *LayeredConfig) SystemConfigDir() string {
+	return filepath.Join("/etc", c.AppName)
+}
+
+// Returns $XDG_CONFIG_HOME/<app>, or ~/.config/<app>
+func (c *LayeredConfig) UserConfigDir() (string, error) {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, err := HomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, c.AppName), nil
+}
+
+// Returns the config file in the directory, with any of the supported
+// extensions; if none exists, the path with the default codec.
+func (c *LayeredConfig) findConfigFile(dir string) (string, bool, error) {
+	for _, ext := range configFileExtensions {
+		path := filepath.Join(dir, c.FileName+ext)
+		exists, err := FileExists(path)
+		if err != nil {
+			return "", false, err
+		}
+		if exists {
+			return path, true, nil
+		}
+	}
+	return filepath.Join(dir, c.FileName+"."+c.DefaultCodec), false, nil
+}
+
+// Loads the file of the layer as a document, so saving it keeps its comments
+func (c *LayeredConfig) loadFileLayer(name string, dir string) error {
+	path, exists, err := c.findConfigFile(dir)
+	if err != nil {
+		return err
+	}
+	var h *MapHelper
+	if exists {
+		h, err = NewMapHelperDocumentFromFile(path, true)
+	} else {
+		h, err = NewMapHelperFromFileWithCodec(path, c.DefaultCodec, false)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error loading %v configuration", name)
+	}
+	c.SetLayer(name, h)
+	return nil
+}
+
+func (c *LayeredConfig) LoadSystemFile() error {
+	return c.loadFileLayer(CONFIG_LAYER_SYSTEM, c.SystemConfigDir())
+}
+
+func (c *LayeredConfig) LoadUserFile() error {
+	dir, err := c.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	return c.loadFileLayer(CONFIG_LAYER_USER, dir)
+}
+
+// Loads the environment variables that start with the prefix and an
+// underscore, as mapped by MapHelperEnvBinding (APP_PROXY__PORT is
+// proxy.port); the values are converted to the type of the values of the
+// lower layers.
+func (c *LayeredConfig) LoadEnvironment(prefix string) error {
+	h, err := NewMapHelperEnvBinding(prefix).Load(c.Merged())
+	if err != nil {
+		return err
+	}
+	c.SetLayer(CONFIG_LAYER_ENVIRONMENT, h)
+	return nil
+}
+
+// Loads overrides in the format "path=value", as given in the command
+// line; values are parsed as JSON if possible ("[1, 2]", "true"), and as
+// strings if not.
+func (c *LayeredConfig) LoadFlags(overrides []string) error {
+	h := NewEmptyMapHelper()
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("Invalid override %v, expected path=value", override)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+			value = parts[1]
+		}
+		err := h.SetPath(parts[0], value, true)
+		if err != nil {
+			return errors.Wrapf(err, "Error setting override %v", override)
+		}
+	}
+	c.SetLayer(CONFIG_LAYER_FLAGS, h)
+	return nil
+}
+
+// Returns the merge of all the layers
+func (c *LayeredConfig) Merged() *MapHelper {
+	merged := map[string]interface{}{}
+	for _, l := range c.Layers {
+		data, err := mapHelperCanonicalData(l.Helper.GenerateMap())
+		if err != nil {
+			Log.Errorf("Error merging layer %v: %v", l.Name, err)
+			continue
+		}
+		merged = mergeMapHelperData(merged, data, c.ListMerge)
+	}
+	return NewMapHelperFromData(merged)
+}
+
+// Returns the merged value in the path, and the name of the highest layer
+// that defines it.
+func (c *LayeredConfig) Lookup(path string) (interface{}, string, bool) {
+	value, exists := c.Merged().LookupPath(path)
+	if !exists {
+		return nil, "", false
+	}
+	return value, c.Source(path), true
+}
+
+// Returns the name of the highest layer that defines the path, or an empty
+// string if none.
+func (c *LayeredConfig) Source(path string) string {
+	for i := len(c.Layers) - 1; i >= 0; i-- {
+		if c.Layers[i].Helper.ExistsPath(path) {
+			return c.Layers[i].Name
+		}
+	}
+	return ""
+}
+
+// Sets the value in the write layer; a warning is logged if a higher layer
+// overrides it.
+func (c *LayeredConfig) Set(path string, value interface{}) error {
+	return c.SetInLayer(c.WriteLayer, path, value)
+}
+
+func (c *LayeredConfig) SetInLayer(layer string, path string, value interface{}) error {
+	l := c.GetLayer(layer)
+	if l == nil {
+		return errors.Errorf("Unknown layer %v", layer)
+	}
+	err := l.Helper.SetPath(path, value, true)
+	if err != nil {
+		return err
+	}
+	l.Modified = true
+	if source := c.Source(path); source != layer {
+		Log.Warningf("Value of %v set in layer %v is overridden by layer %v", path, layer, source)
+	}
+	return nil
+}
+
+// Deletes the value from the write layer, so the one of a lower layer is used
+func (c *LayeredConfig) Delete(path string) error {
+	l := c.GetLayer(c.WriteLayer)
+	if l == nil {
+		return errors.Errorf("Unknown layer %v", c.WriteLayer)
+	}
+	err := l.Helper.DeletePath(path)
+	if err != nil {
+		return err
+	}
+	l.Modified = true
+	return nil
+}
+
+// Saves the modified layers to their files; fails without saving anything if
+// a modified layer has no file, like the user layer when LoadUserFile was not
+// called.
+func (c *LayeredConfig) Save() error {
+	for _, l := range c.Layers {
+		if l.Modified && l.Helper.Filename == "" {
+			return errors.Errorf("The %v configuration was modified, but it has no file", l.Name)
+		}
+	}
+	for _, l := range c.Layers {
+		if !l.Modified {
+			continue
+		}
+		err := EnsureDirectoryExists(filepath.Dir(l.Helper.Filename), 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Error creating directory of %v", l.Helper.Filename)
+		}
+		err = l.Helper.Save()
+		if err != nil {
+			return errors.Wrapf(err, "Error saving %v configuration", l.Name)
+		}
+		l.Modified = false
+	}
+	return nil
+}
+
+// Merges the override into a copy of the base; maps are merged recursively,
+// and lists are replaced or appended.
+func mergeMapHelperData(base map[string]interface{}, override map[string]interface{}, listMerge string) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	keys := []string{}
+	for k := range override {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := override[k]
+		baseMap, baseIsMap := merged[k].(map[string]interface{})
+		overrideMap, overrideIsMap := v.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[k] = mergeMapHelperData(baseMap, overrideMap, listMerge)
+			continue
+		}
+		baseList, baseIsList := merged[k].([]interface{})
+		overrideList, overrideIsList := v.([]interface{})
+		if baseIsList && overrideIsList && listMerge == CONFIG_LIST_MERGE_APPEND {
+			merged[k] = append(append([]interface{}{}, baseList...), overrideList...)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
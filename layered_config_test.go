@@ -0,0 +1,162 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Creates a config whose user directory is in a temporary directory
+func newTestLayeredConfig(t *testing.T) (*LayeredConfig, string, func()) {
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, set := os.LookupEnv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	c := NewLayeredConfig("goutilstest")
+	c.SetDefaultsFromSchema(NewMapSchema().
+		AddProperty("proxy", NewMapSchema().
+			AddProperty("protocol", NewStringSchema("http")).
+			AddProperty("address", NewStringSchema("")).
+			AddProperty("port", NewIntSchema(8080)).
+			SetDefault(map[string]interface{}{})).
+		AddProperty("exceptions", NewListOfStringsSchema().SetDefault([]string{"localhost"})))
+	return c, filepath.Join(dir, "goutilstest"), func() {
+		if set {
+			os.Setenv("XDG_CONFIG_HOME", previous)
+		} else {
+			os.Unsetenv("XDG_CONFIG_HOME")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLayeredConfig(t *testing.T) {
+
+	c, dir, cleanup := newTestLayeredConfig(t)
+	defer cleanup()
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(path, []byte("# User settings\nproxy:\n  port: 3128 # Squid\nexceptions: [intranet]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOUTILSTEST_PROXY__ADDRESS", "10.1.1.1")
+	defer os.Unsetenv("GOUTILSTEST_PROXY__ADDRESS")
+
+	if err := c.LoadUserFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadEnvironment("goutilstest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadFlags([]string{"proxy.protocol=socks5", "proxy.retries=3", "debug=true"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		value  interface{}
+		source string
+	}{
+		{"proxy.port", 3128.0, CONFIG_LAYER_USER},
+		{"proxy.address", "10.1.1.1", CONFIG_LAYER_ENVIRONMENT},
+		{"proxy.protocol", "socks5", CONFIG_LAYER_FLAGS},
+		{"proxy.retries", 3.0, CONFIG_LAYER_FLAGS},
+		{"debug", true, CONFIG_LAYER_FLAGS},
+		{"exceptions", []interface{}{"intranet"}, CONFIG_LAYER_USER},
+		{"proxy", map[string]interface{}{"protocol": "socks5", "address": "10.1.1.1", "port": 3128.0, "retries": 3.0}, CONFIG_LAYER_FLAGS},
+		{"missing", nil, ""},
+	}
+	for _, test := range tests {
+		value, source, _ := c.Lookup(test.path)
+		if !reflect.DeepEqual(value, test.value) || source != test.source {
+			t.Errorf("Unexpected value %#v from %v of %v, want %#v from %v", value, source, test.path, test.value, test.source)
+		}
+	}
+
+	c.ListMerge = CONFIG_LIST_MERGE_APPEND
+	if exceptions := c.Merged().GetPathListOfStrings("exceptions", nil); !reflect.DeepEqual(exceptions, []string{"localhost", "intranet"}) {
+		t.Errorf("Unexpected appended exceptions %v", exceptions)
+	}
+
+	// Values of the user layer are saved keeping the comments, and deleted
+	// values fall back to the lower layers
+	if err := c.Set("proxy.port", 3129); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("exceptions"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "# User settings") || !strings.Contains(string(content), "3129 # Squid") || strings.Contains(string(content), "intranet") {
+		t.Errorf("Unexpected content %q", content)
+	}
+	if value, source, _ := c.Lookup("exceptions"); !reflect.DeepEqual(value, []interface{}{"localhost"}) || source != CONFIG_LAYER_DEFAULTS {
+		t.Errorf("Unexpected exceptions %v from %v", value, source)
+	}
+
+	if err := c.SetInLayer("other", "a", 1); err == nil {
+		t.Errorf("Value set in an unknown layer")
+	}
+	if err := c.LoadFlags([]string{"proxy.port"}); err == nil {
+		t.Errorf("Override without value accepted")
+	}
+
+}
+
+// The user file is created with the default codec
+func TestLayeredConfigNewUserFile(t *testing.T) {
+
+	c, dir, cleanup := newTestLayeredConfig(t)
+	defer cleanup()
+
+	if err := c.LoadUserFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("proxy.port", 3128); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewMapHelperFromFile(filepath.Join(dir, "config.json"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h.GenerateMap(), map[string]interface{}{"proxy": map[string]interface{}{"port": 3128.0}}) {
+		t.Errorf("Unexpected data %v", h.GenerateMap())
+	}
+
+}
+
+func TestLayeredConfigSaveWithoutFile(t *testing.T) {
+
+	c, dir, cleanup := newTestLayeredConfig(t)
+	defer cleanup()
+
+	if err := c.Set("proxy.port", 3128); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err == nil {
+		t.Errorf("Layer without file saved")
+	}
+	if exists, _ := FileExists(dir); exists {
+		t.Errorf("Directory %v created", dir)
+	}
+
+}
@@ -1,7 +1,6 @@
 package goutils
 
 import (
-	"gopkg.in/natefinch/lumberjack.v2"
 	"github.com/juju/loggo"
 	"path/filepath"
 	"fmt"
@@ -16,15 +15,14 @@ func InitLogging(logPath string, logToStdErr bool) {
 		logPath = os.DevNull
 	}
 
-	fileRotateWriter := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    5,
-		MaxBackups: 7,
-	}
+	sink := LoggingSinkConfig{Type: LOG_SINK_FILE, Format: LOG_FORMAT_TEXT}
+	sink.Path = logPath
+	sink.MaxSize = 5
+	sink.MaxBackups = 7
 
-	loggo.ReplaceDefaultWriter(loggo.NewSimpleWriter(fileRotateWriter, func(entry loggo.Entry) string {
-		return TzLoggoFormatter(entry)
-	}))
+	if err := NewLoggingConfig().AddSink(&sink).Apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logging: %v\n", err)
+	}
 
 	SetErrorOutputLogging(logToStdErr)
 
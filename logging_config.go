@@ -0,0 +1,522 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Types of the logging sinks
+const LOG_SINK_FILE = "file"
+const LOG_SINK_STDERR = "stderr"
+const LOG_SINK_STDOUT = "stdout"
+const LOG_SINK_SYSLOG = "syslog"
+const LOG_SINK_JOURNALD = "journald"
+
+// Formats of the entries; text is TzLoggoFormatter, and message is the same
+// without the time and the level, for the sinks that already save them
+// (syslog and journald, that use it by default).
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_MESSAGE = "message"
+const LOG_FORMAT_JSON = "json"
+
+// Colour modes of the stderr and stdout sinks; auto only uses colours if the
+// output is a terminal.
+const LOG_COLOR_AUTO = "auto"
+const LOG_COLOR_ALWAYS = "always"
+const LOG_COLOR_NEVER = "never"
+
+const journaldSocketPath = "/run/systemd/journal/socket"
+
+// Keys of the maps of the logging sinks
+var LoggingSinkSchema = NewMapSchema().
+	AddProperty("type", NewStringSchema(LOG_SINK_FILE).SetEnum(LOG_SINK_FILE, LOG_SINK_STDERR, LOG_SINK_STDOUT, LOG_SINK_SYSLOG, LOG_SINK_JOURNALD)).
+	AddProperty("name", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDescription("Name of the writer; the type by default")).
+	AddProperty("level", NewStringSchema("TRACE").SetDescription("Minimum level of the entries written")).
+	AddProperty("format", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetEnum(LOG_FORMAT_TEXT, LOG_FORMAT_MESSAGE, LOG_FORMAT_JSON)).
+	AddProperty("path", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDescription("File of the file sink")).
+	AddProperty("max_size", NewIntSchema(5).SetDescription("Size in megabytes of the file before it is rotated")).
+	AddProperty("max_age", NewIntSchema(0).SetDescription("Days the rotated files are kept; 0 keeps them")).
+	AddProperty("max_backups", NewIntSchema(7).SetDescription("Rotated files kept; 0 keeps them")).
+	AddProperty("compress", NewBooleanSchema(false).SetDescription("Compress the rotated files with gzip")).
+	AddProperty("local_time", NewBooleanSchema(true).SetDescription("Use the local time in the names of the rotated files")).
+	AddProperty("color", NewStringSchema(LOG_COLOR_AUTO).SetEnum(LOG_COLOR_AUTO, LOG_COLOR_ALWAYS, LOG_COLOR_NEVER)).
+	AddProperty("address", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDescription("Syslog server, as udp://host:514; the local one if empty")).
+	AddProperty("facility", NewStringSchema("user").SetDescription("Syslog facility, like user, daemon or local0")).
+	AddProperty("tag", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDescription("Syslog tag and journald identifier; the program name if empty"))
+
+// Keys of the maps of the logging configuration
+var LoggingConfigSchema = NewMapSchema().
+	AddProperty("level", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDescription("Level of the root logger, or a loggo specification like <root>=INFO;module=DEBUG")).
+	AddProperty("sinks", NewListSchema(LoggingSinkSchema))
+
+// Destination of the log entries; only the fields of its type are used.
+type LoggingSinkConfig struct {
+	Type   string `map:"type"`
+	Name   string `map:"name,omitempty"`
+	Level  string `map:"level,omitempty"`
+	Format string `map:"format,omitempty"`
+	// File sinks; the sizes are in megabytes, and the ages in days
+	Path       string `map:"path,omitempty"`
+	MaxSize    int    `map:"max_size"`
+	MaxAge     int    `map:"max_age"`
+	MaxBackups int    `map:"max_backups"`
+	Compress   bool   `map:"compress"`
+	LocalTime  bool   `map:"local_time"`
+	// Stderr and stdout sinks
+	Color string `map:"color,omitempty"`
+	// Syslog and journald sinks
+	Address  string `map:"address,omitempty"`
+	Facility string `map:"facility,omitempty"`
+	Tag      string `map:"tag,omitempty"`
+}
+
+// Loggers level and sinks, so each deployment can tune the logging, for
+// example from a section of its configuration file. The first sink replaces
+// the default loggo writer, and the rest are registered with their names.
+type LoggingConfig struct {
+	// Empty to keep the levels of the loggers; note that the sinks don't
+	// receive the entries below the level of the loggers.
+	Level string              `map:"level,omitempty"`
+	Sinks []LoggingSinkConfig `map:"sinks"`
+}
+
+// Writers registered by the last applied configuration, so they are removed
+// and closed when another one is applied
+var appliedLogging = struct {
+	lock    sync.Mutex
+	names   []string
+	closers []io.Closer
+}{}
+
+func NewLoggingConfig() *LoggingConfig {
+	c := LoggingConfig{}
+	c.Sinks = []LoggingSinkConfig{}
+	return &c
+}
+
+// Returns the sink with the defaults of LoggingSinkSchema
+func NewLoggingSinkConfig(sinkType string) *LoggingSinkConfig {
+	h := NewEmptyMapHelper()
+	h.SetString("type", sinkType)
+	s := LoggingSinkConfig{}
+	LoggingSinkSchema.WithDefaults(h).Decode(&s)
+	return &s
+}
+
+// Loads the configuration from the map, with the defaults of
+// LoggingConfigSchema
+func NewLoggingConfigFromMap(h *MapHelper) (*LoggingConfig, error) {
+	h = LoggingConfigSchema.WithDefaults(h)
+	err := LoggingConfigSchema.Validate(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid logging configuration")
+	}
+	c := NewLoggingConfig()
+	err = h.Decode(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading logging configuration")
+	}
+	return c, nil
+}
+
+// Returns the map of the configuration, so it can be saved
+func (c *LoggingConfig) ToMap() (*MapHelper, error) {
+	return EncodeMapHelper(c)
+}
+
+// Returns the configuration, so it can be chained to the constructor
+func (c *LoggingConfig) AddSink(s *LoggingSinkConfig) *LoggingConfig {
+	c.Sinks = append(c.Sinks, *s)
+	return c
+}
+
+// Replaces the loggo writers with the ones of the sinks, and sets the level
+// of the loggers. Nothing is changed if the level is not valid or any sink
+// can't be created; without sinks, the entries are discarded.
+func (c *LoggingConfig) Apply() error {
+
+	levels, err := loggo.ParseConfigString(c.Level)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid logging level %v", c.Level)
+	}
+
+	names := []string{}
+	for i := range c.Sinks {
+		name := c.Sinks[i].name(i)
+		// The first sink replaces the default writer, so only the rest can't
+		// use its name
+		if i > 0 && name == loggo.DefaultWriterName {
+			return errors.Errorf("Logging sink name %v is reserved", name)
+		}
+		for _, n := range names {
+			if n == name {
+				return errors.Errorf("Duplicated logging sink %v", name)
+			}
+		}
+		names = append(names, name)
+	}
+
+	writers := []loggo.Writer{}
+	closers := []io.Closer{}
+	closeAll := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	for i := range c.Sinks {
+		w, closer, err := c.Sinks[i].newWriter()
+		if err != nil {
+			closeAll()
+			return errors.Wrapf(err, "Error creating logging sink %v", names[i])
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		writers = append(writers, w)
+	}
+	if len(writers) == 0 {
+		writers = append(writers, loggo.NewSimpleWriter(ioutil.Discard, TzLoggoFormatter))
+		names = append(names, "")
+	}
+
+	appliedLogging.lock.Lock()
+	defer appliedLogging.lock.Unlock()
+
+	// The writers of the last configuration and the ones with the same names,
+	// like the one of SetErrorOutputLogging, are removed, and registered
+	// again if the new ones can't be.
+	removed := map[string]loggo.Writer{}
+	for _, name := range append(append([]string{}, appliedLogging.names...), names[1:]...) {
+		if w, err := loggo.RemoveWriter(name); err == nil {
+			removed[name] = w
+		}
+	}
+	registered := []string{}
+	rollback := func() {
+		for _, name := range registered {
+			loggo.RemoveWriter(name)
+		}
+		for name, w := range removed {
+			loggo.RegisterWriter(name, w)
+		}
+		closeAll()
+	}
+	for i := 1; i < len(writers); i++ {
+		err = loggo.RegisterWriter(names[i], writers[i])
+		if err != nil {
+			rollback()
+			return errors.Wrapf(err, "Error registering log writer %v", names[i])
+		}
+		registered = append(registered, names[i])
+	}
+	_, err = loggo.ReplaceDefaultWriter(writers[0])
+	if err != nil {
+		// The default writer was removed; it is added again
+		err = loggo.RegisterWriter(loggo.DefaultWriterName, writers[0])
+		if err != nil {
+			rollback()
+			return errors.Wrap(err, "Error replacing default log writer")
+		}
+	}
+
+	for _, closer := range appliedLogging.closers {
+		closer.Close()
+	}
+	appliedLogging.names = names[1:]
+	appliedLogging.closers = closers
+
+	if levels != nil {
+		loggo.DefaultContext().ApplyConfig(levels)
+	}
+
+	return nil
+
+}
+
+func (s *LoggingSinkConfig) name(index int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if index == 0 {
+		return s.Type
+	}
+	return fmt.Sprintf("%v-%v", s.Type, index)
+}
+
+// Returns the writer of the sink, filtered by its level, and what must be
+// closed when it is no longer used
+func (s *LoggingSinkConfig) newWriter() (loggo.Writer, io.Closer, error) {
+
+	level := loggo.TRACE
+	if s.Level != "" {
+		var ok bool
+		level, ok = loggo.ParseLevel(s.Level)
+		if !ok {
+			return nil, nil, errors.Errorf("Invalid level %v", s.Level)
+		}
+	}
+
+	format := s.Format
+	if format == "" {
+		format = LOG_FORMAT_TEXT
+		if s.Type == LOG_SINK_SYSLOG || s.Type == LOG_SINK_JOURNALD {
+			format = LOG_FORMAT_MESSAGE
+		}
+	}
+	var formatter func(entry loggo.Entry) string
+	switch format {
+	case LOG_FORMAT_TEXT:
+		formatter = TzLoggoFormatter
+	case LOG_FORMAT_MESSAGE:
+		formatter = MessageLoggoFormatter
+	case LOG_FORMAT_JSON:
+		formatter = JsonLoggoFormatter
+	default:
+		return nil, nil, errors.Errorf("Invalid format %v", s.Format)
+	}
+
+	var w loggo.Writer
+	var closer io.Closer
+	switch s.Type {
+	case LOG_SINK_FILE:
+		if s.Path == "" {
+			return nil, nil, errors.New("No path for the file sink")
+		}
+		logger := &lumberjack.Logger{
+			Filename:   s.Path,
+			MaxSize:    s.MaxSize,
+			MaxAge:     s.MaxAge,
+			MaxBackups: s.MaxBackups,
+			LocalTime:  s.LocalTime,
+			Compress:   s.Compress,
+		}
+		w = loggo.NewSimpleWriter(logger, formatter)
+		closer = logger
+	case LOG_SINK_STDERR, LOG_SINK_STDOUT:
+		output := os.Stderr
+		if s.Type == LOG_SINK_STDOUT {
+			output = os.Stdout
+		}
+		color, err := s.useColor(output)
+		if err != nil {
+			return nil, nil, err
+		}
+		if color && format != LOG_FORMAT_JSON {
+			w = &colorLoggoWriter{output: output, formatter: formatter}
+		} else {
+			w = loggo.NewSimpleWriter(output, formatter)
+		}
+	case LOG_SINK_SYSLOG:
+		writer, err := s.dialSyslog()
+		if err != nil {
+			return nil, nil, err
+		}
+		w = &syslogLoggoWriter{writer: writer, formatter: formatter}
+		closer = writer
+	case LOG_SINK_JOURNALD:
+		conn, err := net.Dial("unixgram", journaldSocketPath)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Error connecting to journald")
+		}
+		w = &journaldLoggoWriter{conn: conn, identifier: s.tag(), formatter: formatter}
+		closer = conn
+	default:
+		return nil, nil, errors.Errorf("Invalid sink type %v", s.Type)
+	}
+
+	return loggo.NewMinimumLevelWriter(w, level), closer, nil
+
+}
+
+func (s *LoggingSinkConfig) useColor(output *os.File) (bool, error) {
+	switch s.Color {
+	case LOG_COLOR_ALWAYS:
+		return true, nil
+	case LOG_COLOR_NEVER:
+		return false, nil
+	case LOG_COLOR_AUTO, "":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		info, err := output.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, errors.Errorf("Invalid color mode %v", s.Color)
+}
+
+func (s *LoggingSinkConfig) tag() string {
+	if s.Tag != "" {
+		return s.Tag
+	}
+	return filepath.Base(os.Args[0])
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+func (s *LoggingSinkConfig) dialSyslog() (*syslog.Writer, error) {
+	facility := syslog.LOG_USER
+	if s.Facility != "" {
+		var ok bool
+		facility, ok = syslogFacilities[strings.ToLower(s.Facility)]
+		if !ok {
+			return nil, errors.Errorf("Invalid syslog facility %v", s.Facility)
+		}
+	}
+	network, address := "", ""
+	if s.Address != "" {
+		parts := strings.SplitN(s.Address, "://", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid syslog address %v; it must be like udp://host:514", s.Address)
+		}
+		network, address = parts[0], parts[1]
+	}
+	writer, err := syslog.Dial(network, address, facility|syslog.LOG_INFO, s.tag())
+	if err != nil {
+		return nil, errors.Wrap(err, "Error connecting to syslog")
+	}
+	return writer, nil
+}
+
+// Formats the entry without the time and the level
+func MessageLoggoFormatter(entry loggo.Entry) string {
+	return fmt.Sprintf("%s %s:%d %s", entry.Module, filepath.Base(entry.Filename), entry.Line, entry.Message)
+}
+
+// Formats the entry as a JSON object in a line
+func JsonLoggoFormatter(entry loggo.Entry) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"time":    entry.Timestamp.Format("2006-01-02T15:04:05.000Z07:00"),
+		"level":   entry.Level.String(),
+		"module":  entry.Module,
+		"file":    filepath.Base(entry.Filename),
+		"line":    entry.Line,
+		"message": entry.Message,
+	})
+	if err != nil {
+		return TzLoggoFormatter(entry)
+	}
+	return string(data)
+}
+
+// ANSI colours of the levels
+var loggoLevelColors = map[loggo.Level]string{
+	loggo.TRACE:    "\x1b[37m",
+	loggo.DEBUG:    "\x1b[32m",
+	loggo.INFO:     "\x1b[94m",
+	loggo.WARNING:  "\x1b[33m",
+	loggo.ERROR:    "\x1b[91m",
+	loggo.CRITICAL: "\x1b[97;41m",
+}
+
+// Writes the entries with the colour of their level
+type colorLoggoWriter struct {
+	output    io.Writer
+	formatter func(entry loggo.Entry) string
+}
+
+func (w *colorLoggoWriter) Write(entry loggo.Entry) {
+	color, ok := loggoLevelColors[entry.Level]
+	if !ok {
+		fmt.Fprintln(w.output, w.formatter(entry))
+		return
+	}
+	fmt.Fprintf(w.output, "%s%s\x1b[0m\n", color, w.formatter(entry))
+}
+
+type syslogLoggoWriter struct {
+	writer    *syslog.Writer
+	formatter func(entry loggo.Entry) string
+}
+
+func (w *syslogLoggoWriter) Write(entry loggo.Entry) {
+	message := w.formatter(entry)
+	var err error
+	switch entry.Level {
+	case loggo.CRITICAL:
+		err = w.writer.Crit(message)
+	case loggo.ERROR:
+		err = w.writer.Err(message)
+	case loggo.WARNING:
+		err = w.writer.Warning(message)
+	case loggo.INFO:
+		err = w.writer.Info(message)
+	default:
+		err = w.writer.Debug(message)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to syslog: %v\n", err)
+	}
+}
+
+// Sends the entries to journald with its native protocol, so the fields
+// of the entries are kept
+type journaldLoggoWriter struct {
+	conn       net.Conn
+	identifier string
+	formatter  func(entry loggo.Entry) string
+}
+
+func (w *journaldLoggoWriter) Write(entry loggo.Entry) {
+	var b bytes.Buffer
+	writeJournaldField(&b, "MESSAGE", w.formatter(entry))
+	writeJournaldField(&b, "PRIORITY", strconv.Itoa(int(journaldPriority(entry.Level))))
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", w.identifier)
+	writeJournaldField(&b, "CODE_FILE", entry.Filename)
+	writeJournaldField(&b, "CODE_LINE", strconv.Itoa(entry.Line))
+	writeJournaldField(&b, "LOGGO_MODULE", entry.Module)
+	_, err := w.conn.Write([]byte(b.String()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to journald: %v\n", err)
+	}
+}
+
+func journaldPriority(level loggo.Level) syslog.Priority {
+	switch level {
+	case loggo.CRITICAL:
+		return syslog.LOG_CRIT
+	case loggo.ERROR:
+		return syslog.LOG_ERR
+	case loggo.WARNING:
+		return syslog.LOG_WARNING
+	case loggo.INFO:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
+
+// Values with line breaks are sent with their length, as the protocol
+// requires
+func writeJournaldField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(value)))
+	b.WriteString(name + "\n")
+	b.Write(size)
+	b.WriteString(value + "\n")
+}
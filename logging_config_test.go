@@ -0,0 +1,309 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// Keeps the messages of the entries
+type testLoggoWriter struct {
+	messages *bytes.Buffer
+}
+
+func (w testLoggoWriter) Write(entry loggo.Entry) {
+	w.messages.WriteString(entry.Message + "\n")
+}
+
+// Replaces the default writer with one that keeps the messages, and returns
+// the function that restores the logging
+func useTestLoggoWriter(t *testing.T) (*bytes.Buffer, func()) {
+	messages := &bytes.Buffer{}
+	previous, err := loggo.ReplaceDefaultWriter(testLoggoWriter{messages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := loggo.DefaultContext().Config()
+	return messages, func() {
+		NewLoggingConfig().Apply()
+		loggo.ReplaceDefaultWriter(previous)
+		loggo.DefaultContext().ResetLoggerLevels()
+		loggo.DefaultContext().ApplyConfig(config)
+	}
+}
+
+func TestNewLoggingConfigFromMap(t *testing.T) {
+
+	h := NewMapHelperFromData(map[string]interface{}{
+		"sinks": []interface{}{
+			map[string]interface{}{"type": "file", "path": "/tmp/app.log", "compress": true},
+			map[string]interface{}{"type": "stdout", "color": "always"},
+		},
+	})
+	c, err := NewLoggingConfigFromMap(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Sinks) != 2 {
+		t.Fatalf("Unexpected sinks %+v", c.Sinks)
+	}
+	file := c.Sinks[0]
+	if file.MaxSize != 5 || file.MaxBackups != 7 || !file.LocalTime || !file.Compress || file.Color != LOG_COLOR_AUTO {
+		t.Errorf("Unexpected file sink %+v", file)
+	}
+	if c.Sinks[1].Color != LOG_COLOR_ALWAYS {
+		t.Errorf("Unexpected stdout sink %+v", c.Sinks[1])
+	}
+
+	// Zero values are kept when saved and loaded again
+	s := NewLoggingSinkConfig(LOG_SINK_FILE)
+	s.Path = "/tmp/app.log"
+	s.MaxSize = 0
+	s.MaxBackups = 0
+	s.LocalTime = false
+	m, err := NewLoggingConfig().AddSink(s).ToMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewLoggingConfigFromMap(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Sinks) != 1 || c.Sinks[0] != *s {
+		t.Errorf("Unexpected sinks %+v, want %+v", c.Sinks, *s)
+	}
+
+	for _, sink := range []map[string]interface{}{
+		{"type": "other"},
+		{"type": "file", "format": "xml"},
+		{"type": "stdout", "color": "sometimes"},
+	} {
+		h := NewMapHelperFromData(map[string]interface{}{"sinks": []interface{}{sink}})
+		if c, err := NewLoggingConfigFromMap(h); err == nil {
+			t.Errorf("Invalid sink %v loaded as %+v", sink, c.Sinks)
+		}
+	}
+
+}
+
+func TestLoggingConfigApply(t *testing.T) {
+
+	messages, restore := useTestLoggoWriter(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := loggo.GetLogger("goutils.test")
+
+	// JSON entries from INFO in the file, and all of them in the other one
+	jsonPath := filepath.Join(dir, "json.log")
+	textPath := filepath.Join(dir, "text.log")
+	c := NewLoggingConfig()
+	c.Level = "<root>=WARNING;goutils.test=DEBUG"
+	jsonSink := NewLoggingSinkConfig(LOG_SINK_FILE)
+	jsonSink.Path = jsonPath
+	jsonSink.Format = LOG_FORMAT_JSON
+	jsonSink.Level = "INFO"
+	textSink := NewLoggingSinkConfig(LOG_SINK_FILE)
+	textSink.Path = textPath
+	textSink.Format = LOG_FORMAT_MESSAGE
+	if err := c.AddSink(jsonSink).AddSink(textSink).Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if logger.LogLevel() != loggo.DEBUG || loggo.GetLogger("other").EffectiveLogLevel() != loggo.WARNING {
+		t.Errorf("Unexpected levels %v", loggo.LoggerInfo())
+	}
+	logger.Debugf("debug entry")
+	logger.Infof("info entry")
+
+	// The writers are closed and removed by the next configuration
+	if err := NewLoggingConfig().Apply(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Infof("discarded entry")
+
+	content, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Unexpected entries %q", content)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["message"] != "info entry" || entry["level"] != "INFO" || entry["module"] != "goutils.test" || entry["file"] != "logging_config_test.go" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+	content, err = ioutil.ReadFile(textPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "goutils.test logging_config_test.go:") || !strings.Contains(string(content), " debug entry\n") || strings.Contains(string(content), "discarded") {
+		t.Errorf("Unexpected entries %q", content)
+	}
+	if messages.Len() != 0 {
+		t.Errorf("Entries written to the replaced writer: %q", messages)
+	}
+
+}
+
+// Configurations that can't be applied keep the current writers and levels
+func TestLoggingConfigApplyErrors(t *testing.T) {
+
+	messages, restore := useTestLoggoWriter(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	other := &bytes.Buffer{}
+	if err := loggo.RegisterWriter("other", testLoggoWriter{other}); err != nil {
+		t.Fatal(err)
+	}
+	defer loggo.RemoveWriter("other")
+	logger := loggo.GetLogger("goutils.test")
+	logger.SetLogLevel(loggo.INFO)
+
+	file := *NewLoggingSinkConfig(LOG_SINK_FILE)
+	file.Path = filepath.Join(dir, "app.log")
+	named := func(s LoggingSinkConfig, name string) LoggingSinkConfig {
+		s.Name = name
+		return s
+	}
+	invalid := func(update func(s *LoggingSinkConfig)) LoggingSinkConfig {
+		s := *NewLoggingSinkConfig(LOG_SINK_STDERR)
+		update(&s)
+		return s
+	}
+	tests := []struct {
+		name  string
+		level string
+		sinks []LoggingSinkConfig
+	}{
+		{"Invalid level", "<root>=NOPE", []LoggingSinkConfig{file}},
+		{"Reserved name", "", []LoggingSinkConfig{file, named(file, loggo.DefaultWriterName)}},
+		{"Duplicated name", "", []LoggingSinkConfig{named(file, "a"), named(file, "a")}},
+		{"File without path", "", []LoggingSinkConfig{file, *NewLoggingSinkConfig(LOG_SINK_FILE)}},
+		{"Invalid sink level", "", []LoggingSinkConfig{file, invalid(func(s *LoggingSinkConfig) { s.Level = "NOPE" })}},
+		{"Invalid format", "", []LoggingSinkConfig{file, invalid(func(s *LoggingSinkConfig) { s.Format = "xml" })}},
+		{"Invalid color", "", []LoggingSinkConfig{file, invalid(func(s *LoggingSinkConfig) { s.Color = "sometimes" })}},
+		{"Invalid type", "", []LoggingSinkConfig{file, invalid(func(s *LoggingSinkConfig) { s.Type = "other" })}},
+		{"Invalid facility", "", []LoggingSinkConfig{file, {Type: LOG_SINK_SYSLOG, Address: "udp://127.0.0.1:514", Facility: "nope"}}},
+		{"Invalid address", "", []LoggingSinkConfig{file, {Type: LOG_SINK_SYSLOG, Address: "127.0.0.1"}}},
+	}
+
+	for _, test := range tests {
+		c := &LoggingConfig{Level: test.level, Sinks: test.sinks}
+		if err := c.Apply(); err == nil {
+			t.Errorf("%v: configuration applied", test.name)
+		}
+		messages.Reset()
+		other.Reset()
+		logger.Debugf("debug entry")
+		logger.Infof("%v", test.name)
+		if messages.String() != test.name+"\n" || other.String() != test.name+"\n" {
+			t.Errorf("%v: unexpected entries %q and %q", test.name, messages, other)
+		}
+	}
+
+	// The files of the sinks created before the failure are not written
+	if _, err := os.Stat(file.Path); !os.IsNotExist(err) {
+		t.Errorf("Log file %v created: %v", file.Path, err)
+	}
+
+}
+
+func TestLoggingConfigSyslog(t *testing.T) {
+
+	_, restore := useTestLoggoWriter(t)
+	defer restore()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := NewLoggingSinkConfig(LOG_SINK_SYSLOG)
+	s.Address = "udp://" + conn.LocalAddr().String()
+	s.Facility = "local3"
+	s.Tag = "goutils-test"
+	if err := NewLoggingConfig().AddSink(s).Apply(); err != nil {
+		t.Fatal(err)
+	}
+	loggo.GetLogger("goutils.test").Warningf("syslog entry")
+
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local3 (19) * 8 + warning (4)
+	message := string(buffer[:n])
+	if !strings.HasPrefix(message, "<156>") || !strings.Contains(message, " goutils-test[") || !strings.Contains(message, " goutils.test logging_config_test.go:") || !strings.HasSuffix(strings.TrimSpace(message), " syslog entry") {
+		t.Errorf("Unexpected message %q", message)
+	}
+
+}
+
+func TestJournaldLoggoWriter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := &journaldLoggoWriter{conn: conn, identifier: "goutils-test", formatter: func(entry loggo.Entry) string { return entry.Message }}
+	w.Write(loggo.Entry{Level: loggo.ERROR, Module: "goutils.test", Filename: "/src/file.go", Line: 10, Message: "line 1\nline 2"})
+
+	buffer := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "MESSAGE\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\n" +
+		"PRIORITY=3\nSYSLOG_IDENTIFIER=goutils-test\nCODE_FILE=/src/file.go\nCODE_LINE=10\nLOGGO_MODULE=goutils.test\n"
+	if string(buffer[:n]) != want {
+		t.Errorf("Unexpected datagram %q, want %q", buffer[:n], want)
+	}
+
+}
+
+func TestColorLoggoWriter(t *testing.T) {
+
+	output := &bytes.Buffer{}
+	w := &colorLoggoWriter{output: output, formatter: func(entry loggo.Entry) string { return entry.Message }}
+	w.Write(loggo.Entry{Level: loggo.WARNING, Message: "warning"})
+	w.Write(loggo.Entry{Level: loggo.UNSPECIFIED, Message: "plain"})
+	if output.String() != "\x1b[33mwarning\x1b[0m\nplain\n" {
+		t.Errorf("Unexpected output %q", output)
+	}
+
+}
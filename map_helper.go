@@ -2,15 +2,29 @@ package goutils
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type MapHelper struct {
 	Filename string
-	Data     map[string]interface{}
+	// Name of the codec used to load and save the file
+	Codec string
+	Data  map[string]interface{}
+	// Original file, when loaded as a document; saving with the same codec
+	// keeps its comments and key order.
+	Document MapHelperDocument
+	// Number of backups of the file kept when saving it
+	Backups int
+	// Paths encrypted when saving the file; see SetSecrets
+	Secrets *MapHelperSecrets
 }
 
 func NewEmptyMapHelper() *MapHelper {
@@ -22,37 +36,7 @@ func NewMapHelperFromData(data map[string]interface{}) *MapHelper {
 }
 
 func NewMapHelperFromJsonFile(configPath string, failIfNotFound bool) (*MapHelper, error) {
-
-	// TODO: Use funvtion LoadJsonFileAsMap
-
-	exists, err := FileExists(configPath)
-	if err != nil {
-		return nil, err
-	}
-
-	if !exists {
-		if failIfNotFound {
-			return nil, errors.Errorf("File %v doesn't exist.", configPath)
-		} else {
-			return &MapHelper{Filename: configPath, Data: map[string]interface{}{}}, nil
-		}
-	}
-
-	reader, err := os.Open(configPath)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error opening file %v.", configPath)
-	}
-
-	decoder := json.NewDecoder(reader)
-
-	var x map[string]interface{}
-	err = decoder.Decode(&x)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error loading JSON from file %v.", configPath)
-	}
-
-	return &MapHelper{Filename: configPath, Data: x}, nil
-
+	return NewMapHelperFromFileWithCodec(configPath, MAP_HELPER_CODEC_JSON, failIfNotFound)
 }
 
 func (h *MapHelper) Clear() {
@@ -63,7 +47,11 @@ func (h *MapHelper) Count() int {
 	return len(h.Data)
 }
 
+// Keys are in the order of the document, if loaded as one
 func (h *MapHelper) Keys() []string {
+	if h.Document != nil {
+		return orderMapHelperKeys(h.Data, h.Document.Keys([]string{}))
+	}
 	keys := []string{}
 	for key, _ := range h.Data {
 		keys = append(keys, key)
@@ -96,7 +84,7 @@ func (h *MapHelper) Set(key string, value interface{}) {
 
 func (h *MapHelper) GetBoolean(key string, value bool) bool {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.(bool); ok {
+		if w, ok := mapHelperBoolean(val); ok {
 			return w
 		}
 	}
@@ -109,12 +97,9 @@ func (h *MapHelper) SetBoolean(key string, value bool) {
 
 func (h *MapHelper) GetInt(key string, value int) int {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.(int); ok {
+		if w, ok := mapHelperInt(val); ok {
 			return w
 		}
-		if w, ok := val.(float64); ok {
-			return int(w)
-		}
 	}
 	return value
 }
@@ -125,7 +110,7 @@ func (h *MapHelper) SetInt(key string, value int) {
 
 func (h *MapHelper) GetInt64(key string, value int64) int64 {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.(int64); ok {
+		if w, ok := mapHelperInt64(val); ok {
 			return w
 		}
 	}
@@ -136,9 +121,66 @@ func (h *MapHelper) SetInt64(key string, value int64) {
 	h.Data[key] = value
 }
 
+func (h *MapHelper) GetFloat64(key string, value float64) float64 {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperFloat64(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) SetFloat64(key string, value float64) {
+	h.Data[key] = value
+}
+
+// Durations can be strings like "1m30s", or numbers of seconds
+func (h *MapHelper) GetDuration(key string, value time.Duration) time.Duration {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperDuration(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+// Saved as a string, like "1m30s"
+func (h *MapHelper) SetDuration(key string, value time.Duration) {
+	h.Data[key] = value.String()
+}
+
+// Times can be RFC 3339 strings, dates like "2006-01-02", or Unix times in
+// seconds
+func (h *MapHelper) GetTime(key string, value time.Time) time.Time {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperTime(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+// Saved as an RFC 3339 string
+func (h *MapHelper) SetTime(key string, value time.Time) {
+	h.Data[key] = value.Format(time.RFC3339Nano)
+}
+
+func (h *MapHelper) GetUrl(key string, value *url.URL) *url.URL {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperUrl(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) SetUrl(key string, value *url.URL) {
+	h.Data[key] = value.String()
+}
+
 func (h *MapHelper) GetString(key string, value string) string {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.(string); ok {
+		if w, ok := mapHelperString(val); ok {
 			return w
 		}
 	}
@@ -151,14 +193,8 @@ func (h *MapHelper) SetString(key string, value string) {
 
 func (h *MapHelper) GetListOfStrings(key string, value []string) []string {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.([]interface{}); ok {
-			strList := []string{}
-			for _, val2 := range w {
-				if w2, ok := val2.(string); ok {
-					strList = append(strList, w2)
-				}
-			}
-			return strList
+		if w, ok := mapHelperListOfStrings(val); ok {
+			return w
 		}
 	}
 	return value
@@ -168,6 +204,34 @@ func (h *MapHelper) SetListOfStrings(key string, value []string) {
 	h.Data[key] = value
 }
 
+// Returns the default if any of the elements is not a number
+func (h *MapHelper) GetListOfInts(key string, value []int) []int {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperListOfInts(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) SetListOfInts(key string, value []int) {
+	h.Data[key] = value
+}
+
+// Returns the default if any of the values can't be converted to a string
+func (h *MapHelper) GetMapOfStrings(key string, value map[string]string) map[string]string {
+	if val, ok := h.Data[key]; ok {
+		if w, ok := mapHelperMapOfStrings(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) SetMapOfStrings(key string, value map[string]string) {
+	h.Data[key] = value
+}
+
 func (h *MapHelper) GetHelper(key string) *MapHelper {
 	if val, ok := h.Data[key]; ok {
 		if w, ok := val.(*MapHelper); ok {
@@ -187,16 +251,11 @@ func (h *MapHelper) SetHelper(key string, value *MapHelper) {
 	h.Data[key] = value
 }
 
+// Elements that are not maps are skipped
 func (h *MapHelper) GetListOfHelpers(key string) []*MapHelper {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.([]*MapHelper); ok {
+		if w, ok := mapHelperListOfHelpers(val); ok {
 			return w
-		} else if w, ok := val.([]interface{}); ok {
-			list := []*MapHelper{}
-			for _, curval := range w {
-				list = append(list, NewMapHelperFromData(curval.(map[string]interface{})))
-			}
-			return list
 		}
 	}
 	// When key doesn't exist or the key is not a list
@@ -209,7 +268,7 @@ func (h *MapHelper) SetListOfHelpers(key string, data []*MapHelper) {
 
 func (h *MapHelper) GetList(key string, value []interface{}) []interface{} {
 	if val, ok := h.Data[key]; ok {
-		if w, ok := val.([]interface{}); ok {
+		if w, ok := mapHelperList(val); ok {
 			return w
 		}
 	}
@@ -266,14 +325,248 @@ func (h *MapHelper) SaveToJsonFile(path string, pretty bool) error {
 	return h.SaveToJsonFileWithMode(path, pretty, 0666)
 }
 
+// Secret values are encrypted
 func (h *MapHelper) SaveToJsonFileWithMode(path string, pretty bool, mode os.FileMode) error {
-	data, err := h.GenerateJson(pretty)
+	stored, err := h.generateStoredMap()
+	if err != nil {
+		return errors.Wrapf(err, "Error encrypting secrets")
+	}
+	var data []byte
+	if pretty {
+		data, err = json.MarshalIndent(stored, "", "  ")
+	} else {
+		data, err = json.Marshal(stored)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "Error marshalling map")
 	}
-	err = ioutil.WriteFile(path, data, mode)
+	err = WriteFileAtomicWithBackups(path, data, mode, h.Backups)
 	if err != nil {
 		return errors.Wrapf(err, "Error saving JSON file")
 	}
 	return nil
 }
+
+// Conversions used by the getters; the second value is false if the value
+// can't be converted. Numbers and booleans can be strings, as values of INI
+// files and environment variables are.
+
+func mapHelperBoolean(val interface{}) (bool, bool) {
+	switch w := val.(type) {
+	case bool:
+		return w, true
+	case string:
+		b, err := strconv.ParseBool(w)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func mapHelperInt(val interface{}) (int, bool) {
+	w, ok := mapHelperInt64(val)
+	if !ok || int64(int(w)) != w {
+		return 0, false
+	}
+	return int(w), true
+}
+
+func mapHelperInt64(val interface{}) (int64, bool) {
+	switch w := val.(type) {
+	case int:
+		return int64(w), true
+	case int64:
+		return w, true
+	case int32:
+		return int64(w), true
+	case string:
+		// Parsed as an integer first, as big ones lose precision as floats
+		if i, err := strconv.ParseInt(strings.TrimSpace(w), 10, 64); err == nil {
+			return i, true
+		}
+	}
+	if w, ok := mapHelperFloat64(val); ok && mapHelperInt64Range(w) {
+		return int64(w), true
+	}
+	return 0, false
+}
+
+// Same as mapHelperInt64, but numbers with decimals are not truncated
+func mapHelperExactInt64(val interface{}) (int64, bool) {
+	if f, ok := mapHelperFloat64(val); ok && f != math.Trunc(f) {
+		return 0, false
+	}
+	return mapHelperInt64(val)
+}
+
+// Whether the number can be converted to int64; NaN can't
+func mapHelperInt64Range(f float64) bool {
+	return f >= math.MinInt64 && f < -math.MinInt64
+}
+
+func mapHelperFloat64(val interface{}) (float64, bool) {
+	switch w := val.(type) {
+	case float64:
+		return w, true
+	case float32:
+		return float64(w), true
+	case int:
+		return float64(w), true
+	case int64:
+		return float64(w), true
+	case int32:
+		return float64(w), true
+	case json.Number:
+		f, err := w.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func mapHelperString(val interface{}) (string, bool) {
+	switch w := val.(type) {
+	case string:
+		return w, true
+	case bool:
+		return strconv.FormatBool(w), true
+	case float64:
+		return strconv.FormatFloat(w, 'f', -1, 64), true
+	case int, int64, int32, json.Number:
+		return fmt.Sprintf("%v", w), true
+	}
+	return "", false
+}
+
+func mapHelperDuration(val interface{}) (time.Duration, bool) {
+	switch w := val.(type) {
+	case time.Duration:
+		return w, true
+	case string:
+		if d, err := time.ParseDuration(w); err == nil {
+			return d, true
+		}
+	}
+	// Numbers are seconds
+	if w, ok := mapHelperFloat64(val); ok {
+		return time.Duration(w * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+func mapHelperTime(val interface{}) (time.Time, bool) {
+	switch w := val.(type) {
+	case time.Time:
+		return w, true
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, w); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	// Numbers are Unix times
+	if w, ok := mapHelperFloat64(val); ok {
+		seconds := math.Floor(w)
+		return time.Unix(int64(seconds), int64((w-seconds)*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+func mapHelperUrl(val interface{}) (*url.URL, bool) {
+	switch w := val.(type) {
+	case *url.URL:
+		return w, w != nil
+	case url.URL:
+		return &w, true
+	case string:
+		u, err := url.Parse(w)
+		return u, err == nil
+	}
+	return nil, false
+}
+
+func mapHelperListOfStrings(val interface{}) ([]string, bool) {
+	if w, ok := val.([]string); ok {
+		return w, true
+	}
+	if w, ok := val.([]interface{}); ok {
+		strList := []string{}
+		for _, val2 := range w {
+			if w2, ok := val2.(string); ok {
+				strList = append(strList, w2)
+			}
+		}
+		return strList, true
+	}
+	return nil, false
+}
+
+func mapHelperListOfInts(val interface{}) ([]int, bool) {
+	switch w := val.(type) {
+	case []int:
+		return w, true
+	case []interface{}:
+		list := []int{}
+		for _, v := range w {
+			i, ok := mapHelperInt(v)
+			if !ok {
+				return nil, false
+			}
+			list = append(list, i)
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+func mapHelperMapOfStrings(val interface{}) (map[string]string, bool) {
+	switch w := val.(type) {
+	case map[string]string:
+		return w, true
+	case *MapHelper:
+		return mapHelperMapOfStrings(w.Data)
+	case map[string]interface{}:
+		m := map[string]string{}
+		for k, v := range w {
+			s, ok := mapHelperString(v)
+			if !ok {
+				return nil, false
+			}
+			m[k] = s
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func mapHelperList(val interface{}) ([]interface{}, bool) {
+	w, ok := val.([]interface{})
+	return w, ok
+}
+
+func mapHelperListOfHelpers(val interface{}) ([]*MapHelper, bool) {
+	switch w := val.(type) {
+	case []*MapHelper:
+		return w, true
+	case []map[string]interface{}:
+		list := []*MapHelper{}
+		for _, curval := range w {
+			list = append(list, NewMapHelperFromData(curval))
+		}
+		return list, true
+	case []interface{}:
+		list := []*MapHelper{}
+		for _, curval := range w {
+			if helper, ok := curval.(*MapHelper); ok {
+				list = append(list, helper)
+			} else if m, ok := curval.(map[string]interface{}); ok {
+				list = append(list, NewMapHelperFromData(m))
+			}
+		}
+		return list, true
+	}
+	return nil, false
+}
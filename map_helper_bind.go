@@ -0,0 +1,515 @@
+package goutils
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Implemented by types that decode themselves from the values of a
+// MapHelper (float64, string, bool, nil, []interface{} or
+// map[string]interface{}).
+type MapHelperUnmarshaler interface {
+	UnmarshalMapHelper(value interface{}) error
+}
+
+// Implemented by types that encode themselves as values of a MapHelper
+type MapHelperMarshaler interface {
+	MarshalMapHelper() (interface{}, error)
+}
+
+// Handles the fields tagged as "secret", so they can be kept out of the
+// file, for example in a keyring.
+type MapHelperSecretHook interface {
+	// Returns the value of the field from what is in the map, that is nil if
+	// the key doesn't exist.
+	LoadSecret(path string, stored interface{}) (interface{}, error)
+	// Returns what is saved in the map for the value of the field; nothing
+	// is saved if the second value is false.
+	SaveSecret(path string, value interface{}) (interface{}, bool, error)
+}
+
+type MapHelperBindOptions struct {
+	// If nil, secrets are decoded as the rest of fields, but not encoded
+	SecretHook MapHelperSecretHook
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var mapHelperType = reflect.TypeOf(MapHelper{})
+
+// Field of a struct and the options of its tag, as in `map:"name,omitempty,secret"`
+type mapHelperField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	secret    bool
+}
+
+// Fills the struct pointed by target with the data of the helper, using the
+// "map" tags of the fields; fields without tag use their name, and fields
+// tagged "-" are ignored. Keys not in the struct are ignored, and fields
+// without key are not modified.
+func (h *MapHelper) Decode(target interface{}) error {
+	return h.DecodeWithOptions(target, nil)
+}
+
+func (h *MapHelper) DecodeWithOptions(target interface{}, options *MapHelperBindOptions) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.Errorf("Target must be a non-nil pointer, not %T", target)
+	}
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return errors.Wrap(err, "Error converting data")
+	}
+	if options == nil {
+		options = &MapHelperBindOptions{}
+	}
+	return decodeMapHelperValue(data, v.Elem(), []MapHelperPathElement{}, options)
+}
+
+// Generates a helper from a struct (or a pointer to it), using the same
+// tags as Decode.
+func EncodeMapHelper(source interface{}) (*MapHelper, error) {
+	return EncodeMapHelperWithOptions(source, nil)
+}
+
+func EncodeMapHelperWithOptions(source interface{}, options *MapHelperBindOptions) (*MapHelper, error) {
+	if options == nil {
+		options = &MapHelperBindOptions{}
+	}
+	value, err := encodeMapHelperValue(reflect.ValueOf(source), []MapHelperPathElement{}, options)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("Source must be a struct or a map, not %T", source)
+	}
+	data, err = mapHelperCanonicalData(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error converting data")
+	}
+	return NewMapHelperFromData(data), nil
+}
+
+func mapHelperStructFields(t reflect.Type) []mapHelperField {
+	fields := []mapHelperField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("map")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		// Embedded structs without tag are flattened, as encoding/json does
+		if f.Anonymous && !tagged {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, embedded := range mapHelperStructFields(ft) {
+					embedded.index = append([]int{i}, embedded.index...)
+					fields = append(fields, embedded)
+				}
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		field := mapHelperField{name: f.Name, index: []int{i}}
+		if parts[0] != "" {
+			field.name = parts[0]
+		}
+		for _, option := range parts[1:] {
+			switch option {
+			case "omitempty":
+				field.omitEmpty = true
+			case "secret":
+				field.secret = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func mapHelperBindError(path []MapHelperPathElement, format string, args ...interface{}) error {
+	return errors.Errorf("Error in %v: %v", FormatMapHelperPath(path), fmt.Sprintf(format, args...))
+}
+
+func decodeMapHelperValue(value interface{}, target reflect.Value, path []MapHelperPathElement, options *MapHelperBindOptions) error {
+
+	if target.CanAddr() {
+		if u, ok := target.Addr().Interface().(MapHelperUnmarshaler); ok {
+			return u.UnmarshalMapHelper(value)
+		}
+	}
+
+	if value == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+
+	if target.Kind() == reflect.Ptr {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return decodeMapHelperValue(value, target.Elem(), path, options)
+	}
+
+	if target.Type() == durationType {
+		switch w := value.(type) {
+		case string:
+			d, err := time.ParseDuration(w)
+			if err != nil {
+				return mapHelperBindError(path, "invalid duration %v", w)
+			}
+			target.SetInt(int64(d))
+		case float64:
+			// Numbers are seconds
+			target.SetInt(int64(w * float64(time.Second)))
+		default:
+			return mapHelperBindError(path, "expected a duration, found %T", value)
+		}
+		return nil
+	}
+
+	if target.Type() == mapHelperType {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return mapHelperBindError(path, "expected a map, found %T", value)
+		}
+		target.Set(reflect.ValueOf(*NewMapHelperFromData(m)))
+		return nil
+	}
+
+	if s, ok := value.(string); ok && target.CanAddr() {
+		if u, ok := target.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			err := u.UnmarshalText([]byte(s))
+			if err != nil {
+				return mapHelperBindError(path, "%v", err)
+			}
+			return nil
+		}
+	}
+
+	switch target.Kind() {
+
+	case reflect.Interface:
+		if target.NumMethod() > 0 {
+			return mapHelperBindError(path, "can't decode into %v", target.Type())
+		}
+		target.Set(reflect.ValueOf(value))
+
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mapHelperBindError(path, "expected a string, found %T", value)
+		}
+		target.SetString(s)
+
+	case reflect.Bool:
+		switch w := value.(type) {
+		case bool:
+			target.SetBool(w)
+		case string:
+			b, err := strconv.ParseBool(w)
+			if err != nil {
+				return mapHelperBindError(path, "invalid boolean %v", w)
+			}
+			target.SetBool(b)
+		default:
+			return mapHelperBindError(path, "expected a boolean, found %T", value)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := value.(int64); ok {
+			// Integers too big for float64
+			if target.OverflowInt(i) {
+				return mapHelperBindError(path, "expected an integer, found %v", value)
+			}
+			target.SetInt(i)
+			break
+		}
+		f, err := mapHelperBindNumber(value)
+		if err != nil || f != math.Trunc(f) || target.OverflowInt(int64(f)) {
+			return mapHelperBindError(path, "expected an integer, found %v", value)
+		}
+		target.SetInt(int64(f))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := value.(int64); ok {
+			if i < 0 || target.OverflowUint(uint64(i)) {
+				return mapHelperBindError(path, "expected a positive integer, found %v", value)
+			}
+			target.SetUint(uint64(i))
+			break
+		}
+		f, err := mapHelperBindNumber(value)
+		if err != nil || f != math.Trunc(f) || f < 0 || target.OverflowUint(uint64(f)) {
+			return mapHelperBindError(path, "expected a positive integer, found %v", value)
+		}
+		target.SetUint(uint64(f))
+
+	case reflect.Float32, reflect.Float64:
+		f, err := mapHelperBindNumber(value)
+		if err != nil {
+			return mapHelperBindError(path, "expected a number, found %v", value)
+		}
+		target.SetFloat(f)
+
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]interface{})
+		if !ok {
+			return mapHelperBindError(path, "expected a list, found %T", value)
+		}
+		if target.Kind() == reflect.Array {
+			if len(list) != target.Len() {
+				return mapHelperBindError(path, "expected %v elements, found %v", target.Len(), len(list))
+			}
+		} else {
+			target.Set(reflect.MakeSlice(target.Type(), len(list), len(list)))
+		}
+		for i, v := range list {
+			err := decodeMapHelperValue(v, target.Index(i), append(path, MapHelperPathElement{Key: strconv.Itoa(i), Index: true}), options)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok || target.Type().Key().Kind() != reflect.String {
+			return mapHelperBindError(path, "expected a map, found %T", value)
+		}
+		if target.IsNil() {
+			target.Set(reflect.MakeMap(target.Type()))
+		}
+		for k, v := range m {
+			element := reflect.New(target.Type().Elem()).Elem()
+			err := decodeMapHelperValue(v, element, append(path, MapHelperPathElement{Key: k}), options)
+			if err != nil {
+				return err
+			}
+			target.SetMapIndex(reflect.ValueOf(k).Convert(target.Type().Key()), element)
+		}
+
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return mapHelperBindError(path, "expected a map, found %T", value)
+		}
+		for _, field := range mapHelperStructFields(target.Type()) {
+			fieldPath := append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: field.name})
+			v, exists := m[field.name]
+			if field.secret && options.SecretHook != nil {
+				var err error
+				v, err = options.SecretHook.LoadSecret(FormatMapHelperPath(fieldPath), v)
+				if err != nil {
+					return errors.Wrapf(err, "Error loading secret %v", FormatMapHelperPath(fieldPath))
+				}
+				exists = v != nil
+			}
+			if !exists {
+				continue
+			}
+			fieldValue, err := mapHelperFieldByIndex(target, field.index)
+			if err != nil {
+				return err
+			}
+			err = decodeMapHelperValue(v, fieldValue, fieldPath, options)
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return mapHelperBindError(path, "can't decode into %v", target.Type())
+
+	}
+
+	return nil
+
+}
+
+// Returns the field, allocating the embedded pointers to structs
+func mapHelperFieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, errors.Errorf("Can't set embedded pointer to %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+func mapHelperBindNumber(value interface{}) (float64, error) {
+	switch w := value.(type) {
+	case float64:
+		return w, nil
+	case int64:
+		return float64(w), nil
+	case string:
+		return strconv.ParseFloat(w, 64)
+	}
+	return 0, errors.Errorf("Not a number: %T", value)
+}
+
+func encodeMapHelperValue(v reflect.Value, path []MapHelperPathElement, options *MapHelperBindOptions) (interface{}, error) {
+
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeMapHelperValue(v.Elem(), path, options)
+	}
+
+	if m, ok := v.Interface().(MapHelperMarshaler); ok {
+		return m.MarshalMapHelper()
+	}
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String(), nil
+	}
+	if v.Type() == mapHelperType {
+		h := v.Interface().(MapHelper)
+		return h.GenerateMap(), nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return nil, mapHelperBindError(path, "%v", err)
+		}
+		return string(text), nil
+	}
+
+	switch v.Kind() {
+
+	case reflect.Ptr:
+		return encodeMapHelperValue(v.Elem(), path, options)
+
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+
+	case reflect.Slice, reflect.Array:
+		list := []interface{}{}
+		for i := 0; i < v.Len(); i++ {
+			element, err := encodeMapHelperValue(v.Index(i), append(path, MapHelperPathElement{Key: strconv.Itoa(i), Index: true}), options)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, element)
+		}
+		return list, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, mapHelperBindError(path, "map keys must be strings, not %v", v.Type().Key())
+		}
+		m := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			element, err := encodeMapHelperValue(v.MapIndex(k), append(path, MapHelperPathElement{Key: k.String()}), options)
+			if err != nil {
+				return nil, err
+			}
+			m[k.String()] = element
+		}
+		return m, nil
+
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		for _, field := range mapHelperStructFields(v.Type()) {
+			fieldPath := append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: field.name})
+			fieldValue, ok := mapHelperFieldByIndexIfSet(v, field.index)
+			if !ok || (field.omitEmpty && isEmptyMapHelperValue(fieldValue)) {
+				continue
+			}
+			value, err := encodeMapHelperValue(fieldValue, fieldPath, options)
+			if err != nil {
+				return nil, err
+			}
+			if field.secret {
+				if options.SecretHook == nil {
+					continue
+				}
+				var save bool
+				value, save, err = options.SecretHook.SaveSecret(FormatMapHelperPath(fieldPath), value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Error saving secret %v", FormatMapHelperPath(fieldPath))
+				}
+				if !save {
+					continue
+				}
+			}
+			m[field.name] = value
+		}
+		return m, nil
+
+	}
+
+	return nil, mapHelperBindError(path, "can't encode %v", v.Type())
+
+}
+
+// Returns the field, or false if it is in a nil embedded pointer
+func mapHelperFieldByIndexIfSet(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Same rules as encoding/json
+func isEmptyMapHelperValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
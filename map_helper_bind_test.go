@@ -0,0 +1,281 @@
+package goutils
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBindServer struct {
+	Name string `map:"name"`
+	Port int    `map:"port,omitempty"`
+}
+
+// Decoded with a prefix, and encoded without it
+type testBindUpper string
+
+func (u *testBindUpper) UnmarshalMapHelper(value interface{}) error {
+	*u = testBindUpper("U:" + value.(string))
+	return nil
+}
+
+func (u testBindUpper) MarshalMapHelper() (interface{}, error) {
+	return strings.TrimPrefix(string(u), "U:"), nil
+}
+
+type testBindBase struct {
+	Base string `map:"base"`
+}
+
+type testBindConfig struct {
+	testBindBase
+	Timeout  time.Duration    `map:"timeout"`
+	Retry    time.Duration    `map:"retry"`
+	When     time.Time        `map:"when"`
+	Address  net.IP           `map:"address"`
+	Server   testBindServer   `map:"server"`
+	Servers  []testBindServer `map:"servers"`
+	Backup   *testBindServer  `map:"backup,omitempty"`
+	Password string           `map:"password,secret"`
+	Custom   testBindUpper    `map:"custom"`
+	Skip     string           `map:"-"`
+	Limits   map[string]int   `map:"limits"`
+	Big      int64            `map:"big"`
+	Ratio    float32          `map:"ratio"`
+	Enabled  bool             `map:"enabled"`
+	Size     uint8            `map:"size"`
+	Pair     [2]string        `map:"pair"`
+	Extra    interface{}      `map:"extra"`
+	Untagged string
+	Helper   MapHelper         `map:"helper"`
+	Labels   map[string]string `map:"labels,omitempty"`
+}
+
+// Secrets saved in memory, as a keyring would do
+type testBindSecretHook struct {
+	secrets map[string]interface{}
+}
+
+func (s *testBindSecretHook) LoadSecret(path string, stored interface{}) (interface{}, error) {
+	return s.secrets[path], nil
+}
+
+func (s *testBindSecretHook) SaveSecret(path string, value interface{}) (interface{}, bool, error) {
+	s.secrets[path] = value
+	return nil, false, nil
+}
+
+func newTestBindMapHelper(t *testing.T) *MapHelper {
+	codec, err := GetMapHelperCodec(MAP_HELPER_CODEC_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.Decode([]byte(`{
+		"base": "b",
+		"timeout": "1m30s",
+		"retry": 2,
+		"when": "2020-01-02T03:04:05Z",
+		"address": "10.1.1.1",
+		"server": {"name": "main", "port": 80, "other": true},
+		"servers": [{"name": "a", "port": 1}, {"name": "b"}],
+		"backup": {"name": "backup"},
+		"password": "plain",
+		"custom": "x",
+		"Skip": "skipped",
+		"limits": {"a": 1, "b": 2},
+		"big": 9007199254740993,
+		"ratio": 0.5,
+		"enabled": "true",
+		"size": 255,
+		"pair": ["x", "y"],
+		"extra": {"a": [1]},
+		"Untagged": "u",
+		"helper": {"a": "b"},
+		"unknown": 1
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMapHelperFromData(data)
+}
+
+func TestMapHelperDecode(t *testing.T) {
+
+	h := newTestBindMapHelper(t)
+	c := testBindConfig{Skip: "kept", Labels: map[string]string{"kept": "yes"}}
+	err := h.Decode(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"Embedded", c.Base, "b"},
+		{"Duration", c.Timeout, 90 * time.Second},
+		{"Duration of seconds", c.Retry, 2 * time.Second},
+		{"Time", c.When.UTC(), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"Text unmarshaler", c.Address.String(), "10.1.1.1"},
+		{"Struct", c.Server, testBindServer{Name: "main", Port: 80}},
+		{"List of structs", c.Servers, []testBindServer{{Name: "a", Port: 1}, {Name: "b"}}},
+		{"Pointer", c.Backup, &testBindServer{Name: "backup"}},
+		{"Secret without hook", c.Password, "plain"},
+		{"Unmarshaler", c.Custom, testBindUpper("U:x")},
+		{"Ignored", c.Skip, "kept"},
+		{"Map", c.Limits, map[string]int{"a": 1, "b": 2}},
+		{"Big integer", c.Big, int64(9007199254740993)},
+		{"Float32", c.Ratio, float32(0.5)},
+		{"Boolean of a string", c.Enabled, true},
+		{"Uint8", c.Size, uint8(255)},
+		{"Array", c.Pair, [2]string{"x", "y"}},
+		{"Interface", c.Extra, map[string]interface{}{"a": []interface{}{1.0}}},
+		{"Untagged", c.Untagged, "u"},
+		{"Helper", c.Helper.GetString("a", ""), "b"},
+		{"Missing", c.Labels, map[string]string{"kept": "yes"}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%v: unexpected value %#v, want %#v", test.name, test.got, test.want)
+		}
+	}
+
+	if err := h.Decode(c); err == nil {
+		t.Errorf("Decoded into a value")
+	}
+
+}
+
+func TestMapHelperDecodeErrors(t *testing.T) {
+
+	tests := []struct {
+		data map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"servers": []interface{}{map[string]interface{}{"port": "x"}}}, "servers[0].port"},
+		{map[string]interface{}{"servers": []interface{}{map[string]interface{}{"port": 1.5}}}, "servers[0].port"},
+		{map[string]interface{}{"limits": map[string]interface{}{"a.b": "x"}}, `limits.a\.b`},
+		{map[string]interface{}{"size": 256.0}, "size"},
+		{map[string]interface{}{"size": -1.0}, "size"},
+		{map[string]interface{}{"timeout": "soon"}, "timeout"},
+		{map[string]interface{}{"server": "main"}, "server"},
+		{map[string]interface{}{"pair": []interface{}{"x"}}, "pair"},
+		{map[string]interface{}{"address": "x"}, "address"},
+		{map[string]interface{}{"base": 1.0}, "base"},
+	}
+	for _, test := range tests {
+		c := testBindConfig{}
+		err := NewMapHelperFromData(test.data).Decode(&c)
+		if err == nil || !strings.Contains(err.Error(), "Error in "+test.want+":") {
+			t.Errorf("Unexpected error decoding %v: %v", test.data, err)
+		}
+	}
+
+}
+
+func TestEncodeMapHelper(t *testing.T) {
+
+	c := testBindConfig{}
+	err := newTestBindMapHelper(t).Decode(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Servers[1].Port = 0
+
+	h, err := EncodeMapHelper(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"base":     "b",
+		"timeout":  "1m30s",
+		"retry":    "2s",
+		"when":     "2020-01-02T03:04:05Z",
+		"address":  "10.1.1.1",
+		"server":   map[string]interface{}{"name": "main", "port": 80.0},
+		"servers":  []interface{}{map[string]interface{}{"name": "a", "port": 1.0}, map[string]interface{}{"name": "b"}},
+		"backup":   map[string]interface{}{"name": "backup"},
+		"custom":   "x",
+		"limits":   map[string]interface{}{"a": 1.0, "b": 2.0},
+		"big":      int64(9007199254740993),
+		"ratio":    0.5,
+		"enabled":  true,
+		"size":     255.0,
+		"pair":     []interface{}{"x", "y"},
+		"extra":    map[string]interface{}{"a": []interface{}{1.0}},
+		"Untagged": "u",
+		"helper":   map[string]interface{}{"a": "b"},
+	}
+	if !reflect.DeepEqual(h.GenerateMap(), want) {
+		t.Errorf("Unexpected data %#v, want %#v", h.GenerateMap(), want)
+	}
+
+	if _, err := EncodeMapHelper("text"); err == nil {
+		t.Errorf("String encoded as a helper")
+	}
+	if _, err := EncodeMapHelper(map[int]string{1: "a"}); err == nil {
+		t.Errorf("Map with int keys encoded")
+	}
+
+}
+
+func TestMapHelperBindSecrets(t *testing.T) {
+
+	hook := &testBindSecretHook{secrets: map[string]interface{}{}}
+	options := &MapHelperBindOptions{SecretHook: hook}
+
+	h, err := EncodeMapHelperWithOptions(&testBindConfig{Password: "s3cret"}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Exists("password") || hook.secrets["password"] != "s3cret" {
+		t.Errorf("Unexpected data %v, secrets %v", h.Data, hook.secrets)
+	}
+
+	// The value in the map is ignored when there is a hook
+	h.Set("password", "plain")
+	c := testBindConfig{}
+	if err := h.DecodeWithOptions(&c, options); err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "s3cret" {
+		t.Errorf("Unexpected password %v", c.Password)
+	}
+
+	// Without hook, secrets are not encoded
+	h, err = EncodeMapHelper(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Exists("password") {
+		t.Errorf("Secret encoded without hook")
+	}
+
+}
+
+func TestProxyBind(t *testing.T) {
+	p := NewEmptyProxy(nil)
+	p.Protocol = "http"
+	p.Address = "10.1.1.1"
+	p.Port = 3128
+	p.Exceptions = []string{"localhost"}
+	h, err := EncodeMapHelper(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"uuid": p.UUID, "protocol": "http", "address": "10.1.1.1", "port": 3128.0, "exceptions": []interface{}{"localhost"}}
+	if !reflect.DeepEqual(h.GenerateMap(), want) {
+		t.Errorf("Unexpected data %v, want %v", h.GenerateMap(), want)
+	}
+	// The password manager is not encoded
+	decoded := Proxy{ProxyPasswordManager: p.ProxyPasswordManager}
+	if err := h.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, p) {
+		t.Errorf("Unexpected proxy %+v, want %+v", decoded, p)
+	}
+}
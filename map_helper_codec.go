@@ -0,0 +1,583 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+const MAP_HELPER_CODEC_JSON = "json"
+const MAP_HELPER_CODEC_YAML = "yaml"
+const MAP_HELPER_CODEC_TOML = "toml"
+const MAP_HELPER_CODEC_INI = "ini"
+
+// JSON with comments and trailing commas, as used by editors for settings
+const MAP_HELPER_CODEC_JSONC = "jsonc"
+
+// Converts files to and from the data of a MapHelper. Decoded values are
+// normalized as encoding/json does: numbers are float64, maps are
+// map[string]interface{} and lists are []interface{}; only integers that
+// float64 can't represent exactly are int64, so they don't change when
+// saved again.
+type MapHelperCodec interface {
+	Decode(data []byte) (map[string]interface{}, error)
+	Encode(data map[string]interface{}) ([]byte, error)
+}
+
+var mapHelperCodecs = struct {
+	lock       sync.RWMutex
+	codecs     map[string]MapHelperCodec
+	extensions map[string]string
+}{codecs: map[string]MapHelperCodec{}, extensions: map[string]string{}}
+
+func init() {
+	RegisterMapHelperCodec(MAP_HELPER_CODEC_JSON, &JsonMapHelperCodec{Pretty: true}, ".json")
+	RegisterMapHelperCodec(MAP_HELPER_CODEC_JSONC, &JsoncMapHelperCodec{}, ".jsonc")
+	RegisterMapHelperCodec(MAP_HELPER_CODEC_YAML, &YamlMapHelperCodec{}, ".yaml", ".yml")
+	RegisterMapHelperCodec(MAP_HELPER_CODEC_TOML, &TomlMapHelperCodec{}, ".toml")
+	RegisterMapHelperCodec(MAP_HELPER_CODEC_INI, &IniMapHelperCodec{}, ".ini", ".conf", ".cfg")
+}
+
+// Registers the codec with the name, and selects it for files with the
+// extensions (including the dot).
+func RegisterMapHelperCodec(name string, codec MapHelperCodec, extensions ...string) {
+	mapHelperCodecs.lock.Lock()
+	defer mapHelperCodecs.lock.Unlock()
+	mapHelperCodecs.codecs[name] = codec
+	for _, ext := range extensions {
+		mapHelperCodecs.extensions[strings.ToLower(ext)] = name
+	}
+}
+
+func GetMapHelperCodec(name string) (MapHelperCodec, error) {
+	mapHelperCodecs.lock.RLock()
+	defer mapHelperCodecs.lock.RUnlock()
+	codec, ok := mapHelperCodecs.codecs[name]
+	if !ok {
+		return nil, errors.Errorf("Unknown codec %v", name)
+	}
+	return codec, nil
+}
+
+// Returns the name of the codec registered for the extension of the file
+func GetMapHelperCodecNameForFile(path string) (string, error) {
+	mapHelperCodecs.lock.RLock()
+	defer mapHelperCodecs.lock.RUnlock()
+	ext := strings.ToLower(filepath.Ext(path))
+	name, ok := mapHelperCodecs.extensions[ext]
+	if !ok {
+		return "", errors.Errorf("No codec registered for extension %v of file %v", ext, path)
+	}
+	return name, nil
+}
+
+// Loads the file with the codec registered for its extension
+func NewMapHelperFromFile(path string, failIfNotFound bool) (*MapHelper, error) {
+	codecName, err := GetMapHelperCodecNameForFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMapHelperFromFileWithCodec(path, codecName, failIfNotFound)
+}
+
+func NewMapHelperFromFileWithCodec(path string, codecName string, failIfNotFound bool) (*MapHelper, error) {
+
+	codec, err := GetMapHelperCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if failIfNotFound {
+			return nil, errors.Errorf("File %v doesn't exist.", path)
+		} else {
+			return &MapHelper{Filename: path, Codec: codecName, Data: map[string]interface{}{}}, nil
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening file %v.", path)
+	}
+
+	data, err := codec.Decode(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading %v from file %v.", codecName, path)
+	}
+
+	return &MapHelper{Filename: path, Codec: codecName, Data: data}, nil
+
+}
+
+// Like NewMapHelperFromFile, but if the file can't be loaded, the newest
+// backup that can be loaded is used; the helper is still saved to the file.
+func NewMapHelperFromFileOrBackup(path string, failIfNotFound bool) (*MapHelper, error) {
+	codecName, err := GetMapHelperCodecNameForFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMapHelperFromFileOrBackupWithCodec(path, codecName, failIfNotFound)
+}
+
+func NewMapHelperFromFileOrBackupWithCodec(path string, codecName string, failIfNotFound bool) (*MapHelper, error) {
+	h, err := NewMapHelperFromFileWithCodec(path, codecName, failIfNotFound)
+	if err == nil {
+		return h, nil
+	}
+	for _, backup := range BackupFiles(path) {
+		b, backupErr := NewMapHelperFromFileWithCodec(backup, codecName, true)
+		if backupErr != nil {
+			Log.Debugf("Error loading backup %v: %v", backup, backupErr)
+			continue
+		}
+		Log.Warningf("Error loading %v, using backup %v: %v", path, backup, err)
+		b.Filename = path
+		return b, nil
+	}
+	return nil, err
+}
+
+// Saves to the file the helper was loaded from, with the same codec
+func (h *MapHelper) Save() error {
+	if h.Filename == "" {
+		return errors.New("Filename not set")
+	}
+	codecName := h.Codec
+	if codecName == "" {
+		var err error
+		codecName, err = GetMapHelperCodecNameForFile(h.Filename)
+		if err != nil {
+			return err
+		}
+	}
+	return h.SaveToFileWithCodec(h.Filename, codecName, 0666)
+}
+
+// Saves to the file with the codec registered for its extension
+func (h *MapHelper) SaveToFile(path string) error {
+	codecName, err := GetMapHelperCodecNameForFile(path)
+	if err != nil {
+		return err
+	}
+	return h.SaveToFileWithCodec(path, codecName, 0666)
+}
+
+func (h *MapHelper) SaveToFileWithCodec(path string, codecName string, mode os.FileMode) error {
+	codec, err := GetMapHelperCodec(codecName)
+	if err != nil {
+		return err
+	}
+	stored, err := h.generateStoredMap()
+	if err != nil {
+		return errors.Wrapf(err, "Error encrypting secrets")
+	}
+	var data []byte
+	if h.Document != nil && codecName == h.Codec {
+		err = h.Document.Update(stored)
+		if err == nil {
+			data, err = h.Document.Bytes()
+		}
+	} else {
+		data, err = codec.Encode(stored)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error encoding map as %v", codecName)
+	}
+	err = WriteFileAtomicWithBackups(path, data, mode, h.Backups)
+	if err != nil {
+		return errors.Wrapf(err, "Error saving %v file", codecName)
+	}
+	return nil
+}
+
+type JsonMapHelperCodec struct {
+	Pretty bool
+}
+
+func (c *JsonMapHelperCodec) Decode(data []byte) (map[string]interface{}, error) {
+	var x map[string]interface{}
+	err := decodeMapHelperJson(data, &x)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Same as json.Unmarshal, but keeping the big integers as normalizeMapHelperValue
+func decodeMapHelperJson(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	value := reflect.ValueOf(v).Elem()
+	if !value.IsNil() {
+		value.Set(reflect.ValueOf(normalizeMapHelperValue(value.Interface())))
+	}
+	return nil
+}
+
+func (c *JsonMapHelperCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	if c.Pretty {
+		return json.MarshalIndent(data, "", "  ")
+	}
+	return json.Marshal(data)
+}
+
+// Comments are lost when saving, unless the file is loaded as a document
+type JsoncMapHelperCodec struct{}
+
+func (c *JsoncMapHelperCodec) Decode(data []byte) (map[string]interface{}, error) {
+	doc, err := newJsonMapHelperDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Data(), nil
+}
+
+func (c *JsoncMapHelperCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	return json.MarshalIndent(data, "", "  ")
+}
+
+type YamlMapHelperCodec struct{}
+
+func (c *YamlMapHelperCodec) Decode(data []byte) (map[string]interface{}, error) {
+	var x interface{}
+	err := yaml.Unmarshal(data, &x)
+	if err != nil {
+		return nil, err
+	}
+	if x == nil {
+		// Empty document
+		return map[string]interface{}{}, nil
+	}
+	m, ok := normalizeMapHelperValue(x).(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("YAML document is a %T, not a map", x)
+	}
+	return m, nil
+}
+
+func (c *YamlMapHelperCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TOML has no null values, so nil values are not saved
+type TomlMapHelperCodec struct{}
+
+func (c *TomlMapHelperCodec) Decode(data []byte) (map[string]interface{}, error) {
+	x := map[string]interface{}{}
+	err := toml.Unmarshal(data, &x)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeMapHelperValue(x).(map[string]interface{}), nil
+}
+
+func (c *TomlMapHelperCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := toml.NewEncoder(&buf)
+	encoder.Indent = ""
+	err := encoder.Encode(tomlMapHelperValue(data))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Converts the values to the types expected by the TOML encoder: integer
+// numbers are saved as integers, and lists of maps as arrays of tables.
+func tomlMapHelperValue(val interface{}) interface{} {
+	switch w := val.(type) {
+	case float64:
+		if w == math.Trunc(w) && math.Abs(w) < 1<<53 {
+			return int64(w)
+		}
+		return w
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range w {
+			if v != nil {
+				m[k] = tomlMapHelperValue(v)
+			}
+		}
+		return m
+	case []map[string]interface{}:
+		list := []map[string]interface{}{}
+		for _, v := range w {
+			list = append(list, tomlMapHelperValue(v).(map[string]interface{}))
+		}
+		return list
+	case []interface{}:
+		maps := []map[string]interface{}{}
+		list := []interface{}{}
+		for _, v := range w {
+			v = tomlMapHelperValue(v)
+			if m, ok := v.(map[string]interface{}); ok {
+				maps = append(maps, m)
+			}
+			list = append(list, v)
+		}
+		if len(maps) > 0 && len(maps) == len(list) {
+			return maps
+		}
+		return list
+	}
+	return val
+}
+
+// Sections are nested maps, using dots for deeper levels ("[proxy.auth]");
+// keys repeated in a section are lists. As INI has no types, values that
+// look like booleans or numbers are converted.
+type IniMapHelperCodec struct{}
+
+var iniNumberRegexp = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+func (c *IniMapHelperCodec) Decode(data []byte) (map[string]interface{}, error) {
+	f, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, data)
+	if err != nil {
+		return nil, err
+	}
+	return iniFileData(f), nil
+}
+
+func iniFileData(f *ini.File) map[string]interface{} {
+
+	x := map[string]interface{}{}
+	for _, section := range f.Sections() {
+		m := x
+		if section.Name() != ini.DefaultSection {
+			for _, name := range strings.Split(section.Name(), ".") {
+				child, ok := m[name].(map[string]interface{})
+				if !ok {
+					child = map[string]interface{}{}
+					m[name] = child
+				}
+				m = child
+			}
+		}
+		for _, key := range section.Keys() {
+			values := key.ValueWithShadows()
+			if len(values) == 1 {
+				m[key.Name()] = iniMapHelperValue(values[0])
+			} else {
+				list := []interface{}{}
+				for _, v := range values {
+					list = append(list, iniMapHelperValue(v))
+				}
+				m[key.Name()] = list
+			}
+		}
+	}
+
+	return x
+
+}
+
+func iniMapHelperValue(val string) interface{} {
+	if val == "true" || val == "false" {
+		return val == "true"
+	}
+	if i, err := strconv.ParseInt(val, 10, 64); err == nil && iniNumberRegexp.MatchString(val) {
+		return normalizeMapHelperInt(i)
+	}
+	if iniNumberRegexp.MatchString(val) {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return val
+}
+
+func (c *IniMapHelperCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	f := ini.Empty(ini.LoadOptions{AllowShadows: true})
+	err := encodeIniSection(f, "", data)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	_, err = f.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeIniSection(f *ini.File, name string, data map[string]interface{}) error {
+
+	sectionName := name
+	if sectionName == "" {
+		sectionName = ini.DefaultSection
+	}
+	section, err := f.NewSection(sectionName)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	children := []string{}
+	for _, k := range keys {
+		val := data[k]
+		if _, ok := val.(map[string]interface{}); ok {
+			children = append(children, k)
+			continue
+		}
+		err = encodeIniKey(section, k, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, k := range children {
+		childName := k
+		if name != "" {
+			childName = name + "." + k
+		}
+		err = encodeIniSection(f, childName, data[k].(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Lists are saved repeating the key; nil values and empty lists are not saved
+func encodeIniKey(section *ini.Section, name string, val interface{}) error {
+	values := []string{}
+	v := reflect.ValueOf(val)
+	if val != nil && v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, fmt.Sprintf("%v", v.Index(i).Interface()))
+		}
+	} else if val != nil {
+		values = append(values, fmt.Sprintf("%v", val))
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	key, err := section.NewKey(name, values[0])
+	if err != nil {
+		return err
+	}
+	for _, v := range values[1:] {
+		err = key.AddShadow(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Integers with a greater absolute value lose precision as float64
+const mapHelperMaxExactInt = 1 << 53
+
+// Integers are float64, as in encoding/json, unless they lose precision
+func normalizeMapHelperInt(i int64) interface{} {
+	if i >= -mapHelperMaxExactInt && i <= mapHelperMaxExactInt {
+		return float64(i)
+	}
+	return i
+}
+
+// Converts the values decoded by any codec to the types used by
+// encoding/json, so the getters work the same with any of them.
+func normalizeMapHelperValue(val interface{}) interface{} {
+	switch w := val.(type) {
+	case map[string]interface{}:
+		for k, v := range w {
+			w[k] = normalizeMapHelperValue(v)
+		}
+		return w
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range w {
+			m[fmt.Sprintf("%v", k)] = normalizeMapHelperValue(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range w {
+			w[i] = normalizeMapHelperValue(v)
+		}
+		return w
+	case []map[string]interface{}:
+		list := []interface{}{}
+		for _, v := range w {
+			list = append(list, normalizeMapHelperValue(v))
+		}
+		return list
+	case int:
+		return normalizeMapHelperInt(int64(w))
+	case int8:
+		return float64(w)
+	case int16:
+		return float64(w)
+	case int32:
+		return float64(w)
+	case int64:
+		return normalizeMapHelperInt(w)
+	case uint:
+		return normalizeMapHelperValue(uint64(w))
+	case uint8:
+		return float64(w)
+	case uint16:
+		return float64(w)
+	case uint32:
+		return float64(w)
+	case uint64:
+		if w <= math.MaxInt64 {
+			return normalizeMapHelperInt(int64(w))
+		}
+		return float64(w)
+	case float32:
+		return float64(w)
+	case json.Number:
+		if i, err := w.Int64(); err == nil {
+			return normalizeMapHelperInt(i)
+		}
+		f, _ := w.Float64()
+		return f
+	case time.Time:
+		return w.Format(time.RFC3339Nano)
+	}
+	return val
+}
@@ -0,0 +1,112 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapHelperCodecsRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "codecs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, extension := range []string{".json", ".yaml", ".toml", ".ini"} {
+		t.Run(extension, func(t *testing.T) {
+
+			h := NewEmptyMapHelper()
+			values := map[string]interface{}{
+				"name":            "app",
+				"port":            8080,
+				"ratio":           1.5,
+				"enabled":         true,
+				"proxy.address":   "127.0.0.1",
+				"proxy.auth.user": "bob",
+				"big":             int64(9007199254740993),
+				"negative":        int64(-9007199254740993),
+			}
+			for path, value := range values {
+				err := h.SetPath(path, value, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := h.SetPath("hosts", []interface{}{"a", "b"}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, "config"+extension)
+			err = h.SaveToFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := NewMapHelperFromFile(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if loaded.GetString("name", "") != "app" || loaded.GetInt("port", 0) != 8080 || loaded.GetFloat64("ratio", 0) != 1.5 || !loaded.GetBoolean("enabled", false) {
+				t.Errorf("Unexpected values %v", loaded.Data)
+			}
+			if loaded.GetPathString("proxy.auth.user", "") != "bob" || !reflect.DeepEqual(loaded.GetListOfStrings("hosts", nil), []string{"a", "b"}) {
+				t.Errorf("Unexpected values %v", loaded.Data)
+			}
+			// Integers that float64 can't represent keep their precision
+			if loaded.GetInt64("big", 0) != 9007199254740993 || loaded.GetInt64("negative", 0) != -9007199254740993 {
+				t.Errorf("Unexpected big integers %v and %v", loaded.Data["big"], loaded.Data["negative"])
+			}
+
+			err = loaded.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(content), "9007199254740993") {
+				t.Errorf("Big integer not saved:\n%s", content)
+			}
+
+		})
+	}
+
+}
+
+func TestMapHelperCodecsBigIntegers(t *testing.T) {
+
+	tests := []struct {
+		codec string
+		src   string
+	}{
+		{MAP_HELPER_CODEC_JSON, `{"id": 9223372036854775807, "small": 3}`},
+		{MAP_HELPER_CODEC_YAML, "id: 9223372036854775807\nsmall: 3\n"},
+		{MAP_HELPER_CODEC_TOML, "id = 9223372036854775807\nsmall = 3\n"},
+		{MAP_HELPER_CODEC_INI, "id = 9223372036854775807\nsmall = 3\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.codec, func(t *testing.T) {
+			codec, err := GetMapHelperCodec(test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := codec.Decode([]byte(test.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{"id": int64(9223372036854775807), "small": float64(3)}
+			if !reflect.DeepEqual(data, want) {
+				t.Errorf("Unexpected data %#v, want %#v", data, want)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,461 @@
+package goutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Operations of JSON Patch (RFC 6902)
+const JSON_PATCH_ADD = "add"
+const JSON_PATCH_REMOVE = "remove"
+const JSON_PATCH_REPLACE = "replace"
+const JSON_PATCH_MOVE = "move"
+const JSON_PATCH_COPY = "copy"
+const JSON_PATCH_TEST = "test"
+
+// Operation of a JSON Patch; the paths are JSON pointers
+type JsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Keeps the value of the operations that need it, even if it is null
+func (o JsonPatchOperation) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{"op": o.Op, "path": o.Path}
+	switch o.Op {
+	case JSON_PATCH_ADD, JSON_PATCH_REPLACE, JSON_PATCH_TEST:
+		m["value"] = o.Value
+	case JSON_PATCH_MOVE, JSON_PATCH_COPY:
+		m["from"] = o.From
+	}
+	return json.Marshal(m)
+}
+
+// Value modified in both sides of a three-way merge; the merge keeps the
+// local value.
+type MapHelperMergeConflict struct {
+	Path string
+	// Nil if the value doesn't exist
+	Base   interface{}
+	Local  interface{}
+	Remote interface{}
+}
+
+// Returns the paths added, removed and changed to convert this helper into
+// the other one. Lists of the same length are compared element by element;
+// other lists are changed as a whole.
+func (h *MapHelper) Diff(other *MapHelper) ([]MapHelperChange, error) {
+	old, new, err := mapHelperCanonicalPair(h, other)
+	if err != nil {
+		return nil, err
+	}
+	return newMapHelperChanges(old, new), nil
+}
+
+// Returns the JSON Patch that converts this helper into the other one
+func (h *MapHelper) CreateJsonPatch(other *MapHelper) ([]JsonPatchOperation, error) {
+	old, new, err := mapHelperCanonicalPair(h, other)
+	if err != nil {
+		return nil, err
+	}
+	patch := []JsonPatchOperation{}
+	for _, c := range mapHelperChanges([]string{}, old, new) {
+		patch = append(patch, JsonPatchOperation{Op: c.Op, Path: mapHelperJsonPointer(c.Path), Value: c.Value})
+	}
+	return patch, nil
+}
+
+// Applies the operations of the JSON Patch in order; if any of them fails,
+// the helper is not modified.
+func (h *MapHelper) ApplyJsonPatch(patch []JsonPatchOperation) error {
+
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return errors.Wrap(err, "Error converting data")
+	}
+	var doc interface{} = data
+
+	for i, o := range patch {
+		doc, err = applyJsonPatchOperation(doc, o)
+		if err != nil {
+			return errors.Wrapf(err, "Error applying operation %v (%v %v)", i, o.Op, o.Path)
+		}
+	}
+
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return errors.New("The patch doesn't result in a map")
+	}
+	h.Data = result
+	return nil
+
+}
+
+// Returns the JSON Merge Patch (RFC 7396) that converts this helper into
+// the other one; null values of the other helper can't be represented, as
+// null means removing the key.
+func (h *MapHelper) CreateMergePatch(other *MapHelper) (map[string]interface{}, error) {
+	old, new, err := mapHelperCanonicalPair(h, other)
+	if err != nil {
+		return nil, err
+	}
+	return createMergePatch(old, new), nil
+}
+
+// Applies the JSON Merge Patch: maps are merged, null values remove the key,
+// and the rest of the values replace the existing ones.
+func (h *MapHelper) ApplyMergePatch(patch map[string]interface{}) error {
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return errors.Wrap(err, "Error converting data")
+	}
+	canonicalPatch, err := mapHelperCanonicalData(patch)
+	if err != nil {
+		return errors.Wrap(err, "Error converting patch")
+	}
+	h.Data = applyMergePatch(data, canonicalPatch).(map[string]interface{})
+	return nil
+}
+
+// Merges the changes made to base in local and in remote. Maps are merged
+// key by key, and the rest of the values, including lists, as a whole; when
+// both sides change the same value differently, the local one is kept and
+// the conflict is returned.
+func MergeMapHelpers(base *MapHelper, local *MapHelper, remote *MapHelper) (*MapHelper, []MapHelperMergeConflict, error) {
+	b, l, err := mapHelperCanonicalPair(base, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := mapHelperCanonicalData(remote.GenerateMap())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error converting data")
+	}
+	conflicts := []MapHelperMergeConflict{}
+	merged := mergeMapHelperValues([]MapHelperPathElement{}, b, l, r, &conflicts)
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return NewMapHelperFromData(merged.(map[string]interface{})), conflicts, nil
+}
+
+func mapHelperCanonicalPair(a *MapHelper, b *MapHelper) (map[string]interface{}, map[string]interface{}, error) {
+	x, err := mapHelperCanonicalData(a.GenerateMap())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error converting data")
+	}
+	y, err := mapHelperCanonicalData(b.GenerateMap())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error converting data")
+	}
+	return x, y, nil
+}
+
+// Marks the values that don't exist in one of the sides of a merge
+type mapHelperMissingValue struct{}
+
+var mapHelperMissing = &mapHelperMissingValue{}
+
+func mergeMapHelperValues(path []MapHelperPathElement, base interface{}, local interface{}, remote interface{}, conflicts *[]MapHelperMergeConflict) interface{} {
+
+	if reflect.DeepEqual(local, remote) || reflect.DeepEqual(base, remote) {
+		return local
+	}
+	if reflect.DeepEqual(base, local) {
+		return remote
+	}
+
+	localMap, localIsMap := local.(map[string]interface{})
+	remoteMap, remoteIsMap := remote.(map[string]interface{})
+	if localIsMap && remoteIsMap {
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			baseMap = map[string]interface{}{}
+		}
+		keys := map[string]bool{}
+		for _, m := range []map[string]interface{}{baseMap, localMap, remoteMap} {
+			for k := range m {
+				keys[k] = true
+			}
+		}
+		value := func(m map[string]interface{}, k string) interface{} {
+			if v, ok := m[k]; ok {
+				return v
+			}
+			return mapHelperMissing
+		}
+		merged := map[string]interface{}{}
+		for k := range keys {
+			child := append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: k})
+			v := mergeMapHelperValues(child, value(baseMap, k), value(localMap, k), value(remoteMap, k), conflicts)
+			if v != mapHelperMissing {
+				merged[k] = v
+			}
+		}
+		return merged
+	}
+
+	present := func(v interface{}) interface{} {
+		if v == mapHelperMissing {
+			return nil
+		}
+		return v
+	}
+	*conflicts = append(*conflicts, MapHelperMergeConflict{Path: FormatMapHelperPath(path), Base: present(base), Local: present(local), Remote: present(remote)})
+	return local
+
+}
+
+func createMergePatch(old map[string]interface{}, new map[string]interface{}) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range new {
+		oldValue, exists := old[k]
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := v.(map[string]interface{})
+		if exists && oldIsMap && newIsMap {
+			if child := createMergePatch(oldMap, newMap); len(child) > 0 {
+				patch[k] = child
+			}
+		} else if !exists || !reflect.DeepEqual(oldValue, v) {
+			patch[k] = v
+		}
+	}
+	return patch
+}
+
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+	for k, v := range patchMap {
+		if v == nil {
+			delete(targetMap, k)
+		} else {
+			targetMap[k] = applyMergePatch(targetMap[k], v)
+		}
+	}
+	return targetMap
+}
+
+func applyJsonPatchOperation(doc interface{}, o JsonPatchOperation) (interface{}, error) {
+
+	tokens, err := jsonPatchTokens(o.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Op {
+	case JSON_PATCH_ADD, JSON_PATCH_REPLACE:
+		value, err := jsonPatchValue(o.Value)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPatchSet(doc, tokens, value, o.Op == JSON_PATCH_ADD)
+	case JSON_PATCH_REMOVE:
+		doc, _, err = jsonPatchRemove(doc, tokens)
+		return doc, err
+	case JSON_PATCH_MOVE, JSON_PATCH_COPY:
+		from, err := jsonPatchTokens(o.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if o.Op == JSON_PATCH_MOVE {
+			if len(tokens) > len(from) && reflect.DeepEqual(tokens[:len(from)], from) {
+				return nil, errors.Errorf("Can't move %v inside itself", o.From)
+			}
+			doc, value, err = jsonPatchRemove(doc, from)
+		} else {
+			value, err = jsonPatchGet(doc, from)
+			if err == nil {
+				value, err = jsonPatchValue(value)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return jsonPatchSet(doc, tokens, value, true)
+	case JSON_PATCH_TEST:
+		value, err := jsonPatchValue(o.Value)
+		if err != nil {
+			return nil, err
+		}
+		current, err := jsonPatchGet(doc, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.Errorf("Value of %v is %v, not %v", o.Path, current, o.Value)
+		}
+		return doc, nil
+	}
+
+	return nil, errors.Errorf("Unknown operation %v", o.Op)
+
+}
+
+func jsonPatchTokens(pointer string) ([]string, error) {
+	if pointer != "" && !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("Invalid JSON pointer %v", pointer)
+	}
+	elements, err := ParseMapHelperPath(pointer)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []string{}
+	for _, e := range elements {
+		tokens = append(tokens, e.Key)
+	}
+	return tokens, nil
+}
+
+// Returns a copy of the value, with the types of the canonical data
+func jsonPatchValue(value interface{}) (interface{}, error) {
+	canonical, err := mapHelperCanonicalData(map[string]interface{}{"v": value})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error converting value")
+	}
+	return canonical["v"], nil
+}
+
+// Returns the index of the token in the list; "-" is the end of the list,
+// only valid if allowEnd.
+func jsonPatchIndex(list []interface{}, token string, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return len(list), nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.Errorf("Invalid index %v", token)
+	}
+	if i > len(list) || (i == len(list) && !allowEnd) {
+		return 0, errors.Errorf("Index %v out of range", token)
+	}
+	return i, nil
+}
+
+func jsonPatchGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch w := doc.(type) {
+		case map[string]interface{}:
+			v, ok := w[token]
+			if !ok {
+				return nil, errors.Errorf("Key %v doesn't exist", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := jsonPatchIndex(w, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = w[i]
+		default:
+			return nil, errors.Errorf("Can't get %v of a value that is not a map or a list", token)
+		}
+	}
+	return doc, nil
+}
+
+// Sets the value in the path; if insert, values are inserted in lists
+// (add), and if not, the value must exist (replace).
+func jsonPatchSet(doc interface{}, tokens []string, value interface{}, insert bool) (interface{}, error) {
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	token := tokens[0]
+	switch w := doc.(type) {
+	case map[string]interface{}:
+		child, exists := w[token]
+		if len(tokens) > 1 || !insert {
+			if !exists {
+				return nil, errors.Errorf("Key %v doesn't exist", token)
+			}
+		}
+		v, err := jsonPatchSet(child, tokens[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		w[token] = v
+		return w, nil
+	case []interface{}:
+		last := len(tokens) == 1 && insert
+		i, err := jsonPatchIndex(w, token, last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			list := append([]interface{}{}, w[:i]...)
+			list = append(list, value)
+			return append(list, w[i:]...), nil
+		}
+		v, err := jsonPatchSet(w[i], tokens[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		w[i] = v
+		return w, nil
+	}
+	return nil, errors.Errorf("Can't set %v of a value that is not a map or a list", token)
+
+}
+
+// Returns the document without the value in the path, and the value removed
+func jsonPatchRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("Can't remove the whole document")
+	}
+
+	token := tokens[0]
+	switch w := doc.(type) {
+	case map[string]interface{}:
+		child, exists := w[token]
+		if !exists {
+			return nil, nil, errors.Errorf("Key %v doesn't exist", token)
+		}
+		if len(tokens) == 1 {
+			delete(w, token)
+			return w, child, nil
+		}
+		v, removed, err := jsonPatchRemove(child, tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		w[token] = v
+		return w, removed, nil
+	case []interface{}:
+		i, err := jsonPatchIndex(w, token, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(tokens) == 1 {
+			return append(append([]interface{}{}, w[:i]...), w[i+1:]...), w[i], nil
+		}
+		v, removed, err := jsonPatchRemove(w[i], tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		w[i] = v
+		return w, removed, nil
+	}
+	return nil, nil, errors.Errorf("Can't remove %v of a value that is not a map or a list", token)
+
+}
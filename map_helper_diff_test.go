@@ -0,0 +1,232 @@
+package goutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func newTestJsonMap(t *testing.T, content string) map[string]interface{} {
+	codec, err := GetMapHelperCodec(MAP_HELPER_CODEC_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.Decode([]byte(content))
+	if err != nil {
+		t.Fatalf("Error decoding %v: %v", content, err)
+	}
+	return data
+}
+
+// Examples of the appendix A of RFC 6902; the errors are expected when the
+// result is empty
+func TestMapHelperApplyJsonPatch(t *testing.T) {
+
+	tests := []struct {
+		doc    string
+		patch  string
+		result string
+	}{
+		// A.1 Adding an object member
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		// A.2 Adding an array element
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		// A.3 Removing an object member
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		// A.4 Removing an array element
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		// A.5 Replacing a value
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		// A.6 Moving a value
+		{`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`, `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		// A.7 Moving an array element
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		// A.8 Testing a value: success
+		{`{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`, `{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		// A.9 Testing a value: error
+		{`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, ``},
+		// A.10 Adding a nested member object
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		// A.11 Ignoring unrecognized elements
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`, `{"foo": "bar", "baz": "qux"}`},
+		// A.12 Adding to a nonexistent target
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, ``},
+		// A.14 ~ escape ordering
+		{`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/": 9, "~1": 10}`},
+		// A.15 Comparing strings and numbers
+		{`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": "10"}]`, ``},
+		// A.16 Adding an array value
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`},
+		// Copies are not modified by later operations
+		{`{"a": {"b": 1}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "replace", "path": "/c/b", "value": 2}]`, `{"a": {"b": 1}, "c": {"b": 2}}`},
+		{`{"a": {"b": 1}}`, `[{"op": "move", "from": "/a", "path": "/a/b"}]`, ``},
+		{`{"a": [1]}`, `[{"op": "add", "path": "/a/2", "value": 2}]`, ``},
+		{`{"a": [1]}`, `[{"op": "remove", "path": "/a/-"}]`, ``},
+		{`{"a": [1, 2]}`, `[{"op": "replace", "path": "/a/01", "value": 3}]`, ``},
+		{`{"a": 1}`, `[{"op": "replace", "path": "/b", "value": 2}]`, ``},
+		{`{"a": 1}`, `[{"op": "other", "path": "/a"}]`, ``},
+		{`{"a": 1}`, `[{"op": "replace", "path": "a", "value": 2}]`, ``},
+		{`{"a": 1}`, `[{"op": "replace", "path": "", "value": {"b": 2}}]`, `{"b": 2}`},
+		{`{"a": 1}`, `[{"op": "replace", "path": "", "value": [1]}]`, ``},
+	}
+
+	for _, test := range tests {
+		patch := []JsonPatchOperation{}
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		h := NewMapHelperFromData(newTestJsonMap(t, test.doc))
+		err := h.ApplyJsonPatch(patch)
+		if test.result == "" {
+			if err == nil {
+				t.Errorf("Patch %v applied to %v", test.patch, test.doc)
+			}
+			// The helper is not modified if the patch fails
+			if !reflect.DeepEqual(h.Data, newTestJsonMap(t, test.doc)) {
+				t.Errorf("Document %v modified to %v", test.doc, h.Data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error applying patch %v to %v: %v", test.patch, test.doc, err)
+			continue
+		}
+		if want := newTestJsonMap(t, test.result); !reflect.DeepEqual(h.Data, want) {
+			t.Errorf("Unexpected result %v of patch %v, want %v", h.Data, test.patch, want)
+		}
+	}
+
+}
+
+// Examples of the appendix A of RFC 7396 whose target and patch are objects
+func TestMapHelperApplyMergePatch(t *testing.T) {
+
+	tests := []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+
+	for _, test := range tests {
+		h := NewMapHelperFromData(newTestJsonMap(t, test.target))
+		if err := h.ApplyMergePatch(newTestJsonMap(t, test.patch)); err != nil {
+			t.Errorf("Error applying patch %v to %v: %v", test.patch, test.target, err)
+			continue
+		}
+		want := newTestJsonMap(t, test.result)
+		if !reflect.DeepEqual(h.Data, want) {
+			t.Errorf("Unexpected result %v of patch %v, want %v", h.Data, test.patch, want)
+		}
+
+		// The patch created from the result gives the same result, unless
+		// the result has null values
+		if test.target == `{"e": null}` {
+			continue
+		}
+		h = NewMapHelperFromData(newTestJsonMap(t, test.target))
+		patch, err := h.CreateMergePatch(NewMapHelperFromData(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ApplyMergePatch(patch); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h.Data, want) {
+			t.Errorf("Unexpected result %v of created patch %v, want %v", h.Data, patch, want)
+		}
+	}
+
+}
+
+func TestMapHelperDiff(t *testing.T) {
+
+	old := NewMapHelperFromData(map[string]interface{}{"a": 1, "list": []string{"a", "b"}, "gone": "x"})
+	old.SetHelper("sub", NewMapHelperFromData(map[string]interface{}{"x": "y", "a/b": true}))
+	new := NewMapHelperFromData(newTestJsonMap(t, `{"a": 2, "list": ["a", "c", "d"], "sub": {"x": "y", "a/b": false, "n": null}}`))
+
+	changes, err := old.Diff(new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanges := []MapHelperChange{
+		{Op: MAP_HELPER_CHANGE_REPLACE, Path: "a", Old: 1.0, New: 2.0},
+		{Op: MAP_HELPER_CHANGE_REMOVE, Path: "gone", Old: "x"},
+		{Op: MAP_HELPER_CHANGE_REPLACE, Path: "list", Old: []interface{}{"a", "b"}, New: []interface{}{"a", "c", "d"}},
+		{Op: MAP_HELPER_CHANGE_REPLACE, Path: "sub.a/b", Old: true, New: false},
+		{Op: MAP_HELPER_CHANGE_ADD, Path: "sub.n"},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("Unexpected changes %+v, want %+v", changes, wantChanges)
+	}
+
+	// The patch survives a JSON round trip, including null values
+	patch, err := old.CreateJsonPatch(new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"replace","path":"/a","value":2},{"op":"remove","path":"/gone"},{"op":"replace","path":"/list","value":["a","c","d"]},{"op":"replace","path":"/sub/a~1b","value":false},{"op":"add","path":"/sub/n","value":null}]`
+	if string(content) != want {
+		t.Errorf("Unexpected patch %s, want %s", content, want)
+	}
+	patch = []JsonPatchOperation{}
+	if err := json.Unmarshal(content, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.ApplyJsonPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	if changes, _ := old.Diff(new); len(changes) != 0 {
+		t.Errorf("Unexpected changes %+v after applying the patch", changes)
+	}
+
+}
+
+func TestMergeMapHelpers(t *testing.T) {
+
+	base := NewMapHelperFromData(newTestJsonMap(t, `{"a": 1, "b": 1, "c": {"x": 1, "y": 1}, "d": 1, "l": [1], "r": 1}`))
+	local := NewMapHelperFromData(newTestJsonMap(t, `{"a": 2, "b": 1, "c": {"x": 2, "y": 1}, "e": 1, "l": [1, 2], "r": 1}`))
+	remote := NewMapHelperFromData(newTestJsonMap(t, `{"a": 3, "b": 5, "c": {"x": 1, "y": 3}, "d": 1, "l": [1, 3], "f": 2}`))
+
+	merged, conflicts, err := MergeMapHelpers(base, local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newTestJsonMap(t, `{"a": 2, "b": 5, "c": {"x": 2, "y": 3}, "e": 1, "l": [1, 2], "f": 2}`)
+	if !reflect.DeepEqual(merged.Data, want) {
+		t.Errorf("Unexpected merge %v, want %v", merged.Data, want)
+	}
+	wantConflicts := []MapHelperMergeConflict{
+		{Path: "a", Base: 1.0, Local: 2.0, Remote: 3.0},
+		{Path: "l", Base: []interface{}{1.0}, Local: []interface{}{1.0, 2.0}, Remote: []interface{}{1.0, 3.0}},
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("Unexpected conflicts %+v, want %+v", conflicts, wantConflicts)
+	}
+
+	// A value removed in one side and changed in the other
+	remote.Set("e", 1)
+	remote.Set("d", 2)
+	merged, conflicts, err = MergeMapHelpers(base, local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Exists("d") || len(conflicts) != 3 || conflicts[1] != (MapHelperMergeConflict{Path: "d", Base: 1.0, Remote: 2.0}) {
+		t.Errorf("Unexpected merge %v, conflicts %+v", merged.Data, conflicts)
+	}
+
+}
@@ -0,0 +1,541 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// A loaded file that keeps its key order, and when the format allows it,
+// its comments and formatting; saving only changes what is different, so
+// the diff with the original file is minimal.
+type MapHelperDocument interface {
+	Data() map[string]interface{}
+	// Keys of the map in the path, in the order of the document
+	Keys(path []string) []string
+	// Changes the document to contain the data
+	Update(data map[string]interface{}) error
+	Bytes() ([]byte, error)
+}
+
+// Implemented by the codecs that can load documents
+type MapHelperDocumentCodec interface {
+	MapHelperCodec
+	DecodeDocument(data []byte) (MapHelperDocument, error)
+}
+
+const mapHelperChangeAdd = "add"
+const mapHelperChangeRemove = "remove"
+const mapHelperChangeReplace = "replace"
+
+type mapHelperChange struct {
+	Op    string
+	Path  []string
+	Old   interface{}
+	Value interface{}
+}
+
+// Loads the file with the codec registered for its extension, keeping the
+// document to save it later with the minimal changes.
+func NewMapHelperDocumentFromFile(path string, failIfNotFound bool) (*MapHelper, error) {
+	codecName, err := GetMapHelperCodecNameForFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMapHelperDocumentFromFileWithCodec(path, codecName, failIfNotFound)
+}
+
+func NewMapHelperDocumentFromFileWithCodec(path string, codecName string, failIfNotFound bool) (*MapHelper, error) {
+
+	codec, err := GetMapHelperCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	documentCodec, ok := codec.(MapHelperDocumentCodec)
+	if !ok {
+		return nil, errors.Errorf("Codec %v doesn't support documents", codecName)
+	}
+
+	exists, err := FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if failIfNotFound {
+			return nil, errors.Errorf("File %v doesn't exist.", path)
+		} else {
+			return &MapHelper{Filename: path, Codec: codecName, Data: map[string]interface{}{}}, nil
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening file %v.", path)
+	}
+
+	document, err := documentCodec.DecodeDocument(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading %v from file %v.", codecName, path)
+	}
+
+	// A copy, as the changes are detected comparing with the document
+	data, err := mapHelperCanonicalData(document.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	return &MapHelper{Filename: path, Codec: codecName, Data: data, Document: document}, nil
+
+}
+
+// Same as Keys, but for the map in the path; keys are returned in the
+// order of the document, if there is one.
+func (h *MapHelper) GetPathKeys(path string) []string {
+	elements, err := ParseMapHelperPath(path)
+	if err != nil {
+		Log.Debugf("Error parsing path: %v", err)
+		return []string{}
+	}
+	helper := h
+	if len(elements) > 0 {
+		helper = h.GetPathHelper(path)
+		if helper == nil {
+			return []string{}
+		}
+	}
+	if h.Document == nil {
+		return helper.Keys()
+	}
+	keys := []string{}
+	for _, e := range elements {
+		keys = append(keys, e.Key)
+	}
+	return orderMapHelperKeys(helper.Data, h.Document.Keys(keys))
+}
+
+// Returns the keys of the data, first the ones in the order, and then the
+// rest sorted.
+func orderMapHelperKeys(data map[string]interface{}, order []string) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, k := range order {
+		if _, ok := data[k]; ok && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
+	}
+	rest := []string{}
+	for k := range data {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// Converts the data to the types returned by encoding/json, without
+// modifying it, so it can be compared with the data of a document.
+func mapHelperCanonicalData(data map[string]interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	x := map[string]interface{}{}
+	err = decodeMapHelperJson(content, &x)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Returns the changes to convert old into new. Maps and lists of the same
+// length are compared element by element; other lists are replaced.
+func mapHelperChanges(path []string, old interface{}, new interface{}) []mapHelperChange {
+
+	changes := []mapHelperChange{}
+	child := func(k string) []string {
+		return append(append([]string{}, path...), k)
+	}
+
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := []string{}
+		for k := range oldMap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v, ok := newMap[k]; ok {
+				changes = append(changes, mapHelperChanges(child(k), oldMap[k], v)...)
+			} else {
+				changes = append(changes, mapHelperChange{Op: mapHelperChangeRemove, Path: child(k), Old: oldMap[k]})
+			}
+		}
+		keys = []string{}
+		for k := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			changes = append(changes, mapHelperChange{Op: mapHelperChangeAdd, Path: child(k), Value: newMap[k]})
+		}
+		return changes
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		for i := range oldList {
+			changes = append(changes, mapHelperChanges(child(strconv.Itoa(i)), oldList[i], newList[i])...)
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		changes = append(changes, mapHelperChange{Op: mapHelperChangeReplace, Path: path, Old: old, Value: new})
+	}
+	return changes
+
+}
+
+// Applies to the document the changes needed to go from its data to the new one
+func updateMapHelperDocument(doc MapHelperDocument, data map[string]interface{}, apply func(mapHelperChange) error) error {
+	data, err := mapHelperCanonicalData(data)
+	if err != nil {
+		return errors.Wrap(err, "Error converting data")
+	}
+	for _, change := range mapHelperChanges([]string{}, doc.Data(), data) {
+		err = apply(change)
+		if err != nil {
+			return errors.Wrapf(err, "Error applying %v of %v", change.Op, strings.Join(change.Path, "."))
+		}
+	}
+	return nil
+}
+
+func (c *JsonMapHelperCodec) DecodeDocument(data []byte) (MapHelperDocument, error) {
+	return newJsonMapHelperDocument(data)
+}
+
+func (c *JsoncMapHelperCodec) DecodeDocument(data []byte) (MapHelperDocument, error) {
+	return newJsonMapHelperDocument(data)
+}
+
+func (c *TomlMapHelperCodec) DecodeDocument(data []byte) (MapHelperDocument, error) {
+	return newTomlMapHelperDocument(data)
+}
+
+func (c *YamlMapHelperCodec) DecodeDocument(data []byte) (MapHelperDocument, error) {
+
+	doc := yamlMapHelperDocument{}
+	err := yaml.Unmarshal(data, &doc.root)
+	if err != nil {
+		return nil, err
+	}
+	if doc.root.Kind == 0 {
+		// Empty document
+		doc.root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if len(doc.root.Content) != 1 || doc.root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("YAML document is not a map")
+	}
+
+	// Indentation of the first indented line
+	doc.indent = 2
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && trimmed != line && !strings.HasPrefix(trimmed, "#") {
+			doc.indent = len(line) - len(trimmed)
+			break
+		}
+	}
+
+	return &doc, nil
+
+}
+
+func (c *IniMapHelperCodec) DecodeDocument(data []byte) (MapHelperDocument, error) {
+	f, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, data)
+	if err != nil {
+		return nil, err
+	}
+	return &iniMapHelperDocument{file: f}, nil
+}
+
+// YAML document; comments and key order are kept, but indentation is
+// normalized when saving.
+type yamlMapHelperDocument struct {
+	root   yaml.Node
+	indent int
+}
+
+func (d *yamlMapHelperDocument) Data() map[string]interface{} {
+	var x interface{}
+	err := d.root.Decode(&x)
+	if err != nil || x == nil {
+		return map[string]interface{}{}
+	}
+	if m, ok := normalizeMapHelperValue(x).(map[string]interface{}); ok {
+		return m
+	}
+	return map[string]interface{}{}
+}
+
+func (d *yamlMapHelperDocument) Keys(path []string) []string {
+	keys := []string{}
+	node := d.find(path)
+	if node != nil && node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keys = append(keys, node.Content[i].Value)
+		}
+	}
+	return keys
+}
+
+func (d *yamlMapHelperDocument) Update(data map[string]interface{}) error {
+	return updateMapHelperDocument(d, data, d.apply)
+}
+
+func (d *yamlMapHelperDocument) Bytes() ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(d.indent)
+	err := encoder.Encode(&d.root)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *yamlMapHelperDocument) find(path []string) *yaml.Node {
+	node := d.root.Content[0]
+	for _, k := range path {
+		if node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		parent := node
+		node = nil
+		switch parent.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(parent.Content); i += 2 {
+				if parent.Content[i].Value == k {
+					node = parent.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(k)
+			if err == nil && i >= 0 && i < len(parent.Content) {
+				node = parent.Content[i]
+			}
+		}
+		if node == nil {
+			return nil
+		}
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func (d *yamlMapHelperDocument) apply(change mapHelperChange) error {
+
+	parent := d.find(change.Path[:len(change.Path)-1])
+	if parent == nil {
+		return errors.New("Parent not found")
+	}
+	key := change.Path[len(change.Path)-1]
+
+	// Position of the value in the content of the parent
+	index := -1
+	switch parent.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(parent.Content); i += 2 {
+			if parent.Content[i].Value == key {
+				index = i + 1
+			}
+		}
+	case yaml.SequenceNode:
+		i, err := strconv.Atoi(key)
+		if err == nil && i >= 0 && i < len(parent.Content) {
+			index = i
+		}
+	default:
+		return errors.New("Parent is not a map or a list")
+	}
+
+	if change.Op == mapHelperChangeRemove {
+		if index < 0 {
+			return errors.New("Key not found")
+		}
+		if parent.Kind == yaml.MappingNode {
+			parent.Content = append(parent.Content[:index-1], parent.Content[index+1:]...)
+		} else {
+			parent.Content = append(parent.Content[:index], parent.Content[index+1:]...)
+		}
+		return nil
+	}
+
+	node := &yaml.Node{}
+	err := node.Encode(change.Value)
+	if err != nil {
+		return err
+	}
+
+	if index < 0 {
+		if parent.Kind != yaml.MappingNode {
+			return errors.New("Index out of range")
+		}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+		return nil
+	}
+
+	old := parent.Content[index]
+	if old.Kind == yaml.ScalarNode && node.Kind == yaml.ScalarNode && old.Tag == node.Tag {
+		node.Style = old.Style
+	}
+	node.HeadComment = old.HeadComment
+	node.LineComment = old.LineComment
+	node.FootComment = old.FootComment
+	parent.Content[index] = node
+	return nil
+
+}
+
+// INI document, that keeps comments and order; sections are the nested maps
+// as in IniMapHelperCodec.
+type iniMapHelperDocument struct {
+	file *ini.File
+}
+
+func (d *iniMapHelperDocument) Data() map[string]interface{} {
+	return iniFileData(d.file)
+}
+
+func (d *iniMapHelperDocument) Keys(path []string) []string {
+	keys := []string{}
+	name := strings.Join(path, ".")
+	if section, err := d.file.GetSection(iniSectionName(name)); err == nil {
+		keys = append(keys, section.KeyStrings()...)
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "."
+	}
+	for _, section := range d.file.SectionStrings() {
+		if section != ini.DefaultSection && strings.HasPrefix(section, prefix) {
+			keys = AddStringToList(keys, strings.Split(section[len(prefix):], ".")[0])
+		}
+	}
+	return keys
+}
+
+func (d *iniMapHelperDocument) Update(data map[string]interface{}) error {
+	return updateMapHelperDocument(d, data, d.apply)
+}
+
+func (d *iniMapHelperDocument) Bytes() ([]byte, error) {
+	buf := bytes.Buffer{}
+	_, err := d.file.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *iniMapHelperDocument) apply(change mapHelperChange) error {
+
+	if len(change.Path) > 1 {
+		listPath := change.Path[:len(change.Path)-1]
+		if list, ok := NewMapHelperFromData(d.Data()).LookupPath(mapHelperJsonPointer(listPath)); ok {
+			if list, ok := list.([]interface{}); ok {
+				return d.applyToList(listPath, list, change)
+			}
+		}
+	}
+
+	name := strings.Join(change.Path, ".")
+	_, oldIsMap := change.Old.(map[string]interface{})
+	newMap, newIsMap := change.Value.(map[string]interface{})
+
+	if oldIsMap {
+		// Removes the section and its subsections
+		for _, section := range d.file.SectionStrings() {
+			if section == name || strings.HasPrefix(section, name+".") {
+				d.file.DeleteSection(section)
+			}
+		}
+		if change.Op != mapHelperChangeReplace {
+			return nil
+		}
+	}
+
+	if newIsMap {
+		return encodeIniSection(d.file, name, newMap)
+	}
+
+	key := change.Path[len(change.Path)-1]
+	section, err := d.file.GetSection(iniSectionName(strings.Join(change.Path[:len(change.Path)-1], ".")))
+	if err != nil {
+		section, err = d.file.NewSection(strings.Join(change.Path[:len(change.Path)-1], "."))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, isList := change.Value.([]interface{}); !isList && change.Value != nil && section.HasKey(key) && len(section.Key(key).ValueWithShadows()) == 1 {
+		// Keeps the comment of the key
+		section.Key(key).SetValue(fmt.Sprintf("%v", change.Value))
+		return nil
+	}
+	section.DeleteKey(key)
+	if change.Op == mapHelperChangeRemove || change.Value == nil {
+		return nil
+	}
+	return encodeIniKey(section, key, change.Value)
+
+}
+
+// Elements of lists are saved as the whole list, as keys are repeated for them
+func (d *iniMapHelperDocument) applyToList(listPath []string, list []interface{}, change mapHelperChange) error {
+	i, err := strconv.Atoi(change.Path[len(change.Path)-1])
+	if err != nil || i < 0 || i >= len(list) {
+		return errors.New("Index out of range")
+	}
+	list[i] = change.Value
+	return d.apply(mapHelperChange{Op: mapHelperChangeReplace, Path: listPath, Value: list})
+}
+
+func iniSectionName(name string) string {
+	if name == "" {
+		return ini.DefaultSection
+	}
+	return name
+}
+
+// Returns the JSON pointer of the path
+func mapHelperJsonPointer(path []string) string {
+	pointer := ""
+	for _, k := range path {
+		pointer += "/" + strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+	}
+	return pointer
+}
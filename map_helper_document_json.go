@@ -0,0 +1,508 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Value parsed from a JSON document, with its position in the text
+type jsonDocumentNode struct {
+	start int
+	end   int
+	// '{', '[', or 0 for the rest of values
+	kind     byte
+	members  []*jsonDocumentMember
+	elements []*jsonDocumentNode
+	// Position of the closing bracket
+	close int
+}
+
+type jsonDocumentMember struct {
+	key      string
+	keyStart int
+	value    *jsonDocumentNode
+	// Position of the comma after the value, or -1
+	comma int
+}
+
+// JSON document that also accepts comments and trailing commas. Changes are
+// made editing the text, so everything else is kept as it was.
+type jsonMapHelperDocument struct {
+	src  []byte
+	root *jsonDocumentNode
+	// Indentation of each level
+	unit string
+}
+
+type jsonDocumentEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+func newJsonMapHelperDocument(src []byte) (*jsonMapHelperDocument, error) {
+
+	d := jsonMapHelperDocument{}
+	err := d.parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	d.unit = "  "
+	for _, m := range d.root.members {
+		if indent, ok := d.indentBefore(m.keyStart); ok && indent != "" {
+			d.unit = indent
+			break
+		}
+	}
+
+	return &d, nil
+
+}
+
+func (d *jsonMapHelperDocument) parse(src []byte) error {
+	p := jsonDocumentParser{src: src}
+	root, err := p.value()
+	if err == nil {
+		err = p.skip()
+	}
+	if err == nil && p.pos < len(src) {
+		err = errors.Errorf("Unexpected content at offset %v", p.pos)
+	}
+	if err != nil {
+		return err
+	}
+	if root.kind != '{' {
+		return errors.New("JSON document is not an object")
+	}
+	d.src = src
+	d.root = root
+	return nil
+}
+
+func (d *jsonMapHelperDocument) Data() map[string]interface{} {
+	return d.value(d.root).(map[string]interface{})
+}
+
+func (d *jsonMapHelperDocument) value(n *jsonDocumentNode) interface{} {
+	switch n.kind {
+	case '{':
+		m := map[string]interface{}{}
+		for _, member := range n.members {
+			m[member.key] = d.value(member.value)
+		}
+		return m
+	case '[':
+		list := []interface{}{}
+		for _, e := range n.elements {
+			list = append(list, d.value(e))
+		}
+		return list
+	}
+	var x interface{}
+	// Already validated when parsing
+	decodeMapHelperJson(d.src[n.start:n.end], &x)
+	return x
+}
+
+func (d *jsonMapHelperDocument) Keys(path []string) []string {
+	keys := []string{}
+	n := d.find(path)
+	if n != nil {
+		for _, m := range n.members {
+			keys = append(keys, m.key)
+		}
+	}
+	return keys
+}
+
+func (d *jsonMapHelperDocument) Update(data map[string]interface{}) error {
+	return updateMapHelperDocument(d, data, d.apply)
+}
+
+func (d *jsonMapHelperDocument) Bytes() ([]byte, error) {
+	return d.src, nil
+}
+
+func (d *jsonMapHelperDocument) find(path []string) *jsonDocumentNode {
+	n := d.root
+	for _, k := range path {
+		switch n.kind {
+		case '{':
+			i := n.member(k)
+			if i < 0 {
+				return nil
+			}
+			n = n.members[i].value
+		case '[':
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(n.elements) {
+				return nil
+			}
+			n = n.elements[i]
+		default:
+			return nil
+		}
+	}
+	return n
+}
+
+// Index of the member with the key; the last one, if repeated, as
+// encoding/json does.
+func (n *jsonDocumentNode) member(key string) int {
+	index := -1
+	for i, m := range n.members {
+		if m.key == key {
+			index = i
+		}
+	}
+	return index
+}
+
+func (d *jsonMapHelperDocument) apply(change mapHelperChange) error {
+
+	var edits []jsonDocumentEdit
+	var err error
+	switch change.Op {
+	case mapHelperChangeReplace:
+		n := d.find(change.Path)
+		if n == nil {
+			return errors.New("Value not found")
+		}
+		edits = []jsonDocumentEdit{{n.start, n.end, d.marshal(change.Value, d.lineIndent(n.start))}}
+	case mapHelperChangeRemove:
+		edits, err = d.removeEdits(change.Path)
+	case mapHelperChangeAdd:
+		edits, err = d.addEdits(change.Path, change.Value)
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	src := append([]byte{}, d.src...)
+	for _, e := range edits {
+		src = append(src[:e.start], append([]byte(e.text), src[e.end:]...)...)
+	}
+	return d.parse(src)
+
+}
+
+func (d *jsonMapHelperDocument) removeEdits(path []string) ([]jsonDocumentEdit, error) {
+
+	parent := d.find(path[:len(path)-1])
+	if parent == nil || parent.kind != '{' {
+		return nil, errors.New("Parent object not found")
+	}
+	i := parent.member(path[len(path)-1])
+	if i < 0 {
+		return nil, errors.New("Key not found")
+	}
+	m := parent.members[i]
+
+	if m.comma >= 0 {
+		start, end := d.expandToLine(m.keyStart, m.comma+1)
+		return []jsonDocumentEdit{{start, end, ""}}, nil
+	}
+	if i > 0 {
+		// The last member; the comma of the previous one is removed
+		prev := parent.members[i-1]
+		start, end := d.expandToLine(m.keyStart, m.value.end)
+		return []jsonDocumentEdit{{prev.comma, prev.comma + 1, ""}, {start, end, ""}}, nil
+	}
+	return []jsonDocumentEdit{{parent.start + 1, parent.close, ""}}, nil
+
+}
+
+func (d *jsonMapHelperDocument) addEdits(path []string, value interface{}) ([]jsonDocumentEdit, error) {
+
+	parent := d.find(path[:len(path)-1])
+	if parent == nil || parent.kind != '{' {
+		return nil, errors.New("Parent object not found")
+	}
+	key := path[len(path)-1]
+	keyText := d.marshal(key, "")
+
+	if len(parent.members) == 0 {
+		text := d.marshal(map[string]interface{}{key: value}, d.lineIndent(parent.start))
+		return []jsonDocumentEdit{{parent.start, parent.end, text}}, nil
+	}
+
+	last := parent.members[len(parent.members)-1]
+	indent, ok := d.indentBefore(last.keyStart)
+	if !ok {
+		// Members in the same line
+		text := keyText + ": " + d.marshalCompact(value)
+		if last.comma >= 0 {
+			return []jsonDocumentEdit{{last.comma + 1, last.comma + 1, " " + text + ","}}, nil
+		}
+		return []jsonDocumentEdit{{last.value.end, last.value.end, ", " + text}}, nil
+	}
+
+	text := "\n" + indent + keyText + ": " + d.marshal(value, indent)
+	if last.comma >= 0 {
+		// Trailing comma, that is also added to the new member
+		pos := d.lineEnd(last.comma + 1)
+		return []jsonDocumentEdit{{pos, pos, text + ","}}, nil
+	}
+	pos := d.lineEnd(last.value.end)
+	if pos == last.value.end {
+		return []jsonDocumentEdit{{pos, pos, "," + text}}, nil
+	}
+	// After the comment that follows the value
+	return []jsonDocumentEdit{{pos, pos, text}, {last.value.end, last.value.end, ","}}, nil
+
+}
+
+func (d *jsonMapHelperDocument) marshal(value interface{}, prefix string) string {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent(prefix, d.unit)
+	encoder.Encode(value)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (d *jsonMapHelperDocument) marshalCompact(value interface{}) string {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (d *jsonMapHelperDocument) lineStart(pos int) int {
+	return bytes.LastIndexByte(d.src[:pos], '\n') + 1
+}
+
+// Returns the whitespace before the position, if it is the first thing in
+// its line.
+func (d *jsonMapHelperDocument) indentBefore(pos int) (string, bool) {
+	indent := d.src[d.lineStart(pos):pos]
+	if len(bytes.TrimLeft(indent, " \t")) > 0 {
+		return "", false
+	}
+	return string(indent), true
+}
+
+// Returns the whitespace at the beginning of the line of the position
+func (d *jsonMapHelperDocument) lineIndent(pos int) string {
+	line := d.src[d.lineStart(pos):pos]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// Returns the position of the end of the line, if after the position there
+// are only spaces and a line comment; if not, the position itself.
+func (d *jsonMapHelperDocument) lineEnd(pos int) int {
+	i := pos
+	for i < len(d.src) && (d.src[i] == ' ' || d.src[i] == '\t') {
+		i++
+	}
+	if bytes.HasPrefix(d.src[i:], []byte("//")) {
+		i += bytes.IndexByte(append(d.src[i:], '\n'), '\n')
+	}
+	if i == len(d.src) || d.src[i] == '\n' || d.src[i] == '\r' {
+		return i
+	}
+	return pos
+}
+
+// Expands the range to the whole lines, if nothing else is in them; if
+// not, only the spaces around are included.
+func (d *jsonMapHelperDocument) expandToLine(start int, end int) (int, int) {
+	_, first := d.indentBefore(start)
+	lineEnd := d.lineEnd(end)
+	if first && lineEnd < len(d.src) && (d.src[lineEnd] == '\n' || d.src[lineEnd] == '\r') {
+		lineEnd += bytes.IndexByte(d.src[lineEnd:], '\n') + 1
+		return d.lineStart(start), lineEnd
+	}
+	if first && lineEnd == len(d.src) {
+		return d.lineStart(start), lineEnd
+	}
+	trailing := end
+	for trailing < len(d.src) && (d.src[trailing] == ' ' || d.src[trailing] == '\t') {
+		trailing++
+	}
+	if trailing > end {
+		return start, trailing
+	}
+	for start > 0 && (d.src[start-1] == ' ' || d.src[start-1] == '\t') {
+		start--
+	}
+	return start, end
+}
+
+type jsonDocumentParser struct {
+	src []byte
+	pos int
+}
+
+// Skips whitespace and comments
+func (p *jsonDocumentParser) skip() error {
+	for p.pos < len(p.src) {
+		switch {
+		case p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n' || p.src[p.pos] == '\r':
+			p.pos++
+		case bytes.HasPrefix(p.src[p.pos:], []byte("//")):
+			i := bytes.IndexByte(p.src[p.pos:], '\n')
+			if i < 0 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += i
+			}
+		case bytes.HasPrefix(p.src[p.pos:], []byte("/*")):
+			i := bytes.Index(p.src[p.pos+2:], []byte("*/"))
+			if i < 0 {
+				return errors.Errorf("Unterminated comment at offset %v", p.pos)
+			}
+			p.pos += i + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *jsonDocumentParser) value() (*jsonDocumentNode, error) {
+
+	err := p.skip()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.src) {
+		return nil, errors.New("Unexpected end of document")
+	}
+
+	n := &jsonDocumentNode{start: p.pos}
+	switch p.src[p.pos] {
+
+	case '{':
+		n.kind = '{'
+		p.pos++
+		for {
+			err = p.skip()
+			if err != nil {
+				return nil, err
+			}
+			if p.pos < len(p.src) && p.src[p.pos] == '}' {
+				break
+			}
+			m := jsonDocumentMember{keyStart: p.pos, comma: -1}
+			if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+				return nil, errors.Errorf("Expected key at offset %v", p.pos)
+			}
+			err = p.string()
+			if err == nil {
+				err = json.Unmarshal(p.src[m.keyStart:p.pos], &m.key)
+			}
+			if err == nil {
+				err = p.expect(':')
+			}
+			if err == nil {
+				m.value, err = p.value()
+			}
+			if err == nil {
+				err = p.skip()
+			}
+			if err != nil {
+				return nil, err
+			}
+			n.members = append(n.members, &m)
+			if p.pos < len(p.src) && p.src[p.pos] == ',' {
+				m.comma = p.pos
+				p.pos++
+			} else if p.pos >= len(p.src) || p.src[p.pos] != '}' {
+				return nil, errors.Errorf("Expected , or } at offset %v", p.pos)
+			}
+		}
+
+	case '[':
+		n.kind = '['
+		p.pos++
+		for {
+			err = p.skip()
+			if err != nil {
+				return nil, err
+			}
+			if p.pos < len(p.src) && p.src[p.pos] == ']' {
+				break
+			}
+			e, err := p.value()
+			if err == nil {
+				err = p.skip()
+			}
+			if err != nil {
+				return nil, err
+			}
+			n.elements = append(n.elements, e)
+			if p.pos < len(p.src) && p.src[p.pos] == ',' {
+				p.pos++
+			} else if p.pos >= len(p.src) || p.src[p.pos] != ']' {
+				return nil, errors.Errorf("Expected , or ] at offset %v", p.pos)
+			}
+		}
+
+	case '"':
+		err = p.string()
+		if err != nil {
+			return nil, err
+		}
+		n.end = p.pos
+		return n, nil
+
+	default:
+		for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n,]}/", rune(p.src[p.pos])) {
+			p.pos++
+		}
+		if !json.Valid(p.src[n.start:p.pos]) {
+			return nil, errors.Errorf("Invalid value at offset %v", n.start)
+		}
+		n.end = p.pos
+		return n, nil
+
+	}
+
+	n.close = p.pos
+	p.pos++
+	n.end = p.pos
+	return n, nil
+
+}
+
+func (p *jsonDocumentParser) string() error {
+	start := p.pos
+	for i := p.pos + 1; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '\n':
+			return errors.Errorf("Unterminated string at offset %v", start)
+		case '"':
+			p.pos = i + 1
+			if !json.Valid(p.src[start:p.pos]) {
+				return errors.Errorf("Invalid string at offset %v", start)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("Unterminated string at offset %v", start)
+}
+
+func (p *jsonDocumentParser) expect(c byte) error {
+	err := p.skip()
+	if err != nil {
+		return err
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != c {
+		return errors.Errorf("Expected %c at offset %v", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
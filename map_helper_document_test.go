@@ -0,0 +1,674 @@
+package goutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+type mapHelperDocumentTest struct {
+	name string
+	src  string
+	edit func(h *MapHelper) error
+	want string
+}
+
+const jsoncDocumentTestSource = `{
+  // Proxy
+  "proxy": {
+    "address": "127.0.0.1", // local
+    "port": 8080
+  },
+  /* hosts */
+  "hosts": ["a", "b"],
+  "debug": false
+}
+`
+
+const tomlDocumentTestSource = `# Settings
+title = "app" # name
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 8080 # default
+
+[[servers]]
+name = "a"
+port = 1
+
+[[servers]]
+name = "b"
+port = 2
+`
+
+func setMapHelperDocumentPath(path string, value interface{}) func(h *MapHelper) error {
+	return func(h *MapHelper) error {
+		return h.SetPath(path, value, true)
+	}
+}
+
+func deleteMapHelperDocumentPath(path string) func(h *MapHelper) error {
+	return func(h *MapHelper) error {
+		return h.DeletePath(path)
+	}
+}
+
+// Decodes the document, edits a copy of its data, updates the document with
+// it, and checks the text generated and that it decodes to the same data.
+func testMapHelperDocument(t *testing.T, codec MapHelperDocumentCodec, tests []mapHelperDocumentTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			doc, err := codec.DecodeDocument([]byte(test.src))
+			if err != nil {
+				t.Fatalf("Error decoding document: %v", err)
+			}
+			data, err := mapHelperCanonicalData(doc.Data())
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewMapHelperFromData(data)
+			if test.edit != nil {
+				err = test.edit(h)
+				if err != nil {
+					t.Fatalf("Error editing data: %v", err)
+				}
+			}
+
+			// The TOML document is generated again if the text can't be
+			// edited, so the editor is called directly to detect it
+			if toml, ok := doc.(*tomlMapHelperDocument); ok {
+				err = updateMapHelperDocument(toml, h.Data, toml.apply)
+			} else {
+				err = doc.Update(h.Data)
+			}
+			if err != nil {
+				t.Fatalf("Error updating document: %v", err)
+			}
+
+			got, err := doc.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Unexpected document:\n%s\nwant:\n%s", got, test.want)
+			}
+
+			decoded, err := codec.DecodeDocument(got)
+			if err != nil {
+				t.Fatalf("Error decoding updated document: %v", err)
+			}
+			want, err := mapHelperCanonicalData(h.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded.Data(), want) {
+				t.Errorf("Unexpected data %v, want %v", decoded.Data(), want)
+			}
+
+		})
+	}
+}
+
+func TestJsoncMapHelperDocument(t *testing.T) {
+	testMapHelperDocument(t, &JsoncMapHelperCodec{}, []mapHelperDocumentTest{
+		{
+			name: "unchanged",
+			src:  jsoncDocumentTestSource,
+			want: jsoncDocumentTestSource,
+		},
+		{
+			name: "replace value with inline comment",
+			src:  jsoncDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/port", 3128),
+			want: `{
+  // Proxy
+  "proxy": {
+    "address": "127.0.0.1", // local
+    "port": 3128
+  },
+  /* hosts */
+  "hosts": ["a", "b"],
+  "debug": false
+}
+`,
+		},
+		{
+			name: "delete value with inline comment",
+			src:  jsoncDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/proxy/address"),
+			want: `{
+  // Proxy
+  "proxy": {
+    "port": 8080
+  },
+  /* hosts */
+  "hosts": ["a", "b"],
+  "debug": false
+}
+`,
+		},
+		{
+			name: "delete last member",
+			src:  jsoncDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/debug"),
+			want: `{
+  // Proxy
+  "proxy": {
+    "address": "127.0.0.1", // local
+    "port": 8080
+  },
+  /* hosts */
+  "hosts": ["a", "b"]
+}
+`,
+		},
+		{
+			name: "add member",
+			src:  jsoncDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/username", "bob"),
+			want: `{
+  // Proxy
+  "proxy": {
+    "address": "127.0.0.1", // local
+    "port": 8080,
+    "username": "bob"
+  },
+  /* hosts */
+  "hosts": ["a", "b"],
+  "debug": false
+}
+`,
+		},
+		{
+			name: "grow array",
+			src:  jsoncDocumentTestSource,
+			edit: setMapHelperDocumentPath("/hosts", []interface{}{"a", "b", "c"}),
+			want: `{
+  // Proxy
+  "proxy": {
+    "address": "127.0.0.1", // local
+    "port": 8080
+  },
+  /* hosts */
+  "hosts": [
+    "a",
+    "b",
+    "c"
+  ],
+  "debug": false
+}
+`,
+		},
+	})
+}
+
+func TestJsonMapHelperDocument(t *testing.T) {
+	testMapHelperDocument(t, &JsonMapHelperCodec{}, []mapHelperDocumentTest{
+		{
+			name: "edit compact document",
+			src:  "{\"a\": 1, \"b\": {\"c\": [1, 2]}}\n",
+			edit: func(h *MapHelper) error {
+				err := h.SetPath("/b/c/1", 3, true)
+				if err != nil {
+					return err
+				}
+				return h.SetPath("/d", "x", true)
+			},
+			want: "{\"a\": 1, \"b\": {\"c\": [1, 3]}, \"d\": \"x\"}\n",
+		},
+	})
+}
+
+func TestTomlMapHelperDocument(t *testing.T) {
+	testMapHelperDocument(t, &TomlMapHelperCodec{}, []mapHelperDocumentTest{
+		{
+			name: "unchanged",
+			src:  tomlDocumentTestSource,
+			want: tomlDocumentTestSource,
+		},
+		{
+			name: "replace value with inline comment",
+			src:  tomlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/port", 3128),
+			want: `# Settings
+title = "app" # name
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 3128 # default
+
+[[servers]]
+name = "a"
+port = 1
+
+[[servers]]
+name = "b"
+port = 2
+`,
+		},
+		{
+			name: "delete value with inline comment",
+			src:  tomlDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/title"),
+			want: `# Settings
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 8080 # default
+
+[[servers]]
+name = "a"
+port = 1
+
+[[servers]]
+name = "b"
+port = 2
+`,
+		},
+		{
+			name: "add value to table",
+			src:  tomlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/username", "bob"),
+			want: `# Settings
+title = "app" # name
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 8080 # default
+username = "bob"
+
+[[servers]]
+name = "a"
+port = 1
+
+[[servers]]
+name = "b"
+port = 2
+`,
+		},
+		{
+			name: "replace value in array of tables",
+			src:  tomlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/servers/1/port", 22),
+			want: `# Settings
+title = "app" # name
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 8080 # default
+
+[[servers]]
+name = "a"
+port = 1
+
+[[servers]]
+name = "b"
+port = 22
+`,
+		},
+		{
+			name: "delete element of array of tables",
+			src:  tomlDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/servers/1"),
+			want: `# Settings
+title = "app" # name
+
+[proxy]
+# Local proxy
+address = "127.0.0.1"
+port = 8080 # default
+
+[[servers]]
+name = "a"
+port = 1
+`,
+		},
+		{
+			name: "add element to array of tables",
+			src:  tomlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/servers/2", map[string]interface{}{"name": "c", "port": 3}),
+			want: tomlDocumentTestSource + `
+[[servers]]
+name = "c"
+port = 3
+`,
+		},
+		{
+			name: "edit inline table and array",
+			src:  "point = { x = 1, y = 2 } # origin\nports = [1, 2] # open\n",
+			edit: func(h *MapHelper) error {
+				err := h.SetPath("/point/y", 5, true)
+				if err != nil {
+					return err
+				}
+				return h.SetPath("/ports/0", 9, true)
+			},
+			want: "point = { x = 1, y = 5 } # origin\nports = [9, 2] # open\n",
+		},
+	})
+}
+
+func TestMapHelperDocumentBigIntegers(t *testing.T) {
+
+	tests := []struct {
+		codec string
+		src   string
+		want  string
+	}{
+		{MAP_HELPER_CODEC_JSONC, "{\"id\": 9223372036854775807, /* small */ \"small\": 3}\n", "{\"id\": 9223372036854775806, /* small */ \"small\": 3}\n"},
+		{MAP_HELPER_CODEC_TOML, "id = 9223372036854775807 # big\nsmall = 3\n", "id = 9223372036854775806 # big\nsmall = 3\n"},
+		{MAP_HELPER_CODEC_YAML, "id: 9223372036854775807 # big\nsmall: 3\n", "id: 9223372036854775806 # big\nsmall: 3\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.codec, func(t *testing.T) {
+
+			codec, err := GetMapHelperCodec(test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := codec.(MapHelperDocumentCodec).DecodeDocument([]byte(test.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := mapHelperCanonicalData(doc.Data())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{"id": int64(9223372036854775807), "small": float64(3)}
+			if !reflect.DeepEqual(data, want) {
+				t.Errorf("Unexpected data %#v, want %#v", data, want)
+			}
+
+			data["id"] = int64(9223372036854775806)
+			err = doc.Update(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := doc.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Unexpected document:\n%s\nwant:\n%s", got, test.want)
+			}
+
+		})
+	}
+
+}
+
+// Blank lines are not kept by the YAML encoder
+const yamlDocumentTestSource = `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 8080 # default
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+hosts: [a, b]
+`
+
+func TestYamlMapHelperDocument(t *testing.T) {
+	testMapHelperDocument(t, &YamlMapHelperCodec{}, []mapHelperDocumentTest{
+		{
+			name: "unchanged",
+			src:  yamlDocumentTestSource,
+			want: yamlDocumentTestSource,
+		},
+		{
+			name: "replace value with inline comment",
+			src:  yamlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/port", 3128),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 3128 # default
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+hosts: [a, b]
+`,
+		},
+		{
+			name: "delete value",
+			src:  yamlDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/proxy/address"),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  port: 8080 # default
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+hosts: [a, b]
+`,
+		},
+		{
+			name: "add value",
+			src:  yamlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/username", "bob"),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 8080 # default
+  username: bob
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+hosts: [a, b]
+`,
+		},
+		{
+			name: "replace value in list of maps",
+			src:  yamlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/servers/1/port", 22),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 8080 # default
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 22
+hosts: [a, b]
+`,
+		},
+		{
+			name: "delete element of list of maps",
+			src:  yamlDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/servers/0"),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 8080 # default
+servers:
+  - name: b
+    port: 2
+hosts: [a, b]
+`,
+		},
+		{
+			name: "grow list",
+			src:  yamlDocumentTestSource,
+			edit: setMapHelperDocumentPath("/hosts/2", "c"),
+			want: `# Settings
+title: app # name
+# Local proxy
+proxy:
+  address: 127.0.0.1
+  port: 8080 # default
+servers:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+hosts:
+  - a
+  - b
+  - c
+`,
+		},
+	})
+}
+
+// As saved by the INI library: comments go before the keys, and the values
+// of a section are aligned
+const iniDocumentTestSource = `; Settings
+; name
+title = app
+
+[proxy]
+; Local proxy
+address = 127.0.0.1
+port    = 8080
+
+[proxy.auth]
+user = bob
+`
+
+func TestIniMapHelperDocument(t *testing.T) {
+	testMapHelperDocument(t, &IniMapHelperCodec{}, []mapHelperDocumentTest{
+		{
+			name: "unchanged",
+			src:  iniDocumentTestSource,
+			want: iniDocumentTestSource,
+		},
+		{
+			name: "inline comment",
+			src:  "title = app ; name\n",
+			want: "; name\ntitle = app\n",
+		},
+		{
+			name: "replace value",
+			src:  iniDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/port", 3128),
+			want: `; Settings
+; name
+title = app
+
+[proxy]
+; Local proxy
+address = 127.0.0.1
+port    = 3128
+
+[proxy.auth]
+user = bob
+`,
+		},
+		{
+			name: "delete value with its comment",
+			src:  iniDocumentTestSource,
+			edit: deleteMapHelperDocumentPath("/proxy/address"),
+			want: `; Settings
+; name
+title = app
+
+[proxy]
+port = 8080
+
+[proxy.auth]
+user = bob
+`,
+		},
+		{
+			name: "add value to subsection",
+			src:  iniDocumentTestSource,
+			edit: setMapHelperDocumentPath("/proxy/auth/password", "secret"),
+			want: `; Settings
+; name
+title = app
+
+[proxy]
+; Local proxy
+address = 127.0.0.1
+port    = 8080
+
+[proxy.auth]
+user     = bob
+password = secret
+`,
+		},
+		{
+			name: "add list",
+			src:  iniDocumentTestSource,
+			edit: setMapHelperDocumentPath("/hosts", []interface{}{"a", "b"}),
+			want: `; Settings
+; name
+title = app
+hosts = a
+hosts = b
+
+[proxy]
+; Local proxy
+address = 127.0.0.1
+port    = 8080
+
+[proxy.auth]
+user = bob
+`,
+		},
+		{
+			name: "add section",
+			src:  iniDocumentTestSource,
+			edit: setMapHelperDocumentPath("/cache/size", 5),
+			want: iniDocumentTestSource + `
+[cache]
+size = 5
+`,
+		},
+	})
+}
+
+func TestMapHelperDocumentKeys(t *testing.T) {
+
+	tests := []struct {
+		codec MapHelperDocumentCodec
+		src   string
+		want  []string
+	}{
+		{&JsoncMapHelperCodec{}, `{"zeta": 1, /* b */ "beta": {"y": 1, "x": 2}, "alpha": 3}`, []string{"zeta", "beta", "alpha"}},
+		{&YamlMapHelperCodec{}, "zeta: 1\nbeta:\n  y: 1\n  x: 2\nalpha: 3\n", []string{"zeta", "beta", "alpha"}},
+		{&TomlMapHelperCodec{}, "zeta = 1\nalpha = 3\n\n[beta]\ny = 1\nx = 2\n", []string{"zeta", "alpha", "beta"}},
+		{&IniMapHelperCodec{}, "zeta = 1\nalpha = 3\n\n[beta]\ny = 1\nx = 2\n", []string{"zeta", "alpha", "beta"}},
+	}
+
+	for _, test := range tests {
+		doc, err := test.codec.DecodeDocument([]byte(test.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := doc.Keys([]string{}); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("Unexpected keys of %T: %v, want %v", test.codec, keys, test.want)
+		}
+		if keys := doc.Keys([]string{"beta"}); !reflect.DeepEqual(keys, []string{"y", "x"}) {
+			t.Errorf("Unexpected keys of beta of %T: %v", test.codec, keys)
+		}
+	}
+
+}
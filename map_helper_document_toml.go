@@ -0,0 +1,673 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+var tomlBareKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Returned for the changes that can't be made editing the text
+var errTomlDocumentUnsupported = errors.New("Change not supported in TOML documents")
+
+// Key and value in a TOML document
+type tomlDocumentEntry struct {
+	path []string
+	// Span of the lines, including the newline
+	start int
+	end   int
+	// Span of the value, without comments
+	valueStart int
+	valueEnd   int
+	// Number of elements in the key, as in "a.b = 1"
+	keyLength int
+}
+
+// Table header and its keys, until the next header; the root table has no
+// header.
+type tomlDocumentTable struct {
+	path  []string
+	start int
+	end   int
+	// Where new keys are inserted: after the last one, or after the header
+	insert int
+}
+
+// TOML document, changed editing the text, so comments and formatting are
+// kept. When a change can't be made this way (for example, adding a table
+// inside an array of tables), the document is generated again, and the
+// comments are lost; a warning is logged then.
+type tomlMapHelperDocument struct {
+	src     []byte
+	data    map[string]interface{}
+	entries []*tomlDocumentEntry
+	tables  []*tomlDocumentTable
+}
+
+func newTomlMapHelperDocument(src []byte) (*tomlMapHelperDocument, error) {
+	d := tomlMapHelperDocument{}
+	err := d.parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (d *tomlMapHelperDocument) parse(src []byte) error {
+
+	data := map[string]interface{}{}
+	err := toml.Unmarshal(src, &data)
+	if err != nil {
+		return err
+	}
+
+	entries := []*tomlDocumentEntry{}
+	root := &tomlDocumentTable{path: []string{}, start: 0}
+	tables := []*tomlDocumentTable{root}
+	current := root
+	// Number of elements of each array of tables
+	arrays := map[string]int{}
+
+	pos := 0
+	for pos < len(src) {
+
+		lineEnd := bytes.IndexByte(src[pos:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(src)
+		} else {
+			lineEnd += pos + 1
+		}
+		line := strings.TrimSpace(string(src[pos:lineEnd]))
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			pos = lineEnd
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			array := strings.HasPrefix(line, "[[")
+			keys, _, err := parseTomlKey(strings.TrimLeft(line, "["), "]")
+			if err != nil {
+				return err
+			}
+			path := []string{}
+			for i, k := range keys {
+				path = append(path, k)
+				// Elements of arrays of tables are referenced by the last one
+				if n, ok := arrays[strings.Join(path, "\x00")]; ok && (i < len(keys)-1 || !array) {
+					path = append(path, strconv.Itoa(n-1))
+				}
+			}
+			if array {
+				n := arrays[strings.Join(path, "\x00")]
+				arrays[strings.Join(path, "\x00")] = n + 1
+				path = append(path, strconv.Itoa(n))
+			}
+			current.end = pos
+			current = &tomlDocumentTable{path: path, start: pos, insert: lineEnd}
+			tables = append(tables, current)
+			pos = lineEnd
+			continue
+		}
+
+		keys, rest, err := parseTomlKey(string(src[pos:]), "=")
+		if err != nil {
+			return err
+		}
+		e := tomlDocumentEntry{start: pos, keyLength: len(keys)}
+		e.path = append(append([]string{}, current.path...), keys...)
+		e.valueStart = len(src) - len(strings.TrimLeft(rest, " \t"))
+		e.valueEnd, e.end = tomlValueEnd(src, e.valueStart)
+		entries = append(entries, &e)
+		current.insert = e.end
+		pos = e.end
+
+	}
+	current.end = len(src)
+	if root.insert == 0 {
+		root.insert = root.end
+	}
+
+	d.src = src
+	d.data = normalizeMapHelperValue(data).(map[string]interface{})
+	d.entries = entries
+	d.tables = tables
+	return nil
+
+}
+
+// Parses a dotted key, until the terminator; returns the text after it
+func parseTomlKey(s string, terminator string) ([]string, string, error) {
+	keys := []string{}
+	s = strings.TrimLeft(s, " \t")
+	for {
+		if s == "" {
+			return nil, "", errors.New("Unexpected end of key")
+		}
+		var key string
+		switch s[0] {
+		case '"':
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, "", errors.New("Unterminated key")
+			}
+			err := json.Unmarshal([]byte(s[:end+1]), &key)
+			if err != nil {
+				return nil, "", errors.Wrapf(err, "Invalid key %v", s[:end+1])
+			}
+			s = s[end+1:]
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return nil, "", errors.New("Unterminated key")
+			}
+			key = s[1 : end+1]
+			s = s[end+2:]
+		default:
+			end := strings.IndexAny(s, " \t."+terminator)
+			if end <= 0 {
+				return nil, "", errors.Errorf("Invalid key %v", strings.SplitN(s, "\n", 2)[0])
+			}
+			key = s[:end]
+			s = s[end:]
+		}
+		keys = append(keys, key)
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, terminator) {
+			return keys, s[len(terminator):], nil
+		}
+		if !strings.HasPrefix(s, ".") {
+			return nil, "", errors.Errorf("Expected %v after key", terminator)
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+	}
+}
+
+// Returns the end of the value that starts in the position, without the
+// comments, and the end of its last line. Values may span several lines,
+// if they are arrays, inline tables or multi-line strings.
+func tomlValueEnd(src []byte, pos int) (int, int) {
+	depth := 0
+	valueEnd := pos
+	i := pos
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '\n':
+			if depth == 0 {
+				return valueEnd, i + 1
+			}
+		case c == '"' || c == '\'':
+			delimiter := string(c)
+			if bytes.HasPrefix(src[i:], []byte(strings.Repeat(delimiter, 3))) {
+				delimiter = strings.Repeat(delimiter, 3)
+			}
+			i += len(delimiter)
+			for i < len(src) && !bytes.HasPrefix(src[i:], []byte(delimiter)) {
+				if c == '"' && src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i += len(delimiter)
+			// Quotes just before the closing delimiter of multi-line strings
+			for len(delimiter) == 3 && i < len(src) && src[i] == c {
+				i++
+			}
+			if i > len(src) {
+				i = len(src)
+			}
+			valueEnd = i
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			valueEnd = i + 1
+		}
+		i++
+	}
+	return valueEnd, len(src)
+}
+
+func (d *tomlMapHelperDocument) Data() map[string]interface{} {
+	return d.data
+}
+
+func (d *tomlMapHelperDocument) Keys(path []string) []string {
+	keys := []string{}
+	add := func(p []string) {
+		if len(p) > len(path) && equalStringLists(p[:len(path)], path) {
+			keys = AddStringToList(keys, p[len(path)])
+		}
+	}
+	// Entries and tables are sorted by position
+	i := 0
+	for _, t := range d.tables {
+		for i < len(d.entries) && d.entries[i].start < t.start {
+			add(d.entries[i].path)
+			i++
+		}
+		add(t.path)
+	}
+	for ; i < len(d.entries); i++ {
+		add(d.entries[i].path)
+	}
+	return keys
+}
+
+func (d *tomlMapHelperDocument) Update(data map[string]interface{}) error {
+	err := updateMapHelperDocument(d, data, d.apply)
+	if err == nil {
+		return nil
+	}
+	Log.Warningf("Error editing TOML document, generating it again without comments: %v", err)
+	src, err := (&TomlMapHelperCodec{}).Encode(data)
+	if err != nil {
+		return err
+	}
+	return d.parse(src)
+}
+
+func (d *tomlMapHelperDocument) Bytes() ([]byte, error) {
+	return d.src, nil
+}
+
+func (d *tomlMapHelperDocument) entry(path []string) *tomlDocumentEntry {
+	for _, e := range d.entries {
+		if equalStringLists(e.path, path) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *tomlMapHelperDocument) table(path []string) *tomlDocumentTable {
+	for _, t := range d.tables {
+		if equalStringLists(t.path, path) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Returns the entry that contains the path in an inline table or array
+func (d *tomlMapHelperDocument) inlineParent(path []string) *tomlDocumentEntry {
+	for _, e := range d.entries {
+		if len(e.path) < len(path) && equalStringLists(e.path, path[:len(e.path)]) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns true if there are keys or tables in the path or under it
+func (d *tomlMapHelperDocument) defined(path []string) bool {
+	for _, e := range d.entries {
+		if len(e.path) >= len(path) && equalStringLists(e.path[:len(path)], path) {
+			return true
+		}
+	}
+	for _, t := range d.tables {
+		if len(t.path) >= len(path) && equalStringLists(t.path[:len(path)], path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *tomlMapHelperDocument) apply(change mapHelperChange) error {
+
+	edits := []jsonDocumentEdit{}
+	path := change.Path
+
+	if e := d.inlineParent(path); e != nil {
+		// Inside an inline table or array, that is replaced
+		value, err := mapHelperCanonicalData(map[string]interface{}{"v": d.valueAt(e.path)})
+		if err != nil {
+			return err
+		}
+		h := NewMapHelperFromData(value)
+		pointer := mapHelperJsonPointer(append([]string{"v"}, path[len(e.path):]...))
+		if change.Op == mapHelperChangeRemove {
+			err = h.DeletePath(pointer)
+		} else {
+			err = h.SetPath(pointer, change.Value, false)
+		}
+		if err != nil {
+			return err
+		}
+		// Kept inline, even if it is a map, so the comments of the line stay
+		text, err := tomlInlineValue(h.Data["v"])
+		if err != nil {
+			return err
+		}
+		edits = append(edits, jsonDocumentEdit{e.valueStart, e.valueEnd, text})
+		return d.edit(edits)
+	}
+
+	switch {
+
+	case change.Op == mapHelperChangeRemove || change.Value == nil:
+		if !d.defined(path) {
+			return nil
+		}
+		for _, e := range d.entries {
+			if len(e.path) >= len(path) && equalStringLists(e.path[:len(path)], path) {
+				edits = append(edits, jsonDocumentEdit{e.start, e.end, ""})
+			}
+		}
+		for _, t := range d.tables {
+			if len(t.path) >= len(path) && equalStringLists(t.path[:len(path)], path) {
+				edits = append(edits, jsonDocumentEdit{t.start, t.end, ""})
+			}
+		}
+		edits = removeNestedTomlEdits(edits)
+
+	case change.Op == mapHelperChangeReplace && d.entry(path) != nil && !tomlIsTable(change.Value):
+		e := d.entry(path)
+		value, err := tomlInlineValue(change.Value)
+		if err != nil {
+			return err
+		}
+		edits = append(edits, jsonDocumentEdit{e.valueStart, e.valueEnd, value})
+
+	case change.Op == mapHelperChangeReplace:
+		// Tables replaced by other values, and the reverse
+		err := d.apply(mapHelperChange{Op: mapHelperChangeRemove, Path: path, Old: change.Old})
+		if err != nil {
+			return err
+		}
+		return d.apply(mapHelperChange{Op: mapHelperChangeAdd, Path: path, Value: change.Value})
+
+	case tomlIsTable(change.Value):
+		for _, k := range path {
+			if _, err := strconv.Atoi(k); err == nil {
+				// Headers always refer to the last element of arrays of tables
+				return errTomlDocumentUnsupported
+			}
+		}
+		edits = append(edits, d.appendEdit(tomlTableText(path, change.Value)))
+
+	default:
+		value, err := tomlInlineValue(change.Value)
+		if err != nil {
+			return err
+		}
+		edit, err := d.addKeyEdit(path, value)
+		if err != nil {
+			return err
+		}
+		edits = append(edits, edit)
+
+	}
+
+	return d.edit(edits)
+
+}
+
+// Applies the edits to the text, and parses it again
+func (d *tomlMapHelperDocument) edit(edits []jsonDocumentEdit) error {
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	src := append([]byte{}, d.src...)
+	for _, e := range edits {
+		src = append(src[:e.start], append([]byte(e.text), src[e.end:]...)...)
+	}
+	return d.parse(src)
+}
+
+// Inserts the key in the table of its parent, after its last key
+func (d *tomlMapHelperDocument) addKeyEdit(path []string, value string) (jsonDocumentEdit, error) {
+
+	parent := path[:len(path)-1]
+	key := tomlKey(path[len(path)-1])
+
+	if t := d.table(parent); t != nil {
+		line := key + " = " + value + "\n"
+		if t.insert > 0 && d.src[t.insert-1] != '\n' {
+			line = "\n" + line
+		}
+		if t.insert < len(d.src) && d.src[t.insert] == '[' {
+			line += "\n"
+		}
+		return jsonDocumentEdit{t.insert, t.insert, line}, nil
+	}
+
+	// Tables defined with dotted keys ("a.b = 1") can't have a header, so
+	// the key is added in the same way
+	var last *tomlDocumentEntry
+	for _, e := range d.entries {
+		table := len(e.path) - e.keyLength
+		if e.keyLength > 1 && table < len(parent) && len(e.path) > len(parent) && equalStringLists(e.path[:len(parent)], parent) {
+			last = e
+		}
+	}
+	if last != nil {
+		line := tomlKeyPath(path[len(last.path)-last.keyLength:]) + " = " + value + "\n"
+		if last.end > 0 && d.src[last.end-1] != '\n' {
+			line = "\n" + line
+		}
+		return jsonDocumentEdit{last.end, last.end, line}, nil
+	}
+
+	for _, k := range parent {
+		if _, err := strconv.Atoi(k); err == nil {
+			return jsonDocumentEdit{}, errTomlDocumentUnsupported
+		}
+	}
+	return d.appendEdit("[" + tomlKeyPath(parent) + "]\n" + key + " = " + value + "\n"), nil
+
+}
+
+// Adds the text at the end, separated by an empty line
+func (d *tomlMapHelperDocument) appendEdit(text string) jsonDocumentEdit {
+	if len(d.src) > 0 && !bytes.HasSuffix(d.src, []byte("\n\n")) {
+		text = "\n" + text
+		if !bytes.HasSuffix(d.src, []byte("\n")) {
+			text = "\n" + text
+		}
+	}
+	return jsonDocumentEdit{len(d.src), len(d.src), text}
+}
+
+func (d *tomlMapHelperDocument) valueAt(path []string) interface{} {
+	val, _ := NewMapHelperFromData(d.data).LookupPath(mapHelperJsonPointer(path))
+	return val
+}
+
+// Removes the edits contained in others
+func removeNestedTomlEdits(edits []jsonDocumentEdit) []jsonDocumentEdit {
+	result := []jsonDocumentEdit{}
+	for i, e := range edits {
+		nested := false
+		for j, o := range edits {
+			if i != j && o.start <= e.start && e.end <= o.end && (o.start != e.start || o.end != e.end || j < i) {
+				nested = true
+			}
+		}
+		if !nested {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Maps and non-empty lists of maps are saved as tables
+func tomlIsTable(value interface{}) bool {
+	if _, ok := value.(map[string]interface{}); ok {
+		return true
+	}
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for _, v := range list {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func tomlKey(key string) string {
+	if tomlBareKeyRegexp.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlKeyPath(path []string) string {
+	keys := []string{}
+	for _, k := range path {
+		keys = append(keys, tomlKey(k))
+	}
+	return strings.Join(keys, ".")
+}
+
+// JSON escapes are valid in TOML basic strings
+func tomlString(s string) string {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func tomlInlineValue(value interface{}) (string, error) {
+	switch w := value.(type) {
+	case bool:
+		return strconv.FormatBool(w), nil
+	case string:
+		return tomlString(w), nil
+	case int64:
+		return strconv.FormatInt(w, 10), nil
+	case float64:
+		switch {
+		case math.IsNaN(w):
+			return "nan", nil
+		case math.IsInf(w, 1):
+			return "inf", nil
+		case math.IsInf(w, -1):
+			return "-inf", nil
+		case w == math.Trunc(w) && math.Abs(w) < 1<<53:
+			return strconv.FormatInt(int64(w), 10), nil
+		}
+		s := strconv.FormatFloat(w, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s, nil
+	case []interface{}:
+		values := []string{}
+		for _, v := range w {
+			s, err := tomlInlineValue(v)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, s)
+		}
+		return "[" + strings.Join(values, ", ") + "]", nil
+	case map[string]interface{}:
+		keys := []string{}
+		for k, v := range w {
+			if v != nil {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			return "{}", nil
+		}
+		sort.Strings(keys)
+		values := []string{}
+		for _, k := range keys {
+			s, err := tomlInlineValue(w[k])
+			if err != nil {
+				return "", err
+			}
+			values = append(values, tomlKey(k)+" = "+s)
+		}
+		return "{ " + strings.Join(values, ", ") + " }", nil
+	}
+	return "", errTomlDocumentUnsupported
+}
+
+// Generates the table (or array of tables) in the path, with its subtables
+func tomlTableText(path []string, value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		text := ""
+		for i, v := range list {
+			if i > 0 {
+				text += "\n"
+			}
+			text += "[[" + tomlKeyPath(path) + "]]\n" + tomlTableBody(path, v.(map[string]interface{}))
+		}
+		return text
+	}
+	body := tomlTableBody(path, value.(map[string]interface{}))
+	if strings.HasPrefix(body, "\n") {
+		// Only subtables; the header is not needed
+		return body[1:]
+	}
+	return "[" + tomlKeyPath(path) + "]\n" + body
+}
+
+func tomlTableBody(path []string, data map[string]interface{}) string {
+	keys := []string{}
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	text := ""
+	tables := []string{}
+	for _, k := range keys {
+		if data[k] == nil {
+			continue
+		}
+		if tomlIsTable(data[k]) {
+			tables = append(tables, k)
+			continue
+		}
+		// Only fails for types not returned by encoding/json
+		value, _ := tomlInlineValue(data[k])
+		text += tomlKey(k) + " = " + value + "\n"
+	}
+	for _, k := range tables {
+		text += "\n" + tomlTableText(append(append([]string{}, path...), k), data[k])
+	}
+	return text
+}
+
+func equalStringLists(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,392 @@
+package goutils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variable that overrides a value, as listed by Variables
+type MapHelperEnvVariable struct {
+	Name string
+	// Path of the value, in the format of ParseMapHelperPath
+	Path string
+	// One of the SCHEMA_TYPE_ constants
+	Type        string
+	Description string
+	Default     interface{}
+}
+
+// Maps environment variables to values of a MapHelper: the variables start
+// with the prefix and an underscore, and the rest of the name is the path of
+// the value, with the levels separated by Separator (APP_PROXY__PORT is
+// proxy.port). The values are converted to the type of the existing value,
+// or of the schema; lists can be JSON or comma separated values.
+type MapHelperEnvBinding struct {
+	Prefix    string
+	Separator string
+	// Optional; used to convert the values, and to list the variables
+	Schema *MapHelperSchema
+}
+
+var envNameInvalidChars = regexp.MustCompile("[^A-Z0-9_]")
+
+func NewMapHelperEnvBinding(prefix string) *MapHelperEnvBinding {
+	b := MapHelperEnvBinding{}
+	b.Prefix = prefix
+	b.Separator = "__"
+	return &b
+}
+
+// Returns the binding, so it can be chained to the constructor
+func (b *MapHelperEnvBinding) SetSchema(s *MapHelperSchema) *MapHelperEnvBinding {
+	b.Schema = s
+	return b
+}
+
+// Returns the name of the variable of the path, given as keys
+func (b *MapHelperEnvBinding) VariableName(keys []string) string {
+	name := strings.ToUpper(strings.Join(keys, b.Separator))
+	return strings.ToUpper(b.Prefix) + "_" + envNameInvalidChars.ReplaceAllString(name, "_")
+}
+
+// Sets in the helper the values of the environment variables
+func (b *MapHelperEnvBinding) Apply(h *MapHelper) error {
+	overrides, bound, err := b.load(h)
+	if err != nil {
+		return err
+	}
+	// The keys are those of Load, as the case of the keys could resolve
+	// differently once the helper is modified
+	for _, v := range bound {
+		value, ok := overrides.LookupPath(mapHelperJsonPointer(v.keys))
+		if !ok {
+			continue
+		}
+		err := h.SetPath(mapHelperJsonPointer(v.keys), value, true)
+		if err != nil {
+			return errors.Wrapf(err, "Error setting environment variable %v", v.name)
+		}
+	}
+	return nil
+}
+
+// Returns a helper with only the values of the environment variables; the
+// reference, that can be nil, gives the types of the values and the case
+// of the keys.
+func (b *MapHelperEnvBinding) Load(reference *MapHelper) (*MapHelper, error) {
+	h, _, err := b.load(reference)
+	return h, err
+}
+
+// Variable set, and the keys of its value
+type mapHelperEnvBound struct {
+	name string
+	keys []string
+}
+
+func (b *MapHelperEnvBinding) load(reference *MapHelper) (*MapHelper, []mapHelperEnvBound, error) {
+	h := NewEmptyMapHelper()
+	bound := []mapHelperEnvBound{}
+	for _, variable := range b.sortedVariables() {
+		keys, ok := b.variableKeys(variable, reference)
+		if !ok {
+			continue
+		}
+		valueType, itemsType := b.valueType(keys, reference)
+		value, err := convertEnvValue(variable[1], valueType, itemsType)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Invalid value of environment variable %v", variable[0])
+		}
+		err = h.SetPath(mapHelperJsonPointer(keys), value, true)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Error setting environment variable %v", variable[0])
+		}
+		bound = append(bound, mapHelperEnvBound{name: variable[0], keys: keys})
+		Log.Debugf("Value of %v set from environment variable %v", strings.Join(keys, "."), variable[0])
+	}
+	return h, bound, nil
+}
+
+// Returns the variables of the values of the schema and of the reference,
+// that can be nil, sorted by name.
+func (b *MapHelperEnvBinding) Variables(reference *MapHelper) []MapHelperEnvVariable {
+	var data interface{}
+	if reference != nil {
+		data = reference
+	}
+	variables := []MapHelperEnvVariable{}
+	b.collectVariables([]MapHelperPathElement{}, b.Schema, data, &variables)
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i].Name < variables[j].Name
+	})
+	return variables
+}
+
+func (b *MapHelperEnvBinding) collectVariables(path []MapHelperPathElement, s *MapHelperSchema, value interface{}, variables *[]MapHelperEnvVariable) {
+
+	m, isMap := mapHelperSchemaMap(value)
+	if isMap || (s != nil && s.Type == SCHEMA_TYPE_MAP && len(s.Properties) > 0) {
+		keys := map[string]bool{}
+		for k := range m {
+			keys[k] = true
+		}
+		if s != nil {
+			for k := range s.Properties {
+				keys[k] = true
+			}
+		}
+		for k := range keys {
+			var child *MapHelperSchema
+			if s != nil {
+				child = s.Properties[k]
+			}
+			b.collectVariables(append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: k}), child, m[k], variables)
+		}
+		return
+	}
+
+	if len(path) == 0 {
+		return
+	}
+	keys := []string{}
+	for _, e := range path {
+		keys = append(keys, e.Key)
+	}
+	variable := MapHelperEnvVariable{Name: b.VariableName(keys), Path: FormatMapHelperPath(path), Type: mapHelperSchemaTypeOf(value)}
+	if s != nil {
+		variable.Type = s.Type
+		variable.Description = s.Description
+		variable.Default = s.Default
+	}
+	*variables = append(*variables, variable)
+
+}
+
+// Returns the name and value of the variables with the prefix
+func (b *MapHelperEnvBinding) sortedVariables() [][]string {
+	prefix := strings.ToUpper(b.Prefix) + "_"
+	variables := [][]string{}
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) || len(parts[0]) == len(prefix) {
+			continue
+		}
+		variables = append(variables, parts)
+	}
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i][0] < variables[j][0]
+	})
+	return variables
+}
+
+// Returns the keys of the path of the variable; the keys are in lower
+// case, unless the reference or the schema have the key with other case.
+func (b *MapHelperEnvBinding) variableKeys(variable []string, reference *MapHelper) ([]string, bool) {
+
+	prefix := strings.ToUpper(b.Prefix) + "_"
+	keys := strings.Split(strings.ToLower(variable[0][len(prefix):]), strings.ToLower(b.Separator))
+
+	var node interface{}
+	if reference != nil {
+		node = reference
+	}
+	s := b.Schema
+	for i, k := range keys {
+		if k == "" {
+			Log.Debugf("Ignoring environment variable %v with empty key", variable[0])
+			return nil, false
+		}
+		candidates := []string{}
+		m, _ := mapHelperSchemaMap(node)
+		for key := range m {
+			candidates = append(candidates, key)
+		}
+		if s != nil {
+			for key := range s.Properties {
+				candidates = append(candidates, key)
+			}
+		}
+		sort.Strings(candidates)
+		for _, c := range candidates {
+			if strings.EqualFold(c, k) {
+				keys[i] = c
+				break
+			}
+		}
+		node, _ = mapHelperPathChild(node, MapHelperPathElement{Key: keys[i]})
+		if s != nil {
+			if s.Type == SCHEMA_TYPE_LIST {
+				s = s.Items
+			} else {
+				s = s.Properties[keys[i]]
+			}
+		}
+	}
+	return keys, true
+
+}
+
+// Returns the type of the value in the path, and of its elements if it is a
+// list; empty if not known.
+func (b *MapHelperEnvBinding) valueType(keys []string, reference *MapHelper) (string, string) {
+	if reference != nil {
+		if value, ok := reference.LookupPath(mapHelperJsonPointer(keys)); ok && value != nil {
+			itemsType := ""
+			switch list := value.(type) {
+			case []interface{}:
+				if len(list) > 0 {
+					itemsType = mapHelperSchemaTypeOf(list[0])
+				}
+			case []string:
+				itemsType = SCHEMA_TYPE_STRING
+			case []int:
+				itemsType = SCHEMA_TYPE_INT
+			}
+			return mapHelperSchemaTypeOf(value), itemsType
+		}
+	}
+	if b.Schema != nil {
+		if s := b.Schema.GetPathSchema(mapHelperJsonPointer(keys)); s != nil {
+			if s.Items != nil {
+				return s.Type, s.Items.Type
+			}
+			return s.Type, ""
+		}
+	}
+	return "", ""
+}
+
+// Returns the schema type of the value; lists of strings are lists. Only
+// integer types are SCHEMA_TYPE_INT, as decoded files have float64 numbers.
+func mapHelperSchemaTypeOf(value interface{}) string {
+	switch w := value.(type) {
+	case int, int32, int64:
+		return SCHEMA_TYPE_INT
+	case json.Number:
+		if _, err := w.Int64(); err == nil {
+			return SCHEMA_TYPE_INT
+		}
+		return SCHEMA_TYPE_NUMBER
+	}
+	switch mapHelperTypeName(value) {
+	case "boolean":
+		return SCHEMA_TYPE_BOOLEAN
+	case "string":
+		return SCHEMA_TYPE_STRING
+	case "number":
+		return SCHEMA_TYPE_NUMBER
+	case "list":
+		return SCHEMA_TYPE_LIST
+	case "map":
+		return SCHEMA_TYPE_MAP
+	}
+	return SCHEMA_TYPE_ANY
+}
+
+// Converts the value of the variable to the type; if the type is not known,
+// JSON lists and maps are parsed, and booleans and numbers are detected.
+func convertEnvValue(raw string, valueType string, itemsType string) (interface{}, error) {
+
+	trimmed := strings.TrimSpace(raw)
+
+	switch valueType {
+	case SCHEMA_TYPE_STRING:
+		return raw, nil
+	case SCHEMA_TYPE_BOOLEAN:
+		b, err := strconv.ParseBool(trimmed)
+		if err != nil {
+			return nil, errors.Errorf("%v is not a boolean", raw)
+		}
+		return b, nil
+	case SCHEMA_TYPE_INT:
+		i, err := strconv.ParseInt(trimmed, 10, 64)
+		if err != nil {
+			if _, err := strconv.ParseFloat(trimmed, 64); err == nil {
+				return nil, errors.Errorf("%v is not an integer", raw)
+			}
+			return nil, errors.Errorf("%v is not a number", raw)
+		}
+		if int64(int(i)) != i {
+			return i, nil
+		}
+		return int(i), nil
+	case SCHEMA_TYPE_NUMBER:
+		f, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil {
+			return nil, errors.Errorf("%v is not a number", raw)
+		}
+		return f, nil
+	case SCHEMA_TYPE_LIST:
+		if strings.HasPrefix(trimmed, "[") {
+			list := []interface{}{}
+			err := json.Unmarshal([]byte(trimmed), &list)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error parsing JSON list")
+			}
+			for i, element := range list {
+				list[i], err = convertEnvListElement(element, itemsType)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		}
+		list := []interface{}{}
+		if trimmed == "" {
+			return list, nil
+		}
+		reader := csv.NewReader(strings.NewReader(raw))
+		reader.TrimLeadingSpace = true
+		record, err := reader.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing list")
+		}
+		for _, element := range record {
+			value, err := convertEnvValue(element, itemsType, "")
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case SCHEMA_TYPE_MAP:
+		m := map[string]interface{}{}
+		err := json.Unmarshal([]byte(trimmed), &m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing JSON map")
+		}
+		return m, nil
+	}
+
+	if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+		var value interface{}
+		if err := json.Unmarshal([]byte(trimmed), &value); err == nil {
+			return value, nil
+		}
+	}
+	return iniMapHelperValue(raw), nil
+
+}
+
+// Converts an element of a JSON list to the type of the elements, as the
+// comma separated values are
+func convertEnvListElement(element interface{}, itemsType string) (interface{}, error) {
+	if itemsType == "" || itemsType == SCHEMA_TYPE_ANY {
+		return element, nil
+	}
+	if w, ok := element.(string); ok {
+		return convertEnvValue(w, itemsType, "")
+	}
+	data, err := json.Marshal(element)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error converting list element %v", element)
+	}
+	return convertEnvValue(string(data), itemsType, "")
+}
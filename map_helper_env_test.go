@@ -0,0 +1,138 @@
+package goutils
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Sets the variables, and returns the function that unsets them
+func setTestEnvironment(t *testing.T, variables map[string]string) func() {
+	for k, v := range variables {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k := range variables {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestMapHelperEnvBindingVariableName(t *testing.T) {
+	b := NewMapHelperEnvBinding("app")
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"proxy", "port"}, "APP_PROXY__PORT"},
+		{[]string{"maxRetries"}, "APP_MAXRETRIES"},
+		{[]string{"log-level"}, "APP_LOG_LEVEL"},
+		{[]string{"servers", "0", "host"}, "APP_SERVERS__0__HOST"},
+	}
+	for _, test := range tests {
+		if name := b.VariableName(test.keys); name != test.want {
+			t.Errorf("Unexpected name %v of %v, want %v", name, test.keys, test.want)
+		}
+	}
+}
+
+func TestMapHelperEnvBindingApply(t *testing.T) {
+
+	schema := NewMapSchema().
+		AddProperty("proxy", ProxySchema).
+		AddProperty("name", NewStringSchema(""))
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		reference map[string]interface{}
+		path      string
+		want      interface{}
+		err       bool
+	}{
+		{"Int of the reference", map[string]string{"APP_PORT": "9090"}, map[string]interface{}{"port": 8080}, "port", 9090, false},
+		{"Fraction for an int", map[string]string{"APP_PORT": "9090.5"}, map[string]interface{}{"port": 8080}, "", nil, true},
+		{"Not a number", map[string]string{"APP_PORT": "x"}, map[string]interface{}{"port": 8080}, "", nil, true},
+		{"Int of the schema", map[string]string{"APP_PROXY__PORT": "3128"}, nil, "proxy.port", 3128, false},
+		{"Fraction for an int of the schema", map[string]string{"APP_PROXY__PORT": "3128.5"}, nil, "", nil, true},
+		{"Number of the reference", map[string]string{"APP_RATIO": "2"}, map[string]interface{}{"ratio": 0.5}, "ratio", 2.0, false},
+		{"String of the schema", map[string]string{"APP_NAME": "0123"}, nil, "name", "0123", false},
+		{"Key case of the reference", map[string]string{"APP_MAXRETRIES": "5"}, map[string]interface{}{"maxRetries": 1}, "maxRetries", 5, false},
+		{"Key case of nested maps", map[string]string{"APP_HTTP__PROXYURL": "http://proxy"}, map[string]interface{}{"Http": map[string]interface{}{"proxyUrl": ""}}, "Http.proxyUrl", "http://proxy", false},
+		{"Unknown key", map[string]string{"APP_DEBUG": "true"}, nil, "debug", true, false},
+		{"CSV list", map[string]string{"APP_PROXY__EXCEPTIONS": `localhost, "a,b"`}, nil, "proxy.exceptions", []interface{}{"localhost", "a,b"}, false},
+		{"CSV list of ints", map[string]string{"APP_PORTS": "80, 443"}, map[string]interface{}{"ports": []int{1}}, "ports", []interface{}{80, 443}, false},
+		{"JSON list of ints", map[string]string{"APP_PORTS": `[80, "443"]`}, map[string]interface{}{"ports": []interface{}{1}}, "ports", []interface{}{80, 443}, false},
+		{"JSON list with fractions for ints", map[string]string{"APP_PORTS": "[80.5]"}, map[string]interface{}{"ports": []interface{}{1}}, "", nil, true},
+		{"JSON list of strings", map[string]string{"APP_PROXY__EXCEPTIONS": `["localhost", 10]`}, nil, "proxy.exceptions", []interface{}{"localhost", "10"}, false},
+		{"JSON map", map[string]string{"APP_LABELS": `{"a": "b"}`}, map[string]interface{}{"labels": map[string]interface{}{}}, "labels.a", "b", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setTestEnvironment(t, test.env)()
+			var reference *MapHelper
+			if test.reference != nil {
+				reference = NewMapHelperFromData(test.reference)
+			}
+			h, err := NewMapHelperEnvBinding("app").SetSchema(schema).Load(reference)
+			if test.err {
+				if err == nil {
+					t.Errorf("Invalid value loaded: %v", h.Data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, _ := h.LookupPath(test.path)
+			if !reflect.DeepEqual(value, test.want) {
+				t.Errorf("Unexpected value %#v, want %#v", value, test.want)
+			}
+		})
+	}
+
+}
+
+// Values are set in the path of the existing keys, whatever their case
+func TestMapHelperEnvBindingApplyKeys(t *testing.T) {
+	defer setTestEnvironment(t, map[string]string{"APP_PROXY__PORT": "3128", "APP_NAME": "test"})()
+	h := NewMapHelperFromData(map[string]interface{}{
+		"Proxy": map[string]interface{}{"Port": 80},
+	})
+	err := NewMapHelperEnvBinding("app").Apply(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"Proxy": map[string]interface{}{"Port": 3128},
+		"name":  "test",
+	}
+	if !reflect.DeepEqual(h.GenerateMap(), want) {
+		t.Errorf("Unexpected data %v, want %v", h.GenerateMap(), want)
+	}
+}
+
+func TestMapHelperEnvBindingVariables(t *testing.T) {
+	schema := NewMapSchema().
+		AddProperty("name", NewStringSchema("app").SetDescription("Name of the application")).
+		AddProperty("proxy", NewMapSchema().AddProperty("port", NewIntSchema(8080)))
+	reference := NewMapHelperFromData(map[string]interface{}{
+		"maxRetries": 3,
+		"ratio":      0.5,
+		"hosts":      []interface{}{"a"},
+	})
+	want := []MapHelperEnvVariable{
+		{Name: "APP_HOSTS", Path: "hosts", Type: SCHEMA_TYPE_LIST},
+		{Name: "APP_MAXRETRIES", Path: "maxRetries", Type: SCHEMA_TYPE_INT},
+		{Name: "APP_NAME", Path: "name", Type: SCHEMA_TYPE_STRING, Description: "Name of the application", Default: "app"},
+		{Name: "APP_PROXY__PORT", Path: "proxy.port", Type: SCHEMA_TYPE_INT, Default: 8080},
+		{Name: "APP_RATIO", Path: "ratio", Type: SCHEMA_TYPE_NUMBER},
+	}
+	variables := NewMapHelperEnvBinding("app").SetSchema(schema).Variables(reference)
+	if !reflect.DeepEqual(variables, want) {
+		t.Errorf("Unexpected variables %+v, want %+v", variables, want)
+	}
+}
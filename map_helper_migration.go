@@ -0,0 +1,224 @@
+package goutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const MAP_HELPER_VERSION_KEY = "version"
+
+// Returned (as the cause) when the config was written by a newer version of
+// the application, that may have changed it in ways this one doesn't know.
+var MapHelperNewerVersionError error
+
+func init() {
+	MapHelperNewerVersionError = errors.New("Configuration written by a newer version")
+}
+
+// Upgrades the config from the previous version to Version
+type MapHelperMigration struct {
+	Version     int
+	Description string
+	Migrate     func(h *MapHelper) error
+}
+
+// Result of Migrate; when dry run, the changes that would be made
+type MapHelperMigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	// Descriptions of the migrations applied
+	Applied []string
+	Changes []MapHelperChange
+	// Copy of the file before migrating it, if any
+	Backup string
+}
+
+// Upgrades configs written by previous versions of the application. The
+// version of the config is saved in VersionKey; configs without it are
+// version 0.
+type MapHelperMigrator struct {
+	VersionKey string
+	Migrations []*MapHelperMigration
+}
+
+func NewMapHelperMigrator() *MapHelperMigrator {
+	m := MapHelperMigrator{}
+	m.VersionKey = MAP_HELPER_VERSION_KEY
+	m.Migrations = []*MapHelperMigration{}
+	return &m
+}
+
+// Registers the migration to the version; they are applied in order of
+// version, whatever the order they are added. Returns the migrator, so they
+// can be chained.
+func (m *MapHelperMigrator) AddMigration(version int, description string, migrate func(h *MapHelper) error) *MapHelperMigrator {
+	m.Migrations = append(m.Migrations, &MapHelperMigration{Version: version, Description: description, Migrate: migrate})
+	sort.SliceStable(m.Migrations, func(i, j int) bool {
+		return m.Migrations[i].Version < m.Migrations[j].Version
+	})
+	return m
+}
+
+// Version of the last migration, written in the configs migrated
+func (m *MapHelperMigrator) CurrentVersion() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+func (m *MapHelperMigrator) GetVersion(h *MapHelper) int {
+	return h.GetPathInt(m.VersionKey, 0)
+}
+
+// Returns the migrations not applied yet to the config
+func (m *MapHelperMigrator) Pending(h *MapHelper) ([]*MapHelperMigration, error) {
+	version := m.GetVersion(h)
+	if version > m.CurrentVersion() {
+		return nil, errors.Wrapf(MapHelperNewerVersionError, "Version %v is newer than %v", version, m.CurrentVersion())
+	}
+	pending := []*MapHelperMigration{}
+	for i, migration := range m.Migrations {
+		if i > 0 && migration.Version == m.Migrations[i-1].Version {
+			return nil, errors.Errorf("Duplicated migration to version %v", migration.Version)
+		}
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Applies the pending migrations to a copy of the config; if all of them
+// succeed, and it is not a dry run, the config is replaced with the copy.
+// Configs with a file are saved, after copying the file to
+// <file>.v<version>.bak.
+func (m *MapHelperMigrator) Migrate(h *MapHelper, dryRun bool) (*MapHelperMigrationReport, error) {
+
+	pending, err := m.Pending(h)
+	if err != nil {
+		return nil, err
+	}
+
+	report := MapHelperMigrationReport{}
+	report.FromVersion = m.GetVersion(h)
+	report.ToVersion = report.FromVersion
+	report.Applied = []string{}
+	report.Changes = []MapHelperChange{}
+	if len(pending) == 0 {
+		return &report, nil
+	}
+
+	c := &MapHelper{Filename: h.Filename, Codec: h.Codec, Data: copyMapHelperData(h.Data)}
+	for _, migration := range pending {
+		err := migration.Migrate(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error migrating to version %v (%v)", migration.Version, migration.Description)
+		}
+		err = c.SetPath(m.VersionKey, migration.Version, true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error setting version %v", migration.Version)
+		}
+		report.ToVersion = migration.Version
+		report.Applied = append(report.Applied, migration.Description)
+	}
+
+	old, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return nil, err
+	}
+	new, err := mapHelperCanonicalData(c.GenerateMap())
+	if err != nil {
+		return nil, err
+	}
+	report.Changes = newMapHelperChanges(old, new)
+
+	if dryRun {
+		return &report, nil
+	}
+
+	if h.Filename != "" {
+		report.Backup, err = backupBeforeMigration(h.Filename, report.FromVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.Data = c.Data
+	if h.Filename != "" {
+		err = h.Save()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error saving migrated configuration")
+		}
+	}
+
+	Log.Infof("Configuration migrated from version %v to %v", report.FromVersion, report.ToVersion)
+	return &report, nil
+
+}
+
+// Loads the file as a document, and migrates it. If the file doesn't exist
+// (and failIfNotFound is false), the config is new, so it only gets the
+// current version; the file is not created until it is saved.
+func (m *MapHelperMigrator) Load(path string, failIfNotFound bool) (*MapHelper, error) {
+	exists, err := FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewMapHelperDocumentFromFile(path, failIfNotFound)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = h.SetPath(m.VersionKey, m.CurrentVersion(), true)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	_, err = m.Migrate(h, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error migrating %v", path)
+	}
+	return h, nil
+}
+
+// Moves the value in the path to the other one, creating the missing maps;
+// nothing is done if the path doesn't exist. Useful in migrations.
+func (h *MapHelper) MovePath(from string, to string) error {
+	value, exists := h.LookupPath(from)
+	if !exists {
+		return nil
+	}
+	err := h.DeletePath(from)
+	if err != nil {
+		return err
+	}
+	return h.SetPath(to, value, true)
+}
+
+// Returns the path of the backup, or an empty string if the file doesn't
+// exist yet.
+func backupBeforeMigration(path string, version int) (string, error) {
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "Error checking file %v", path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error reading file %v", path)
+	}
+	backup := fmt.Sprintf("%v.v%v.bak", path, version)
+	err = WriteFileAtomic(backup, content, stat.Mode().Perm())
+	if err != nil {
+		return "", errors.Wrapf(err, "Error creating backup of %v", path)
+	}
+	return backup, nil
+}
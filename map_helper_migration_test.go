@@ -0,0 +1,127 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestMapHelperMigrator() *MapHelperMigrator {
+	return NewMapHelperMigrator().
+		AddMigration(2, "Default timeout", func(h *MapHelper) error {
+			if !h.Exists("timeout") {
+				h.SetInt("timeout", 30)
+			}
+			return nil
+		}).
+		AddMigration(1, "Proxy keys", func(h *MapHelper) error {
+			err := h.MovePath("proxy_address", "proxy.address")
+			if err != nil {
+				return err
+			}
+			return h.MovePath("proxy_port", "proxy.port")
+		})
+}
+
+func TestMapHelperMigratorMigrate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	original := "name: app # Application\nproxy_address: proxy\nproxy_port: 3128\n"
+	err = ioutil.WriteFile(path, []byte(original), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestMapHelperMigrator()
+	h, err := NewMapHelperDocumentFromFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := m.Migrate(h, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FromVersion != 0 || report.ToVersion != 2 || len(report.Applied) != 2 || len(report.Changes) == 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if h.ExistsPath("proxy.port") {
+		t.Errorf("Config migrated in a dry run")
+	}
+
+	h, err = m.Load(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.GetPathInt("proxy.port", 0) != 3128 || h.GetInt("timeout", 0) != 30 || m.GetVersion(h) != 2 {
+		t.Errorf("Unexpected migrated config %v", h.Data)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# Application") || !strings.Contains(string(data), "version: 2") {
+		t.Errorf("Unexpected migrated file:\n%s", data)
+	}
+	backup, err := ioutil.ReadFile(path + ".v0.bak")
+	if err != nil || string(backup) != original {
+		t.Errorf("Unexpected backup %q: %v", backup, err)
+	}
+
+	h.SetInt("version", 5)
+	_, err = m.Migrate(h, false)
+	if errors.Cause(err) != MapHelperNewerVersionError {
+		t.Errorf("Unexpected error migrating a newer version: %v", err)
+	}
+
+}
+
+func TestMapHelperMigratorLoad(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newTestMapHelperMigrator()
+
+	// New files are not created, not even their directory
+	path := filepath.Join(dir, "app", "config.json")
+	h, err := m.Load(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.GetVersion(h) != 2 || h.Exists("timeout") {
+		t.Errorf("Unexpected new config %v", h.Data)
+	}
+	if exists, _ := DirExists(filepath.Dir(path)); exists {
+		t.Errorf("Directory of a new config created when loading it")
+	}
+	_, err = m.Load(path, true)
+	if err == nil {
+		t.Errorf("Missing file loaded")
+	}
+
+	// Existing files without data are migrated, as they are version 0
+	path = filepath.Join(dir, "empty.json")
+	err = ioutil.WriteFile(path, []byte("{}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = m.Load(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.GetVersion(h) != 2 || h.GetInt("timeout", 0) != 30 {
+		t.Errorf("Unexpected migrated empty config %v", h.Data)
+	}
+
+}
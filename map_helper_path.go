@@ -0,0 +1,461 @@
+package goutils
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Element of a path; Index is true when it was written between brackets.
+type MapHelperPathElement struct {
+	Key   string
+	Index bool
+}
+
+// Splits a path in its elements. Paths starting with "/" (and the empty
+// path) are JSON pointers (RFC 6901), where "-" means the end of a list;
+// the rest are dotted paths like "proxy.exceptions[2]", where ".", "[" and
+// "\" can be escaped with "\".
+func ParseMapHelperPath(path string) ([]MapHelperPathElement, error) {
+
+	elements := []MapHelperPathElement{}
+	if path == "" {
+		return elements, nil
+	}
+
+	if strings.HasPrefix(path, "/") {
+		for _, token := range strings.Split(path[1:], "/") {
+			token = strings.Replace(token, "~1", "/", -1)
+			token = strings.Replace(token, "~0", "~", -1)
+			elements = append(elements, MapHelperPathElement{Key: token})
+		}
+		return elements, nil
+	}
+
+	current := []rune{}
+	pendingKey := true
+	inIndex := false
+	escaped := false
+	for _, c := range path {
+		if escaped {
+			current = append(current, c)
+			escaped = false
+			continue
+		}
+		if inIndex {
+			if c == ']' {
+				if _, err := strconv.Atoi(string(current)); err != nil {
+					return nil, errors.Errorf("Invalid index %v in path %v", string(current), path)
+				}
+				elements = append(elements, MapHelperPathElement{Key: string(current), Index: true})
+				current = []rune{}
+				inIndex = false
+			} else {
+				current = append(current, c)
+			}
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '.', '[':
+			if pendingKey {
+				if len(current) == 0 {
+					return nil, errors.Errorf("Empty key in path %v", path)
+				}
+				elements = append(elements, MapHelperPathElement{Key: string(current)})
+				current = []rune{}
+			}
+			pendingKey = c == '.'
+			inIndex = c == '['
+		default:
+			if !pendingKey {
+				return nil, errors.Errorf("Missing dot after index in path %v", path)
+			}
+			current = append(current, c)
+		}
+	}
+	if inIndex || escaped {
+		return nil, errors.Errorf("Unterminated path %v", path)
+	}
+	if pendingKey {
+		if len(current) == 0 {
+			return nil, errors.Errorf("Empty key in path %v", path)
+		}
+		elements = append(elements, MapHelperPathElement{Key: string(current)})
+	}
+
+	return elements, nil
+
+}
+
+// Returns the dotted path of the elements, escaping the keys as needed
+func FormatMapHelperPath(elements []MapHelperPathElement) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `.`, `\.`, `[`, `\[`)
+	path := ""
+	for _, e := range elements {
+		if e.Index {
+			path += "[" + e.Key + "]"
+			continue
+		}
+		if path != "" {
+			path += "."
+		}
+		path += escaper.Replace(e.Key)
+	}
+	return path
+}
+
+// Returns the value in the path, without modifying the helper; nested
+// helpers, maps and lists are traversed.
+func (h *MapHelper) LookupPath(path string) (interface{}, bool) {
+	elements, err := ParseMapHelperPath(path)
+	if err != nil {
+		Log.Debugf("Error parsing path: %v", err)
+		return nil, false
+	}
+	var node interface{} = h
+	for _, e := range elements {
+		var ok bool
+		node, ok = mapHelperPathChild(node, e)
+		if !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+func (h *MapHelper) ExistsPath(path string) bool {
+	_, ok := h.LookupPath(path)
+	return ok
+}
+
+func (h *MapHelper) GetPath(path string, value interface{}) interface{} {
+	if val, ok := h.LookupPath(path); ok {
+		return val
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathBoolean(path string, value bool) bool {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperBoolean(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathInt(path string, value int) int {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperInt(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathInt64(path string, value int64) int64 {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperInt64(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathFloat64(path string, value float64) float64 {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperFloat64(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathDuration(path string, value time.Duration) time.Duration {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperDuration(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathTime(path string, value time.Time) time.Time {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperTime(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathUrl(path string, value *url.URL) *url.URL {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperUrl(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathString(path string, value string) string {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperString(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathListOfStrings(path string, value []string) []string {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperListOfStrings(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathListOfInts(path string, value []int) []int {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperListOfInts(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathMapOfStrings(path string, value map[string]string) map[string]string {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperMapOfStrings(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+func (h *MapHelper) GetPathList(path string, value []interface{}) []interface{} {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperList(val); ok {
+			return w
+		}
+	}
+	return value
+}
+
+// Unlike GetHelper, returns nil if the path doesn't exist or is not a map;
+// the returned helper shares the data with this one.
+func (h *MapHelper) GetPathHelper(path string) *MapHelper {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := val.(*MapHelper); ok {
+			return w
+		} else if w, ok := val.(map[string]interface{}); ok {
+			return NewMapHelperFromData(w)
+		}
+	}
+	return nil
+}
+
+func (h *MapHelper) GetPathListOfHelpers(path string) []*MapHelper {
+	if val, ok := h.LookupPath(path); ok {
+		if w, ok := mapHelperListOfHelpers(val); ok {
+			return w
+		}
+	}
+	return []*MapHelper{}
+}
+
+// Sets the value in the path. If create is true, the missing maps and lists
+// in the path are created; if not, an error is returned. An index equal to
+// the length of a list (or "-" in JSON pointers) appends the value.
+func (h *MapHelper) SetPath(path string, value interface{}, create bool) error {
+	elements, err := ParseMapHelperPath(path)
+	if err != nil {
+		return err
+	}
+	if len(elements) == 0 {
+		return errors.New("Empty path")
+	}
+	_, err = mapHelperPathUpdate(h, elements, path, func(parent interface{}, e MapHelperPathElement) (interface{}, error) {
+		return mapHelperPathSetChild(parent, e, value)
+	}, create)
+	return err
+}
+
+// Removes the key or list element in the path; nothing is done if the path
+// doesn't exist.
+func (h *MapHelper) DeletePath(path string) error {
+	elements, err := ParseMapHelperPath(path)
+	if err != nil {
+		return err
+	}
+	if len(elements) == 0 {
+		return errors.New("Empty path")
+	}
+	if !h.ExistsPath(path) {
+		return nil
+	}
+	_, err = mapHelperPathUpdate(h, elements, path, mapHelperPathDeleteChild, false)
+	return err
+}
+
+// Traverses the path, and applies the update to the parent of the last
+// element; lists may be replaced when they grow or shrink, so the parents
+// are updated with the value returned for their child.
+func mapHelperPathUpdate(node interface{}, elements []MapHelperPathElement, path string, update func(interface{}, MapHelperPathElement) (interface{}, error), create bool) (interface{}, error) {
+
+	e := elements[0]
+	if len(elements) == 1 {
+		return update(node, e)
+	}
+
+	child, ok := mapHelperPathChild(node, e)
+	if !ok || child == nil {
+		if !create {
+			return nil, errors.Errorf("Path %v not found", path)
+		}
+		if elements[1].Index || elements[1].Key == "-" {
+			child = []interface{}{}
+		} else {
+			child = map[string]interface{}{}
+		}
+	}
+
+	newChild, err := mapHelperPathUpdate(child, elements[1:], path, update, create)
+	if err != nil {
+		return nil, err
+	}
+	return mapHelperPathSetChild(node, e, newChild)
+
+}
+
+func mapHelperPathChild(node interface{}, e MapHelperPathElement) (interface{}, bool) {
+
+	switch w := node.(type) {
+	case *MapHelper:
+		val, ok := w.Data[e.Key]
+		return val, ok
+	case map[string]interface{}:
+		val, ok := w[e.Key]
+		return val, ok
+	}
+
+	v := reflect.ValueOf(node)
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		val := v.MapIndex(reflect.ValueOf(e.Key).Convert(v.Type().Key()))
+		if !val.IsValid() {
+			return nil, false
+		}
+		return val.Interface(), true
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(e.Key)
+		if err != nil || i < 0 || i >= v.Len() {
+			return nil, false
+		}
+		return v.Index(i).Interface(), true
+	}
+
+	return nil, false
+
+}
+
+// Sets the child of the node, and returns the node, that is a new one when a
+// value is appended to a list.
+func mapHelperPathSetChild(node interface{}, e MapHelperPathElement, value interface{}) (interface{}, error) {
+
+	switch w := node.(type) {
+	case *MapHelper:
+		w.Data[e.Key] = value
+		return w, nil
+	case map[string]interface{}:
+		w[e.Key] = value
+		return w, nil
+	}
+
+	v := reflect.ValueOf(node)
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, errors.Errorf("Can't set key %v in a %v", e.Key, v.Type())
+		}
+		val, err := mapHelperPathValueFor(v.Type().Elem(), value)
+		if err != nil {
+			return nil, err
+		}
+		v.SetMapIndex(reflect.ValueOf(e.Key).Convert(v.Type().Key()), val)
+		return node, nil
+	case reflect.Slice:
+		val, err := mapHelperPathValueFor(v.Type().Elem(), value)
+		if err != nil {
+			return nil, err
+		}
+		if e.Key == "-" {
+			return reflect.Append(v, val).Interface(), nil
+		}
+		i, err := strconv.Atoi(e.Key)
+		if err != nil || i < 0 || i > v.Len() {
+			return nil, errors.Errorf("Invalid index %v for a list of %v elements", e.Key, v.Len())
+		}
+		if i == v.Len() {
+			return reflect.Append(v, val).Interface(), nil
+		}
+		v.Index(i).Set(val)
+		return node, nil
+	}
+
+	return nil, errors.Errorf("Can't set %v in a %T", e.Key, node)
+
+}
+
+func mapHelperPathDeleteChild(node interface{}, e MapHelperPathElement) (interface{}, error) {
+
+	switch w := node.(type) {
+	case *MapHelper:
+		delete(w.Data, e.Key)
+		return w, nil
+	case map[string]interface{}:
+		delete(w, e.Key)
+		return w, nil
+	}
+
+	v := reflect.ValueOf(node)
+	switch v.Kind() {
+	case reflect.Map:
+		v.SetMapIndex(reflect.ValueOf(e.Key).Convert(v.Type().Key()), reflect.Value{})
+		return node, nil
+	case reflect.Slice:
+		i, err := strconv.Atoi(e.Key)
+		if err != nil || i < 0 || i >= v.Len() {
+			return nil, errors.Errorf("Invalid index %v for a list of %v elements", e.Key, v.Len())
+		}
+		// A new list, as the old one may be shared
+		newList := reflect.MakeSlice(v.Type(), 0, v.Len()-1)
+		newList = reflect.AppendSlice(newList, v.Slice(0, i))
+		newList = reflect.AppendSlice(newList, v.Slice(i+1, v.Len()))
+		return newList.Interface(), nil
+	}
+
+	return nil, errors.Errorf("Can't delete %v from a %T", e.Key, node)
+
+}
+
+func mapHelperPathValueFor(t reflect.Type, value interface{}) (reflect.Value, error) {
+	if value == nil {
+		return reflect.Zero(t), nil
+	}
+	v := reflect.ValueOf(value)
+	if !v.Type().AssignableTo(t) {
+		return reflect.Value{}, errors.Errorf("Can't set a %T in a list or map of %v", value, t)
+	}
+	return v, nil
+}
@@ -0,0 +1,150 @@
+package goutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseMapHelperPath(t *testing.T) {
+
+	tests := []struct {
+		path string
+		want []MapHelperPathElement
+	}{
+		{"", []MapHelperPathElement{}},
+		{"proxy", []MapHelperPathElement{{Key: "proxy"}}},
+		{"proxy.exceptions[2]", []MapHelperPathElement{{Key: "proxy"}, {Key: "exceptions"}, {Key: "2", Index: true}}},
+		{"list[0][1].name", []MapHelperPathElement{{Key: "list"}, {Key: "0", Index: true}, {Key: "1", Index: true}, {Key: "name"}}},
+		{`a\.b.c\[0\]\\`, []MapHelperPathElement{{Key: "a.b"}, {Key: `c[0]\`}}},
+		{"/", []MapHelperPathElement{{Key: ""}}},
+		{"/proxy/exceptions/2", []MapHelperPathElement{{Key: "proxy"}, {Key: "exceptions"}, {Key: "2"}}},
+		{"/a~1b/~0c/-", []MapHelperPathElement{{Key: "a/b"}, {Key: "~c"}, {Key: "-"}}},
+	}
+	for _, test := range tests {
+		elements, err := ParseMapHelperPath(test.path)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(elements, test.want) {
+			t.Errorf("Unexpected elements %v of %v, want %v", elements, test.path, test.want)
+		}
+	}
+
+	for _, path := range []string{"a..b", ".a", "a.", "a[x]", "a[1", "a[1]b", `a\`} {
+		if elements, err := ParseMapHelperPath(path); err == nil {
+			t.Errorf("Invalid path %v parsed as %v", path, elements)
+		}
+	}
+
+}
+
+func newTestPathMapHelper(t *testing.T) *MapHelper {
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"proxy": {"port": 3128, "exceptions": ["a", "b", "c"], "a.b": 1, "x/y": {"~": 2}},
+		"list": [{"n": 1}, {"n": 2}]
+	}`), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMapHelperFromData(data)
+}
+
+func TestMapHelperLookupPath(t *testing.T) {
+
+	h := newTestPathMapHelper(t)
+	// Nested helpers are traversed too
+	h.GetHelper("proxy")
+
+	tests := []struct {
+		path   string
+		want   interface{}
+		exists bool
+	}{
+		{"proxy.port", 3128.0, true},
+		{"proxy.exceptions[2]", "c", true},
+		{"/proxy/exceptions/1", "b", true},
+		{`proxy.a\.b`, 1.0, true},
+		{"/proxy/x~1y/~0", 2.0, true},
+		{"list[1].n", 2.0, true},
+		{"proxy.exceptions[3]", nil, false},
+		{"proxy.exceptions.x", nil, false},
+		{"proxy.port.x", nil, false},
+		{"missing.x", nil, false},
+		{"a..b", nil, false},
+	}
+	for _, test := range tests {
+		value, exists := h.LookupPath(test.path)
+		if exists != test.exists || !reflect.DeepEqual(value, test.want) {
+			t.Errorf("Unexpected value %v (%v) of %v, want %v", value, exists, test.path, test.want)
+		}
+	}
+
+	if h.GetPathInt("proxy.port", 0) != 3128 || h.GetPathString("proxy.nope", "d") != "d" {
+		t.Errorf("Unexpected values of the getters")
+	}
+	if helpers := h.GetPathListOfHelpers("list"); len(helpers) != 2 || helpers[1].GetInt("n", 0) != 2 {
+		t.Errorf("Unexpected helpers %v", helpers)
+	}
+	if h.GetPathHelper("missing") != nil || h.Exists("missing") {
+		t.Errorf("Lookup of a missing helper created it")
+	}
+
+}
+
+func TestMapHelperSetPath(t *testing.T) {
+
+	h := newTestPathMapHelper(t)
+	h.SetListOfStrings("strings", []string{"x"})
+
+	tests := []struct {
+		path   string
+		value  interface{}
+		create bool
+		err    bool
+	}{
+		{"a.b.c", 1, false, true},
+		{"a.b[0].c", 1, true, false},
+		{"a.b[2]", 1, true, true},
+		{"proxy.exceptions[3]", "d", false, false},
+		{"/proxy/exceptions/-", "e", false, false},
+		{"proxy.exceptions[0]", "z", false, false},
+		{"proxy.port.x", 1, true, true},
+		{"strings[1]", "y", false, false},
+		{"strings[2]", 3, false, true},
+		{"a[", 1, true, true},
+	}
+	for _, test := range tests {
+		err := h.SetPath(test.path, test.value, test.create)
+		if (err != nil) != test.err {
+			t.Errorf("Unexpected error setting %v: %v", test.path, err)
+		}
+	}
+
+	if err := h.DeletePath("proxy.exceptions[1]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DeletePath("list[0]"); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting a missing path does nothing
+	if err := h.DeletePath("missing.x"); err != nil {
+		t.Errorf("Error deleting a missing path: %v", err)
+	}
+	if err := h.DeletePath(""); err == nil {
+		t.Errorf("Empty path deleted")
+	}
+
+	want := map[string]interface{}{
+		"proxy":   map[string]interface{}{"port": 3128.0, "exceptions": []interface{}{"z", "c", "d", "e"}, "a.b": 1.0, "x/y": map[string]interface{}{"~": 2.0}},
+		"list":    []interface{}{map[string]interface{}{"n": 2.0}},
+		"a":       map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": 1}}},
+		"strings": []string{"x", "y"},
+	}
+	if data := h.GenerateMap(); !reflect.DeepEqual(data, want) {
+		t.Errorf("Unexpected data %v, want %v", data, want)
+	}
+
+}
@@ -0,0 +1,360 @@
+package goutils
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const SCHEMA_TYPE_ANY = "any"
+const SCHEMA_TYPE_STRING = "string"
+const SCHEMA_TYPE_BOOLEAN = "boolean"
+const SCHEMA_TYPE_INT = "int"
+const SCHEMA_TYPE_NUMBER = "number"
+const SCHEMA_TYPE_LIST = "list"
+const SCHEMA_TYPE_MAP = "map"
+
+// Declares the type, default value and restrictions of a value of a
+// MapHelper; maps declare their keys in Properties, and lists their
+// elements in Items.
+type MapHelperSchema struct {
+	// One of the SCHEMA_TYPE_ constants
+	Type        string
+	Description string
+	// Set by ApplyDefaults when the key doesn't exist
+	Default  interface{}
+	Required bool
+	// The value can be nil
+	Nullable bool
+	// Allowed values
+	Enum []interface{}
+	// Limits of numbers
+	Minimum *float64
+	Maximum *float64
+	// Strings must match it
+	Pattern    *regexp.Regexp
+	Items      *MapHelperSchema
+	Properties map[string]*MapHelperSchema
+	// Keys not in Properties are reported as violations
+	Strict bool
+}
+
+// Value that doesn't match the schema; the path is in the format of
+// ParseMapHelperPath.
+type MapHelperSchemaViolation struct {
+	Path    string
+	Message string
+}
+
+// Returned by Validate, with all the violations found
+type MapHelperSchemaError struct {
+	Violations []MapHelperSchemaViolation
+}
+
+func (e *MapHelperSchemaError) Error() string {
+	messages := []string{}
+	for _, v := range e.Violations {
+		messages = append(messages, fmt.Sprintf("%v: %v", v.Path, v.Message))
+	}
+	return fmt.Sprintf("Invalid configuration (%v errors): %v", len(e.Violations), strings.Join(messages, "; "))
+}
+
+func NewMapHelperSchema(schemaType string) *MapHelperSchema {
+	s := MapHelperSchema{}
+	s.Type = schemaType
+	s.Properties = map[string]*MapHelperSchema{}
+	return &s
+}
+
+func NewStringSchema(defaultValue string) *MapHelperSchema {
+	return NewMapHelperSchema(SCHEMA_TYPE_STRING).SetDefault(defaultValue)
+}
+
+func NewBooleanSchema(defaultValue bool) *MapHelperSchema {
+	return NewMapHelperSchema(SCHEMA_TYPE_BOOLEAN).SetDefault(defaultValue)
+}
+
+func NewIntSchema(defaultValue int) *MapHelperSchema {
+	return NewMapHelperSchema(SCHEMA_TYPE_INT).SetDefault(defaultValue)
+}
+
+func NewNumberSchema(defaultValue float64) *MapHelperSchema {
+	return NewMapHelperSchema(SCHEMA_TYPE_NUMBER).SetDefault(defaultValue)
+}
+
+func NewListSchema(items *MapHelperSchema) *MapHelperSchema {
+	s := NewMapHelperSchema(SCHEMA_TYPE_LIST)
+	s.Items = items
+	return s
+}
+
+// A list of strings, that is empty by default
+func NewListOfStringsSchema() *MapHelperSchema {
+	return NewListSchema(NewMapHelperSchema(SCHEMA_TYPE_STRING)).SetDefault([]string{})
+}
+
+func NewMapSchema() *MapHelperSchema {
+	return NewMapHelperSchema(SCHEMA_TYPE_MAP)
+}
+
+// The setters return the schema, so they can be chained
+
+func (s *MapHelperSchema) SetDefault(value interface{}) *MapHelperSchema {
+	s.Default = value
+	return s
+}
+
+func (s *MapHelperSchema) SetDescription(description string) *MapHelperSchema {
+	s.Description = description
+	return s
+}
+
+func (s *MapHelperSchema) SetRequired() *MapHelperSchema {
+	s.Required = true
+	s.Default = nil
+	return s
+}
+
+func (s *MapHelperSchema) SetNullable() *MapHelperSchema {
+	s.Nullable = true
+	return s
+}
+
+func (s *MapHelperSchema) SetEnum(values ...interface{}) *MapHelperSchema {
+	s.Enum = values
+	return s
+}
+
+func (s *MapHelperSchema) SetRange(minimum float64, maximum float64) *MapHelperSchema {
+	s.Minimum = &minimum
+	s.Maximum = &maximum
+	return s
+}
+
+func (s *MapHelperSchema) SetPattern(pattern string) *MapHelperSchema {
+	s.Pattern = regexp.MustCompile(pattern)
+	return s
+}
+
+func (s *MapHelperSchema) SetStrict() *MapHelperSchema {
+	s.Strict = true
+	return s
+}
+
+func (s *MapHelperSchema) AddProperty(key string, property *MapHelperSchema) *MapHelperSchema {
+	s.Properties[key] = property
+	return s
+}
+
+// Returns the schema of the value in the path, or nil if not declared
+func (s *MapHelperSchema) GetPathSchema(path string) *MapHelperSchema {
+	elements, err := ParseMapHelperPath(path)
+	if err != nil {
+		return nil
+	}
+	for _, e := range elements {
+		if s.Type == SCHEMA_TYPE_LIST {
+			s = s.Items
+		} else {
+			s = s.Properties[e.Key]
+		}
+		if s == nil {
+			return nil
+		}
+	}
+	return s
+}
+
+// Sets the defaults of the missing keys, also in the maps inside lists;
+// missing maps without default are not created.
+func (s *MapHelperSchema) ApplyDefaults(h *MapHelper) {
+	s.applyDefaults(h, []string{})
+}
+
+func (s *MapHelperSchema) applyDefaults(h *MapHelper, path []string) {
+
+	value, exists := h.LookupPath(mapHelperJsonPointer(path))
+
+	if !exists {
+		if s.Default != nil {
+			defaultValue, err := mapHelperCanonicalData(map[string]interface{}{"v": s.Default})
+			if err == nil {
+				h.SetPath(mapHelperJsonPointer(path), defaultValue["v"], true)
+			}
+		} else {
+			return
+		}
+		value, _ = h.LookupPath(mapHelperJsonPointer(path))
+	}
+
+	child := func(k string) []string {
+		return append(append([]string{}, path...), k)
+	}
+	switch s.Type {
+	case SCHEMA_TYPE_MAP:
+		if _, ok := mapHelperSchemaMap(value); ok {
+			for _, k := range sortedSchemaKeys(s.Properties) {
+				s.Properties[k].applyDefaults(h, child(k))
+			}
+		}
+	case SCHEMA_TYPE_LIST:
+		if list, ok := mapHelperList(value); ok && s.Items != nil {
+			for i := range list {
+				s.Items.applyDefaults(h, child(strconv.Itoa(i)))
+			}
+		}
+	}
+
+}
+
+// Returns a *MapHelperSchemaError with every value that doesn't match the
+// schema, or nil if the helper is valid.
+func (s *MapHelperSchema) Validate(h *MapHelper) error {
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return &MapHelperSchemaError{Violations: []MapHelperSchemaViolation{{Path: "", Message: err.Error()}}}
+	}
+	violations := s.validate(data, []MapHelperPathElement{})
+	if len(violations) > 0 {
+		return &MapHelperSchemaError{Violations: violations}
+	}
+	return nil
+}
+
+// Applies the defaults, and validates the helper
+func (s *MapHelperSchema) Load(h *MapHelper) error {
+	s.ApplyDefaults(h)
+	return s.Validate(h)
+}
+
+// Returns a copy of the helper with the defaults applied
+func (s *MapHelperSchema) WithDefaults(h *MapHelper) *MapHelper {
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		Log.Debugf("Error copying map: %v", err)
+		data = map[string]interface{}{}
+	}
+	c := NewMapHelperFromData(data)
+	s.ApplyDefaults(c)
+	return c
+}
+
+func (s *MapHelperSchema) validate(value interface{}, path []MapHelperPathElement) []MapHelperSchemaViolation {
+
+	violations := []MapHelperSchemaViolation{}
+	violation := func(format string, args ...interface{}) []MapHelperSchemaViolation {
+		return append(violations, MapHelperSchemaViolation{Path: FormatMapHelperPath(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if value == nil {
+		if s.Nullable || s.Type == SCHEMA_TYPE_ANY {
+			return violations
+		}
+		return violation("can't be null")
+	}
+
+	switch s.Type {
+	case SCHEMA_TYPE_STRING:
+		w, ok := value.(string)
+		if !ok {
+			return violation("must be a string")
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(w) {
+			violations = violation("doesn't match %v", s.Pattern)
+		}
+	case SCHEMA_TYPE_BOOLEAN:
+		if _, ok := value.(bool); !ok {
+			return violation("must be a boolean")
+		}
+	case SCHEMA_TYPE_INT, SCHEMA_TYPE_NUMBER:
+		w, ok := value.(float64)
+		if i, isInt := value.(int64); isInt {
+			// Integers too big for float64
+			w, ok = float64(i), true
+		}
+		if !ok {
+			return violation("must be a number")
+		}
+		if s.Type == SCHEMA_TYPE_INT && w != math.Trunc(w) {
+			return violation("must be an integer")
+		}
+		if s.Minimum != nil && w < *s.Minimum {
+			violations = violation("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && w > *s.Maximum {
+			violations = violation("must be at most %v", *s.Maximum)
+		}
+	case SCHEMA_TYPE_LIST:
+		list, ok := value.([]interface{})
+		if !ok {
+			return violation("must be a list")
+		}
+		if s.Items != nil {
+			for i, v := range list {
+				violations = append(violations, s.Items.validate(v, append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: strconv.Itoa(i), Index: true}))...)
+			}
+		}
+	case SCHEMA_TYPE_MAP:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return violation("must be a map")
+		}
+		for _, k := range sortedSchemaKeys(s.Properties) {
+			child := append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: k})
+			if v, ok := m[k]; ok {
+				violations = append(violations, s.Properties[k].validate(v, child)...)
+			} else if s.Properties[k].Required {
+				violations = append(violations, MapHelperSchemaViolation{Path: FormatMapHelperPath(child), Message: "is required"})
+			}
+		}
+		if s.Strict {
+			keys := []string{}
+			for k := range m {
+				if _, ok := s.Properties[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				violations = append(violations, MapHelperSchemaViolation{Path: FormatMapHelperPath(append(append([]MapHelperPathElement{}, path...), MapHelperPathElement{Key: k})), Message: "unknown key"})
+			}
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			canonical, err := mapHelperCanonicalData(map[string]interface{}{"v": e})
+			if err == nil && reflect.DeepEqual(canonical["v"], value) {
+				found = true
+			}
+		}
+		if !found {
+			violations = violation("must be one of %v", s.Enum)
+		}
+	}
+
+	return violations
+
+}
+
+func mapHelperSchemaMap(value interface{}) (map[string]interface{}, bool) {
+	if w, ok := value.(*MapHelper); ok {
+		return w.Data, true
+	}
+	w, ok := value.(map[string]interface{})
+	return w, ok
+}
+
+func sortedSchemaKeys(properties map[string]*MapHelperSchema) []string {
+	keys := []string{}
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
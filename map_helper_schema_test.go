@@ -0,0 +1,90 @@
+package goutils
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMapHelperSchemaValidate(t *testing.T) {
+
+	schema := NewMapSchema().
+		AddProperty("name", NewStringSchema("app").SetPattern("^[a-z]+$")).
+		AddProperty("port", NewIntSchema(8080).SetRange(1, 65535)).
+		AddProperty("ratio", NewNumberSchema(0.5)).
+		AddProperty("mode", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetRequired().SetEnum("a", "b")).
+		AddProperty("parent", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetNullable()).
+		AddProperty("tags", NewListOfStringsSchema())
+
+	tests := []struct {
+		name  string
+		data  map[string]interface{}
+		paths []string
+	}{
+		{"Valid", map[string]interface{}{"mode": "a"}, []string{}},
+		{"Required", map[string]interface{}{}, []string{"mode"}},
+		{"Enum", map[string]interface{}{"mode": "c"}, []string{"mode"}},
+		{"Pattern", map[string]interface{}{"mode": "a", "name": "App1"}, []string{"name"}},
+		{"Fraction for an int", map[string]interface{}{"mode": "a", "port": 80.5}, []string{"port"}},
+		{"Out of range", map[string]interface{}{"mode": "a", "port": 70000}, []string{"port"}},
+		{"Big integer out of range", map[string]interface{}{"mode": "a", "port": int64(1) << 60}, []string{"port"}},
+		{"Int for a number", map[string]interface{}{"mode": "a", "ratio": 1}, []string{}},
+		{"String for an int", map[string]interface{}{"mode": "a", "port": "80"}, []string{"port"}},
+		{"Null", map[string]interface{}{"mode": "a", "parent": nil, "name": nil}, []string{"name"}},
+		{"Element of a list", map[string]interface{}{"mode": "a", "tags": []interface{}{"a", 3}}, []string{"tags[1]"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewMapHelperFromData(test.data)
+			err := schema.Load(h)
+			paths := []string{}
+			if err != nil {
+				schemaErr, ok := err.(*MapHelperSchemaError)
+				if !ok {
+					t.Fatalf("Unexpected error type %T", err)
+				}
+				for _, v := range schemaErr.Violations {
+					paths = append(paths, v.Path)
+				}
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.paths) {
+				t.Errorf("Unexpected violations %v (%v), want %v", paths, err, test.paths)
+			}
+		})
+	}
+
+}
+
+func TestMapHelperSchemaDefaults(t *testing.T) {
+
+	schema := NewMapSchema().
+		AddProperty("proxy", ProxySchema).
+		AddProperty("servers", NewListSchema(NewMapSchema().AddProperty("port", NewIntSchema(22))))
+	h := NewMapHelperFromData(map[string]interface{}{
+		"servers": []interface{}{map[string]interface{}{"host": "a"}, map[string]interface{}{"port": 2222}},
+	})
+
+	c := schema.WithDefaults(h)
+	if h.Exists("proxy") || h.ExistsPath("servers[0].port") {
+		t.Errorf("Defaults applied to the original helper: %v", h.Data)
+	}
+	if c.Exists("proxy") {
+		t.Errorf("Map without default created: %v", c.Data)
+	}
+	if c.GetPathInt("servers[0].port", 0) != 22 || c.GetPathInt("servers[1].port", 0) != 2222 {
+		t.Errorf("Unexpected defaults in lists: %v", c.Data)
+	}
+
+	c.SetPath("proxy.address", "proxy", true)
+	schema.ApplyDefaults(c)
+	if c.GetPathInt("proxy.port", 0) != 8080 || c.GetPathString("proxy.address", "") != "proxy" {
+		t.Errorf("Unexpected defaults in maps: %v", c.Data)
+	}
+
+	if s := ProxySchema.GetPathSchema("exceptions[0]"); s == nil || s.Type != SCHEMA_TYPE_STRING {
+		t.Errorf("Unexpected schema of list elements %+v", s)
+	}
+
+}
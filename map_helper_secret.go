@@ -0,0 +1,435 @@
+package goutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Start of the encrypted values saved in the files
+const MAP_HELPER_SECRET_PREFIX = "enc:v1:"
+
+// Replaces the secrets in the redacted maps
+const MAP_HELPER_REDACTED = "*****"
+
+// Returns the key used to encrypt the secrets; it must have 32 bytes
+// (AES-256).
+type MapHelperKeySource interface {
+	GetKey() ([]byte, error)
+}
+
+// Key given by the application, for example from a keyring
+type StaticMapHelperKeySource struct {
+	Key []byte
+}
+
+func NewStaticMapHelperKeySource(key []byte) *StaticMapHelperKeySource {
+	s := StaticMapHelperKeySource{}
+	s.Key = key
+	return &s
+}
+
+func (s *StaticMapHelperKeySource) GetKey() ([]byte, error) {
+	return s.Key, nil
+}
+
+// Key saved in base64 in a file, that is created with a random key, and
+// only readable by the user, if it doesn't exist.
+type FileMapHelperKeySource struct {
+	Path string
+}
+
+func NewFileMapHelperKeySource(path string) *FileMapHelperKeySource {
+	s := FileMapHelperKeySource{}
+	s.Path = path
+	return &s
+}
+
+func (s *FileMapHelperKeySource) GetKey() ([]byte, error) {
+	content, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, errors.Wrap(err, "Error generating key")
+		}
+		err = WriteFileAtomic(s.Path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error saving key file %v", s.Path)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading key file %v", s.Path)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error decoding key file %v", s.Path)
+	}
+	return key, nil
+}
+
+// Key derived from a passphrase with scrypt; the random salt is saved in
+// base64 in a file, that is created if it doesn't exist, so the same
+// passphrase and salt file always give the same key.
+type PassphraseMapHelperKeySource struct {
+	Passphrase string
+	SaltPath   string
+
+	lock sync.Mutex
+	key  []byte
+}
+
+func NewPassphraseMapHelperKeySource(passphrase string, saltPath string) *PassphraseMapHelperKeySource {
+	s := PassphraseMapHelperKeySource{}
+	s.Passphrase = passphrase
+	s.SaltPath = saltPath
+	return &s
+}
+
+func (s *PassphraseMapHelperKeySource) GetKey() ([]byte, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Deriving the key is slow on purpose, so it is only done once
+	if s.key != nil {
+		return s.key, nil
+	}
+
+	var salt []byte
+	content, err := ioutil.ReadFile(s.SaltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, errors.Wrap(err, "Error generating salt")
+		}
+		err = WriteFileAtomic(s.SaltPath, []byte(base64.StdEncoding.EncodeToString(salt)+"\n"), 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error saving salt file %v", s.SaltPath)
+		}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Error reading salt file %v", s.SaltPath)
+	} else {
+		salt, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error decoding salt file %v", s.SaltPath)
+		}
+	}
+
+	key, err := scrypt.Key([]byte(s.Passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error deriving key")
+	}
+	s.key = key
+	return key, nil
+
+}
+
+// Key in base64 in an environment variable
+type EnvMapHelperKeySource struct {
+	Variable string
+}
+
+func NewEnvMapHelperKeySource(variable string) *EnvMapHelperKeySource {
+	s := EnvMapHelperKeySource{}
+	s.Variable = variable
+	return &s
+}
+
+func (s *EnvMapHelperKeySource) GetKey() ([]byte, error) {
+	value := os.Getenv(s.Variable)
+	if value == "" {
+		return nil, errors.Errorf("Environment variable %v not set", s.Variable)
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error decoding environment variable %v", s.Variable)
+	}
+	return key, nil
+}
+
+// Paths of a MapHelper whose values are secret: they are encrypted when
+// saved, and redacted in GenerateRedactedJson. Paths are in the format of
+// ParseMapHelperPath, and "*" matches any key or index, as in
+// "proxies.*.password". If KeySource is nil, the values are only redacted.
+type MapHelperSecrets struct {
+	KeySource MapHelperKeySource
+	Paths     []string
+
+	lock sync.Mutex
+	// Encrypted values of the last saved or loaded plain values, so saving
+	// the same value doesn't change the file
+	encrypted map[string][2]string
+}
+
+func NewMapHelperSecrets(keySource MapHelperKeySource, paths ...string) *MapHelperSecrets {
+	s := MapHelperSecrets{}
+	s.KeySource = keySource
+	s.Paths = paths
+	s.encrypted = map[string][2]string{}
+	return &s
+}
+
+// Decrypts the values of the secret paths, and marks them as secret; if
+// they can't be decrypted, the helper is not modified.
+func (h *MapHelper) SetSecrets(s *MapHelperSecrets) error {
+	err := s.Decrypt(h)
+	if err != nil {
+		return err
+	}
+	h.Secrets = s
+	return nil
+}
+
+// Replaces the encrypted values of the secret paths with the decrypted ones;
+// if any value can't be decrypted, none is replaced.
+func (s *MapHelperSecrets) Decrypt(h *MapHelper) error {
+	var block cipher.AEAD
+	decrypted := map[string]interface{}{}
+	err := s.walk(h, func(path []string, bound []string, value interface{}) (interface{}, error) {
+		stored, ok := value.(string)
+		if !ok || !strings.HasPrefix(stored, MAP_HELPER_SECRET_PREFIX) {
+			return value, nil
+		}
+		if block == nil {
+			var err error
+			block, err = s.cipher()
+			if err != nil {
+				return nil, err
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(stored[len(MAP_HELPER_SECRET_PREFIX):])
+		if err != nil || len(data) < block.NonceSize() {
+			return nil, errors.Errorf("Invalid encrypted value in %v", strings.Join(path, "."))
+		}
+		plain, err := block.Open(nil, data[:block.NonceSize()], data[block.NonceSize():], mapHelperSecretData(bound))
+		if err != nil {
+			return nil, errors.Errorf("Error decrypting %v; the key may be wrong, or the value was moved from another path", strings.Join(path, "."))
+		}
+		var decryptedValue interface{}
+		err = json.Unmarshal(plain, &decryptedValue)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error decoding %v", strings.Join(path, "."))
+		}
+		s.remember(path, string(plain), stored)
+		decrypted[strings.Join(path, "\x00")] = decryptedValue
+		return value, nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.walk(h, func(path []string, bound []string, value interface{}) (interface{}, error) {
+		if d, ok := decrypted[strings.Join(path, "\x00")]; ok {
+			return d, nil
+		}
+		return value, nil
+	})
+}
+
+// Returns the data of the helper with the secret values encrypted
+func (s *MapHelperSecrets) encryptedMap(h *MapHelper) (map[string]interface{}, error) {
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		return nil, errors.Wrap(err, "Error converting data")
+	}
+	if s.KeySource == nil {
+		return data, nil
+	}
+	var block cipher.AEAD
+	err = s.walk(NewMapHelperFromData(data), func(path []string, bound []string, value interface{}) (interface{}, error) {
+		if w, ok := value.(string); value == nil || ok && strings.HasPrefix(w, MAP_HELPER_SECRET_PREFIX) {
+			return value, nil
+		}
+		plain, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if stored, ok := s.remembered(path, string(plain)); ok {
+			return stored, nil
+		}
+		if block == nil {
+			block, err = s.cipher()
+			if err != nil {
+				return nil, err
+			}
+		}
+		nonce := make([]byte, block.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, errors.Wrap(err, "Error generating nonce")
+		}
+		stored := MAP_HELPER_SECRET_PREFIX + base64.StdEncoding.EncodeToString(block.Seal(nonce, nonce, plain, mapHelperSecretData(bound)))
+		s.remember(path, string(plain), stored)
+		return stored, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the data of the helper with the secret values replaced by
+// MAP_HELPER_REDACTED
+func (h *MapHelper) GenerateRedactedMap() map[string]interface{} {
+	data, err := mapHelperCanonicalData(h.GenerateMap())
+	if err != nil {
+		Log.Debugf("Error converting data: %v", err)
+		return map[string]interface{}{}
+	}
+	if h.Secrets != nil {
+		h.Secrets.walk(NewMapHelperFromData(data), func(path []string, bound []string, value interface{}) (interface{}, error) {
+			if value == nil {
+				return nil, nil
+			}
+			return MAP_HELPER_REDACTED, nil
+		})
+	}
+	return data
+}
+
+// Same as GenerateJson, but without the secrets, so it can be logged or
+// attached to bug reports
+func (h *MapHelper) GenerateRedactedJson(pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(h.GenerateRedactedMap(), "", "  ")
+	}
+	return json.Marshal(h.GenerateRedactedMap())
+}
+
+// Returns the data saved in the files, with the secrets encrypted
+func (h *MapHelper) generateStoredMap() (map[string]interface{}, error) {
+	if h.Secrets == nil {
+		return h.GenerateMap(), nil
+	}
+	return h.Secrets.encryptedMap(h)
+}
+
+func (s *MapHelperSecrets) cipher() (cipher.AEAD, error) {
+	if s.KeySource == nil {
+		return nil, errors.New("No key source to decrypt the secrets")
+	}
+	key, err := s.KeySource.GetKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting the key of the secrets")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid key")
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *MapHelperSecrets) remember(path []string, plain string, stored string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.encrypted == nil {
+		s.encrypted = map[string][2]string{}
+	}
+	s.encrypted[strings.Join(path, "\x00")] = [2]string{plain, stored}
+}
+
+func (s *MapHelperSecrets) remembered(path []string, plain string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.encrypted[strings.Join(path, "\x00")]; ok && e[0] == plain {
+		return e[1], true
+	}
+	return "", false
+}
+
+// Replaces the values of the secret paths that exist with the ones returned
+// by the function; bound is the path with the indexes of the lists replaced
+// by "*", that the encrypted values are bound to, so they can't be moved to
+// other paths, but the lists can be reordered.
+func (s *MapHelperSecrets) walk(h *MapHelper, f mapHelperSecretVisitor) error {
+	for _, p := range s.Paths {
+		elements, err := ParseMapHelperPath(p)
+		if err != nil {
+			return err
+		}
+		if len(elements) == 0 {
+			continue
+		}
+		err = walkMapHelperSecret(h, elements, []string{}, []string{}, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type mapHelperSecretVisitor func(path []string, bound []string, value interface{}) (interface{}, error)
+
+// Additional data of the encrypted values
+func mapHelperSecretData(bound []string) []byte {
+	return []byte(strings.Join(bound, "\x00"))
+}
+
+func walkMapHelperSecret(node interface{}, elements []MapHelperPathElement, path []string, bound []string, f mapHelperSecretVisitor) error {
+
+	e := elements[0]
+	visit := func(k string, b string, child interface{}, set func(interface{})) error {
+		childPath := append(append([]string{}, path...), k)
+		childBound := append(append([]string{}, bound...), b)
+		if len(elements) > 1 {
+			return walkMapHelperSecret(child, elements[1:], childPath, childBound, f)
+		}
+		value, err := f(childPath, childBound, child)
+		if err != nil {
+			return err
+		}
+		set(value)
+		return nil
+	}
+
+	var m map[string]interface{}
+	switch w := node.(type) {
+	case *MapHelper:
+		m = w.Data
+	case map[string]interface{}:
+		m = w
+	case []interface{}:
+		for i := range w {
+			if e.Key != "*" && e.Key != strconv.Itoa(i) {
+				continue
+			}
+			i := i
+			if err := visit(strconv.Itoa(i), "*", w[i], func(v interface{}) { w[i] = v }); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []*MapHelper:
+		for i := range w {
+			if (e.Key == "*" || e.Key == strconv.Itoa(i)) && len(elements) > 1 {
+				if err := walkMapHelperSecret(w[i], elements[1:], append(append([]string{}, path...), strconv.Itoa(i)), append(append([]string{}, bound...), "*"), f); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	for k, child := range m {
+		if e.Key != "*" && e.Key != k {
+			continue
+		}
+		k := k
+		if err := visit(k, k, child, func(v interface{}) { m[k] = v }); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
@@ -0,0 +1,258 @@
+package goutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSecretsContent = `{
+  // Connection settings
+  "user": "bob",
+  "password": "s3cret",
+  "token": 1234,
+  "proxies": [{"name": "a", "password": "p1"}, {"name": "b"}]
+}
+`
+
+var testSecretPaths = []string{"password", "token", "proxies.*.password"}
+
+func newTestSecretsFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.jsonc")
+	if err := ioutil.WriteFile(path, []byte(testSecretsContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func loadTestSecretsFile(t *testing.T, path string) *MapHelper {
+	h, err := NewMapHelperDocumentFromFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestMapHelperSecrets(t *testing.T) {
+
+	path, cleanup := newTestSecretsFile(t)
+	defer cleanup()
+	keySource := NewFileMapHelperKeySource(filepath.Join(filepath.Dir(path), "key"))
+
+	// Plain values are encrypted when saved
+	h := loadTestSecretsFile(t, path)
+	if err := h.SetSecrets(NewMapHelperSecrets(keySource, testSecretPaths...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"s3cret", "1234", "p1"} {
+		if bytes.Contains(content, []byte(plain)) {
+			t.Errorf("Secret %v saved in %s", plain, content)
+		}
+	}
+	if !bytes.Contains(content, []byte("// Connection settings")) || !bytes.Contains(content, []byte(`"user": "bob"`)) {
+		t.Errorf("Unexpected content %s", content)
+	}
+	stored := loadTestSecretsFile(t, path)
+	for _, p := range []string{"password", "token", "proxies[0].password"} {
+		if value := stored.GetPathString(p, ""); !strings.HasPrefix(value, MAP_HELPER_SECRET_PREFIX) {
+			t.Errorf("Unexpected value %v of %v", value, p)
+		}
+	}
+	if stored.ExistsPath("proxies[1].password") {
+		t.Errorf("Missing secret added")
+	}
+
+	// The values in memory are not encrypted, and saving the same values
+	// doesn't change the file
+	if h.GetString("password", "") != "s3cret" {
+		t.Errorf("Unexpected password %v", h.GetString("password", ""))
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(path); !bytes.Equal(again, content) {
+		t.Errorf("File changed without changes: %s", again)
+	}
+
+	// Loaded with the same key
+	h = loadTestSecretsFile(t, path)
+	if err := h.SetSecrets(NewMapHelperSecrets(keySource, testSecretPaths...)); err != nil {
+		t.Fatal(err)
+	}
+	if h.GetString("password", "") != "s3cret" || h.GetInt("token", 0) != 1234 || h.GetPathString("proxies[0].password", "") != "p1" {
+		t.Errorf("Unexpected data %v", h.Data)
+	}
+
+	// New values are encrypted too
+	h.SetString("password", "changed")
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); bytes.Contains(content, []byte("changed")) {
+		t.Errorf("Secret saved in %s", content)
+	}
+	h = loadTestSecretsFile(t, path)
+	if err := h.SetSecrets(NewMapHelperSecrets(keySource, testSecretPaths...)); err != nil {
+		t.Fatal(err)
+	}
+	if h.GetString("password", "") != "changed" {
+		t.Errorf("Unexpected password %v", h.GetString("password", ""))
+	}
+
+}
+
+func TestMapHelperSecretsDecrypt(t *testing.T) {
+
+	path, cleanup := newTestSecretsFile(t)
+	defer cleanup()
+	keySource := NewStaticMapHelperKeySource(bytes.Repeat([]byte{1}, 32))
+
+	h := loadTestSecretsFile(t, path)
+	if err := h.SetSecrets(NewMapHelperSecrets(keySource, testSecretPaths...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lists can be reordered
+	h = loadTestSecretsFile(t, path)
+	proxies := h.GetList("proxies", nil)
+	h.Set("proxies", []interface{}{proxies[1], proxies[0]})
+	if err := NewMapHelperSecrets(keySource, testSecretPaths...).Decrypt(h); err != nil {
+		t.Fatal(err)
+	}
+	if h.GetPathString("proxies[1].password", "") != "p1" {
+		t.Errorf("Unexpected data %v", h.Data)
+	}
+
+	tests := []struct {
+		name      string
+		keySource MapHelperKeySource
+		update    func(h *MapHelper)
+	}{
+		{"Wrong key", NewStaticMapHelperKeySource(bytes.Repeat([]byte{2}, 32)), func(h *MapHelper) {}},
+		{"Invalid key", NewStaticMapHelperKeySource([]byte("short")), func(h *MapHelper) {}},
+		{"Without key", nil, func(h *MapHelper) {}},
+		{"Moved value", keySource, func(h *MapHelper) {
+			h.SetPath("proxies[1].password", h.GetString("password", ""), true)
+		}},
+		{"Invalid value", keySource, func(h *MapHelper) {
+			h.SetPath("proxies[1].password", MAP_HELPER_SECRET_PREFIX+"x", true)
+		}},
+	}
+	for _, test := range tests {
+		h := loadTestSecretsFile(t, path)
+		test.update(h)
+		before := copyMapHelperData(h.Data)
+		if err := h.SetSecrets(NewMapHelperSecrets(test.keySource, testSecretPaths...)); err == nil {
+			t.Errorf("%v: secrets decrypted", test.name)
+		}
+		// Nothing is decrypted if any value fails
+		if !reflect.DeepEqual(h.Data, before) || h.Secrets != nil {
+			t.Errorf("%v: helper modified to %v", test.name, h.Data)
+		}
+	}
+
+}
+
+func TestMapHelperRedacted(t *testing.T) {
+
+	path, cleanup := newTestSecretsFile(t)
+	defer cleanup()
+
+	// Without key source, secrets are only redacted
+	h := loadTestSecretsFile(t, path)
+	if err := h.SetSecrets(NewMapHelperSecrets(nil, testSecretPaths...)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := h.GenerateRedactedJson(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"password":"*****","proxies":[{"name":"a","password":"*****"},{"name":"b"}],"token":"*****","user":"bob"}`
+	if string(content) != want {
+		t.Errorf("Unexpected redacted JSON %s, want %s", content, want)
+	}
+	if h.GetString("password", "") != "s3cret" {
+		t.Errorf("Helper modified by the redaction")
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); !bytes.Contains(content, []byte("s3cret")) {
+		t.Errorf("Secret encrypted without key: %s", content)
+	}
+
+	if redacted := NewMapHelperFromData(map[string]interface{}{"password": "x"}).GenerateRedactedMap(); redacted["password"] != "x" {
+		t.Errorf("Unexpected redacted map %v without secrets", redacted)
+	}
+
+}
+
+func TestMapHelperKeySources(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Created if it doesn't exist, and reused
+	keyPath := filepath.Join(dir, "key")
+	key, err := NewFileMapHelperKeySource(keyPath).GetKey()
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Unexpected key %v: %v", key, err)
+	}
+	if stat, err := os.Stat(keyPath); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected mode of %v: %v", keyPath, err)
+	}
+	if again, _ := NewFileMapHelperKeySource(keyPath).GetKey(); !bytes.Equal(again, key) {
+		t.Errorf("Different key read from the file")
+	}
+
+	// Same passphrase and salt give the same key
+	saltPath := filepath.Join(dir, "salt")
+	key, err = NewPassphraseMapHelperKeySource("passphrase", saltPath).GetKey()
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Unexpected key %v: %v", key, err)
+	}
+	if again, _ := NewPassphraseMapHelperKeySource("passphrase", saltPath).GetKey(); !bytes.Equal(again, key) {
+		t.Errorf("Different key with the same salt")
+	}
+	if other, _ := NewPassphraseMapHelperKeySource("other", saltPath).GetKey(); bytes.Equal(other, key) {
+		t.Errorf("Same key with another passphrase")
+	}
+	if other, _ := NewPassphraseMapHelperKeySource("passphrase", filepath.Join(dir, "salt2")).GetKey(); bytes.Equal(other, key) {
+		t.Errorf("Same key with another salt")
+	}
+
+	defer os.Unsetenv("GOUTILS_TEST_KEY")
+	os.Setenv("GOUTILS_TEST_KEY", base64.StdEncoding.EncodeToString(key))
+	if env, err := NewEnvMapHelperKeySource("GOUTILS_TEST_KEY").GetKey(); err != nil || !bytes.Equal(env, key) {
+		t.Errorf("Unexpected key %v: %v", env, err)
+	}
+	for _, value := range []string{"", "not base64"} {
+		os.Setenv("GOUTILS_TEST_KEY", value)
+		if _, err := NewEnvMapHelperKeySource("GOUTILS_TEST_KEY").GetKey(); err == nil {
+			t.Errorf("Key read from %q", value)
+		}
+	}
+
+}
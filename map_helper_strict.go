@@ -0,0 +1,648 @@
+package goutils
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Returned by the Err getters when the key doesn't exist or its value can't
+// be converted; the Must getters panic with it.
+type MapHelperTypeError struct {
+	// Key, or path for the GetPath getters
+	Key string
+	// Type requested, like "int" or "list of strings"
+	Expected string
+	// Type of the value found; empty if the key doesn't exist
+	Actual string
+}
+
+func (e *MapHelperTypeError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("Key %v doesn't exist, expected %v", e.Key, e.Expected)
+	}
+	return fmt.Sprintf("Value of %v is %v, expected %v", e.Key, e.Actual, e.Expected)
+}
+
+// The Err getters return an error instead of the default value, and unlike
+// the lenient ones, the value must have the type requested: strings are not
+// parsed as numbers or booleans, nor numbers formatted as strings. Numbers
+// with decimals or out of range are not valid integers, durations are
+// strings like "1m30s" or seconds, times are strings or Unix times, and URLs
+// must have scheme and host.
+
+func (h *MapHelper) GetBooleanErr(key string) (bool, error) {
+	val, err := h.strictValue(key, "boolean")
+	if err != nil {
+		return false, err
+	}
+	return strictMapHelperBoolean(key, val)
+}
+
+func (h *MapHelper) GetIntErr(key string) (int, error) {
+	val, err := h.strictValue(key, "int")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperInt(key, val)
+}
+
+func (h *MapHelper) GetInt64Err(key string) (int64, error) {
+	val, err := h.strictValue(key, "int64")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperInt64(key, val)
+}
+
+func (h *MapHelper) GetFloat64Err(key string) (float64, error) {
+	val, err := h.strictValue(key, "float64")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperFloat64(key, val)
+}
+
+func (h *MapHelper) GetStringErr(key string) (string, error) {
+	val, err := h.strictValue(key, "string")
+	if err != nil {
+		return "", err
+	}
+	return strictMapHelperString(key, val)
+}
+
+func (h *MapHelper) GetDurationErr(key string) (time.Duration, error) {
+	val, err := h.strictValue(key, "duration")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperDuration(key, val)
+}
+
+func (h *MapHelper) GetTimeErr(key string) (time.Time, error) {
+	val, err := h.strictValue(key, "time")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return strictMapHelperTime(key, val)
+}
+
+func (h *MapHelper) GetUrlErr(key string) (*url.URL, error) {
+	val, err := h.strictValue(key, "URL")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperUrl(key, val)
+}
+
+// Unlike GetListOfStrings, all the elements must be strings
+func (h *MapHelper) GetListOfStringsErr(key string) ([]string, error) {
+	val, err := h.strictValue(key, "list of strings")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfStrings(key, val)
+}
+
+func (h *MapHelper) GetListOfIntsErr(key string) ([]int, error) {
+	val, err := h.strictValue(key, "list of ints")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfInts(key, val)
+}
+
+func (h *MapHelper) GetMapOfStringsErr(key string) (map[string]string, error) {
+	val, err := h.strictValue(key, "map of strings")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperMapOfStrings(key, val)
+}
+
+func (h *MapHelper) GetListErr(key string) ([]interface{}, error) {
+	val, err := h.strictValue(key, "list")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperList(key, val)
+}
+
+// Unlike GetHelper, the key must exist; the helper shares the data with this
+// one.
+func (h *MapHelper) GetHelperErr(key string) (*MapHelper, error) {
+	val, err := h.strictValue(key, "map")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperHelper(key, val)
+}
+
+// Unlike GetListOfHelpers, all the elements must be maps
+func (h *MapHelper) GetListOfHelpersErr(key string) ([]*MapHelper, error) {
+	val, err := h.strictValue(key, "list of maps")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfHelpers(key, val)
+}
+
+// Same as the Err getters, with the value in the path, in the format of
+// ParseMapHelperPath.
+
+func (h *MapHelper) GetPathBooleanErr(path string) (bool, error) {
+	val, err := h.strictPathValue(path, "boolean")
+	if err != nil {
+		return false, err
+	}
+	return strictMapHelperBoolean(path, val)
+}
+
+func (h *MapHelper) GetPathIntErr(path string) (int, error) {
+	val, err := h.strictPathValue(path, "int")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperInt(path, val)
+}
+
+func (h *MapHelper) GetPathInt64Err(path string) (int64, error) {
+	val, err := h.strictPathValue(path, "int64")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperInt64(path, val)
+}
+
+func (h *MapHelper) GetPathFloat64Err(path string) (float64, error) {
+	val, err := h.strictPathValue(path, "float64")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperFloat64(path, val)
+}
+
+func (h *MapHelper) GetPathStringErr(path string) (string, error) {
+	val, err := h.strictPathValue(path, "string")
+	if err != nil {
+		return "", err
+	}
+	return strictMapHelperString(path, val)
+}
+
+func (h *MapHelper) GetPathDurationErr(path string) (time.Duration, error) {
+	val, err := h.strictPathValue(path, "duration")
+	if err != nil {
+		return 0, err
+	}
+	return strictMapHelperDuration(path, val)
+}
+
+func (h *MapHelper) GetPathTimeErr(path string) (time.Time, error) {
+	val, err := h.strictPathValue(path, "time")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return strictMapHelperTime(path, val)
+}
+
+func (h *MapHelper) GetPathUrlErr(path string) (*url.URL, error) {
+	val, err := h.strictPathValue(path, "URL")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperUrl(path, val)
+}
+
+func (h *MapHelper) GetPathListOfStringsErr(path string) ([]string, error) {
+	val, err := h.strictPathValue(path, "list of strings")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfStrings(path, val)
+}
+
+func (h *MapHelper) GetPathListOfIntsErr(path string) ([]int, error) {
+	val, err := h.strictPathValue(path, "list of ints")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfInts(path, val)
+}
+
+func (h *MapHelper) GetPathMapOfStringsErr(path string) (map[string]string, error) {
+	val, err := h.strictPathValue(path, "map of strings")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperMapOfStrings(path, val)
+}
+
+func (h *MapHelper) GetPathListErr(path string) ([]interface{}, error) {
+	val, err := h.strictPathValue(path, "list")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperList(path, val)
+}
+
+func (h *MapHelper) GetPathHelperErr(path string) (*MapHelper, error) {
+	val, err := h.strictPathValue(path, "map")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperHelper(path, val)
+}
+
+func (h *MapHelper) GetPathListOfHelpersErr(path string) ([]*MapHelper, error) {
+	val, err := h.strictPathValue(path, "list of maps")
+	if err != nil {
+		return nil, err
+	}
+	return strictMapHelperListOfHelpers(path, val)
+}
+
+// The Must getters panic with a *MapHelperTypeError; useful for values
+// that are always set, like the ones with defaults in a schema.
+
+func (h *MapHelper) MustGetBoolean(key string) bool {
+	w, err := h.GetBooleanErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetInt(key string) int {
+	w, err := h.GetIntErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetInt64(key string) int64 {
+	w, err := h.GetInt64Err(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetFloat64(key string) float64 {
+	w, err := h.GetFloat64Err(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetString(key string) string {
+	w, err := h.GetStringErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetDuration(key string) time.Duration {
+	w, err := h.GetDurationErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetTime(key string) time.Time {
+	w, err := h.GetTimeErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetUrl(key string) *url.URL {
+	w, err := h.GetUrlErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetListOfStrings(key string) []string {
+	w, err := h.GetListOfStringsErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetListOfInts(key string) []int {
+	w, err := h.GetListOfIntsErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetMapOfStrings(key string) map[string]string {
+	w, err := h.GetMapOfStringsErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetList(key string) []interface{} {
+	w, err := h.GetListErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetHelper(key string) *MapHelper {
+	w, err := h.GetHelperErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetListOfHelpers(key string) []*MapHelper {
+	w, err := h.GetListOfHelpersErr(key)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathBoolean(path string) bool {
+	w, err := h.GetPathBooleanErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathInt(path string) int {
+	w, err := h.GetPathIntErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathInt64(path string) int64 {
+	w, err := h.GetPathInt64Err(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathFloat64(path string) float64 {
+	w, err := h.GetPathFloat64Err(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathString(path string) string {
+	w, err := h.GetPathStringErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathDuration(path string) time.Duration {
+	w, err := h.GetPathDurationErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathTime(path string) time.Time {
+	w, err := h.GetPathTimeErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathUrl(path string) *url.URL {
+	w, err := h.GetPathUrlErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathListOfStrings(path string) []string {
+	w, err := h.GetPathListOfStringsErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathListOfInts(path string) []int {
+	w, err := h.GetPathListOfIntsErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathMapOfStrings(path string) map[string]string {
+	w, err := h.GetPathMapOfStringsErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathList(path string) []interface{} {
+	w, err := h.GetPathListErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathHelper(path string) *MapHelper {
+	w, err := h.GetPathHelperErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) MustGetPathListOfHelpers(path string) []*MapHelper {
+	w, err := h.GetPathListOfHelpersErr(path)
+	mustMapHelper(err)
+	return w
+}
+
+func (h *MapHelper) strictValue(key string, expected string) (interface{}, error) {
+	val, ok := h.Data[key]
+	if !ok {
+		return nil, &MapHelperTypeError{Key: key, Expected: expected}
+	}
+	return val, nil
+}
+
+func (h *MapHelper) strictPathValue(path string, expected string) (interface{}, error) {
+	if _, err := ParseMapHelperPath(path); err != nil {
+		return nil, err
+	}
+	val, ok := h.LookupPath(path)
+	if !ok {
+		return nil, &MapHelperTypeError{Key: path, Expected: expected}
+	}
+	return val, nil
+}
+
+func strictMapHelperBoolean(key string, val interface{}) (bool, error) {
+	if w, ok := val.(bool); ok {
+		return w, nil
+	}
+	return false, newMapHelperTypeError(key, "boolean", val)
+}
+
+func strictMapHelperInt(key string, val interface{}) (int, error) {
+	if w, ok := strictMapHelperExactInt64(val); ok && int64(int(w)) == w {
+		return int(w), nil
+	}
+	return 0, newMapHelperTypeError(key, "int", val)
+}
+
+func strictMapHelperInt64(key string, val interface{}) (int64, error) {
+	if w, ok := strictMapHelperExactInt64(val); ok {
+		return w, nil
+	}
+	return 0, newMapHelperTypeError(key, "int64", val)
+}
+
+func strictMapHelperFloat64(key string, val interface{}) (float64, error) {
+	if w, ok := strictMapHelperNumber(val); ok {
+		return w, nil
+	}
+	return 0, newMapHelperTypeError(key, "float64", val)
+}
+
+func strictMapHelperString(key string, val interface{}) (string, error) {
+	if w, ok := val.(string); ok {
+		return w, nil
+	}
+	return "", newMapHelperTypeError(key, "string", val)
+}
+
+func strictMapHelperDuration(key string, val interface{}) (time.Duration, error) {
+	switch w := val.(type) {
+	case time.Duration:
+		return w, nil
+	case string:
+		if d, err := time.ParseDuration(w); err == nil {
+			return d, nil
+		}
+	default:
+		if f, ok := strictMapHelperNumber(val); ok {
+			return time.Duration(f * float64(time.Second)), nil
+		}
+	}
+	return 0, newMapHelperTypeError(key, "duration", val)
+}
+
+func strictMapHelperTime(key string, val interface{}) (time.Time, error) {
+	if w, ok := mapHelperTime(val); ok {
+		return w, nil
+	}
+	return time.Time{}, newMapHelperTypeError(key, "time", val)
+}
+
+// url.Parse accepts almost anything, so the scheme and the host are required
+func strictMapHelperUrl(key string, val interface{}) (*url.URL, error) {
+	if w, ok := mapHelperUrl(val); ok && w.Scheme != "" && w.Host != "" {
+		return w, nil
+	}
+	return nil, newMapHelperTypeError(key, "URL", val)
+}
+
+func strictMapHelperListOfStrings(key string, val interface{}) ([]string, error) {
+	if w, ok := val.([]string); ok {
+		return w, nil
+	}
+	if w, ok := val.([]interface{}); ok {
+		list := []string{}
+		for _, v := range w {
+			s, ok := v.(string)
+			if !ok {
+				return nil, newMapHelperTypeError(key, "list of strings", val)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, newMapHelperTypeError(key, "list of strings", val)
+}
+
+func strictMapHelperListOfInts(key string, val interface{}) ([]int, error) {
+	if w, ok := val.([]int); ok {
+		return w, nil
+	}
+	if w, ok := val.([]interface{}); ok {
+		list := []int{}
+		for _, v := range w {
+			i, ok := strictMapHelperExactInt64(v)
+			if !ok || int64(int(i)) != i {
+				return nil, newMapHelperTypeError(key, "list of ints", val)
+			}
+			list = append(list, int(i))
+		}
+		return list, nil
+	}
+	return nil, newMapHelperTypeError(key, "list of ints", val)
+}
+
+func strictMapHelperMapOfStrings(key string, val interface{}) (map[string]string, error) {
+	switch w := val.(type) {
+	case map[string]string:
+		return w, nil
+	case *MapHelper:
+		return strictMapHelperMapOfStrings(key, w.Data)
+	case map[string]interface{}:
+		m := map[string]string{}
+		for k, v := range w {
+			s, ok := v.(string)
+			if !ok {
+				return nil, newMapHelperTypeError(key, "map of strings", val)
+			}
+			m[k] = s
+		}
+		return m, nil
+	}
+	return nil, newMapHelperTypeError(key, "map of strings", val)
+}
+
+func strictMapHelperList(key string, val interface{}) ([]interface{}, error) {
+	if w, ok := mapHelperList(val); ok {
+		return w, nil
+	}
+	return nil, newMapHelperTypeError(key, "list", val)
+}
+
+func strictMapHelperHelper(key string, val interface{}) (*MapHelper, error) {
+	if w, ok := val.(*MapHelper); ok {
+		return w, nil
+	} else if w, ok := val.(map[string]interface{}); ok {
+		return NewMapHelperFromData(w), nil
+	}
+	return nil, newMapHelperTypeError(key, "map", val)
+}
+
+func strictMapHelperListOfHelpers(key string, val interface{}) ([]*MapHelper, error) {
+	list, ok := mapHelperListOfHelpers(val)
+	if w, isList := val.([]interface{}); ok && isList && len(list) != len(w) {
+		ok = false
+	}
+	if !ok {
+		return nil, newMapHelperTypeError(key, "list of maps", val)
+	}
+	return list, nil
+}
+
+// Numbers of any type, but not strings
+func strictMapHelperNumber(val interface{}) (float64, bool) {
+	if _, ok := val.(string); ok {
+		return 0, false
+	}
+	return mapHelperFloat64(val)
+}
+
+// Integers, and numbers without decimals in range, but not strings; big
+// integers are int64, as decoded from the files
+func strictMapHelperExactInt64(val interface{}) (int64, bool) {
+	if _, ok := val.(string); ok {
+		return 0, false
+	}
+	return mapHelperExactInt64(val)
+}
+
+func mustMapHelper(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newMapHelperTypeError(key string, expected string, val interface{}) *MapHelperTypeError {
+	return &MapHelperTypeError{Key: key, Expected: expected, Actual: mapHelperTypeName(val)}
+}
+
+// Returns the name of the type of the value, as written in the files
+func mapHelperTypeName(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case int, int32, int64, float32, float64:
+		return "number"
+	case []interface{}, []string, []int, []*MapHelper:
+		return "list"
+	case map[string]interface{}, map[string]string, *MapHelper:
+		return "map"
+	}
+	return fmt.Sprintf("%T", val)
+}
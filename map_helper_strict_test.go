@@ -0,0 +1,240 @@
+package goutils
+
+import (
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestGettersMapHelper(t *testing.T) *MapHelper {
+	codec, err := GetMapHelperCodec(MAP_HELPER_CODEC_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.Decode([]byte(`{
+		"int": 42,
+		"whole": 3.0,
+		"fraction": 3.7,
+		"big": 12345678901234567890,
+		"bigint": 9007199254740993,
+		"huge": 1e19,
+		"intString": "42",
+		"floatString": "3.5",
+		"true": true,
+		"trueString": "true",
+		"string": "text",
+		"duration": "1m30s",
+		"seconds": 2,
+		"durationNumberString": "2",
+		"time": "2020-01-02T03:04:05Z",
+		"unix": 1577934245,
+		"url": "https://example.com/path",
+		"relativeUrl": "path/file",
+		"strings": ["a", "b"],
+		"mixedStrings": ["a", 1],
+		"ints": [1, 2.0],
+		"intStrings": [1, "2"],
+		"fractions": [1, 2.5],
+		"stringsMap": {"a": "b"},
+		"mixedMap": {"a": 1},
+		"map": {"port": 80, "list": [{"a": "b"}]},
+		"helpers": [{"a": 1}, {"b": 2}],
+		"mixedHelpers": [{"a": 1}, 2, "x"],
+		"null": null
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMapHelperFromData(data)
+	h.Set("nan", math.NaN())
+	return h
+}
+
+// The lenient getters convert strings and numbers, and return the default
+// value if the value can't be converted
+func TestMapHelperGetters(t *testing.T) {
+
+	h := newTestGettersMapHelper(t)
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"Int", h.GetInt("int", 0), 42},
+		{"Int of a fraction", h.GetInt("fraction", 0), 3},
+		{"Int of a string", h.GetInt("intString", 0), 42},
+		{"Int out of range", h.GetInt64("huge", 7), int64(7)},
+		{"Int64 of a big integer", h.GetInt64("bigint", 0), int64(9007199254740993)},
+		{"Float64", h.GetFloat64("fraction", 0), 3.7},
+		{"Float64 of a string", h.GetFloat64("floatString", 0), 3.5},
+		{"Boolean of a string", h.GetBoolean("trueString", false), true},
+		{"String of a number", h.GetString("int", ""), "42"},
+		{"Duration", h.GetDuration("duration", 0), 90 * time.Second},
+		{"Duration of seconds", h.GetDuration("seconds", 0), 2 * time.Second},
+		{"Time", h.GetTime("time", time.Time{}).UTC(), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"Unix time", h.GetTime("unix", time.Time{}).UTC(), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"Url", h.GetUrl("url", nil).Host, "example.com"},
+		{"List of ints", h.GetListOfInts("intStrings", nil), []int{1, 2}},
+		{"Map of strings", h.GetMapOfStrings("mixedMap", nil), map[string]string{"a": "1"}},
+		{"Missing", h.GetDuration("missing", time.Second), time.Second},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%v: unexpected value %#v, want %#v", test.name, test.got, test.want)
+		}
+	}
+
+	// Elements that are not maps are skipped
+	if helpers := h.GetListOfHelpers("mixedHelpers"); len(helpers) != 1 || helpers[0].GetInt("a", 0) != 1 {
+		t.Errorf("Unexpected helpers %v", helpers)
+	}
+	if helpers := h.GetListOfHelpers("string"); len(helpers) != 0 {
+		t.Errorf("Unexpected helpers %v", helpers)
+	}
+
+}
+
+// The Err getters require the type requested
+func TestMapHelperErrGetters(t *testing.T) {
+
+	h := newTestGettersMapHelper(t)
+
+	tests := []struct {
+		name string
+		get  func() (interface{}, error)
+		want interface{}
+	}{
+		{"Int", func() (interface{}, error) { return h.GetIntErr("int") }, 42},
+		{"Int of a whole number", func() (interface{}, error) { return h.GetIntErr("whole") }, 3},
+		{"Int of a fraction", func() (interface{}, error) { return h.GetIntErr("fraction") }, nil},
+		{"Int of a string", func() (interface{}, error) { return h.GetIntErr("intString") }, nil},
+		{"Int of NaN", func() (interface{}, error) { return h.GetIntErr("nan") }, nil},
+		{"Int of a big integer", func() (interface{}, error) { return h.GetIntErr("bigint") }, 9007199254740993},
+		{"Int out of range", func() (interface{}, error) { return h.GetIntErr("huge") }, nil},
+		{"Int of a map", func() (interface{}, error) { return h.GetIntErr("map") }, nil},
+		{"Int64 of a big integer", func() (interface{}, error) { return h.GetInt64Err("bigint") }, int64(9007199254740993)},
+		{"Int64 out of range", func() (interface{}, error) { return h.GetInt64Err("big") }, nil},
+		{"Int64 of a string", func() (interface{}, error) { return h.GetInt64Err("intString") }, nil},
+		{"Float64", func() (interface{}, error) { return h.GetFloat64Err("fraction") }, 3.7},
+		{"Float64 of an int", func() (interface{}, error) { return h.GetFloat64Err("int") }, 42.0},
+		{"Float64 of a string", func() (interface{}, error) { return h.GetFloat64Err("floatString") }, nil},
+		{"Boolean", func() (interface{}, error) { return h.GetBooleanErr("true") }, true},
+		{"Boolean of a string", func() (interface{}, error) { return h.GetBooleanErr("trueString") }, nil},
+		{"String", func() (interface{}, error) { return h.GetStringErr("string") }, "text"},
+		{"String of a number", func() (interface{}, error) { return h.GetStringErr("whole") }, nil},
+		{"String of null", func() (interface{}, error) { return h.GetStringErr("null") }, nil},
+		{"Duration", func() (interface{}, error) { return h.GetDurationErr("duration") }, 90 * time.Second},
+		{"Duration of seconds", func() (interface{}, error) { return h.GetDurationErr("seconds") }, 2 * time.Second},
+		{"Duration of a number string", func() (interface{}, error) { return h.GetDurationErr("durationNumberString") }, nil},
+		{"Duration of a URL", func() (interface{}, error) { return h.GetDurationErr("url") }, nil},
+		{"Time", func() (interface{}, error) { return h.GetTimeErr("time") }, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"Time of a string", func() (interface{}, error) { return h.GetTimeErr("string") }, nil},
+		{"Url", func() (interface{}, error) { return h.GetUrlErr("url") }, "https://example.com/path"},
+		{"Relative url", func() (interface{}, error) { return h.GetUrlErr("relativeUrl") }, nil},
+		{"List of strings", func() (interface{}, error) { return h.GetListOfStringsErr("strings") }, []string{"a", "b"}},
+		{"List of mixed strings", func() (interface{}, error) { return h.GetListOfStringsErr("mixedStrings") }, nil},
+		{"List of ints", func() (interface{}, error) { return h.GetListOfIntsErr("ints") }, []int{1, 2}},
+		{"List of ints with strings", func() (interface{}, error) { return h.GetListOfIntsErr("intStrings") }, nil},
+		{"List of ints with fractions", func() (interface{}, error) { return h.GetListOfIntsErr("fractions") }, nil},
+		{"Map of strings", func() (interface{}, error) { return h.GetMapOfStringsErr("stringsMap") }, map[string]string{"a": "b"}},
+		{"Map of mixed strings", func() (interface{}, error) { return h.GetMapOfStringsErr("mixedMap") }, nil},
+		{"List", func() (interface{}, error) { return h.GetListErr("strings") }, []interface{}{"a", "b"}},
+		{"List of a string", func() (interface{}, error) { return h.GetListErr("string") }, nil},
+		{"Helper", func() (interface{}, error) { return h.GetHelperErr("stringsMap") }, map[string]interface{}{"a": "b"}},
+		{"Helper of a list", func() (interface{}, error) { return h.GetHelperErr("strings") }, nil},
+		{"List of helpers", func() (interface{}, error) { return h.GetListOfHelpersErr("helpers") }, 2},
+		{"List of mixed helpers", func() (interface{}, error) { return h.GetListOfHelpersErr("mixedHelpers") }, nil},
+		{"Missing", func() (interface{}, error) { return h.GetIntErr("missing") }, nil},
+	}
+
+	for _, test := range tests {
+		value, err := test.get()
+		if test.want == nil {
+			if _, ok := err.(*MapHelperTypeError); !ok {
+				t.Errorf("%v: unexpected value %#v, error %v", test.name, value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		switch w := value.(type) {
+		case time.Time:
+			value = w.UTC()
+		case *url.URL:
+			value = w.String()
+		case *MapHelper:
+			value = w.Data
+		case []*MapHelper:
+			value = len(w)
+		}
+		if !reflect.DeepEqual(value, test.want) {
+			t.Errorf("%v: unexpected value %#v, want %#v", test.name, value, test.want)
+		}
+	}
+
+}
+
+func TestMapHelperErrGettersError(t *testing.T) {
+	h := newTestGettersMapHelper(t)
+	tests := []struct {
+		err  error
+		want MapHelperTypeError
+	}{
+		{errorOf(h.GetIntErr("missing")), MapHelperTypeError{Key: "missing", Expected: "int"}},
+		{errorOf(h.GetStringErr("int")), MapHelperTypeError{Key: "int", Expected: "string", Actual: "number"}},
+		{errorOf(h.GetPathIntErr("map.missing")), MapHelperTypeError{Key: "map.missing", Expected: "int"}},
+		{errorOf(h.GetPathBooleanErr("map.list")), MapHelperTypeError{Key: "map.list", Expected: "boolean", Actual: "list"}},
+	}
+	for _, test := range tests {
+		err, ok := test.err.(*MapHelperTypeError)
+		if !ok || *err != test.want {
+			t.Errorf("Unexpected error %#v, want %#v", test.err, test.want)
+		}
+	}
+}
+
+func errorOf(value interface{}, err error) error {
+	return err
+}
+
+func TestMapHelperPathGetters(t *testing.T) {
+
+	h := newTestGettersMapHelper(t)
+
+	if port := h.MustGetPathInt("map.port"); port != 80 {
+		t.Errorf("Unexpected port %v", port)
+	}
+	if a := h.MustGetPathString("map.list[0].a"); a != "b" {
+		t.Errorf("Unexpected value %v", a)
+	}
+	if helpers, err := h.GetPathListOfHelpersErr("map.list"); err != nil || len(helpers) != 1 {
+		t.Errorf("Unexpected helpers %v: %v", helpers, err)
+	}
+	if _, err := h.GetPathStringErr("map.port"); err == nil {
+		t.Errorf("Number returned as a string")
+	}
+	if _, err := h.GetPathIntErr("map["); err == nil {
+		t.Errorf("Invalid path accepted")
+	}
+
+	for _, f := range []func(){
+		func() { h.MustGetDuration("url") },
+		func() { h.MustGetPathBoolean("map.port.x") },
+		func() { h.MustGetInt("intString") },
+	} {
+		func() {
+			defer func() {
+				if _, ok := recover().(*MapHelperTypeError); !ok {
+					t.Errorf("Must getter didn't panic with a type error")
+				}
+			}()
+			f()
+		}()
+	}
+
+}
@@ -0,0 +1,266 @@
+package goutils
+
+import (
+	"sync"
+)
+
+// MapHelper that can be used from several goroutines. The data is never
+// modified in place: every update works on a copy, that replaces the
+// current data when the update finishes, so readers get snapshots that
+// don't change while they use them.
+type SyncMapHelper struct {
+	lock   sync.RWMutex
+	helper *MapHelper
+}
+
+// The helper must not be used directly after this
+func NewSyncMapHelper(h *MapHelper) *SyncMapHelper {
+	s := SyncMapHelper{}
+	s.helper = h
+	return &s
+}
+
+// Returns the current data; it is shared by all the readers, so it must not
+// be modified (including GetHelper, that stores the helper it returns). Use
+// Update to modify it.
+func (s *SyncMapHelper) Snapshot() *MapHelper {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	c := *s.helper
+	return &c
+}
+
+// Returns a copy of the data, that can be modified
+func (s *SyncMapHelper) Copy() *MapHelper {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.copyHelper()
+}
+
+// Runs the function with a copy of the data, that replaces the current one
+// if no error is returned; other updates wait until it finishes, and readers
+// see all the changes or none of them.
+func (s *SyncMapHelper) Update(f func(h *MapHelper) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.copyHelper()
+	err := f(c)
+	if err != nil {
+		return err
+	}
+	*s.helper = *c
+	return nil
+}
+
+// Copies the data and the document, as saving modifies it; the rest of
+// fields are shared.
+func (s *SyncMapHelper) copyHelper() *MapHelper {
+	c := *s.helper
+	c.Data = copyMapHelperData(s.helper.Data)
+	c.Document = copyMapHelperDocument(s.helper.Codec, s.helper.Document)
+	return &c
+}
+
+// Replaces all the data, for example when the file is reloaded
+func (s *SyncMapHelper) Replace(data map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.helper.Data = data
+}
+
+// Replaces the data and the document with the ones of a reloaded file, and
+// returns the previous ones
+func (s *SyncMapHelper) replaceLoaded(loaded *MapHelper) *MapHelper {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previous := *s.helper
+	s.helper.Data = loaded.Data
+	s.helper.Document = loaded.Document
+	return &previous
+}
+
+// Saves the data to the file of the helper, keeping its document if it was
+// loaded as one. Saving updates the document, so a copy is saved, as the
+// snapshots share the current one.
+func (s *SyncMapHelper) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.copyHelper()
+	err := c.Save()
+	if err != nil {
+		return err
+	}
+	s.helper.Document = c.Document
+	return nil
+}
+
+func (s *SyncMapHelper) Count() int {
+	return s.Snapshot().Count()
+}
+
+func (s *SyncMapHelper) Keys() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.helper.Keys()
+}
+
+func (s *SyncMapHelper) Exists(key string) bool {
+	return s.Snapshot().Exists(key)
+}
+
+func (s *SyncMapHelper) Get(key string, value interface{}) interface{} {
+	return s.Snapshot().Get(key, value)
+}
+
+func (s *SyncMapHelper) GetBoolean(key string, value bool) bool {
+	return s.Snapshot().GetBoolean(key, value)
+}
+
+func (s *SyncMapHelper) GetInt(key string, value int) int {
+	return s.Snapshot().GetInt(key, value)
+}
+
+func (s *SyncMapHelper) GetInt64(key string, value int64) int64 {
+	return s.Snapshot().GetInt64(key, value)
+}
+
+func (s *SyncMapHelper) GetString(key string, value string) string {
+	return s.Snapshot().GetString(key, value)
+}
+
+func (s *SyncMapHelper) GetListOfStrings(key string, value []string) []string {
+	return s.Snapshot().GetListOfStrings(key, value)
+}
+
+func (s *SyncMapHelper) GetList(key string, value []interface{}) []interface{} {
+	return s.Snapshot().GetList(key, value)
+}
+
+// Unlike MapHelper.GetHelper, returns nil if the key doesn't exist; the
+// helper is part of the snapshot, so it must not be modified.
+func (s *SyncMapHelper) GetHelper(key string) *MapHelper {
+	return s.Snapshot().GetPathHelper(FormatMapHelperPath([]MapHelperPathElement{{Key: key}}))
+}
+
+func (s *SyncMapHelper) LookupPath(path string) (interface{}, bool) {
+	return s.Snapshot().LookupPath(path)
+}
+
+func (s *SyncMapHelper) ExistsPath(path string) bool {
+	return s.Snapshot().ExistsPath(path)
+}
+
+func (s *SyncMapHelper) GetPath(path string, value interface{}) interface{} {
+	return s.Snapshot().GetPath(path, value)
+}
+
+func (s *SyncMapHelper) GetPathString(path string, value string) string {
+	return s.Snapshot().GetPathString(path, value)
+}
+
+func (s *SyncMapHelper) GetPathInt(path string, value int) int {
+	return s.Snapshot().GetPathInt(path, value)
+}
+
+func (s *SyncMapHelper) GetPathBoolean(path string, value bool) bool {
+	return s.Snapshot().GetPathBoolean(path, value)
+}
+
+func (s *SyncMapHelper) Set(key string, value interface{}) {
+	s.Update(func(h *MapHelper) error {
+		h.Set(key, value)
+		return nil
+	})
+}
+
+func (s *SyncMapHelper) Delete(key string) {
+	s.Update(func(h *MapHelper) error {
+		h.Delete(key)
+		return nil
+	})
+}
+
+func (s *SyncMapHelper) SetPath(path string, value interface{}, create bool) error {
+	return s.Update(func(h *MapHelper) error {
+		return h.SetPath(path, value, create)
+	})
+}
+
+func (s *SyncMapHelper) DeletePath(path string) error {
+	return s.Update(func(h *MapHelper) error {
+		return h.DeletePath(path)
+	})
+}
+
+// Copies the maps and lists of the data, and the nested helpers; the rest of
+// the values are shared.
+func copyMapHelperData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	c := map[string]interface{}{}
+	for k, v := range data {
+		c[k] = copyMapHelperValue(v)
+	}
+	return c
+}
+
+func copyMapHelperValue(val interface{}) interface{} {
+	switch w := val.(type) {
+	case map[string]interface{}:
+		return copyMapHelperData(w)
+	case *MapHelper:
+		if w == nil {
+			return w
+		}
+		return &MapHelper{Filename: w.Filename, Codec: w.Codec, Data: copyMapHelperData(w.Data)}
+	case []interface{}:
+		list := make([]interface{}, len(w))
+		for i, v := range w {
+			list[i] = copyMapHelperValue(v)
+		}
+		return list
+	case []*MapHelper:
+		list := make([]*MapHelper, len(w))
+		for i, v := range w {
+			list[i] = copyMapHelperValue(v).(*MapHelper)
+		}
+		return list
+	case []map[string]interface{}:
+		list := make([]map[string]interface{}, len(w))
+		for i, v := range w {
+			list[i] = copyMapHelperData(v)
+		}
+		return list
+	case []string:
+		return append([]string{}, w...)
+	}
+	return val
+}
+
+// Decodes the document again; if it can't be done, the same document is
+// returned, so its comments are not lost.
+func copyMapHelperDocument(codecName string, doc MapHelperDocument) MapHelperDocument {
+	if doc == nil {
+		return nil
+	}
+	codec, err := GetMapHelperCodec(codecName)
+	if err != nil {
+		Log.Debugf("Error copying document: %v", err)
+		return doc
+	}
+	documentCodec, ok := codec.(MapHelperDocumentCodec)
+	if !ok {
+		return doc
+	}
+	data, err := doc.Bytes()
+	if err == nil {
+		var c MapHelperDocument
+		c, err = documentCodec.DecodeDocument(data)
+		if err == nil {
+			return c
+		}
+	}
+	Log.Debugf("Error copying document: %v", err)
+	return doc
+}
@@ -0,0 +1,109 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSyncMapHelperUpdate(t *testing.T) {
+
+	s := NewSyncMapHelper(NewMapHelperFromData(map[string]interface{}{
+		"a": map[string]interface{}{"b": 1},
+		"n": 0,
+	}))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.Update(func(h *MapHelper) error {
+				h.SetInt("n", h.GetInt("n", 0)+1)
+				h.GetHelper("a").SetInt("b", i)
+				return nil
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			s.Snapshot().GetPathInt("a.b", 0)
+			s.GetHelper("a")
+			s.Keys()
+		}()
+	}
+	wg.Wait()
+	if n := s.GetInt("n", 0); n != 20 {
+		t.Fatalf("Unexpected count %v, want 20", n)
+	}
+
+	snapshot := s.Snapshot()
+	err := s.Update(func(h *MapHelper) error {
+		h.Set("x", 1)
+		return errors.New("Cancelled")
+	})
+	if err == nil || s.Exists("x") {
+		t.Errorf("Failed update applied")
+	}
+	s.SetPath("a.c", 3, true)
+	if snapshot.ExistsPath("a.c") || !s.ExistsPath("a.c") {
+		t.Errorf("Snapshot changed by an update")
+	}
+
+}
+
+// Saving must not modify the document shared by the snapshots
+func TestSyncMapHelperSave(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.jsonc")
+	err = ioutil.WriteFile(path, []byte("{\n  // Settings\n  \"a\": 1, // first\n  \"b\": 2\n}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewMapHelperDocumentFromFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSyncMapHelper(h)
+	s.Set("c", 3)
+	snapshot := s.Snapshot()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := s.Save(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			snapshot.Keys()
+		}
+	}()
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "// Settings") || !strings.Contains(string(data), "// first") {
+		t.Errorf("Comments lost saving the file:\n%s", data)
+	}
+	if keys := s.Keys(); strings.Join(keys, ",") != "a,b,c" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+}
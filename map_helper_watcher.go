@@ -0,0 +1,278 @@
+package goutils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const MAP_HELPER_CHANGE_ADD = mapHelperChangeAdd
+const MAP_HELPER_CHANGE_REMOVE = mapHelperChangeRemove
+const MAP_HELPER_CHANGE_REPLACE = mapHelperChangeReplace
+
+// Value changed, for example when the file was reloaded; the path is in the
+// format of ParseMapHelperPath.
+type MapHelperChange struct {
+	// One of the MAP_HELPER_CHANGE_ constants
+	Op   string
+	Path string
+	// Nil when the value was added
+	Old interface{}
+	// Nil when the value was removed
+	New interface{}
+}
+
+// Listeners are called from the goroutine of the watcher, so GTK
+// applications must use glib.IdleAdd to update the interface.
+type MapHelperChangeListener interface {
+	OnMapHelperChanged(h *MapHelper, changes []MapHelperChange)
+	// The file couldn't be reloaded; the helper keeps the last good data
+	OnMapHelperReloadError(h *MapHelper, err error)
+}
+
+// Reloads the file of the helper when it is modified, and notifies the
+// listeners of the values changed. The data of Helper is replaced from the
+// goroutine of the watcher, so it must not be used by other goroutines; use
+// NewSyncMapHelperWatcher for helpers shared between goroutines.
+type MapHelperWatcher struct {
+	Helper *MapHelper
+	// If set, the data is replaced with its lock, and Helper is not used
+	Sync *SyncMapHelper
+	// Time without new writes before the file is reloaded, so editors and
+	// programs that write the file in several steps trigger one reload
+	Debounce  time.Duration
+	Listeners []MapHelperChangeListener
+
+	lock    sync.Mutex
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewMapHelperWatcher(h *MapHelper) *MapHelperWatcher {
+	w := MapHelperWatcher{}
+	w.Helper = h
+	w.Debounce = 200 * time.Millisecond
+	w.Listeners = []MapHelperChangeListener{}
+	return &w
+}
+
+// Watches the file of a helper shared between goroutines; readers of its
+// snapshots are not affected by the reloads.
+func NewSyncMapHelperWatcher(s *SyncMapHelper) *MapHelperWatcher {
+	w := NewMapHelperWatcher(nil)
+	w.Sync = s
+	return w
+}
+
+func (w *MapHelperWatcher) AddListener(listener MapHelperChangeListener) {
+	w.Listeners = append(w.Listeners, listener)
+}
+
+// Starts watching the file in the background. The directory is watched
+// instead of the file, so files replaced by renaming them are detected too.
+func (w *MapHelperWatcher) Start() error {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.watcher != nil {
+		return errors.New("Watcher already started")
+	}
+	filename := w.helper().Filename
+	if filename == "" {
+		return errors.New("The helper has no file to watch")
+	}
+
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Error getting absolute path of %v", filename)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Error creating file watcher")
+	}
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "Error watching directory of %v", path)
+	}
+
+	w.watcher = watcher
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run(watcher, path, w.stop, w.done)
+	return nil
+
+}
+
+// Stops watching the file, and waits for the pending notifications
+func (w *MapHelperWatcher) Stop() {
+	w.lock.Lock()
+	if w.watcher == nil {
+		w.lock.Unlock()
+		return
+	}
+	watcher, stop, done := w.watcher, w.stop, w.done
+	w.watcher = nil
+	w.lock.Unlock()
+	close(stop)
+	<-done
+	watcher.Close()
+}
+
+func (w *MapHelperWatcher) run(watcher *fsnotify.Watcher, path string, stop chan struct{}, done chan struct{}) {
+
+	defer close(done)
+
+	timer := time.NewTimer(w.Debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+				continue
+			}
+			Log.Debugf("File %v changed: %v", path, event.Op)
+			timer.Reset(w.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			w.notifyError(errors.Wrapf(err, "Error watching file %v", path))
+		case <-timer.C:
+			w.Reload()
+		}
+	}
+
+}
+
+// Loads the file again, and notifies the listeners of the changes; if the
+// file can't be loaded, the helper is not modified.
+func (w *MapHelperWatcher) Reload() {
+
+	h := w.helper()
+	var loaded *MapHelper
+	var err error
+	if h.Document != nil {
+		loaded, err = NewMapHelperDocumentFromFileWithCodec(h.Filename, h.Codec, true)
+	} else {
+		loaded, err = NewMapHelperFromFileWithCodec(h.Filename, h.Codec, true)
+	}
+	if err != nil {
+		if _, statErr := os.Stat(h.Filename); os.IsNotExist(statErr) {
+			err = errors.Errorf("File %v was removed", h.Filename)
+		}
+		Log.Warningf("Error reloading %v, keeping the last loaded values: %v", h.Filename, err)
+		w.notifyError(err)
+		return
+	}
+	if h.Secrets != nil {
+		loaded.Secrets = h.Secrets
+		err = h.Secrets.Decrypt(loaded)
+		if err != nil {
+			w.notifyError(err)
+			return
+		}
+	}
+
+	new, err := mapHelperCanonicalData(loaded.GenerateMap())
+	if err != nil {
+		w.notifyError(err)
+		return
+	}
+
+	// The previous data is taken when it is replaced, so updates done
+	// meanwhile are not reported as changes of the file
+	var previous *MapHelper
+	if w.Sync != nil {
+		previous = w.Sync.replaceLoaded(loaded)
+		h = w.Sync.Snapshot()
+	} else {
+		previous = &MapHelper{Data: h.Data, Document: h.Document}
+		h.Data = loaded.Data
+		h.Document = loaded.Document
+	}
+	old, err := mapHelperCanonicalData(previous.GenerateMap())
+	if err != nil {
+		w.notifyError(err)
+		return
+	}
+
+	changes := newMapHelperChanges(old, new)
+	if len(changes) == 0 {
+		Log.Debugf("File %v reloaded without changes", h.Filename)
+		return
+	}
+
+	Log.Debugf("File %v reloaded with %v changes", h.Filename, len(changes))
+	for _, l := range w.Listeners {
+		l.OnMapHelperChanged(h, changes)
+	}
+
+}
+
+// Returns the helper watched; a snapshot if it is shared
+func (w *MapHelperWatcher) helper() *MapHelper {
+	if w.Sync != nil {
+		return w.Sync.Snapshot()
+	}
+	return w.Helper
+}
+
+func (w *MapHelperWatcher) notifyError(err error) {
+	for _, l := range w.Listeners {
+		l.OnMapHelperReloadError(w.helper(), err)
+	}
+}
+
+// Returns the changes between the canonical data
+func newMapHelperChanges(old map[string]interface{}, new map[string]interface{}) []MapHelperChange {
+	changes := []MapHelperChange{}
+	for _, c := range mapHelperChanges([]string{}, old, new) {
+		elements := mapHelperPathElements(new, c.Path)
+		if c.Op == mapHelperChangeRemove {
+			elements = mapHelperPathElements(old, c.Path)
+		}
+		changes = append(changes, MapHelperChange{Op: c.Op, Path: FormatMapHelperPath(elements), Old: c.Old, New: c.Value})
+	}
+	return changes
+}
+
+// Converts the keys of a path of the data to path elements, marking the
+// indexes of the lists.
+func mapHelperPathElements(data interface{}, path []string) []MapHelperPathElement {
+	elements := []MapHelperPathElement{}
+	for _, k := range path {
+		switch w := data.(type) {
+		case []interface{}:
+			elements = append(elements, MapHelperPathElement{Key: k, Index: true})
+			i, err := strconv.Atoi(k)
+			if err == nil && i >= 0 && i < len(w) {
+				data = w[i]
+			} else {
+				data = nil
+			}
+		case map[string]interface{}:
+			elements = append(elements, MapHelperPathElement{Key: k})
+			data = w[k]
+		default:
+			elements = append(elements, MapHelperPathElement{Key: k})
+			data = nil
+		}
+	}
+	return elements
+}
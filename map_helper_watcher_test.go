@@ -0,0 +1,234 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends the notifications to channels
+type testMapHelperListener struct {
+	changes chan []MapHelperChange
+	errors  chan error
+}
+
+func newTestMapHelperListener() *testMapHelperListener {
+	return &testMapHelperListener{changes: make(chan []MapHelperChange, 10), errors: make(chan error, 10)}
+}
+
+func (l *testMapHelperListener) OnMapHelperChanged(h *MapHelper, changes []MapHelperChange) {
+	l.changes <- changes
+}
+
+func (l *testMapHelperListener) OnMapHelperReloadError(h *MapHelper, err error) {
+	l.errors <- err
+}
+
+func (l *testMapHelperListener) waitChanges(t *testing.T) []MapHelperChange {
+	select {
+	case changes := <-l.changes:
+		return changes
+	case err := <-l.errors:
+		t.Fatalf("Unexpected error %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for changes")
+	}
+	return nil
+}
+
+func (l *testMapHelperListener) waitError(t *testing.T) error {
+	select {
+	case changes := <-l.changes:
+		t.Fatalf("Unexpected changes %v", changes)
+	case err := <-l.errors:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for an error")
+	}
+	return nil
+}
+
+func (l *testMapHelperListener) assertNothing(t *testing.T) {
+	select {
+	case changes := <-l.changes:
+		t.Errorf("Unexpected changes %v", changes)
+	case err := <-l.errors:
+		t.Errorf("Unexpected error %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func newTestWatchedFile(t *testing.T, name string, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestMapHelperWatcher(t *testing.T) {
+
+	path, cleanup := newTestWatchedFile(t, "config.yaml", "# Settings\na: 1\nlist: [1, 2]\nold: x\n")
+	defer cleanup()
+
+	h, err := NewMapHelperDocumentFromFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMapHelperWatcher(h)
+	w.Debounce = 50 * time.Millisecond
+	l := newTestMapHelperListener()
+	w.AddListener(l)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.Start(); err == nil {
+		t.Errorf("Watcher started twice")
+	}
+
+	// Several writes are notified once
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(path, []byte("# Settings\na: 2\nlist: [1, 3]\nnew: y\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []MapHelperChange{
+		{Op: MAP_HELPER_CHANGE_REPLACE, Path: "a", Old: 1.0, New: 2.0},
+		{Op: MAP_HELPER_CHANGE_REPLACE, Path: "list[1]", Old: 2.0, New: 3.0},
+		{Op: MAP_HELPER_CHANGE_REMOVE, Path: "old", Old: "x"},
+		{Op: MAP_HELPER_CHANGE_ADD, Path: "new", New: "y"},
+	}
+	if changes := l.waitChanges(t); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Unexpected changes %+v, want %+v", changes, want)
+	}
+	l.assertNothing(t)
+	if h.GetInt("a", 0) != 2 || h.Document == nil {
+		t.Errorf("Unexpected data %v", h.Data)
+	}
+
+	// Invalid files keep the last values
+	if err := ioutil.WriteFile(path, []byte("a: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l.waitError(t)
+	if h.GetInt("a", 0) != 2 {
+		t.Errorf("Unexpected data %v after an invalid file", h.Data)
+	}
+
+	// Files replaced by renaming them
+	if err := ioutil.WriteFile(path+".tmp", []byte("a: 3\nlist: [1, 3]\nnew: y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	want = []MapHelperChange{{Op: MAP_HELPER_CHANGE_REPLACE, Path: "a", Old: 2.0, New: 3.0}}
+	if changes := l.waitChanges(t); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Unexpected changes %+v, want %+v", changes, want)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.waitError(t); !strings.Contains(err.Error(), "removed") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	w.Stop()
+	w.Stop()
+
+}
+
+// Nested helpers are compared by their data, so reloading the same file
+// doesn't report changes
+func TestMapHelperWatcherReload(t *testing.T) {
+
+	path, cleanup := newTestWatchedFile(t, "config.json", `{"proxy": {"port": 1}, "a.b": {"c": [1]}}`)
+	defer cleanup()
+
+	h, err := NewMapHelperFromJsonFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetHelper("proxy", NewMapHelperFromData(map[string]interface{}{"port": 1}))
+	w := NewMapHelperWatcher(h)
+	l := newTestMapHelperListener()
+	w.AddListener(l)
+
+	w.Reload()
+	l.assertNothing(t)
+
+	if err := ioutil.WriteFile(path, []byte(`{"proxy": {"port": 1}, "a.b": {"c": [1, 2]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.Reload()
+	// Lists of different length are replaced
+	want := []MapHelperChange{{Op: MAP_HELPER_CHANGE_REPLACE, Path: `a\.b.c`, Old: []interface{}{1.0}, New: []interface{}{1.0, 2.0}}}
+	if changes := l.waitChanges(t); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Unexpected changes %+v, want %+v", changes, want)
+	}
+
+	if err := NewMapHelperWatcher(NewEmptyMapHelper()).Start(); err == nil {
+		t.Errorf("Watcher of a helper without file started")
+	}
+
+}
+
+func TestSyncMapHelperWatcher(t *testing.T) {
+
+	path, cleanup := newTestWatchedFile(t, "config.json", `{"a": 1}`)
+	defer cleanup()
+
+	h, err := NewMapHelperFromJsonFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSyncMapHelper(h)
+	snapshot := s.Snapshot()
+	w := NewSyncMapHelperWatcher(s)
+	w.Debounce = 10 * time.Millisecond
+	l := newTestMapHelperListener()
+	w.AddListener(l)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.GetInt("a", 0)
+			}
+		}
+	}()
+
+	if err := ioutil.WriteFile(path, []byte(`{"a": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []MapHelperChange{{Op: MAP_HELPER_CHANGE_REPLACE, Path: "a", Old: 1.0, New: 2.0}}
+	if changes := l.waitChanges(t); !reflect.DeepEqual(changes, want) {
+		t.Errorf("Unexpected changes %+v, want %+v", changes, want)
+	}
+	close(stop)
+	<-done
+
+	if s.GetInt("a", 0) != 2 || snapshot.GetInt("a", 0) != 1 {
+		t.Errorf("Unexpected values %v and %v of the snapshot", s.GetInt("a", 0), snapshot.GetInt("a", 0))
+	}
+
+}
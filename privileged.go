@@ -0,0 +1,432 @@
+package goutils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pkexec if there is a graphical session, sudo with askpass if zenity is
+// installed, and plain sudo otherwise
+const PRIVILEGED_METHOD_AUTO = "auto"
+
+// Graphical authentication using polkit; the command is run in / with a
+// minimal environment.
+const PRIVILEGED_METHOD_PKEXEC = "pkexec"
+
+// sudo -A, asking the password with the askpass program
+const PRIVILEGED_METHOD_SUDO_ASKPASS = "sudo-askpass"
+
+// sudo, with the password returned by the password provider
+const PRIVILEGED_METHOD_SUDO = "sudo"
+
+var PrivilegedAuthFailedError error
+var PrivilegedCancelledError error
+
+func init() {
+	PrivilegedAuthFailedError = errors.New("Authentication failed")
+	PrivilegedCancelledError = errors.New("Authentication cancelled by the user")
+}
+
+// Start of the messages of pkexec when the user is not authorized; the
+// exit codes alone can't tell them from the exit codes of the command.
+const pkexecAuthMessage = "Error executing command as another user:"
+const pkexecNotFoundMessage = "Cannot run program"
+
+// Returned when pkexec or sudo don't run the command because the
+// authentication failed or was cancelled; its cause (errors.Cause) is
+// PrivilegedAuthFailedError or PrivilegedCancelledError.
+type PrivilegedAuthError struct {
+	Method string
+	// Exit code of pkexec or sudo; the command has not been run
+	ExitCode int
+	// Message of pkexec or sudo, if any
+	Message string
+	Reason  error
+}
+
+func (e *PrivilegedAuthError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v (%v)", e.Reason, e.Method)
+	}
+	return fmt.Sprintf("%v (%v): %v", e.Reason, e.Method, e.Message)
+}
+
+func (e *PrivilegedAuthError) Cause() error {
+	return e.Reason
+}
+
+// Returns the password, or PrivilegedCancelledError if the user cancels
+type PasswordProvider func() (string, error)
+
+// Asks the password using a zenity dialog
+func ZenityPasswordProvider(title string) PasswordProvider {
+	return func() (string, error) {
+		err, _, exitCode, stdOut, _ := RunCommandAndWait("", nil, "zenity", []string{"--password", "--title", title}, nil)
+		if err != nil {
+			return "", errors.Wrap(err, "Error asking password with zenity")
+		}
+		if exitCode != 0 {
+			return "", PrivilegedCancelledError
+		}
+		return strings.TrimSuffix(stdOut, "\n"), nil
+	}
+}
+
+// Command run as root; the password is never passed as an argument or
+// logged. Proxy settings are ignored, as sudo and pkexec reset the
+// environment.
+type PrivilegedCommand struct {
+	*Command
+	// One of the PRIVILEGED_METHOD_ constants
+	Method string
+	// Title of the password dialogs
+	Title string
+	// Used with PRIVILEGED_METHOD_SUDO; if nil, the command fails if sudo
+	// needs a password. It is only called if sudo asks the password, and
+	// only once, so a wrong password fails without retrying.
+	PasswordProvider PasswordProvider
+	// Program used with PRIVILEGED_METHOD_SUDO_ASKPASS; if empty, a script
+	// that runs zenity is used.
+	AskpassProgram string
+}
+
+func NewPrivilegedCommand(command string, arguments ...string) *PrivilegedCommand {
+	c := PrivilegedCommand{}
+	c.Command = NewCommand(command, arguments...)
+	c.Method = PRIVILEGED_METHOD_AUTO
+	c.Title = "Authentication required"
+	return &c
+}
+
+func (c *PrivilegedCommand) Run() (*CommandResult, error) {
+	return c.RunContext(context.Background())
+}
+
+// Runs the command as root; a PrivilegedAuthError is returned if the
+// password is not valid or the user cancels the authentication, and the
+// error of the password provider if it fails.
+func (c *PrivilegedCommand) RunContext(ctx context.Context) (*CommandResult, error) {
+
+	method, err := c.detectMethod()
+	if err != nil {
+		return nil, err
+	}
+	Log.Debugf("Running %v as root using %v", c.Command.Command, method)
+
+	run := *c.Command
+	run.ProxyManager = nil
+	var providerAskpass *fifoAskpass
+	pkexecMessage := ""
+
+	switch method {
+
+	case PRIVILEGED_METHOD_PKEXEC:
+		commandPath, err := Which(c.Command.Command)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error locating command %v", c.Command.Command)
+		}
+		if commandPath == "" {
+			commandPath = c.Command.Command
+		}
+		run.Command = "pkexec"
+		run.Arguments = append([]string{commandPath}, c.Arguments...)
+		// Detected even if the output is not captured
+		run.OnOutputLine = func(stream string, line string) {
+			if stream == COMMAND_STDERR && pkexecMessage == "" && (strings.HasPrefix(line, pkexecAuthMessage) || strings.HasPrefix(line, pkexecNotFoundMessage)) {
+				pkexecMessage = line
+			}
+			if c.OnOutputLine != nil {
+				c.OnOutputLine(stream, line)
+			}
+		}
+
+	case PRIVILEGED_METHOD_SUDO_ASKPASS:
+		askpass := c.AskpassProgram
+		if askpass == "" {
+			askpass, err = writeZenityAskpassScript()
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(askpass)
+		}
+		run.Env = c.askpassEnvironment(askpass)
+		run.Command = "sudo"
+		run.Arguments = append([]string{"-A", "--", c.Command.Command}, c.Arguments...)
+
+	case PRIVILEGED_METHOD_SUDO:
+		run.Command = "sudo"
+		if c.PasswordProvider == nil {
+			run.Arguments = append([]string{"-n", "--", c.Command.Command}, c.Arguments...)
+			break
+		}
+		// The password is passed to sudo by an askpass script, and not over
+		// stdin, so it never reaches the command if sudo doesn't need it
+		providerAskpass, err = newFifoAskpass(c.PasswordProvider)
+		if err != nil {
+			return nil, err
+		}
+		defer providerAskpass.Close()
+		run.Env = c.askpassEnvironment(providerAskpass.Script)
+		run.Arguments = append([]string{"-A", "--", c.Command.Command}, c.Arguments...)
+
+	}
+
+	result, err := run.RunContext(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error running %v", method)
+	}
+
+	if providerAskpass != nil {
+		err = providerAskpass.Close()
+		if errors.Cause(err) == PrivilegedCancelledError {
+			return nil, &PrivilegedAuthError{Method: method, ExitCode: result.ExitCode, Reason: PrivilegedCancelledError}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if providerAskpass.Retried() {
+			return nil, &PrivilegedAuthError{Method: method, ExitCode: result.ExitCode, Reason: PrivilegedAuthFailedError}
+		}
+	}
+
+	if method == PRIVILEGED_METHOD_PKEXEC {
+		err = checkPkexecResult(result, pkexecMessage)
+	} else {
+		err = checkSudoResult(method, result)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+
+}
+
+func (c *PrivilegedCommand) detectMethod() (string, error) {
+
+	if c.Method != PRIVILEGED_METHOD_AUTO && c.Method != "" {
+		return c.Method, nil
+	}
+
+	graphical := os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	if graphical {
+		pkexecPath, err := Which("pkexec")
+		if err != nil {
+			return "", errors.Wrap(err, "Error checking if pkexec is installed")
+		}
+		if pkexecPath != "" {
+			return PRIVILEGED_METHOD_PKEXEC, nil
+		}
+		askpass := c.AskpassProgram
+		if askpass == "" {
+			askpass, err = Which("zenity")
+			if err != nil {
+				return "", errors.Wrap(err, "Error checking if zenity is installed")
+			}
+		}
+		if askpass != "" {
+			return PRIVILEGED_METHOD_SUDO_ASKPASS, nil
+		}
+	}
+	return PRIVILEGED_METHOD_SUDO, nil
+
+}
+
+// Detects authentication failures and cancellations of pkexec; it exits
+// with 126 if the authentication is dismissed, and 127 if the user is not
+// authorized or the command can't be run, but the command can exit with
+// these codes too, so the message of pkexec must also be found.
+func checkPkexecResult(result *CommandResult, message string) error {
+	if result.ExitCode != 126 && result.ExitCode != 127 {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(message, pkexecNotFoundMessage):
+		return errors.Errorf("Error running command with pkexec: %v", message)
+	case !strings.HasPrefix(message, pkexecAuthMessage):
+		return nil
+	case result.ExitCode == 126:
+		return &PrivilegedAuthError{Method: PRIVILEGED_METHOD_PKEXEC, ExitCode: result.ExitCode, Message: message, Reason: PrivilegedCancelledError}
+	default:
+		return &PrivilegedAuthError{Method: PRIVILEGED_METHOD_PKEXEC, ExitCode: result.ExitCode, Message: message, Reason: PrivilegedAuthFailedError}
+	}
+}
+
+// Detects authentication failures and cancellations from the exit code and
+// messages of sudo.
+func checkSudoResult(method string, result *CommandResult) error {
+
+	if result.ExitCode != 1 {
+		return nil
+	}
+	if strings.Contains(result.Stderr, "sudo: no password was provided") {
+		return &PrivilegedAuthError{Method: method, ExitCode: result.ExitCode, Message: "sudo: no password was provided", Reason: PrivilegedCancelledError}
+	}
+	for _, message := range []string{"incorrect password attempt", "sudo: a password is required", "Sorry, try again."} {
+		if strings.Contains(result.Stderr, message) {
+			return &PrivilegedAuthError{Method: method, ExitCode: result.ExitCode, Message: message, Reason: PrivilegedAuthFailedError}
+		}
+	}
+	return nil
+
+}
+
+// Environment of the command with the askpass program for sudo
+func (c *PrivilegedCommand) askpassEnvironment(askpass string) map[string]string {
+	env := map[string]string{}
+	for k, v := range c.Env {
+		env[k] = v
+	}
+	env["SUDO_ASKPASS"] = askpass
+	env["GOUTILS_ASKPASS_TITLE"] = c.Title
+	return env
+}
+
+// Askpass script for sudo that prints the password of a provider; the
+// password is written to a FIFO in a private directory when the script reads
+// it, so it is never saved to disk, and the provider is only called if sudo
+// asks the password. The password is only given once; if sudo asks again,
+// the script fails.
+type fifoAskpass struct {
+	Script string
+
+	dir      string
+	fifo     string
+	provider PasswordProvider
+	lock     sync.Mutex
+	err      error
+	retried  bool
+	stop     chan struct{}
+	done     chan struct{}
+	closed   bool
+}
+
+func newFifoAskpass(provider PasswordProvider) (*fifoAskpass, error) {
+
+	dir, err := ioutil.TempDir("", "askpass")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating temporary askpass directory")
+	}
+
+	a := fifoAskpass{}
+	a.dir = dir
+	a.fifo = filepath.Join(dir, "password")
+	a.Script = filepath.Join(dir, "askpass")
+	a.provider = provider
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+
+	quote := func(path string) string {
+		return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+	}
+	// mkdir is atomic, so it marks which call is the first
+	script := "#!/bin/sh\n" +
+		"if ! mkdir " + quote(filepath.Join(dir, "asked")) + " 2>/dev/null; then\n" +
+		"\tmkdir " + quote(filepath.Join(dir, "retried")) + " 2>/dev/null\n" +
+		"\texit 1\n" +
+		"fi\n" +
+		"exec cat " + quote(a.fifo) + "\n"
+	err = syscall.Mkfifo(a.fifo, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(a.Script, []byte(script), 0700)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "Error writing temporary askpass script")
+	}
+
+	go a.serve()
+	return &a, nil
+
+}
+
+// Whether sudo asked the password more than once, that is, the password was
+// wrong; valid after Close.
+func (a *fifoAskpass) Retried() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.retried
+}
+
+func (a *fifoAskpass) serve() {
+	defer close(a.done)
+	// Blocks until the script opens the FIFO, or Close releases it
+	f, err := os.OpenFile(a.fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	select {
+	case <-a.stop:
+		return
+	default:
+	}
+	password, err := a.provider()
+	if err != nil {
+		a.lock.Lock()
+		a.err = err
+		a.lock.Unlock()
+		return
+	}
+	f.WriteString(password + "\n")
+}
+
+// Stops serving the password and removes the script; returns the error of
+// the provider, if any.
+func (a *fifoAskpass) Close() error {
+	a.lock.Lock()
+	if a.closed {
+		defer a.lock.Unlock()
+		return a.err
+	}
+	a.closed = true
+	close(a.stop)
+	a.lock.Unlock()
+	for {
+		// Opening the FIFO for reading releases the writer
+		if r, err := os.OpenFile(a.fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+			r.Close()
+		}
+		select {
+		case <-a.done:
+			_, err := os.Stat(filepath.Join(a.dir, "retried"))
+			os.RemoveAll(a.dir)
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			a.retried = err == nil
+			return a.err
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Generates a temporary askpass script for sudo that asks the password using
+// zenity; the title is read from the environment, to avoid quoting it.
+func writeZenityAskpassScript() (string, error) {
+
+	script, err := ioutil.TempFile("", "askpass")
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating temporary askpass script")
+	}
+	defer script.Close()
+
+	_, err = script.WriteString("#!/bin/sh\nexec zenity --password --title \"$GOUTILS_ASKPASS_TITLE\"\n")
+	if err == nil {
+		err = script.Chmod(0700)
+	}
+	if err != nil {
+		os.Remove(script.Name())
+		return "", errors.Wrap(err, "Error writing temporary askpass script")
+	}
+
+	return script.Name(), nil
+
+}
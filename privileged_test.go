@@ -0,0 +1,155 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// pkexec and sudo that don't change the user, and fail as the real ones
+const fakePkexecScript = `#!/bin/sh
+case "$FAKE_PKEXEC" in
+dismiss) echo "Error executing command as another user: Request dismissed" >&2; exit 126;;
+deny) echo "Error executing command as another user: Not authorized" >&2; exit 127;;
+missing) echo "Cannot run program $1: No such file or directory" >&2; exit 127;;
+esac
+exec "$@"
+`
+
+const fakeSudoScript = `#!/bin/sh
+[ "$1" = "-A" ] || exit 2
+shift; shift
+[ -n "$FAKE_NOPASSWD" ] && exec "$@"
+for i in 1 2 3; do
+  p=$("$SUDO_ASKPASS")
+  [ -z "$p" ] && { echo "sudo: no password was provided" >&2; exit 1; }
+  [ "$p" = "secret" ] && exec "$@"
+  echo "Sorry, try again." >&2
+done
+echo "sudo: 3 incorrect password attempts" >&2
+exit 1
+`
+
+// Puts the fake programs first in the PATH; the returned function restores it
+func installFakePrivilegedPrograms(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "privileged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range map[string]string{"pkexec": fakePkexecScript, "sudo": fakeSudoScript} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPrivilegedCommandPkexec(t *testing.T) {
+
+	defer installFakePrivilegedPrograms(t)()
+
+	tests := []struct {
+		name     string
+		fake     string
+		command  string
+		reason   error
+		exitCode int
+		fails    bool
+	}{
+		{name: "run", command: "exit 0"},
+		{name: "dismissed", fake: "dismiss", command: "exit 0", reason: PrivilegedCancelledError},
+		{name: "not authorized", fake: "deny", command: "exit 0", reason: PrivilegedAuthFailedError},
+		{name: "program not found", fake: "missing", command: "exit 0", fails: true},
+		{name: "command exits with 126", command: "exit 126", exitCode: 126},
+		{name: "command exits with 127", command: "echo 'not found' >&2; exit 127", exitCode: 127},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewPrivilegedCommand("sh", "-c", test.command)
+			c.Method = PRIVILEGED_METHOD_PKEXEC
+			c.Env = map[string]string{"FAKE_PKEXEC": test.fake}
+			c.MaxCaptureBytes = -1
+			result, err := c.Run()
+			switch {
+			case test.reason != nil:
+				authErr, ok := err.(*PrivilegedAuthError)
+				if !ok || errors.Cause(err) != test.reason || authErr.Method != PRIVILEGED_METHOD_PKEXEC {
+					t.Errorf("Unexpected error %#v, want %v", err, test.reason)
+				}
+			case test.fails:
+				if err == nil || errors.Cause(err) == PrivilegedAuthFailedError {
+					t.Errorf("Unexpected error %v", err)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error %v", err)
+			case result.ExitCode != test.exitCode:
+				t.Errorf("Unexpected exit code %v, want %v", result.ExitCode, test.exitCode)
+			}
+		})
+	}
+
+}
+
+func TestPrivilegedCommandSudoPassword(t *testing.T) {
+
+	defer installFakePrivilegedPrograms(t)()
+
+	tests := []struct {
+		name          string
+		password      string
+		providerError error
+		noPassword    bool
+		calls         int
+		reason        error
+	}{
+		{name: "no password needed", password: "secret", noPassword: true, calls: 0},
+		{name: "valid password", password: "secret", calls: 1},
+		{name: "invalid password", password: "invalid", calls: 1, reason: PrivilegedAuthFailedError},
+		{name: "cancelled", providerError: PrivilegedCancelledError, calls: 1, reason: PrivilegedCancelledError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			c := NewPrivilegedCommand("cat")
+			c.Method = PRIVILEGED_METHOD_SUDO
+			c.Stdin = strings.NewReader("input\n")
+			c.PasswordProvider = func() (string, error) {
+				calls++
+				return test.password, test.providerError
+			}
+			if test.noPassword {
+				c.Env = map[string]string{"FAKE_NOPASSWD": "1"}
+			}
+			result, err := c.Run()
+			if calls != test.calls {
+				t.Errorf("Password provider called %v times, want %v", calls, test.calls)
+			}
+			if test.reason != nil {
+				if _, ok := err.(*PrivilegedAuthError); !ok || errors.Cause(err) != test.reason {
+					t.Errorf("Unexpected error %v, want %v", err, test.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The password is never sent to the command
+			if result.Stdout != "input\n" {
+				t.Errorf("Unexpected output %q", result.Stdout)
+			}
+		})
+	}
+
+}
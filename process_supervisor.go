@@ -0,0 +1,382 @@
+package goutils
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const PROCESS_STATE_STOPPED = "stopped"
+const PROCESS_STATE_RUNNING = "running"
+
+// The process exited with code 0
+const PROCESS_STATE_EXITED = "exited"
+
+// The process exited with a code other than 0, was killed, or couldn't be started
+const PROCESS_STATE_CRASHED = "crashed"
+
+const PROCESS_RESTART_NEVER = "never"
+const PROCESS_RESTART_ON_FAILURE = "on-failure"
+const PROCESS_RESTART_ALWAYS = "always"
+
+// Listeners are called from the goroutine of the process, so GTK
+// applications must use glib.IdleAdd to update the interface.
+type ProcessStateListener interface {
+	OnProcessStateChanged(p *SupervisedProcess, state string)
+}
+
+type SupervisedProcess struct {
+	Name string
+	// Run again on every restart; its callbacks are called on every run, and
+	// its lines channel receives the lines of all the runs, and it is never
+	// closed, as the process can be started again. Only the last 4096 bytes
+	// of the output are captured, unless MaxCaptureBytes is set. Stdin can't
+	// be set if the process can be restarted, as the first run consumes it.
+	Command *Command
+	// One of the PROCESS_RESTART_ constants
+	RestartPolicy string
+	// Time waited before the first restart, that must be positive; it is
+	// doubled on every restart, up to MaxBackoff, and reset if the process
+	// runs for more than MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Maximum number of restarts; 0 means no limit
+	MaxRestarts int
+	// Rotation of the log file, in megabytes
+	LogMaxSize    int
+	LogMaxBackups int
+
+	lock       sync.Mutex
+	state      string
+	pid        int
+	restarts   int
+	lastResult *CommandResult
+	lastError  error
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+func NewSupervisedProcess(name string, command *Command) *SupervisedProcess {
+	p := SupervisedProcess{}
+	p.Name = name
+	p.Command = command
+	p.RestartPolicy = PROCESS_RESTART_ON_FAILURE
+	p.MinBackoff = 1 * time.Second
+	p.MaxBackoff = 1 * time.Minute
+	p.LogMaxSize = 5
+	p.LogMaxBackups = 7
+	p.state = PROCESS_STATE_STOPPED
+	return &p
+}
+
+func (p *SupervisedProcess) State() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.state
+}
+
+// Returns the pid of the running process, or 0 if it is not running
+func (p *SupervisedProcess) Pid() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pid
+}
+
+func (p *SupervisedProcess) Restarts() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.restarts
+}
+
+// Returns the result of the last execution; its output contains the last
+// lines written by the process.
+func (p *SupervisedProcess) LastResult() *CommandResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastResult
+}
+
+// Returns the error of the last execution, if the process couldn't be started
+func (p *SupervisedProcess) LastError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastError
+}
+
+func (p *SupervisedProcess) shouldRestart(state string) bool {
+	switch p.RestartPolicy {
+	case PROCESS_RESTART_ALWAYS:
+		return true
+	case PROCESS_RESTART_ON_FAILURE:
+		return state == PROCESS_STATE_CRASHED
+	default:
+		return false
+	}
+}
+
+// Starts and keeps track of background processes, restarting them when they
+// fail; the output of every process is saved in LogDir/<name>.log.
+type ProcessSupervisor struct {
+	LogDir    string
+	Listeners []ProcessStateListener
+	lock      sync.Mutex
+	processes map[string]*SupervisedProcess
+}
+
+func NewProcessSupervisor(logDir string) *ProcessSupervisor {
+	s := ProcessSupervisor{}
+	s.LogDir = logDir
+	s.Listeners = []ProcessStateListener{}
+	s.processes = map[string]*SupervisedProcess{}
+	return &s
+}
+
+func (s *ProcessSupervisor) AddListener(listener ProcessStateListener) {
+	s.Listeners = append(s.Listeners, listener)
+}
+
+// Returns the process with the name, or nil if there is none
+func (s *ProcessSupervisor) GetProcess(name string) *SupervisedProcess {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.processes[name]
+}
+
+func (s *ProcessSupervisor) GetProcesses() []*SupervisedProcess {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	processes := []*SupervisedProcess{}
+	for _, p := range s.processes {
+		processes = append(processes, p)
+	}
+	return processes
+}
+
+// Starts the process in background; a stopped or finished process with the
+// same name is replaced.
+func (s *ProcessSupervisor) StartProcess(p *SupervisedProcess) error {
+
+	// Without backoff, a process that fails at start would be restarted in
+	// a busy loop
+	if p.MinBackoff <= 0 {
+		return errors.Errorf("Invalid minimum backoff %v of process %v; it must be positive", p.MinBackoff, p.Name)
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		return errors.Errorf("Invalid maximum backoff %v of process %v; it must not be less than the minimum", p.MaxBackoff, p.Name)
+	}
+	if p.Command.Stdin != nil && p.RestartPolicy != PROCESS_RESTART_NEVER {
+		return errors.Errorf("Process %v can be restarted, so its input can't be set", p.Name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current, ok := s.processes[p.Name]; ok {
+		current.lock.Lock()
+		running := current.done != nil
+		current.lock.Unlock()
+		if running {
+			return errors.Errorf("Process %v is already running", p.Name)
+		}
+	}
+
+	if s.LogDir != "" {
+		err := EnsureDirectoryExists(s.LogDir, 0700)
+		if err != nil {
+			return errors.Wrapf(err, "Error checking/creating directory %v", s.LogDir)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.lock.Lock()
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	p.restarts = 0
+	p.lock.Unlock()
+
+	s.processes[p.Name] = p
+	go s.run(ctx, p)
+	return nil
+
+}
+
+// Stops the process and waits for it to finish
+func (s *ProcessSupervisor) StopProcess(name string) error {
+	p := s.GetProcess(name)
+	if p == nil {
+		return errors.Errorf("Process %v not found", name)
+	}
+	s.stop(p)
+	return nil
+}
+
+// Stops all the processes, waiting for them to finish; it must be called
+// before the application exits.
+func (s *ProcessSupervisor) StopAll() {
+	wg := sync.WaitGroup{}
+	for _, p := range s.GetProcesses() {
+		wg.Add(1)
+		go func(p *SupervisedProcess) {
+			defer wg.Done()
+			s.stop(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (s *ProcessSupervisor) stop(p *SupervisedProcess) {
+	p.lock.Lock()
+	cancel := p.cancel
+	done := p.done
+	p.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (s *ProcessSupervisor) run(ctx context.Context, p *SupervisedProcess) {
+
+	var logWriter *lumberjack.Logger
+	if s.LogDir != "" {
+		logWriter = &lumberjack.Logger{
+			Filename:   filepath.Join(s.LogDir, p.Name+".log"),
+			MaxSize:    p.LogMaxSize,
+			MaxBackups: p.LogMaxBackups,
+		}
+		defer logWriter.Close()
+	}
+	writeLog := func(format string, args ...interface{}) {
+		if logWriter != nil {
+			ts := time.Now().Format("2006-01-02 15:04:05")
+			fmt.Fprintf(logWriter, "=== %s %s\n", ts, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// The channel of the command would be closed at the end of every run,
+	// so the lines are forwarded to it instead
+	lines := p.Command.OutputLines
+
+	backoff := p.MinBackoff
+	for {
+
+		c := *p.Command
+		if c.MaxCaptureBytes == 0 {
+			c.MaxCaptureBytes = 4096
+		}
+		c.OnOutputChunk = func(stream string, data []byte) {
+			if logWriter != nil {
+				logWriter.Write(data)
+			}
+			if p.Command.OnOutputChunk != nil {
+				p.Command.OnOutputChunk(stream, data)
+			}
+		}
+		c.OnStarted = func(pid int) {
+			Log.Infof("Process %v started with pid %v", p.Name, pid)
+			writeLog("Started with pid %v", pid)
+			s.setState(p, PROCESS_STATE_RUNNING, pid, nil, nil)
+			if p.Command.OnStarted != nil {
+				p.Command.OnStarted(pid)
+			}
+		}
+		if lines != nil {
+			c.OutputLines = nil
+			c.OnOutputLine = func(stream string, line string) {
+				if p.Command.OnOutputLine != nil {
+					p.Command.OnOutputLine(stream, line)
+				}
+				select {
+				case lines <- &CommandOutputLine{Stream: stream, Line: line}:
+				case <-ctx.Done():
+				}
+			}
+		}
+
+		start := time.Now()
+		result, err := c.RunContext(ctx)
+
+		if ctx.Err() != nil {
+			Log.Infof("Process %v stopped", p.Name)
+			writeLog("Stopped")
+			s.setState(p, PROCESS_STATE_STOPPED, 0, result, err)
+			break
+		}
+
+		state := PROCESS_STATE_EXITED
+		if err != nil {
+			Log.Errorf("Error running process %v: %v", p.Name, err)
+			writeLog("Error running process: %v", err)
+			state = PROCESS_STATE_CRASHED
+		} else if result.Signal != 0 {
+			Log.Warningf("Process %v crashed; killed by signal %v", p.Name, result.Signal)
+			writeLog("Crashed; killed by signal %v", result.Signal)
+			state = PROCESS_STATE_CRASHED
+		} else if result.ExitCode != 0 {
+			Log.Warningf("Process %v crashed; exit code %v", p.Name, result.ExitCode)
+			writeLog("Crashed; exit code %v", result.ExitCode)
+			state = PROCESS_STATE_CRASHED
+		} else {
+			writeLog("Exited")
+		}
+		s.setState(p, state, 0, result, err)
+
+		if !p.shouldRestart(state) {
+			break
+		}
+		if p.MaxRestarts > 0 && p.Restarts() >= p.MaxRestarts {
+			Log.Errorf("Process %v not restarted, maximum restarts (%v) reached", p.Name, p.MaxRestarts)
+			break
+		}
+
+		if time.Since(start) > p.MaxBackoff {
+			backoff = p.MinBackoff
+		}
+		Log.Infof("Restarting process %v in %v", p.Name, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.setState(p, PROCESS_STATE_STOPPED, 0, result, err)
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+
+		p.lock.Lock()
+		p.restarts++
+		p.lock.Unlock()
+
+	}
+
+	p.lock.Lock()
+	close(p.done)
+	p.cancel = nil
+	p.done = nil
+	p.lock.Unlock()
+
+}
+
+func (s *ProcessSupervisor) setState(p *SupervisedProcess, state string, pid int, result *CommandResult, err error) {
+	p.lock.Lock()
+	p.state = state
+	p.pid = pid
+	if state != PROCESS_STATE_RUNNING {
+		p.lastResult = result
+		p.lastError = err
+	}
+	p.lock.Unlock()
+	for _, l := range s.Listeners {
+		l.OnProcessStateChanged(p, state)
+	}
+}
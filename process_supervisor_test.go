@@ -0,0 +1,165 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type processStateRecorder struct {
+	lock   sync.Mutex
+	states []string
+}
+
+func (r *processStateRecorder) OnProcessStateChanged(p *SupervisedProcess, state string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.states = append(r.states, state)
+}
+
+// Waits for the process to stop running, or fails after the timeout
+func waitSupervisedProcess(t *testing.T, p *SupervisedProcess, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		p.lock.Lock()
+		done := p.done
+		p.lock.Unlock()
+		if done == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Process %v still running", p.Name)
+}
+
+func TestProcessSupervisorRestart(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewProcessSupervisor(dir)
+	recorder := &processStateRecorder{}
+	s.AddListener(recorder)
+
+	p := NewSupervisedProcess("crasher", NewCommand("sh", "-c", "echo boom; exit 2"))
+	p.MinBackoff = 10 * time.Millisecond
+	p.MaxBackoff = 40 * time.Millisecond
+	p.MaxRestarts = 3
+	err = s.StartProcess(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSupervisedProcess(t, p, 5*time.Second)
+
+	if p.Restarts() != 3 || p.State() != PROCESS_STATE_CRASHED {
+		t.Errorf("Unexpected restarts %v and state %v", p.Restarts(), p.State())
+	}
+	if p.LastResult() == nil || p.LastResult().ExitCode != 2 {
+		t.Errorf("Unexpected last result %+v", p.LastResult())
+	}
+	recorder.lock.Lock()
+	states := strings.Join(recorder.states, ",")
+	recorder.lock.Unlock()
+	if strings.Count(states, PROCESS_STATE_RUNNING) != 4 || strings.Count(states, PROCESS_STATE_CRASHED) != 4 {
+		t.Errorf("Unexpected states %v", states)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "crasher.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(log), "boom\n") != 4 {
+		t.Errorf("Unexpected log:\n%s", log)
+	}
+
+}
+
+// The channel and callbacks of the command are used in every run
+func TestProcessSupervisorRestartWithOutput(t *testing.T) {
+
+	lines := make(chan *CommandOutputLine, 100)
+	c := NewCommand("sh", "-c", "echo line; exit 1")
+	c.OutputLines = lines
+	lock := sync.Mutex{}
+	started, chunks, callbackLines := 0, 0, 0
+	c.OnStarted = func(pid int) {
+		lock.Lock()
+		defer lock.Unlock()
+		started++
+	}
+	c.OnOutputChunk = func(stream string, data []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		chunks++
+	}
+	c.OnOutputLine = func(stream string, line string) {
+		lock.Lock()
+		defer lock.Unlock()
+		callbackLines++
+	}
+	c.MaxCaptureBytes = 2
+
+	s := NewProcessSupervisor("")
+	p := NewSupervisedProcess("output", c)
+	p.MinBackoff = 10 * time.Millisecond
+	p.MaxBackoff = 10 * time.Millisecond
+	p.MaxRestarts = 2
+	err := s.StartProcess(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSupervisedProcess(t, p, 5*time.Second)
+
+	if len(lines) != 3 {
+		t.Errorf("Unexpected number of lines %v", len(lines))
+	}
+	lock.Lock()
+	if started != 3 || chunks != 3 || callbackLines != 3 {
+		t.Errorf("Unexpected calls: %v started, %v chunks, %v lines", started, chunks, callbackLines)
+	}
+	lock.Unlock()
+	if p.LastResult().Output != "e\n" {
+		t.Errorf("Unexpected captured output %q", p.LastResult().Output)
+	}
+
+	// The channel is not closed, so the process can be started again
+	err = s.StartProcess(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSupervisedProcess(t, p, 5*time.Second)
+	if len(lines) != 6 {
+		t.Errorf("Unexpected number of lines %v", len(lines))
+	}
+
+}
+
+func TestProcessSupervisorInvalidProcess(t *testing.T) {
+
+	s := NewProcessSupervisor("")
+
+	p := NewSupervisedProcess("invalid", NewCommand("false"))
+	p.MinBackoff = 0
+	if err := s.StartProcess(p); err == nil {
+		t.Error("Process started without backoff")
+	}
+
+	p = NewSupervisedProcess("invalid", NewCommand("false"))
+	p.MaxBackoff = p.MinBackoff / 2
+	if err := s.StartProcess(p); err == nil {
+		t.Error("Process started with a maximum backoff less than the minimum")
+	}
+
+	p = NewSupervisedProcess("invalid", NewCommand("cat"))
+	p.Command.Stdin = strings.NewReader("input")
+	if err := s.StartProcess(p); err == nil {
+		t.Error("Process that can be restarted started with input")
+	}
+
+}
@@ -0,0 +1,171 @@
+package goutils
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The command is run without proxy
+const PROXIFY_STRATEGY_NONE = "none"
+
+// Proxychains is used if installed; if not, the environment variables
+const PROXIFY_STRATEGY_AUTO = "auto"
+
+// The command is run using proxychains4
+const PROXIFY_STRATEGY_PROXYCHAINS = "proxychains"
+
+// The proxy is passed to the command using the http_proxy and similar environment variables
+const PROXIFY_STRATEGY_ENVIRONMENT = "environment"
+
+// Both proxychains and environment variables are used
+const PROXIFY_STRATEGY_BOTH = "both"
+
+type proxifiedCommand struct {
+	Command   string
+	Arguments []string
+	Env       map[string]string
+	Strategy  string
+	Cleanup   func()
+}
+
+// Returns the proxy to use for the destination URL or address; if none of
+// them is set, the default proxy is returned.
+func getProxyForDestination(pm *ProxyManager, destinationUrl string, destinationAddress string) (*Proxy, error) {
+
+	if pm == nil {
+		return nil, nil
+	}
+
+	if destinationUrl != "" {
+		p, err := pm.GetProxyForUrl(destinationUrl)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error checking if proxy is valid for URL")
+		}
+		return p, nil
+	} else if destinationAddress != "" {
+		p, err := pm.GetProxyForAddress(destinationAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error checking if proxy is valid for address")
+		}
+		return p, nil
+	} else {
+		p, err := pm.GetDefaultProxy()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error getting default proxy")
+		}
+		return p, nil
+	}
+
+}
+
+// Builds the command and environment needed to run the command through the
+// proxy using the strategy; the env map is modified. The Cleanup function
+// of the result must be called once the command has finished.
+func proxifyCommand(p *Proxy, strategy string, command string, arguments []string, env map[string]string) (*proxifiedCommand, error) {
+
+	pc := proxifiedCommand{
+		Command:   command,
+		Arguments: arguments,
+		Env:       env,
+		Strategy:  PROXIFY_STRATEGY_NONE,
+		Cleanup:   func() {},
+	}
+
+	if p == nil {
+		return &pc, nil
+	}
+
+	proxychainsPath := ""
+	if strategy == PROXIFY_STRATEGY_AUTO || strategy == PROXIFY_STRATEGY_PROXYCHAINS || strategy == PROXIFY_STRATEGY_BOTH {
+		var err error
+		proxychainsPath, err = Which("proxychains4")
+		if err != nil {
+			return nil, errors.Wrap(err, "Error checking if proxychains is installed")
+		}
+	}
+
+	switch strategy {
+	case PROXIFY_STRATEGY_AUTO:
+		if proxychainsPath != "" {
+			pc.Strategy = PROXIFY_STRATEGY_PROXYCHAINS
+		} else {
+			Log.Debugf("Proxychains not found, falling back to environment variables")
+			pc.Strategy = PROXIFY_STRATEGY_ENVIRONMENT
+		}
+	case PROXIFY_STRATEGY_PROXYCHAINS, PROXIFY_STRATEGY_BOTH:
+		if proxychainsPath == "" {
+			return nil, ProxychainsNotFoundError
+		}
+		pc.Strategy = strategy
+	case PROXIFY_STRATEGY_ENVIRONMENT:
+		pc.Strategy = strategy
+	case PROXIFY_STRATEGY_NONE:
+		return &pc, nil
+	default:
+		return nil, errors.Errorf("Unknown proxify strategy %v", strategy)
+	}
+
+	if pc.Strategy == PROXIFY_STRATEGY_ENVIRONMENT || pc.Strategy == PROXIFY_STRATEGY_BOTH {
+		err := SetEnvironmentMapProxy(env, p)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error setting proxy environment variables")
+		}
+	}
+
+	if pc.Strategy == PROXIFY_STRATEGY_PROXYCHAINS || pc.Strategy == PROXIFY_STRATEGY_BOTH {
+
+		proxychainsConfig := NewProxychainsConfig(p)
+		proxychainsConfig.AddLocalNetsFromExceptions(p.Exceptions)
+		if pc.Strategy == PROXIFY_STRATEGY_BOTH {
+			// Programs honouring the environment connect to the proxy by themselves
+			proxychainsConfig.AddLocalNetsFromExceptions([]string{p.Address})
+		}
+		proxychainsConfigFile, err := proxychainsConfig.WriteToTempFile()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error generating temporary proxychains config file")
+		}
+		Log.Debugf("Proxychains config file generated in %v", proxychainsConfigFile)
+
+		env["PROXYCHAINS_CONF_FILE"] = proxychainsConfigFile
+		env["PROXYCHAINS_QUIET_MODE"] = "1"
+
+		pc.Command = proxychainsPath
+		pc.Arguments = append([]string{command}, arguments...)
+		pc.Cleanup = func() {
+			os.Remove(proxychainsConfigFile)
+		}
+
+	}
+
+	return &pc, nil
+
+}
+
+// Runs the command through the proxy returned by the proxy manager for the
+// destination, using the proxify strategy. If env is nil, the environment of
+// the current process is used.
+func RunCommandProxifiedWithStrategy(pm *ProxyManager, strategy string, destinationUrl string, destinationAddress string, initialPath string, stdin io.Reader, command string, arguments []string, env map[string]string) (*CommandResult, error) {
+	return RunCommandProxifiedContext(context.Background(), 0, pm, strategy, destinationUrl, destinationAddress, initialPath, stdin, command, arguments, env)
+}
+
+// Same as RunCommandProxifiedWithStrategy, but the command is killed when the
+// context is done, as in RunCommandAndWaitContext.
+func RunCommandProxifiedContext(ctx context.Context, gracePeriod time.Duration, pm *ProxyManager, strategy string, destinationUrl string, destinationAddress string, initialPath string, stdin io.Reader, command string, arguments []string, env map[string]string) (*CommandResult, error) {
+	c := NewCommand(command, arguments...)
+	c.Dir = initialPath
+	c.Stdin = stdin
+	if env != nil {
+		c.Env = env
+		c.ReplaceEnv = true
+	}
+	c.ProxyManager = pm
+	c.ProxifyStrategy = strategy
+	c.DestinationUrl = destinationUrl
+	c.DestinationAddress = destinationAddress
+	c.KillGracePeriod = gracePeriod
+	return c.RunContext(ctx)
+}
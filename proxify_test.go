@@ -0,0 +1,193 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Sets PATH to a directory with a fake proxychains4 if installed is true,
+// or without it if not; returns the function that restores PATH.
+func setTestProxychainsPath(t *testing.T, installed bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "proxychains4")
+	if installed {
+		err = ioutil.WriteFile(path, []byte("#!/bin/sh\nexec \"$@\"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	return path, func() {
+		os.Setenv("PATH", previous)
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestProxy() *Proxy {
+	p := NewEmptyProxy(nil)
+	p.Protocol = "http"
+	p.Address = "10.1.1.1"
+	p.Port = 3128
+	p.Exceptions = []string{"localhost", "192.168.0.0/16"}
+	return p
+}
+
+func TestProxifyCommandEnvironment(t *testing.T) {
+
+	env := map[string]string{"NO_PROXY": "old", "HOME": "/home/user"}
+	pc, err := proxifyCommand(newTestProxy(), PROXIFY_STRATEGY_ENVIRONMENT, "curl", []string{"-s"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Cleanup()
+	if pc.Strategy != PROXIFY_STRATEGY_ENVIRONMENT || pc.Command != "curl" || !reflect.DeepEqual(pc.Arguments, []string{"-s"}) {
+		t.Errorf("Unexpected command %+v", pc)
+	}
+	for _, k := range []string{"http_proxy", "HTTPS_PROXY", "ftp_proxy"} {
+		if env[k] != "http://10.1.1.1:3128" {
+			t.Errorf("Unexpected %v %q", k, env[k])
+		}
+	}
+	if env["NO_PROXY"] != "localhost,192.168.0.0/16" || env["HOME"] != "/home/user" {
+		t.Errorf("Unexpected environment %v", env)
+	}
+
+	_, err = proxifyCommand(newTestProxy(), "other", "curl", nil, map[string]string{})
+	if err == nil {
+		t.Errorf("Unknown strategy accepted")
+	}
+
+}
+
+func TestProxifyCommandProxychains(t *testing.T) {
+
+	proxychains, restore := setTestProxychainsPath(t, true)
+	defer restore()
+
+	tests := []struct {
+		strategy    string
+		want        string
+		environment bool
+		localNets   []string
+	}{
+		{PROXIFY_STRATEGY_AUTO, PROXIFY_STRATEGY_PROXYCHAINS, false, []string{"192.168.0.0/255.255.0.0"}},
+		{PROXIFY_STRATEGY_PROXYCHAINS, PROXIFY_STRATEGY_PROXYCHAINS, false, []string{"192.168.0.0/255.255.0.0"}},
+		{PROXIFY_STRATEGY_BOTH, PROXIFY_STRATEGY_BOTH, true, []string{"192.168.0.0/255.255.0.0", "10.1.1.1/255.255.255.255"}},
+	}
+
+	for _, test := range tests {
+
+		env := map[string]string{}
+		pc, err := proxifyCommand(newTestProxy(), test.strategy, "curl", []string{"-s"}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc.Strategy != test.want || pc.Command != proxychains || !reflect.DeepEqual(pc.Arguments, []string{"curl", "-s"}) {
+			t.Errorf("Unexpected command %+v with strategy %v", pc, test.strategy)
+		}
+		if _, ok := env["http_proxy"]; ok != test.environment {
+			t.Errorf("Unexpected environment %v with strategy %v", env, test.strategy)
+		}
+
+		file, err := os.Open(env["PROXYCHAINS_CONF_FILE"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := ParseProxychainsConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(config.Proxies) != 1 || config.Proxies[0].ToSimpleUrl() != "http://10.1.1.1:3128" || !reflect.DeepEqual(config.LocalNets, test.localNets) {
+			t.Errorf("Unexpected proxychains config %+v with strategy %v", config, test.strategy)
+		}
+
+		pc.Cleanup()
+		if exists, _ := FileExists(env["PROXYCHAINS_CONF_FILE"]); exists {
+			t.Errorf("Proxychains config not removed with strategy %v", test.strategy)
+		}
+
+	}
+
+}
+
+// Without proxychains, the auto strategy uses the environment
+func TestProxifyCommandWithoutProxychains(t *testing.T) {
+
+	_, restore := setTestProxychainsPath(t, false)
+	defer restore()
+
+	env := map[string]string{}
+	pc, err := proxifyCommand(newTestProxy(), PROXIFY_STRATEGY_AUTO, "curl", nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Strategy != PROXIFY_STRATEGY_ENVIRONMENT || pc.Command != "curl" || env["http_proxy"] == "" {
+		t.Errorf("Unexpected command %+v, environment %v", pc, env)
+	}
+	for _, strategy := range []string{PROXIFY_STRATEGY_PROXYCHAINS, PROXIFY_STRATEGY_BOTH} {
+		_, err = proxifyCommand(newTestProxy(), strategy, "curl", nil, map[string]string{})
+		if err != ProxychainsNotFoundError {
+			t.Errorf("Unexpected error with strategy %v: %v", strategy, err)
+		}
+	}
+
+}
+
+func TestProxifyCommandWithoutProxy(t *testing.T) {
+	for _, test := range []struct {
+		proxy    *Proxy
+		strategy string
+	}{
+		{nil, PROXIFY_STRATEGY_BOTH},
+		{newTestProxy(), PROXIFY_STRATEGY_NONE},
+	} {
+		env := map[string]string{}
+		pc, err := proxifyCommand(test.proxy, test.strategy, "curl", nil, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc.Strategy != PROXIFY_STRATEGY_NONE || pc.Command != "curl" || len(env) != 0 {
+			t.Errorf("Unexpected command %+v, environment %v", pc, env)
+		}
+	}
+}
+
+func TestGetProxyForDestination(t *testing.T) {
+
+	p, err := getProxyForDestination(nil, "http://example.com", "")
+	if err != nil || p != nil {
+		t.Errorf("Unexpected proxy %v without proxy manager: %v", p, err)
+	}
+
+	pm := &ProxyManager{}
+	pm.SetSimpleMethod(newTestProxy())
+	tests := []struct {
+		url     string
+		address string
+		proxied bool
+	}{
+		{"http://example.com", "", true},
+		{"http://localhost:8080", "", false},
+		{"", "localhost", false},
+		{"", "192.168.1.1", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		p, err := getProxyForDestination(pm, test.url, test.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (p != nil) != test.proxied {
+			t.Errorf("Unexpected proxy %v for %v%v", p, test.url, test.address)
+		}
+	}
+
+}
@@ -32,14 +32,29 @@ func (s *SimpleProxyPasswordManager) SetProxyPassword(p *Proxy, password string)
 	return nil
 }
 
+// Keys of the maps of proxies, as generated by ToMap
+var ProxySchema = NewMapSchema().
+	AddProperty("uuid", NewMapHelperSchema(SCHEMA_TYPE_STRING)).
+	AddProperty("protocol", NewStringSchema("http").SetEnum("http", "https", "socks", "socks4", "socks5")).
+	AddProperty("address", NewStringSchema("127.0.0.1")).
+	AddProperty("port", NewIntSchema(8080).SetRange(1, 65535)).
+	AddProperty("username", NewStringSchema("")).
+	AddProperty("password", NewMapHelperSchema(SCHEMA_TYPE_STRING)).
+	AddProperty("exceptions", NewListOfStringsSchema())
+
+// Paths of the maps of proxies that are secret, to encrypt them with
+// MapHelperSecrets when the password is saved in the map
+var ProxySecretPaths = []string{"password"}
+
+// The tags are the keys used by ToMap, so it can be used with Decode and EncodeMapHelper
 type Proxy struct {
-	ProxyPasswordManager
-	UUID       string
-	Protocol   string
-	Address    string
-	Port       int
-	Username   string
-	Exceptions []string
+	ProxyPasswordManager `map:"-"`
+	UUID                 string   `map:"uuid"`
+	Protocol             string   `map:"protocol"`
+	Address              string   `map:"address"`
+	Port                 int      `map:"port"`
+	Username             string   `map:"username,omitempty"`
+	Exceptions           []string `map:"exceptions,omitempty"`
 }
 
 func NewEmptyProxy(passwordManager ProxyPasswordManager) *Proxy {
@@ -52,15 +67,33 @@ func NewEmptyProxy(passwordManager ProxyPasswordManager) *Proxy {
 	return &p
 }
 
+// Same as NewProxyFromMapErr, but the map is not validated; values of other
+// types are taken as empty.
 func NewProxyFromMap(h *MapHelper, passwordManager ProxyPasswordManager, loadPasswordsFromMap bool) *Proxy {
+	return newProxyFromMap(ProxySchema.WithDefaults(h), passwordManager, loadPasswordsFromMap)
+}
+
+// Loads a map generated by ToMap, with the defaults of ProxySchema;
+// returns a *MapHelperSchemaError (as the cause) if it is not valid.
+func NewProxyFromMapErr(h *MapHelper, passwordManager ProxyPasswordManager, loadPasswordsFromMap bool) (*Proxy, error) {
+	h = ProxySchema.WithDefaults(h)
+	err := ProxySchema.Validate(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid proxy")
+	}
+	return newProxyFromMap(h, passwordManager, loadPasswordsFromMap), nil
+}
+
+// The map must have the defaults applied
+func newProxyFromMap(h *MapHelper, passwordManager ProxyPasswordManager, loadPasswordsFromMap bool) *Proxy {
 	if passwordManager == nil {
 		passwordManager = NewSimpleProxyPasswordManager("")
 	}
 	p := Proxy{ProxyPasswordManager: passwordManager}
 	p.UUID = h.GetString("uuid", uuid.Must(uuid.NewV4()).String())
-	p.Protocol = h.GetString("protocol", "http")
-	p.Address = h.GetString("address", "127.0.0.1")
-	p.Port = h.GetInt("port", 8080)
+	p.Protocol = h.GetString("protocol", "")
+	p.Address = h.GetString("address", "")
+	p.Port = h.GetInt("port", 0)
 	p.Username = h.GetString("username", "")
 	p.Exceptions = h.GetListOfStrings("exceptions", []string{})
 	if loadPasswordsFromMap {
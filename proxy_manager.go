@@ -11,6 +11,12 @@ const PROXY_METHOD_PAC = "pac"
 const PROXY_METHOD_SIMPLE = "simple"
 const PROXY_METHOD_DIRECT = "direct"
 
+// Keys of the maps generated by ToMap
+var ProxyManagerSchema = NewMapSchema().
+	AddProperty("method", NewMapHelperSchema(SCHEMA_TYPE_STRING).SetRequired().SetEnum(PROXY_METHOD_DIRECT, PROXY_METHOD_PAC, PROXY_METHOD_SIMPLE)).
+	AddProperty("pac", NewMapHelperSchema(SCHEMA_TYPE_STRING)).
+	AddProperty("proxy", ProxySchema)
+
 type ProxyManager struct {
 	UUID        string
 	Method      string
@@ -18,6 +24,32 @@ type ProxyManager struct {
 	SimpleProxy *Proxy
 }
 
+// Loads the maps generated by ToMap, validating them with ProxyManagerSchema
+func NewProxyManagerFromMap(h *MapHelper, passwordManager ProxyPasswordManager, loadPasswordsFromMap bool) (*ProxyManager, error) {
+	h = ProxyManagerSchema.WithDefaults(h)
+	err := ProxyManagerSchema.Validate(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid proxy configuration")
+	}
+	pm := ProxyManager{}
+	switch h.GetString("method", "") {
+	case PROXY_METHOD_DIRECT:
+		pm.SetDirectMethod("")
+	case PROXY_METHOD_PAC:
+		pm.SetPACMethod(h.GetString("pac", ""))
+	case PROXY_METHOD_SIMPLE:
+		if !h.Exists("proxy") {
+			return nil, errors.New("Invalid proxy configuration: no proxy for the simple method")
+		}
+		proxy, err := NewProxyFromMapErr(h.GetHelper("proxy"), passwordManager, loadPasswordsFromMap)
+		if err != nil {
+			return nil, err
+		}
+		pm.SetSimpleMethod(proxy)
+	}
+	return &pm, nil
+}
+
 func (pm *ProxyManager) SetDirectMethod(pacUrl string) {
 	pm.Method = PROXY_METHOD_DIRECT
 }
@@ -39,7 +71,7 @@ func (pm *ProxyManager) GetProxyForUrl(destinationUrl string) (*Proxy, error) {
 	} else if pm.Method == PROXY_METHOD_PAC {
 		// TODO
 		return nil, errors.New("Not implemented")
-	} else if pm.Method == PROXY_METHOD_PAC {
+	} else if pm.Method == PROXY_METHOD_SIMPLE {
 		// Simple mode
 		parsedUrl, err := url.Parse(destinationUrl)
 		if err != nil {
@@ -0,0 +1,101 @@
+package goutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewProxyFromMap(t *testing.T) {
+
+	p, err := NewProxyFromMapErr(NewEmptyMapHelper(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Protocol != "http" || p.Address != "127.0.0.1" || p.Port != 8080 || p.UUID == "" {
+		t.Errorf("Unexpected defaults %+v", p)
+	}
+
+	h := NewMapHelperFromData(map[string]interface{}{
+		"protocol":   "socks5",
+		"address":    "proxy",
+		"port":       1080.0,
+		"username":   "user",
+		"password":   "secret",
+		"exceptions": []interface{}{"localhost"},
+	})
+	p, err = NewProxyFromMapErr(h, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := p.GetPassword()
+	if p.Protocol != "socks5" || p.Address != "proxy" || p.Port != 1080 || password != "secret" || !reflect.DeepEqual(p.Exceptions, []string{"localhost"}) {
+		t.Errorf("Unexpected proxy %+v", p)
+	}
+	m, err := p.ToMap(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewProxyFromMapErr(m, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ToSimpleUrl() != "socks5://proxy:1080" {
+		t.Errorf("Unexpected proxy loaded from ToMap %v", again.ToSimpleUrl())
+	}
+
+}
+
+func TestNewProxyFromMapInvalid(t *testing.T) {
+
+	tests := []map[string]interface{}{
+		{"protocol": "ftp"},
+		{"port": 70000},
+		{"port": "x"},
+		{"address": []interface{}{}},
+		{"exceptions": []interface{}{"a", 3}},
+	}
+	for _, data := range tests {
+		_, err := NewProxyFromMapErr(NewMapHelperFromData(data), nil, false)
+		if _, ok := errors.Cause(err).(*MapHelperSchemaError); !ok {
+			t.Errorf("Unexpected error loading %v: %v", data, err)
+		}
+	}
+
+	// Without validating, the values of other types are empty
+	p := NewProxyFromMap(NewMapHelperFromData(map[string]interface{}{"port": "x"}), nil, false)
+	if p.Port != 0 || p.Address != "127.0.0.1" {
+		t.Errorf("Unexpected proxy %+v", p)
+	}
+
+}
+
+func TestNewProxyManagerFromMap(t *testing.T) {
+
+	h := NewMapHelperFromData(map[string]interface{}{
+		"method": PROXY_METHOD_SIMPLE,
+		"proxy":  map[string]interface{}{"protocol": "socks", "address": "proxy", "port": 1080},
+	})
+	pm, err := NewProxyManagerFromMap(h, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Method != PROXY_METHOD_SIMPLE || pm.SimpleProxy.ToSimpleUrl() != "socks://proxy:1080" {
+		t.Errorf("Unexpected proxy manager %+v", pm)
+	}
+
+	tests := []map[string]interface{}{
+		{},
+		{"method": "other"},
+		{"method": PROXY_METHOD_SIMPLE},
+		{"method": PROXY_METHOD_SIMPLE, "proxy": map[string]interface{}{"port": 0}},
+	}
+	for _, data := range tests {
+		_, err := NewProxyManagerFromMap(NewMapHelperFromData(data), nil, false)
+		if err == nil {
+			t.Errorf("Invalid configuration %v loaded", data)
+		}
+	}
+
+}
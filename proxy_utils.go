@@ -86,48 +86,63 @@ func GetEnvironmentProxy(passwordManager ProxyPasswordManager) (*Proxy, error) {
 
 }
 
-func SetEnvironmentProxy(p *Proxy) error {
-	var err error
+// Names of the environment variables that define the proxy; they are set in
+// lower and upper case.
+var proxyEnvironmentVariables = []string{"http_proxy", "https_proxy", "ftp_proxy"}
+
+// Returns the environment variables used by most programs (curl, git,
+// pip...) to connect through the proxy.
+func GetProxyEnvironmentVariables(p *Proxy) (map[string]string, error) {
+	url, err := p.ToUrl(true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating proxy URL")
+	}
+	vars := map[string]string{}
+	for _, k := range proxyEnvironmentVariables {
+		vars[k] = url
+		vars[strings.ToUpper(k)] = url
+	}
+	if len(p.Exceptions) > 0 {
+		vars["no_proxy"] = strings.Join(p.Exceptions, ",")
+		vars["NO_PROXY"] = strings.Join(p.Exceptions, ",")
+	}
+	return vars, nil
+}
+
+// Same as SetEnvironmentProxy, but modifying the env map instead of the
+// environment of the current process.
+func SetEnvironmentMapProxy(env map[string]string, p *Proxy) error {
+	for _, k := range append(proxyEnvironmentVariables, "no_proxy") {
+		delete(env, k)
+		delete(env, strings.ToUpper(k))
+	}
 	if p != nil {
-		var url string
-		url, err = p.ToUrl(true)
+		vars, err := GetProxyEnvironmentVariables(p)
 		if err != nil {
-			return errors.Wrap(err, "Error generating proxy URL")
+			return err
 		}
-		err = os.Setenv("http_proxy", url)
-		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "http_proxy")
-		}
-		err = os.Setenv("HTTP_PROXY", url)
-		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "HTTP_PROXY")
-		}
-		err = os.Setenv("https_proxy", url)
-		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "https_proxy")
-		}
-		err = os.Setenv("HTTPS_PROXY", url)
-		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "HTTPS_PROXY")
-		}
-		err = os.Setenv("ftp_proxy", url)
-		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "ftp_proxy")
+		for k, v := range vars {
+			env[k] = v
 		}
-		err = os.Setenv("FTP_PROXY", url)
+	}
+	return nil
+}
+
+func SetEnvironmentProxy(p *Proxy) error {
+	var err error
+	if p != nil {
+		var vars map[string]string
+		vars, err = GetProxyEnvironmentVariables(p)
 		if err != nil {
-			return errors.Wrapf(err, "Error unsetting environment variable %v", "FTP_PROXY")
+			return err
 		}
-		if len(p.Exceptions) > 0 {
-			err = os.Setenv("no_proxy", strings.Join(p.Exceptions, ","))
-			if err != nil {
-				return errors.Wrapf(err, "Error setting environment variable %v", "no_proxy")
-			}
-			err = os.Setenv("NO_PROXY", strings.Join(p.Exceptions, ","))
+		for k, v := range vars {
+			err = os.Setenv(k, v)
 			if err != nil {
-				return errors.Wrapf(err, "Error setting environment variable %v", "NO_PROXY")
+				return errors.Wrapf(err, "Error setting environment variable %v", k)
 			}
-		} else {
+		}
+		if len(p.Exceptions) == 0 {
 			err = os.Unsetenv("no_proxy")
 			if err != nil {
 				return errors.Wrapf(err, "Error unsetting environment variable %v", "no_proxy")
@@ -138,7 +153,7 @@ func SetEnvironmentProxy(p *Proxy) error {
 			}
 		}
 	} else {
-		for _, k := range []string{"http_proxy", "https_proxy", "ftp_proxy", "no_proxy"} {
+		for _, k := range append(proxyEnvironmentVariables, "no_proxy") {
 			err = os.Unsetenv(k)
 			if err != nil {
 				return errors.Wrapf(err, "Error unsetting environment variable %v", k)
@@ -152,6 +167,24 @@ func SetEnvironmentProxy(p *Proxy) error {
 	return nil
 }
 
+// Same as SetEnvironmentProxy, but saving the variables in the .env file,
+// keeping its other variables.
+func SetDotEnvProxy(path string, p *Proxy) error {
+	vars := map[string]string{}
+	if p != nil {
+		var err error
+		vars, err = GetProxyEnvironmentVariables(p)
+		if err != nil {
+			return err
+		}
+	}
+	remove := []string{}
+	for _, k := range append(proxyEnvironmentVariables, "no_proxy") {
+		remove = append(remove, k, strings.ToUpper(k))
+	}
+	return UpdateDotEnvFile(path, vars, remove)
+}
+
 func GetGnomeProxy(passwordManager ProxyPasswordManager) (*Proxy, error) {
 
 	proxySettings := glib.SettingsNew("org.gnome.system.proxy")
@@ -0,0 +1,335 @@
+package goutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const PROXYCHAINS_STRICT_CHAIN = "strict_chain"
+const PROXYCHAINS_DYNAMIC_CHAIN = "dynamic_chain"
+const PROXYCHAINS_RANDOM_CHAIN = "random_chain"
+
+// Configuration for proxychains4 (proxychains-ng); it can be generated
+// to be used by RunCommandProxified, or parsed from an existing file.
+type ProxychainsConfig struct {
+	ChainType         string
+	ChainLen          int
+	QuietMode         bool
+	ProxyDNS          bool
+	RemoteDNSSubnet   int
+	TCPReadTimeOut    int
+	TCPConnectTimeOut int
+	LocalNets         []string
+	Proxies           []*Proxy
+}
+
+func NewProxychainsConfig(proxies ...*Proxy) *ProxychainsConfig {
+	c := ProxychainsConfig{}
+	c.ChainType = PROXYCHAINS_STRICT_CHAIN
+	c.ProxyDNS = true
+	c.LocalNets = []string{}
+	c.Proxies = []*Proxy{}
+	for _, p := range proxies {
+		c.AddProxy(p)
+	}
+	return &c
+}
+
+func (c *ProxychainsConfig) AddProxy(p *Proxy) {
+	c.Proxies = append(c.Proxies, p)
+}
+
+// Adds a network that won't be proxified. The network can be specified
+// as an IPv4 address, as a CIDR (10.0.0.0/8) or in the proxychains
+// format (10.0.0.0/255.0.0.0).
+func (c *ProxychainsConfig) AddLocalNet(network string) error {
+	localNet, err := normalizeProxychainsLocalNet(network)
+	if err != nil {
+		return err
+	}
+	c.LocalNets = AddStringToList(c.LocalNets, localNet)
+	return nil
+}
+
+// Adds as local networks the proxy exceptions that are IPv4 addresses or
+// networks; host names and globs are ignored, as proxychains only can
+// exclude networks.
+func (c *ProxychainsConfig) AddLocalNetsFromExceptions(exceptions []string) {
+	for _, e := range exceptions {
+		err := c.AddLocalNet(strings.TrimSpace(e))
+		if err != nil {
+			Log.Debugf("Proxy exception %v not added as proxychains localnet: %v", e, err)
+		}
+	}
+}
+
+func (c *ProxychainsConfig) Generate() ([]byte, error) {
+
+	if len(c.Proxies) == 0 {
+		return nil, errors.New("No proxies defined for proxychains")
+	}
+
+	content := bytes.Buffer{}
+
+	switch c.ChainType {
+	case PROXYCHAINS_STRICT_CHAIN, PROXYCHAINS_DYNAMIC_CHAIN:
+		content.WriteString(fmt.Sprintf("%v\n", c.ChainType))
+	case PROXYCHAINS_RANDOM_CHAIN:
+		content.WriteString(fmt.Sprintf("%v\n", c.ChainType))
+		if c.ChainLen > 0 {
+			content.WriteString(fmt.Sprintf("chain_len = %v\n", c.ChainLen))
+		}
+	default:
+		return nil, errors.Errorf("Unknown proxychains chain type %v", c.ChainType)
+	}
+
+	if c.QuietMode {
+		content.WriteString("quiet_mode\n")
+	}
+	if c.ProxyDNS {
+		content.WriteString("proxy_dns\n")
+		if c.RemoteDNSSubnet > 0 {
+			content.WriteString(fmt.Sprintf("remote_dns_subnet %v\n", c.RemoteDNSSubnet))
+		}
+	}
+	if c.TCPReadTimeOut > 0 {
+		content.WriteString(fmt.Sprintf("tcp_read_time_out %v\n", c.TCPReadTimeOut))
+	}
+	if c.TCPConnectTimeOut > 0 {
+		content.WriteString(fmt.Sprintf("tcp_connect_time_out %v\n", c.TCPConnectTimeOut))
+	}
+	for _, n := range c.LocalNets {
+		content.WriteString(fmt.Sprintf("localnet %v\n", n))
+	}
+
+	content.WriteString("[ProxyList]\n")
+	for _, p := range c.Proxies {
+		password, err := p.GetPassword()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error getting password for proxy %v", p.ToSimpleUrl())
+		}
+		proxyType := proxychainsProxyType(p.Protocol)
+		if p.Username != "" && password != "" {
+			content.WriteString(fmt.Sprintf("%v %v %v %v %v\n", proxyType, p.Address, p.Port, p.Username, password))
+		} else {
+			content.WriteString(fmt.Sprintf("%v %v %v\n", proxyType, p.Address, p.Port))
+		}
+	}
+
+	return content.Bytes(), nil
+
+}
+
+// Writes the configuration to a new temporary file, and returns its path;
+// the caller is responsible of removing it.
+func (c *ProxychainsConfig) WriteToTempFile() (string, error) {
+
+	data, err := c.Generate()
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating proxychains config")
+	}
+
+	configFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating temporary proxychains config file")
+	}
+	defer configFile.Close()
+
+	_, err = configFile.Write(data)
+	if err != nil {
+		os.Remove(configFile.Name())
+		return "", errors.Wrap(err, "Error writing temporary proxychains config file")
+	}
+
+	return configFile.Name(), nil
+
+}
+
+func LoadProxychainsConfigFile(path string) (*ProxychainsConfig, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening file %v.", path)
+	}
+	defer reader.Close()
+	c, err := ParseProxychainsConfig(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing proxychains config file %v.", path)
+	}
+	return c, nil
+}
+
+// Parses a proxychains config; each proxy in the list is created with
+// its own simple password manager, holding the password found in the file.
+func ParseProxychainsConfig(reader io.Reader) (*ProxychainsConfig, error) {
+
+	c := NewProxychainsConfig()
+	c.ProxyDNS = false
+
+	inProxyList := false
+	lineNumber := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Passwords can contain # and =, so the proxies only support whole
+		// line comments, as proxychains does
+		if inProxyList && !strings.HasPrefix(line, "[") {
+			p, err := parseProxychainsProxyLine(strings.Fields(line))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error parsing line %v", lineNumber)
+			}
+			c.AddProxy(p)
+			continue
+		}
+
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			inProxyList = strings.EqualFold(line, "[ProxyList]")
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+
+		var err error
+		switch fields[0] {
+		case PROXYCHAINS_STRICT_CHAIN, PROXYCHAINS_DYNAMIC_CHAIN, PROXYCHAINS_RANDOM_CHAIN:
+			c.ChainType = fields[0]
+		case "quiet_mode":
+			c.QuietMode = true
+		case "proxy_dns":
+			c.ProxyDNS = true
+		case "chain_len":
+			c.ChainLen, err = parseProxychainsIntOption(fields)
+		case "remote_dns_subnet":
+			c.RemoteDNSSubnet, err = parseProxychainsIntOption(fields)
+		case "tcp_read_time_out":
+			c.TCPReadTimeOut, err = parseProxychainsIntOption(fields)
+		case "tcp_connect_time_out":
+			c.TCPConnectTimeOut, err = parseProxychainsIntOption(fields)
+		case "localnet":
+			if len(fields) != 2 {
+				err = errors.New("Invalid localnet definition")
+			} else {
+				err = c.AddLocalNet(fields[1])
+			}
+		default:
+			Log.Debugf("Ignoring unsupported proxychains option %v", fields[0])
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing line %v", lineNumber)
+		}
+
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error reading proxychains config")
+	}
+
+	return c, nil
+
+}
+
+func parseProxychainsIntOption(fields []string) (int, error) {
+	if len(fields) != 2 {
+		return 0, errors.Errorf("Invalid value for option %v", fields[0])
+	}
+	i, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, errors.Wrapf(err, "Error parsing %v as integer for option %v", fields[1], fields[0])
+	}
+	return i, nil
+}
+
+func parseProxychainsProxyLine(fields []string) (*Proxy, error) {
+
+	if len(fields) != 3 && len(fields) != 5 {
+		return nil, errors.Errorf("Invalid proxy definition %v", strings.Join(fields, " "))
+	}
+
+	port, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing port %v as integer", fields[2])
+	}
+
+	p := NewEmptyProxy(nil)
+	p.Protocol = fields[0]
+	p.Address = fields[1]
+	p.Port = port
+	if len(fields) == 5 {
+		p.Username = fields[3]
+		err = p.SetPassword(fields[4])
+		if err != nil {
+			return nil, errors.Wrap(err, "Error setting the password for the proxy")
+		}
+	}
+
+	return p, nil
+
+}
+
+// Proxychains only knows about http, raw, socks4 and socks5 proxies.
+func proxychainsProxyType(protocol string) string {
+	switch protocol {
+	case "https":
+		return "http"
+	case "socks":
+		return "socks5"
+	default:
+		return protocol
+	}
+}
+
+// Converts the network to the address/netmask format used by proxychains
+func normalizeProxychainsLocalNet(network string) (string, error) {
+
+	if network == "" {
+		return "", errors.New("Empty network")
+	}
+
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil || ip.To4() == nil {
+			return "", errors.Errorf("%v is not an IPv4 address", network)
+		}
+		return fmt.Sprintf("%v/255.255.255.255", ip.To4()), nil
+	}
+
+	parts := strings.SplitN(network, "/", 2)
+	if strings.Contains(parts[1], ".") {
+		ip := net.ParseIP(parts[0])
+		mask := net.ParseIP(parts[1])
+		if ip == nil || ip.To4() == nil || mask == nil || mask.To4() == nil {
+			return "", errors.Errorf("%v is not an IPv4 network", network)
+		}
+		return fmt.Sprintf("%v/%v", ip.To4(), mask.To4()), nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing network %v", network)
+	}
+	if ipNet.IP.To4() == nil {
+		return "", errors.Errorf("%v is not an IPv4 network", network)
+	}
+	return fmt.Sprintf("%v/%v", ipNet.IP.To4(), net.IP(ipNet.Mask).To4()), nil
+
+}
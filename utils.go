@@ -2,6 +2,7 @@ package goutils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,7 +12,6 @@ import (
 	"path"
 	"regexp"
 	"strings"
-	"syscall"
 
 	"github.com/pkg/errors"
 )
@@ -33,216 +33,25 @@ func RunCommandBackground(command string, arguments []string) (int, *exec.Cmd, e
 }
 
 func RunCommandAndWait(initialPath string, stdin io.Reader, command string, arguments []string, env map[string]string) (error, int, int, string, string) {
-
-	cmd := exec.Command(command, arguments...)
-
-	if env != nil {
-		envList := []string{}
-		for key, val := range env {
-			envList = append(envList, fmt.Sprintf("%v=%v", key, val))
-		}
-		cmd.Env = envList
-	}
-
-	if stdin != nil {
-		cmd.Stdin = stdin
-	}
-
-	var outBuff bytes.Buffer
-	cmd.Stdout = &outBuff
-
-	var errBuff bytes.Buffer
-	cmd.Stderr = &errBuff
-
-	if initialPath != "" {
-		cmd.Dir = initialPath
-	}
-
-	err := cmd.Start()
-	if err != nil {
-		return err, 0, 0, "", ""
-	}
-
-	state, err := cmd.Process.Wait()
+	result, err := RunCommandAndWaitContext(context.Background(), 0, initialPath, stdin, command, arguments, env)
 	if err != nil {
 		return err, 0, 0, "", ""
 	}
-
-	exitCode := state.Sys().(syscall.WaitStatus).ExitStatus()
-	pid := cmd.Process.Pid
-	return nil, pid, exitCode, outBuff.String(), errBuff.String()
-
+	return nil, result.Pid, result.ExitCode, result.Stdout, result.Stderr
 }
 
 func RunCommandProxified(pm *ProxyManager, destinationUrl string, destinationAddress string, initialPath string, stdin io.Reader, command string, arguments []string, env map[string]string, callback func(error, int, int, string, string)) (error, int, int, string, string) {
-
-	var err error
-
-	if env == nil {
-		env = map[string]string{}
-		for _, e := range os.Environ() {
-			elems := strings.SplitN(e, "=", 2)
-			val := ""
-			if len(elems) >= 2 {
-				val = elems[1]
-			}
-			env[elems[0]] = val
-		}
-	}
-
-	var cmd *exec.Cmd
-	var p *Proxy
-	if pm != nil {
-
-		if destinationUrl != "" {
-
-			p, err = pm.GetProxyForUrl(destinationUrl)
-			if err != nil {
-				newErr := errors.Wrap(err, "Error checking if proxy is valid for URL")
-				if callback != nil {
-					callback(newErr, 0, 0, "", "")
-				}
-				return newErr, 0, 0, "", ""
-			}
-
-		} else if destinationAddress != "" {
-
-			p, err = pm.GetProxyForAddress(destinationAddress)
-			if err != nil {
-				newErr := errors.Wrap(err, "Error checking if proxy is valid for address")
-				if callback != nil {
-					callback(newErr, 0, 0, "", "")
-				}
-				return newErr, 0, 0, "", ""
-			}
-
-		} else {
-			p, err = pm.GetDefaultProxy()
-			if err != nil {
-				newErr := errors.Wrap(err, "Error getting default proxy")
-				if callback != nil {
-					callback(newErr, 0, 0, "", "")
-				}
-				return newErr, 0, 0, "", ""
-			}
-		}
-
-	}
-
-	if p != nil {
-
-		proxychainsPath, err := Which("proxychains4")
-		if err != nil {
-			newErr := errors.Wrap(err, "Error checking if proxychains is installed")
-			if callback != nil {
-				callback(newErr, 0, 0, "", "")
-			}
-			return newErr, 0, 0, "", ""
-		}
-
-		if proxychainsPath == "" {
-			if callback != nil {
-				callback(ProxychainsNotFoundError, 0, 0, "", "")
-			}
-			return ProxychainsNotFoundError, 0, 0, "", ""
-		}
-
-		password, err := p.GetPassword()
-		if err != nil {
-			newErr := errors.Wrap(err, "Error getting proxy password")
-			if callback != nil {
-				callback(newErr, 0, 0, "", "")
-			}
-			return newErr, 0, 0, "", ""
-		}
-
-		proxychainsConfigFileContents := bytes.Buffer{}
-		proxychainsConfigFileContents.WriteString("strict_chain\n")
-		proxychainsConfigFileContents.WriteString("proxy_dns\n")
-		proxychainsConfigFileContents.WriteString("[ProxyList]\n")
-		if p.Username != "" && password != "" {
-			proxychainsConfigFileContents.WriteString(fmt.Sprintf("%v %v %v %v %v\n", p.Protocol, p.Address, p.Port, p.Username, password))
-		} else {
-			proxychainsConfigFileContents.WriteString(fmt.Sprintf("%v %v %v\n", p.Protocol, p.Address, p.Port))
-		}
-
-		proxychainsConfigFile, err := ioutil.TempFile("", "")
-		if err != nil {
-			newErr := errors.Wrap(err, "Error generating temporary proxychains config file")
-			if callback != nil {
-				callback(newErr, 0, 0, "", "")
-			}
-			return newErr, 0, 0, "", ""
-		}
-
-		_, err = proxychainsConfigFileContents.WriteTo(proxychainsConfigFile)
-		if err != nil {
-			newErr := errors.Wrap(err, "Error writing temporary proxychains config file")
-			if callback != nil {
-				callback(newErr, 0, 0, "", "")
-			}
-			return newErr, 0, 0, "", ""
-		}
-		proxychainsConfigFile.Close()
-		Log.Debugf("Proxychains config file generated in %v", proxychainsConfigFile.Name())
-		defer os.Remove(proxychainsConfigFile.Name())
-
-		env["PROXYCHAINS_CONF_FILE"] = proxychainsConfigFile.Name()
-		env["PROXYCHAINS_QUIET_MODE"] = "1"
-
-		newCommand := proxychainsPath
-		newArguments := append([]string{command}, arguments...)
-		cmd = exec.Command(newCommand, newArguments...)
-
-	} else {
-		cmd = exec.Command(command, arguments...)
-	}
-
-	envList := []string{}
-	for key, val := range env {
-		envList = append(envList, fmt.Sprintf("%v=%v", key, val))
-	}
-	cmd.Env = envList
-
-	if stdin != nil {
-		cmd.Stdin = stdin
-	}
-
-	var outBuff bytes.Buffer
-	cmd.Stdout = &outBuff
-
-	var errBuff bytes.Buffer
-	cmd.Stderr = &errBuff
-
-	if initialPath != "" {
-		cmd.Dir = initialPath
-	}
-
-	err = cmd.Start()
-	if err != nil {
-		if callback != nil {
-			callback(err, 0, 0, "", "")
-		}
-		return err, 0, 0, "", ""
-	}
-
-	state, err := cmd.Process.Wait()
+	result, err := RunCommandProxifiedWithStrategy(pm, PROXIFY_STRATEGY_PROXYCHAINS, destinationUrl, destinationAddress, initialPath, stdin, command, arguments, env)
 	if err != nil {
 		if callback != nil {
 			callback(err, 0, 0, "", "")
 		}
 		return err, 0, 0, "", ""
 	}
-
-	exitCode := state.Sys().(syscall.WaitStatus).ExitStatus()
-	pid := cmd.Process.Pid
-
 	if callback != nil {
-		callback(nil, pid, exitCode, outBuff.String(), errBuff.String())
+		callback(nil, result.Pid, result.ExitCode, result.Stdout, result.Stderr)
 	}
-
-	return nil, pid, exitCode, outBuff.String(), errBuff.String()
-
+	return nil, result.Pid, result.ExitCode, result.Stdout, result.Stderr
 }
 
 func CombineStdErrOutput(stdOut string, errOut string) string {
@@ -259,28 +68,6 @@ func CombineStdErrOutput(stdOut string, errOut string) string {
 	}
 }
 
-// Returns the full path of the specified command, if it is in the path.
-// If the command is not found, no error is returned, but an empty string as path.
-func Which(command string) (string, error) {
-	err, _, exitCode, stdOut, stdErr := RunCommandAndWait("", nil, "bash", []string{"-c", "which " + command}, map[string]string{})
-	if err != nil {
-		return "", errors.Wrapf(err, "Error locating command %s", command)
-	} else if exitCode == 1 {
-		// Not found
-		return "", nil
-	} else if exitCode != 0 {
-		return "", errors.Errorf("Error detecting command %s: %s/%s", command, stdOut, stdErr)
-	}
-	parts := FilterEmptyStrings(strings.Split(stdOut, "\n"))
-	if len(parts) == 0 {
-		return "", nil
-	} else if len(parts) > 1 {
-		return "", errors.Errorf("Command %s not found (%d lines)", command, len(parts))
-	} else {
-		return parts[0], nil
-	}
-}
-
 func HomeDir() (string, error) {
 	dir := os.Getenv("HOME")
 	if dir == "" {
@@ -476,7 +263,7 @@ func SaveMapAsJsonFile(path string, data map[string]interface{}) error {
 		return errors.Wrapf(err, "Error marshalling map")
 	}
 	// TODO: usar algo como os.ModeFile, igual que hay os.ModeDir
-	err = ioutil.WriteFile(path, byteData, 0664)
+	err = WriteFileAtomic(path, byteData, 0664)
 	if err != nil {
 		return errors.Wrapf(err, "Error saving JSON file")
 	}
@@ -90,3 +90,83 @@ func GetBuilder(assetProvider AssetProvider, assetPath string) (*gtk.Builder, er
 	return builder, nil
 
 }
+
+// Asks for a password; returns false if the user cancels
+func AskPassword(w *gtk.Window, title string, message string) (string, bool) {
+
+	d, err := gtk.DialogNew()
+	if err != nil {
+		Log.Errorf("Error creating password dialog: %v", err)
+		return "", false
+	}
+	defer d.Destroy()
+
+	d.SetTitle(title)
+	d.SetModal(true)
+	if w != nil {
+		d.SetTransientFor(w)
+	}
+	d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+	d.AddButton("_OK", gtk.RESPONSE_OK)
+	d.SetDefaultResponse(gtk.RESPONSE_OK)
+
+	box, err := d.GetContentArea()
+	if err != nil {
+		Log.Errorf("Error getting password dialog content area: %v", err)
+		return "", false
+	}
+	box.SetSpacing(6)
+	box.SetBorderWidth(12)
+
+	label, err := gtk.LabelNew(message)
+	if err != nil {
+		Log.Errorf("Error creating password dialog label: %v", err)
+		return "", false
+	}
+	box.PackStart(label, false, false, 0)
+
+	entry, err := gtk.EntryNew()
+	if err != nil {
+		Log.Errorf("Error creating password dialog entry: %v", err)
+		return "", false
+	}
+	entry.SetVisibility(false)
+	entry.SetActivatesDefault(true)
+	box.PackStart(entry, false, false, 0)
+
+	d.ShowAll()
+	res := d.Run()
+	if res != int(gtk.RESPONSE_OK) {
+		return "", false
+	}
+
+	password, err := entry.GetText()
+	if err != nil {
+		Log.Errorf("Error getting password from dialog: %v", err)
+		return "", false
+	}
+	return password, true
+
+}
+
+// Returns a password provider for PrivilegedCommand that asks the password
+// using AskPassword; it must be called from a goroutine other than the one
+// running the GTK main loop.
+func GtkPasswordProvider(w *gtk.Window, title string, message string) PasswordProvider {
+	return func() (string, error) {
+		passwords := make(chan string, 1)
+		glib.IdleAdd(func() {
+			password, ok := AskPassword(w, title, message)
+			if !ok {
+				close(passwords)
+				return
+			}
+			passwords <- password
+		})
+		password, ok := <-passwords
+		if !ok {
+			return "", PrivilegedCancelledError
+		}
+		return password, nil
+	}
+}
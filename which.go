@@ -0,0 +1,107 @@
+package goutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Results of the lookups; they are discarded when PATH changes
+var whichCache = struct {
+	lock    sync.Mutex
+	path    string
+	entries map[string][]string
+}{entries: map[string][]string{}}
+
+// Returns the full path of the specified command, if it is in the path.
+// If the command is not found, no error is returned, but an empty string as path.
+func Which(command string) (string, error) {
+	return WhichInDirs(command, nil)
+}
+
+// Same as Which, but also looking in the extra directories, after the ones
+// in the path.
+func WhichInDirs(command string, extraDirs []string) (string, error) {
+	paths, err := WhichAllInDirs(command, extraDirs)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", nil
+	}
+	return paths[0], nil
+}
+
+// Returns all the matches of the command in the path, in order
+func WhichAll(command string) ([]string, error) {
+	return WhichAllInDirs(command, nil)
+}
+
+// Same as WhichAll, but also looking in the extra directories, after the
+// ones in the path. Results are cached until PATH changes or
+// ClearWhichCache is called, so commands installed while the application
+// is running may not be found.
+func WhichAllInDirs(command string, extraDirs []string) ([]string, error) {
+
+	if command == "" {
+		return nil, errors.New("Empty command")
+	}
+
+	// Paths are checked directly, as which does
+	if strings.Contains(command, "/") {
+		if isExecutableFile(command) {
+			return []string{command}, nil
+		}
+		return []string{}, nil
+	}
+
+	path := os.Getenv("PATH")
+	cacheKey := command + "\x00" + strings.Join(extraDirs, "\x00")
+
+	whichCache.lock.Lock()
+	defer whichCache.lock.Unlock()
+
+	if whichCache.path != path {
+		whichCache.path = path
+		whichCache.entries = map[string][]string{}
+	}
+	if paths, ok := whichCache.entries[cacheKey]; ok {
+		return append([]string{}, paths...), nil
+	}
+
+	paths := []string{}
+	for _, dir := range append(filepath.SplitList(path), extraDirs...) {
+		if dir == "" {
+			// Empty elements mean the current directory
+			dir = "."
+		}
+		candidate := filepath.Join(dir, command)
+		if isExecutableFile(candidate) {
+			paths = AddStringToList(paths, candidate)
+		}
+	}
+
+	whichCache.entries[cacheKey] = paths
+	return append([]string{}, paths...), nil
+
+}
+
+func ClearWhichCache() {
+	whichCache.lock.Lock()
+	defer whichCache.lock.Unlock()
+	whichCache.entries = map[string][]string{}
+}
+
+// Returns true if the path (or the file it links to) is a regular file that
+// the current user can execute.
+func isExecutableFile(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() || stat.Mode().Perm()&0111 == 0 {
+		return false
+	}
+	return unix.Access(path, unix.X_OK) == nil
+}
@@ -0,0 +1,121 @@
+package goutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Creates a directory with the executable "command", the not executable
+// "data", the link "link" to command and the directory "dir"
+func newTestWhichDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{"command": 0755, "data": 0644} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "command"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestWhich(t *testing.T) {
+
+	dir := newTestWhichDir(t)
+	defer os.RemoveAll(dir)
+	other := newTestWhichDir(t)
+	defer os.RemoveAll(other)
+
+	previous := os.Getenv("PATH")
+	defer os.Setenv("PATH", previous)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+other+string(os.PathListSeparator)+dir)
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"command", []string{filepath.Join(dir, "command"), filepath.Join(other, "command")}},
+		{"link", []string{filepath.Join(dir, "link"), filepath.Join(other, "link")}},
+		{"data", []string{}},
+		{"dir", []string{}},
+		{"missing", []string{}},
+		{filepath.Join(dir, "command"), []string{filepath.Join(dir, "command")}},
+		{filepath.Join(dir, "data"), []string{}},
+		{"command; rm -rf /", []string{}},
+	}
+	for _, test := range tests {
+		paths, err := WhichAll(test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, test.want) {
+			t.Errorf("Unexpected paths %v of %v, want %v", paths, test.command, test.want)
+		}
+		path, err := Which(test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(test.want) == 0 && path != "") || (len(test.want) > 0 && path != test.want[0]) {
+			t.Errorf("Unexpected path %v of %v", path, test.command)
+		}
+	}
+
+	if _, err := Which(""); err == nil {
+		t.Errorf("Empty command accepted")
+	}
+
+}
+
+func TestWhichCache(t *testing.T) {
+
+	dir := newTestWhichDir(t)
+	defer os.RemoveAll(dir)
+	previous := os.Getenv("PATH")
+	defer os.Setenv("PATH", previous)
+	os.Setenv("PATH", dir)
+
+	if path, _ := WhichInDirs("command", []string{"/nonexistent"}); path != filepath.Join(dir, "command") {
+		t.Errorf("Unexpected path %v", path)
+	}
+
+	// Installed after the lookup, so it is not found until the cache is cleared
+	if path, _ := Which("installed"); path != "" {
+		t.Fatalf("Unexpected path %v before the installation", path)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "installed"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := Which("installed"); path != "" {
+		t.Errorf("Result not cached")
+	}
+	ClearWhichCache()
+	if path, _ := Which("installed"); path != filepath.Join(dir, "installed") {
+		t.Errorf("Unexpected path %v after clearing the cache", path)
+	}
+
+	// Changing PATH discards the results
+	other := newTestWhichDir(t)
+	defer os.RemoveAll(other)
+	os.Setenv("PATH", other)
+	if path, _ := Which("command"); path != filepath.Join(other, "command") {
+		t.Errorf("Unexpected path %v after changing PATH", path)
+	}
+
+	// Extra directories are checked after PATH
+	if path, _ := WhichInDirs("installed", []string{dir}); path != filepath.Join(dir, "installed") {
+		t.Errorf("Unexpected path %v in the extra directories", path)
+	}
+
+}